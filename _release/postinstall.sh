@@ -1,12 +1,6 @@
 #!/bin/bash
 set -e
 
-# Check that dnsutils is installed
-if ! command -v nslookup &> /dev/null; then
-  echo "nslookup not found, can be installed with: sudo apt install dnsutils"
-  exit 1
-fi
-
 udevadm control --reload-rules
 
 # --- Configuration ---
@@ -2,12 +2,13 @@ package connrequester
 
 import (
 	"errors"
-	"fmt"
-	"os/exec"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/modemd/probe"
 	"github.com/godbus/dbus"
 )
 
@@ -19,7 +20,10 @@ const (
 	methodBase    = "org.cacophony.modemd"
 	wifiInterface = "wlan0"
 
-	pingTimeout = 5
+	pingTimeout  = 5
+	dnsTimeout   = 5
+	dnsAttempts  = 3
+	dnsCheckName = "google.com"
 )
 
 var (
@@ -100,11 +104,11 @@ func CheckWifiConnection() bool {
 }
 
 func isInterfaceUp(interfaceName string) bool {
-	outBytes, err := exec.Command("ip", "a", "show", interfaceName).Output()
+	operstate, err := os.ReadFile(filepath.Join("/sys/class/net", interfaceName, "operstate"))
 	if err != nil {
 		return false
 	}
-	return strings.Contains(string(outBytes), "state UP")
+	return strings.TrimSpace(string(operstate)) == "up"
 }
 
 func CheckConnection() bool {
@@ -112,18 +116,22 @@ func CheckConnection() bool {
 }
 
 func checkDNS() bool {
-	res := exec.Command("nslookup", "google.com", "-timeout=5", "-retry=3").Run() == nil
-	if !res {
-		log.Println("DNS lookup failed")
+	var result probe.Result
+	for i := 0; i < dnsAttempts; i++ {
+		result = probe.DNS(dnsCheckName, "", probe.Options{Timeout: dnsTimeout * time.Second})
+		if result.OK() {
+			return true
+		}
 	}
-	return res
+	log.Println("DNS lookup failed:", result.Err)
+	return false
 }
 
 func pingAllHosts(interfaceName string) bool {
 	pingChan := make(chan bool)
 	for _, host := range hosts {
 		go func(host string) {
-			pingChan <- ping(interfaceName, host)
+			pingChan <- ping(interfaceName, host).OK()
 		}(host)
 	}
 	fails := 0
@@ -145,20 +153,11 @@ func pingAllHosts(interfaceName string) bool {
 	}
 }
 
-func ping(interfaceName string, host string) bool {
-	params := []string{}
-	if interfaceName != "" {
-		params = []string{
-			"-I",
-			interfaceName,
-		}
-	}
-	params = append(params, "-n",
-		"-q",
-		"-c1",
-		fmt.Sprintf("-w%d", pingTimeout),
-		host)
-	return exec.Command("ping", params...).Run() == nil
+func ping(interfaceName string, host string) probe.Result {
+	return probe.ICMP(host, 1, probe.Options{
+		Interface: interfaceName,
+		Timeout:   pingTimeout * time.Second,
+	})
 }
 
 // Start will start requesting for a connection to be made.
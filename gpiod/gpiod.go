@@ -0,0 +1,184 @@
+// Package gpiod drives GPIO lines through the kernel's GPIO character device, /dev/gpiochip*, with the v2 uAPI.
+package gpiod
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioctls and flags from linux/gpio.h.
+const (
+	getChipInfoIoctl   = 0x8044b401 // GPIO_GET_CHIPINFO_IOCTL
+	getLineInfoIoctl   = 0xc100b405 // GPIO_V2_GET_LINEINFO_IOCTL
+	getLineIoctl       = 0xc250b407 // GPIO_V2_GET_LINE_IOCTL
+	setLineValuesIoctl = 0xc010b40f // GPIO_V2_LINE_SET_VALUES_IOCTL
+
+	lineFlagActiveLow = 1 << 1
+	lineFlagOutput    = 1 << 3
+
+	lineAttrIDOutputValues = 2
+
+	maxLines     = 64
+	maxLineAttrs = 10
+	maxNameSize  = 32
+	consumer     = "modemd"
+)
+
+type chipInfo struct {
+	Name  [maxNameSize]byte
+	Label [maxNameSize]byte
+	Lines uint32
+}
+
+type lineAttribute struct {
+	ID      uint32
+	Padding uint32
+	Value   uint64 // Union of the flags, output values and debounce period.
+}
+
+type lineConfigAttribute struct {
+	Attr lineAttribute
+	Mask uint64
+}
+
+type lineConfig struct {
+	Flags    uint64
+	NumAttrs uint32
+	Padding  [5]uint32
+	Attrs    [maxLineAttrs]lineConfigAttribute
+}
+
+type lineRequest struct {
+	Offsets         [maxLines]uint32
+	Consumer        [maxNameSize]byte
+	Config          lineConfig
+	NumLines        uint32
+	EventBufferSize uint32
+	Padding         [5]uint32
+	Fd              int32
+}
+
+type lineInfo struct {
+	Name     [maxNameSize]byte
+	Consumer [maxNameSize]byte
+	Offset   uint32
+	NumAttrs uint32
+	Flags    uint64
+	Attrs    [maxLineAttrs]lineAttribute
+	Padding  [4]uint32
+}
+
+type lineValues struct {
+	Bits uint64
+	Mask uint64
+}
+
+// Chip is a GPIO chip, e.g "/dev/gpiochip0".
+type Chip struct {
+	f     *os.File
+	lines int
+}
+
+func Open(path string) (*Chip, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	var info chipInfo
+	if err := ioctl(f.Fd(), getChipInfoIoctl, unsafe.Pointer(&info)); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read GPIO chip info of '%s': %w", path, err)
+	}
+	return &Chip{f: f, lines: int(info.Lines)}, nil
+}
+
+func (c *Chip) Close() error {
+	return c.f.Close()
+}
+
+// LineOffset finds a line by its offset, e.g "22", its offset with a "GPIO" prefix, e.g "GPIO22", which is
+// how the Raspberry Pi's lines are numbered, or its name in the device tree.
+func (c *Chip) LineOffset(name string) (int, error) {
+	if offset, err := strconv.Atoi(strings.TrimPrefix(name, "GPIO")); err == nil {
+		if offset < 0 || offset >= c.lines {
+			return 0, fmt.Errorf("GPIO line %d is out of range, the chip has %d lines", offset, c.lines)
+		}
+		return offset, nil
+	}
+	for offset := 0; offset < c.lines; offset++ {
+		info := lineInfo{Offset: uint32(offset)}
+		if err := ioctl(c.f.Fd(), getLineInfoIoctl, unsafe.Pointer(&info)); err != nil {
+			return 0, fmt.Errorf("failed to read GPIO line %d info: %w", offset, err)
+		}
+		if cString(info.Name[:]) == name {
+			return offset, nil
+		}
+	}
+	return 0, fmt.Errorf("no GPIO line named '%s'", name)
+}
+
+// Line is a requested output line. It keeps its value until it is closed.
+type Line struct {
+	f      *os.File
+	offset int
+}
+
+// RequestOutput requests a line as an output, starting with the value. When activeLow is set the line is
+// low when the value is true.
+func (c *Chip) RequestOutput(offset int, activeLow bool, value bool) (*Line, error) {
+	req := lineRequest{NumLines: 1}
+	req.Offsets[0] = uint32(offset)
+	copy(req.Consumer[:maxNameSize-1], consumer)
+	req.Config.Flags = lineFlagOutput
+	if activeLow {
+		req.Config.Flags |= lineFlagActiveLow
+	}
+	req.Config.NumAttrs = 1
+	req.Config.Attrs[0] = lineConfigAttribute{
+		Attr: lineAttribute{ID: lineAttrIDOutputValues, Value: boolBit(value)},
+		Mask: 1,
+	}
+	if err := ioctl(c.f.Fd(), getLineIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("failed to request GPIO line %d: %w", offset, err)
+	}
+	return &Line{f: os.NewFile(uintptr(req.Fd), fmt.Sprintf("gpio-line-%d", offset)), offset: offset}, nil
+}
+
+func (l *Line) Set(value bool) error {
+	values := lineValues{Bits: boolBit(value), Mask: 1}
+	if err := ioctl(l.f.Fd(), setLineValuesIoctl, unsafe.Pointer(&values)); err != nil {
+		return fmt.Errorf("failed to set GPIO line %d: %w", l.offset, err)
+	}
+	return nil
+}
+
+func (l *Line) Close() error {
+	return l.f.Close()
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func boolBit(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,165 @@
+package checkgps
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// fix is a GPS fix as sent by modemd in the LocationUpdated signal.
+type fix struct {
+	latitude       float64
+	longitude      float64
+	altitude       float64
+	speed          float64 // km/h
+	course         float64
+	utcTime        time.Time
+	satellites     int
+	hdop           float64
+	timeToFirstFix time.Duration // Only set on the first fix.
+}
+
+func parseFix(m map[string]interface{}) (fix, error) {
+	f := fix{}
+	var ok bool
+	if f.latitude, ok = m["latitude"].(float64); !ok {
+		return fix{}, fmt.Errorf("missing latitude")
+	}
+	if f.longitude, ok = m["longitude"].(float64); !ok {
+		return fix{}, fmt.Errorf("missing longitude")
+	}
+	f.altitude, _ = m["altitude"].(float64)
+	f.speed, _ = m["speed"].(float64)
+	f.course, _ = m["course"].(float64)
+	f.hdop, _ = m["hdop"].(float64)
+	switch satellites := m["satellites"].(type) {
+	case int32:
+		f.satellites = int(satellites)
+	case int64:
+		f.satellites = int(satellites)
+	}
+	if utcTime, ok := m["utcTime"].(string); ok {
+		var err error
+		if f.utcTime, err = time.Parse(time.RFC3339, utcTime); err != nil {
+			return fix{}, fmt.Errorf("invalid utcTime '%s'", utcTime)
+		}
+	}
+	return f, nil
+}
+
+type fixWriter interface {
+	start() error
+	write(f fix) error
+	end() error
+}
+
+var fixWriters = map[string]func(w io.Writer) fixWriter{
+	"text": func(w io.Writer) fixWriter { return &textWriter{w: w} },
+	"json": func(w io.Writer) fixWriter { return &jsonWriter{enc: json.NewEncoder(w)} },
+	"csv":  func(w io.Writer) fixWriter { return &csvWriter{w: csv.NewWriter(w)} },
+	"gpx":  func(w io.Writer) fixWriter { return &gpxWriter{w: w} },
+}
+
+type textWriter struct {
+	w io.Writer
+}
+
+func (t *textWriter) start() error { return nil }
+func (t *textWriter) end() error   { return nil }
+
+func (t *textWriter) write(f fix) error {
+	_, err := fmt.Fprintf(t.w, "%s lat: %.6f lon: %.6f alt: %.1fm speed: %.1fkm/h course: %.1f satellites: %d hdop: %.1f\n",
+		f.utcTime.Format(time.RFC3339), f.latitude, f.longitude, f.altitude, f.speed, f.course, f.satellites, f.hdop)
+	if err == nil && f.timeToFirstFix != 0 {
+		_, err = fmt.Fprintf(t.w, "time to first fix: %s\n", f.timeToFirstFix.Round(time.Second))
+	}
+	return err
+}
+
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonWriter) start() error { return nil }
+func (j *jsonWriter) end() error   { return nil }
+
+func (j *jsonWriter) write(f fix) error {
+	out := map[string]interface{}{
+		"utcTime":    f.utcTime.Format(time.RFC3339),
+		"latitude":   f.latitude,
+		"longitude":  f.longitude,
+		"altitude":   f.altitude,
+		"speed":      f.speed,
+		"course":     f.course,
+		"satellites": f.satellites,
+		"hdop":       f.hdop,
+	}
+	if f.timeToFirstFix != 0 {
+		out["timeToFirstFix"] = f.timeToFirstFix.Seconds()
+	}
+	return j.enc.Encode(out)
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) start() error {
+	return c.writeRecord([]string{"utc_time", "latitude", "longitude", "altitude", "speed", "course", "satellites", "hdop", "time_to_first_fix"})
+}
+
+func (c *csvWriter) end() error { return nil }
+
+func (c *csvWriter) write(f fix) error {
+	ttff := ""
+	if f.timeToFirstFix != 0 {
+		ttff = strconv.FormatFloat(f.timeToFirstFix.Seconds(), 'f', 1, 64)
+	}
+	return c.writeRecord([]string{
+		f.utcTime.Format(time.RFC3339),
+		strconv.FormatFloat(f.latitude, 'f', 6, 64),
+		strconv.FormatFloat(f.longitude, 'f', 6, 64),
+		strconv.FormatFloat(f.altitude, 'f', 1, 64),
+		strconv.FormatFloat(f.speed, 'f', 1, 64),
+		strconv.FormatFloat(f.course, 'f', 1, 64),
+		strconv.Itoa(f.satellites),
+		strconv.FormatFloat(f.hdop, 'f', 1, 64),
+		ttff,
+	})
+}
+
+// writeRecord flushes after each record so the output can be followed while watching.
+func (c *csvWriter) writeRecord(record []string) error {
+	if err := c.w.Write(record); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// gpxWriter writes the fixes as a single GPX track, the footer is written when the output ends.
+type gpxWriter struct {
+	w io.Writer
+}
+
+func (g *gpxWriter) start() error {
+	_, err := fmt.Fprint(g.w, xml.Header+
+		`<gpx version="1.1" creator="check-gps" xmlns="http://www.topografix.com/GPX/1/1">`+"\n"+
+		"<trk><name>check-gps</name><trkseg>\n")
+	return err
+}
+
+func (g *gpxWriter) write(f fix) error {
+	_, err := fmt.Fprintf(g.w, `<trkpt lat="%.6f" lon="%.6f"><ele>%.1f</ele><time>%s</time><sat>%d</sat><hdop>%.1f</hdop></trkpt>`+"\n",
+		f.latitude, f.longitude, f.altitude, f.utcTime.Format(time.RFC3339), f.satellites, f.hdop)
+	return err
+}
+
+func (g *gpxWriter) end() error {
+	_, err := fmt.Fprint(g.w, "</trkseg></trk>\n</gpx>\n")
+	return err
+}
@@ -14,12 +14,17 @@ import (
 )
 
 type Args struct {
-	ConfigDir string           `arg:"-c,--config" help:"path to configuration directory"`
-	ATCmd     *atSubcommand    `arg:"subcommand:AT" help:"send an AT command"`
-	Power     *powerSubcommand `arg:"subcommand:power" help:"power control"`
-	Status    *subcommand      `arg:"subcommand:status" help:"get modem status"`
+	ConfigDir string             `arg:"-c,--config" help:"path to configuration directory"`
+	ATCmd     *atSubcommand      `arg:"subcommand:AT" help:"send an AT command"`
+	Power     *powerSubcommand   `arg:"subcommand:power" help:"power control"`
+	Status    *subcommand        `arg:"subcommand:status" help:"get modem status"`
+	Reset     *subcommand        `arg:"subcommand:reset-failures" help:"clear failures finding the modem or SIM card so they are retried"`
+	GPS       *gpsSubcommand     `arg:"subcommand:gps" help:"GPS control"`
+	History   *historySubcommand `arg:"subcommand:history" help:"show the signal history"`
+	DataUsage *subcommand        `arg:"subcommand:data-usage" help:"show the data used in the current billing period"`
+	Quality   *qualitySubcommand `arg:"subcommand:quality" help:"show the connection quality measurements"`
+	PDP       *pdpSubcommand     `arg:"subcommand:pdp" help:"manage the PDP contexts"`
 	// TODO:
-	// GPS: on, off, restart, log
 	// Reception: log
 	logging.LogArgs
 }
@@ -38,6 +43,48 @@ type powerSubcommand struct {
 	Restart *subcommand           `arg:"subcommand:restart" help:"restart modem"`
 }
 
+type gpsSubcommand struct {
+	On        *subcommand `arg:"subcommand:on" help:"turn GPS on"`
+	Off       *subcommand `arg:"subcommand:off" help:"turn GPS off"`
+	ColdStart *subcommand `arg:"subcommand:cold-start" help:"restart GPS without previous satellite data"`
+	HotStart  *subcommand `arg:"subcommand:hot-start" help:"restart GPS using previous satellite data"`
+	Location  *subcommand `arg:"subcommand:location" help:"get the last GPS location"`
+	Cell      *subcommand `arg:"subcommand:cell-location" help:"get the approximate location from the serving cell"`
+}
+
+type historySubcommand struct {
+	Since time.Duration `arg:"--since" default:"1h" help:"how far back to show the history"`
+}
+
+type qualitySubcommand struct {
+	Since time.Duration `arg:"--since" default:"24h" help:"how far back to show the measurements"`
+}
+
+type pdpSubcommand struct {
+	List    *subcommand          `arg:"subcommand:list" help:"list the PDP contexts"`
+	Define  *pdpDefineSubcommand `arg:"subcommand:define" help:"create or change a PDP context"`
+	Delete  *pdpCIDSubcommand    `arg:"subcommand:delete" help:"delete a PDP context"`
+	Auth    *pdpAuthSubcommand   `arg:"subcommand:auth" help:"set the authentication for a PDP context"`
+	Default *pdpCIDSubcommand    `arg:"subcommand:default" help:"set the PDP context used for the data connection"`
+}
+
+type pdpDefineSubcommand struct {
+	CID  int    `arg:"positional,required" help:"context ID"`
+	APN  string `arg:"positional,required" help:"access point name"`
+	Type string `arg:"--type" default:"IP" help:"PDP type, IP, IPV6 or IPV4V6"`
+}
+
+type pdpCIDSubcommand struct {
+	CID int `arg:"positional,required" help:"context ID"`
+}
+
+type pdpAuthSubcommand struct {
+	CID      int    `arg:"positional,required" help:"context ID"`
+	Auth     string `arg:"positional,required" help:"authentication type, none, pap or chap"`
+	Username string `arg:"--username" help:"username for pap or chap"`
+	Password string `arg:"--password,env:MODEM_PDP_PASSWORD" help:"password for pap or chap"`
+}
+
 type powerOffOnSubcommand struct {
 	Minutes int `arg:"required" help:"minutes to stay on"`
 }
@@ -86,13 +133,25 @@ func Run(inputArgs []string, ver string) error {
 		return runPower(args.Power)
 	} else if args.Status != nil {
 		return runStatus()
+	} else if args.Reset != nil {
+		return runResetFailures()
+	} else if args.GPS != nil {
+		return runGPS(args.GPS)
+	} else if args.History != nil {
+		return runHistory(args.History)
+	} else if args.DataUsage != nil {
+		return runDataUsage()
+	} else if args.Quality != nil {
+		return runQuality(args.Quality)
+	} else if args.PDP != nil {
+		return runPDP(args.PDP)
 	}
 
 	return nil
 }
 
 func runAT(args *atSubcommand) error {
-	log.Printf("Running AT command: %s", args.Cmd)
+	log.Printf("Running AT command: %s", modemcontroller.RedactATCommand(args.Cmd))
 	totalOut, out, err := modemcontroller.RunATCommand(args.Cmd)
 	if err != nil {
 		return fmt.Errorf("failed to run AT command: %w, output: %s", err, out)
@@ -160,6 +219,129 @@ func runStatus() error {
 	return nil
 }
 
+func runResetFailures() error {
+	log.Println("Resetting modem failures")
+	if err := modemcontroller.ResetFailures(); err != nil {
+		return fmt.Errorf("failed to reset modem failures: %w", err)
+	}
+	return nil
+}
+
+func runGPS(args *gpsSubcommand) error {
+	var err error
+	switch {
+	case args.On != nil:
+		log.Println("Turning GPS on")
+		err = modemcontroller.GPSOn()
+	case args.Off != nil:
+		log.Println("Turning GPS off")
+		err = modemcontroller.GPSOff()
+	case args.ColdStart != nil:
+		log.Println("Cold starting GPS")
+		err = modemcontroller.GPSColdStart()
+	case args.HotStart != nil:
+		log.Println("Hot starting GPS")
+		err = modemcontroller.GPSHotStart()
+	case args.Location != nil:
+		var location map[string]interface{}
+		location, err = modemcontroller.GetLocation()
+		if err == nil {
+			printMap(location, "")
+		}
+	case args.Cell != nil:
+		var location map[string]interface{}
+		location, err = modemcontroller.GetCellLocation()
+		if err == nil {
+			printMap(location, "")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("GPS command failed: %w", err)
+	}
+	return nil
+}
+
+func runHistory(args *historySubcommand) error {
+	history, err := modemcontroller.GetSignalHistory(time.Now().Add(-args.Since))
+	if err != nil {
+		return fmt.Errorf("failed to get signal history: %w", err)
+	}
+	if len(history) == 0 {
+		log.Printf("No signal history in the last %s", args.Since)
+		return nil
+	}
+	printTable(history, []string{"time", "registration", "accessTechnology", "csq", "rsrp", "rsrq", "sinr", "temp", "voltage"})
+	return nil
+}
+
+func runQuality(args *qualitySubcommand) error {
+	measurements, err := modemcontroller.GetConnectionQuality(time.Now().Add(-args.Since))
+	if err != nil {
+		return fmt.Errorf("failed to get connection quality: %w", err)
+	}
+	if len(measurements) == 0 {
+		log.Printf("No connection quality measurements in the last %s", args.Since)
+		return nil
+	}
+	printTable(measurements, []string{"time", "class", "loss", "rttMedianMs", "rttP95Ms", "jitterMs", "throughputKbps", "reason"})
+	return nil
+}
+
+// printTable prints a row for each map with the given columns, "-" for missing values.
+func printTable(rows []map[string]interface{}, columns []string) {
+	for _, column := range columns {
+		fmt.Printf("%-26s", column)
+	}
+	fmt.Println()
+	for _, row := range rows {
+		for _, column := range columns {
+			value, ok := row[column]
+			if !ok {
+				value = "-"
+			}
+			fmt.Printf("%-26v", value)
+		}
+		fmt.Println()
+	}
+}
+
+func runPDP(args *pdpSubcommand) error {
+	var err error
+	switch {
+	case args.List != nil:
+		var contexts []map[string]interface{}
+		contexts, err = modemcontroller.ListPDPContexts()
+		if err == nil {
+			printTable(contexts, []string{"cid", "type", "apn", "auth", "hasCredentials", "default"})
+		}
+	case args.Define != nil:
+		log.Printf("Setting PDP context %d to '%s' %s", args.Define.CID, args.Define.APN, args.Define.Type)
+		err = modemcontroller.DefinePDPContext(args.Define.CID, args.Define.Type, args.Define.APN)
+	case args.Delete != nil:
+		log.Printf("Deleting PDP context %d", args.Delete.CID)
+		err = modemcontroller.DeletePDPContext(args.Delete.CID)
+	case args.Auth != nil:
+		log.Printf("Setting PDP context %d authentication to %s", args.Auth.CID, args.Auth.Auth)
+		err = modemcontroller.SetPDPAuth(args.Auth.CID, args.Auth.Auth, args.Auth.Username, args.Auth.Password)
+	case args.Default != nil:
+		log.Printf("Setting default PDP context to %d", args.Default.CID)
+		err = modemcontroller.SetDefaultPDPContext(args.Default.CID)
+	}
+	if err != nil {
+		return fmt.Errorf("PDP command failed: %w", err)
+	}
+	return nil
+}
+
+func runDataUsage() error {
+	usage, err := modemcontroller.GetDataUsage()
+	if err != nil {
+		return fmt.Errorf("failed to get data usage: %w", err)
+	}
+	printMap(usage, "")
+	return nil
+}
+
 func printMap(m map[string]interface{}, indent string) {
 	// Collect keys and sort them, this is so when printing it out multiple times the order will stay the same.
 	keys := make([]string, 0, len(m))
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	modemcontroller "github.com/TheCacophonyProject/modemd/modem-controller"
 	"github.com/tarm/serial"
 )
 
@@ -19,6 +20,7 @@ var (
 	ErrATCommandFailed     = errors.New("AT command failed")
 	ErrATErrorResponse     = errors.New("error response from AT command")
 	ErrATTestCommandFailed = errors.New("test AT command failed")
+	ErrATManagerStopped    = errors.New("AT manager was stopped")
 )
 
 type ATError struct {
@@ -29,9 +31,9 @@ type ATError struct {
 
 func (e *ATError) Error() string {
 	if e.Detail == "" {
-		return fmt.Sprintf("failed to run AT command '%s' because %s", e.Cmd, e.Cause)
+		return fmt.Sprintf("failed to run AT command '%s' because %s", modemcontroller.RedactATCommand(e.Cmd), e.Cause)
 	}
-	return fmt.Sprintf("failed to run AT command '%s' because %s, extra details: %s", e.Cmd, e.Cause, e.Detail)
+	return fmt.Sprintf("failed to run AT command '%s' because %s, extra details: %s", modemcontroller.RedactATCommand(e.Cmd), e.Cause, modemcontroller.RedactATCommand(e.Detail))
 }
 
 func (e *ATError) Unwrap() error { return e.Cause }
@@ -53,38 +55,78 @@ type result struct {
 // Struct for managing the AT commands
 type atManager struct {
 	requests chan atRequest
+	done     chan struct{}
 }
 
 func newATManager() *atManager {
 	am := &atManager{
 		requests: make(chan atRequest, 100),
+		done:     make(chan struct{}),
 	}
 	go am.processRequestsLoop()
 	return am
 }
 
+// stop will stop processing AT commands. Requests still in the queue get an ErrATManagerStopped error.
+func (am *atManager) stop() {
+	close(am.done)
+}
+
 func (am *atManager) asyncRequest(cmd string, timeout time.Time, retries int) chan (result) {
 	// Make AT request
-	req := atRequest{cmd: cmd, reply: make(chan result), timeout: timeout, retries: retries}
+	req := atRequest{cmd: cmd, reply: make(chan result, 1), timeout: timeout, retries: retries}
+	// Check that the manager hasn't been stopped first, as select picks randomly when the queue has room too.
+	select {
+	case <-am.done:
+		req.reply <- result{"", &ATError{Cause: ErrATManagerStopped, Cmd: cmd}}
+		return req.reply
+	default:
+	}
 	// Send request to queue
-	am.requests <- req
+	select {
+	case <-am.done:
+		req.reply <- result{"", &ATError{Cause: ErrATManagerStopped, Cmd: cmd}}
+	case am.requests <- req:
+	}
 	// Return channel
 	return req.reply
 }
 
 func (am *atManager) request(cmd string, timeoutmSec int, retries int) (string, error) {
+	start := time.Now()
 	// Make async request
-	reply := am.asyncRequest(cmd, time.Now().Add(time.Duration(timeoutmSec)*time.Millisecond), retries)
-	// Wait for reply
-	result := <-reply
-	return result.resp, result.err
+	reply := am.asyncRequest(cmd, start.Add(time.Duration(timeoutmSec)*time.Millisecond), retries)
+	// Wait for reply. A request queued just as the manager stopped might not be processed, so stop waiting then.
+	var res result
+	select {
+	case res = <-reply:
+	case <-am.done:
+		select {
+		case res = <-reply:
+		default:
+			res = result{"", &ATError{Cause: ErrATManagerStopped, Cmd: cmd}}
+		}
+	}
+	modemdCounters.atCommand(time.Since(start), res.err)
+	return res.resp, res.err
 }
 
 // Function to process the AT commands one by one.
 func (am *atManager) processRequestsLoop() {
 	for {
-		req := <-am.requests
-		req.reply <- processATRequest(req)
+		select {
+		case <-am.done:
+			for {
+				select {
+				case req := <-am.requests:
+					req.reply <- result{"", &ATError{Cause: ErrATManagerStopped, Cmd: req.cmd}}
+				default:
+					return
+				}
+			}
+		case req := <-am.requests:
+			req.reply <- processATRequest(req)
+		}
 	}
 }
 
@@ -178,7 +220,7 @@ func attemptATCommand(req atRequest, atPort string) (string, error) {
 
 	// Run the given AT command
 	fullResponse, response, err := runATCommand(serialPort, req.cmd)
-	log.Debugf("AT command '%s' full response: %s", req.cmd, formatFullResponse(fullResponse))
+	log.Debugf("AT command '%s' full response: %s", modemcontroller.RedactATCommand(req.cmd), formatFullResponse(modemcontroller.RedactATCommand(fullResponse)))
 	return response, err
 }
 
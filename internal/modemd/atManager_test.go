@@ -0,0 +1,42 @@
+package modemd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSetATManagerStopsPrevious(t *testing.T) {
+	mc := &ModemController{}
+	if err := mc.setATManager(); err == nil {
+		t.Fatal("expected an error without a modem")
+	}
+	mc.setModem(&Modem{})
+	if err := mc.setATManager(); err != nil {
+		t.Fatal(err)
+	}
+	first, err := mc.atManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.reopenATPort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.request("AT", 1000, 0); !errors.Is(err, ErrATManagerStopped) {
+		t.Errorf("replaced AT manager got error %v, want %v", err, ErrATManagerStopped)
+	}
+	second, err := mc.atManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("AT manager wasn't replaced")
+	}
+
+	mc.setModem(nil)
+	if _, err := second.request("AT", 1000, 0); !errors.Is(err, ErrATManagerStopped) {
+		t.Errorf("AT manager of the removed modem got error %v, want %v", err, ErrATManagerStopped)
+	}
+	if _, err := mc.RunATCommand("AT", 1000, 0); err == nil {
+		t.Error("expected an error without a modem")
+	}
+}
@@ -0,0 +1,120 @@
+package modemd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const BoardKey = "modemd-board"
+
+// Board profiles.
+const (
+	boardAuto   = "auto"
+	boardPi3    = "pi3"
+	boardPi4    = "pi4"
+	boardCM4    = "cm4"
+	boardCustom = "custom"
+)
+
+// deviceTreeModel has the board's model, e.g "Raspberry Pi 4 Model B Rev 1.4".
+const deviceTreeModel = "/proc/device-tree/model"
+
+// BoardConfig is read from the "modemd-board" config section. The profile sets how the modem is powered on
+// the board, the other fields override it.
+type BoardConfig struct {
+	Profile  string             `mapstructure:"profile"` // "auto", "pi3", "pi4", "cm4" or "custom".
+	USBPower USBPowerConfig     `mapstructure:"usb-power"`
+	Power    PowerControlConfig `mapstructure:"power"`
+}
+
+func DefaultBoardConfig() BoardConfig {
+	return BoardConfig{
+		Profile: boardAuto,
+	}
+}
+
+// The modem board's pins, the same on each Raspberry Pi. gpiochip0 has the BCM pins for "gpiod".
+var piModemPower = PowerControlConfig{
+	Backend:      powerGPIO,
+	Chip:         "/dev/gpiochip0",
+	EnablePin:    PinConfig{Name: "GPIO22"},
+	SupplyPin:    PinConfig{Name: "GPIO20"},
+	ShutdownWait: 30 * time.Second,
+}
+
+// boardProfiles are the defaults for each board. A custom board has to set everything in its config.
+var boardProfiles = map[string]BoardConfig{
+	boardPi3: {
+		Power: piModemPower,
+		USBPower: USBPowerConfig{
+			Backend:      usbPowerBus,
+			BusPowerPath: "/sys/devices/platform/soc/3f980000.usb/buspower",
+			Hub:          "1-1",
+			OffPorts:     []int{1}, // The ethernet, it uses a bit of power.
+		},
+	},
+	// The Pi 4's VL805 hub gangs its ports so they are all switched together. The ports only lose power
+	// when they are off on both the USB 2 hub and the USB 3 root hub, which uhubctl calls hub "2".
+	boardPi4: {
+		Power: piModemPower,
+		USBPower: USBPowerConfig{
+			Backend:   usbPowerHub,
+			Hub:       "1-1",
+			ExtraHubs: []string{"usb2"},
+			Ports:     []int{1, 2, 3, 4},
+		},
+	},
+	// The CM4 has no hub of its own. Carrier boards with a hub that can switch its ports set the backend.
+	boardCM4: {
+		Power:    piModemPower,
+		USBPower: USBPowerConfig{Backend: usbPowerNone},
+	},
+	boardCustom: {
+		Power:    PowerControlConfig{Backend: powerNone, ShutdownWait: 30 * time.Second},
+		USBPower: USBPowerConfig{Backend: usbPowerNone},
+	},
+}
+
+// resolve returns the config with the profile's defaults for everything not set. The "auto" profile is
+// found from the board's model.
+func (c BoardConfig) resolve(modemPowerPin string) (BoardConfig, error) {
+	if c.Profile == boardAuto {
+		c.Profile = detectBoard()
+	}
+	profile, ok := boardProfiles[c.Profile]
+	if !ok {
+		return BoardConfig{}, fmt.Errorf("invalid board profile '%s'", c.Profile)
+	}
+	c.USBPower = c.USBPower.withDefaults(profile.USBPower)
+	if err := c.USBPower.validate(); err != nil {
+		return BoardConfig{}, err
+	}
+	c.Power = c.Power.withDefaults(profile.Power, modemPowerPin)
+	if err := c.Power.validate(); err != nil {
+		return BoardConfig{}, err
+	}
+	return c, nil
+}
+
+// detectBoard finds the board's profile from its device tree model. Unknown boards get the Pi 3 profile,
+// which is what modemd was first made for.
+func detectBoard() string {
+	model, err := os.ReadFile(deviceTreeModel)
+	if err != nil {
+		log.Errorf("Failed to read the board model, using the '%s' profile: %v", boardPi3, err)
+		return boardPi3
+	}
+	m := strings.TrimRight(string(model), "\x00\n")
+	switch {
+	case strings.HasPrefix(m, "Raspberry Pi Compute Module 4"):
+		return boardCM4
+	case strings.HasPrefix(m, "Raspberry Pi 4"):
+		return boardPi4
+	case strings.HasPrefix(m, "Raspberry Pi 3"):
+		return boardPi3
+	}
+	log.Infof("Unknown board '%s', using the '%s' profile.", m, boardPi3)
+	return boardPi3
+}
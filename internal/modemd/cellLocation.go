@@ -0,0 +1,286 @@
+package modemd
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CellLocationKey = "modemd-cell-location"
+
+// CellLocationConfig is read from the "modemd-cell-location" config section.
+type CellLocationConfig struct {
+	// Cell tower database in the OpenCellID CSV format (radio,mcc,net,area,cell,unit,lon,lat,range,...).
+	// Leave empty to only record the cell fingerprints.
+	CellDatabase string `mapstructure:"cell-database"`
+	// If the serving cell isn't in the database, estimate the location from other cells in the same tracking area.
+	UseAreaFallback bool `mapstructure:"use-area-fallback"`
+}
+
+func DefaultCellLocationConfig() CellLocationConfig {
+	return CellLocationConfig{
+		CellDatabase:    "",
+		UseAreaFallback: true,
+	}
+}
+
+var ErrNoCellLocation = errors.New("no cell location available")
+
+// CellFingerprint identifies the serving cell, read from AT+CPSI?.
+type CellFingerprint struct {
+	Radio  string // GSM, UMTS or LTE, matching the OpenCellID radio names.
+	MCC    int
+	MNC    int
+	Area   int // LAC for GSM/UMTS, TAC for LTE.
+	CellID int64
+	ReadAt time.Time
+}
+
+func (f CellFingerprint) key() string {
+	return fmt.Sprintf("%s/%d/%d/%d/%d", f.Radio, f.MCC, f.MNC, f.Area, f.CellID)
+}
+
+func (f CellFingerprint) ToDBusMap() map[string]interface{} {
+	return map[string]interface{}{
+		"radio":  f.Radio,
+		"mcc":    f.MCC,
+		"mnc":    f.MNC,
+		"area":   f.Area,
+		"cellID": f.CellID,
+		"readAt": f.ReadAt.Format(time.RFC3339),
+	}
+}
+
+// CellLocation is an approximate location from the serving cell.
+type CellLocation struct {
+	Latitude    float64
+	Longitude   float64
+	Accuracy    float64 // Radius in meters.
+	Method      string  // "cell" if the serving cell was found, "area" if estimated from the tracking area.
+	Fingerprint CellFingerprint
+}
+
+func (l CellLocation) ToDBusMap() map[string]interface{} {
+	return map[string]interface{}{
+		"latitude":    l.Latitude,
+		"longitude":   l.Longitude,
+		"accuracy":    l.Accuracy,
+		"method":      l.Method,
+		"fingerprint": l.Fingerprint.ToDBusMap(),
+	}
+}
+
+// CellLocator records the serving cell fingerprint and resolves it against the cell database.
+type CellLocator struct {
+	CellLocationConfig
+
+	mu              sync.Mutex
+	lastFingerprint *CellFingerprint
+	lastLocation    *CellLocation
+	resolved        map[string]*CellLocation // Cache of lookups, nil if the cell wasn't found.
+}
+
+func NewCellLocator(conf CellLocationConfig) *CellLocator {
+	return &CellLocator{
+		CellLocationConfig: conf,
+		resolved:           map[string]*CellLocation{},
+	}
+}
+
+// record stores the fingerprint and looks up its location. The database is read without the lock held
+// so the status isn't blocked by a slow lookup.
+func (cl *CellLocator) record(fp CellFingerprint) *CellLocation {
+	cl.mu.Lock()
+	cl.lastFingerprint = &fp
+	location, ok := cl.resolved[fp.key()]
+	cl.mu.Unlock()
+	if cl.CellDatabase == "" {
+		return nil
+	}
+	if !ok {
+		var err error
+		location, err = lookupCell(cl.CellDatabase, fp, cl.UseAreaFallback)
+		if err != nil {
+			log.Errorf("Failed to look up cell location: %v", err)
+			return nil
+		}
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.resolved[fp.key()] = location
+	if location == nil {
+		log.Infof("Cell '%s' not found in the cell database.", fp.key())
+		return nil
+	}
+	l := *location
+	l.Fingerprint = fp
+	cl.lastLocation = &l
+	return &l
+}
+
+// Location returns the location from the most recent cell fingerprint that could be resolved.
+func (cl *CellLocator) Location() (*CellLocation, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.lastLocation == nil {
+		return nil, ErrNoCellLocation
+	}
+	l := *cl.lastLocation
+	return &l, nil
+}
+
+func (cl *CellLocator) Status() map[string]interface{} {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	status := map[string]interface{}{}
+	if cl.lastFingerprint != nil {
+		status["fingerprint"] = cl.lastFingerprint.ToDBusMap()
+	}
+	if cl.lastLocation != nil {
+		status["location"] = cl.lastLocation.ToDBusMap()
+	}
+	return status
+}
+
+func (mc *ModemController) readCellFingerprint() (CellFingerprint, error) {
+	out, err := mc.RunATCommand("AT+CPSI?", 1000, 1)
+	if err != nil {
+		return CellFingerprint{}, err
+	}
+	return parseCPSI(out)
+}
+
+// recordCellFingerprint reads the serving cell and resolves its location if a cell database is configured.
+func (mc *ModemController) recordCellFingerprint() (*CellFingerprint, *CellLocation) {
+	fp, err := mc.readCellFingerprint()
+	if err != nil {
+		log.Printf("Failed to get cell fingerprint: %s", err)
+		return nil, nil
+	}
+	return &fp, mc.CellLocator.record(fp)
+}
+
+// parseCPSI parses the serving cell from AT+CPSI?, for example
+// +CPSI: LTE,Online,530-05,0x2F3A,27447297,275,EUTRAN-BAND28,9410,5,5,-94,-1022,-734,11
+// +CPSI: WCDMA,Online,530-05,0x0C3F,12345678,WCDMA IMT 2000,325,10737,0,4.5,64,30,31,500
+// +CPSI: GSM,Online,530-05,0x1234,5678,48,EGSM 900,-70,0,42-42
+func parseCPSI(out string) (CellFingerprint, error) {
+	raw := strings.TrimSpace(out)
+	parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(raw, "+CPSI:")), ",")
+	if len(parts) < 5 {
+		return CellFingerprint{}, fmt.Errorf("no serving cell in CPSI '%s'", raw)
+	}
+	fp := CellFingerprint{ReadAt: time.Now()}
+	switch strings.TrimSpace(parts[0]) {
+	case "LTE":
+		fp.Radio = "LTE"
+	case "WCDMA":
+		fp.Radio = "UMTS"
+	case "GSM":
+		fp.Radio = "GSM"
+	default:
+		return CellFingerprint{}, fmt.Errorf("unsupported system mode in CPSI '%s'", raw)
+	}
+	mccMNC := strings.Split(strings.TrimSpace(parts[2]), "-")
+	if len(mccMNC) != 2 {
+		return CellFingerprint{}, fmt.Errorf("invalid MCC-MNC in CPSI '%s'", raw)
+	}
+	var err error
+	if fp.MCC, err = strconv.Atoi(mccMNC[0]); err != nil {
+		return CellFingerprint{}, fmt.Errorf("invalid MCC in CPSI '%s'", raw)
+	}
+	if fp.MNC, err = strconv.Atoi(mccMNC[1]); err != nil {
+		return CellFingerprint{}, fmt.Errorf("invalid MNC in CPSI '%s'", raw)
+	}
+	area, err := parseCPSIInt(parts[3])
+	if err != nil {
+		return CellFingerprint{}, fmt.Errorf("invalid area code in CPSI '%s'", raw)
+	}
+	fp.Area = int(area)
+	if fp.CellID, err = parseCPSIInt(parts[4]); err != nil {
+		return CellFingerprint{}, fmt.Errorf("invalid cell ID in CPSI '%s'", raw)
+	}
+	return fp, nil
+}
+
+// parseCPSIInt parses a number that is in hex if it has a "0x" prefix, otherwise decimal.
+func parseCPSIInt(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if hex, ok := strings.CutPrefix(s, "0x"); ok {
+		return strconv.ParseInt(hex, 16, 64)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// lookupCell finds the cell in an OpenCellID CSV file. The file is streamed rather than loaded
+// as country extracts can be too large to keep in memory. Returns nil if the cell isn't found.
+func lookupCell(path string, fp CellFingerprint, useAreaFallback bool) (*CellLocation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type cell struct{ lat, lon, rangeM float64 }
+	var areaCells []cell
+	r := csv.NewReader(f)
+	r.ReuseRecord = true
+	r.FieldsPerRecord = -1
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 9 || record[0] != fp.Radio {
+			continue // Also skips the header line.
+		}
+		if record[1] != strconv.Itoa(fp.MCC) || record[2] != strconv.Itoa(fp.MNC) || record[3] != strconv.Itoa(fp.Area) {
+			continue
+		}
+		lon, err1 := strconv.ParseFloat(record[6], 64)
+		lat, err2 := strconv.ParseFloat(record[7], 64)
+		rangeM, err3 := strconv.ParseFloat(record[8], 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		if record[4] == strconv.FormatInt(fp.CellID, 10) {
+			return &CellLocation{Latitude: lat, Longitude: lon, Accuracy: rangeM, Method: "cell"}, nil
+		}
+		areaCells = append(areaCells, cell{lat, lon, rangeM})
+	}
+	if !useAreaFallback || len(areaCells) == 0 {
+		return nil, nil
+	}
+
+	// Use the center of the area's cells, with the accuracy covering the range of every cell.
+	location := &CellLocation{Method: "area"}
+	for _, c := range areaCells {
+		location.Latitude += c.lat / float64(len(areaCells))
+		location.Longitude += c.lon / float64(len(areaCells))
+	}
+	for _, c := range areaCells {
+		d := distanceMeters(location.Latitude, location.Longitude, c.lat, c.lon) + c.rangeM
+		location.Accuracy = math.Max(location.Accuracy, d)
+	}
+	return location, nil
+}
+
+// distanceMeters returns the great circle distance between two points.
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,125 @@
+package modemd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/modemd/probe"
+)
+
+const ConnectivityKey = "modemd-connectivity"
+
+// ConnectivityConfig is read from the "modemd-connectivity" config section. The test hosts are pinged
+// first, the other probes are optional.
+type ConnectivityConfig struct {
+	PingCount        int      `mapstructure:"ping-count"`         // Echo requests sent to each test host.
+	TCPAddresses     []string `mapstructure:"tcp-addresses"`      // "host:port" to connect to if no test host replies, for networks that block ICMP.
+	HTTPURL          string   `mapstructure:"http-url"`           // URL to check for a captive portal, e.g "http://connectivitycheck.gstatic.com/generate_204".
+	HTTPExpectStatus int      `mapstructure:"http-expect-status"` // Status expected from HTTPURL, 0 for any 2xx.
+	DNSName          string   `mapstructure:"dns-name"`           // Name to look up through the modem, "" to skip.
+	DNSServer        string   `mapstructure:"dns-server"`         // DNS server to use, "" for the ones in /etc/resolv.conf.
+}
+
+func DefaultConnectivityConfig() ConnectivityConfig {
+	return ConnectivityConfig{
+		PingCount: 3,
+	}
+}
+
+// probeResults are the results from the last connectivity test.
+type probeResults struct {
+	mu      sync.Mutex
+	results []probe.Result
+	time    time.Time
+}
+
+func (p *probeResults) set(results []probe.Result) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.results = results
+	p.time = time.Now()
+}
+
+func (p *probeResults) ToDBusMap() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := map[string]interface{}{}
+	if p.time.IsZero() {
+		return m
+	}
+	m["time"] = p.time.Format(time.RFC3339)
+	for _, r := range p.results {
+		result := map[string]interface{}{
+			"ok":        r.OK(),
+			"latencyMs": float64(r.Latency.Microseconds()) / 1000,
+		}
+		if r.Sent > 0 {
+			result["sent"] = r.Sent
+			result["received"] = r.Received
+		}
+		if r.Detail != "" {
+			result["detail"] = r.Detail
+		}
+		if r.Err != nil {
+			result["error"] = r.Err.Error()
+		}
+		m[r.Probe+" "+r.Target] = result
+	}
+	return m
+}
+
+// PingTest checks the connection through the modem, not the wifi if available. One of the test hosts, or
+// TCP addresses, has to reply and the HTTP and DNS probes have to pass if they are configured.
+func (mc *ModemController) PingTest() bool {
+	conf := mc.Connectivity
+	opts := probe.Options{Interface: mc.Modem.Netdev, Timeout: mc.PingWaitTime}
+	results := []probe.Result{}
+	ok := false
+	for _, host := range mc.testHosts() {
+		r := probe.ICMP(host, conf.PingCount, opts)
+		results = append(results, r)
+		if r.OK() {
+			mc.Modem.LastPingRTT = r.Latency
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		for _, address := range conf.TCPAddresses {
+			r := probe.TCP(address, opts)
+			results = append(results, r)
+			if r.OK() {
+				ok = true
+				break
+			}
+		}
+	}
+	if ok && conf.HTTPURL != "" {
+		r := probe.HTTP(conf.HTTPURL, conf.HTTPExpectStatus, opts)
+		results = append(results, r)
+		ok = r.OK()
+	}
+	if ok && conf.DNSName != "" {
+		r := probe.DNS(conf.DNSName, conf.DNSServer, opts)
+		results = append(results, r)
+		ok = r.OK()
+	}
+	mc.probeResults.set(results)
+
+	if !ok {
+		log.Info(probeSummary(results))
+	} else {
+		log.Debug(probeSummary(results))
+	}
+	return ok
+}
+
+func probeSummary(results []probe.Result) string {
+	lines := make([]string, len(results))
+	for i, r := range results {
+		lines[i] = r.String()
+	}
+	return fmt.Sprintf("Connectivity probes: %s.", strings.Join(lines, "; "))
+}
@@ -0,0 +1,269 @@
+package modemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const ControlKey = "modemd-control"
+
+// Control backends.
+const (
+	controlAT   = "at"
+	controlQMI  = "qmi"
+	controlMBIM = "mbim"
+)
+
+// defaultControlDevice is the udev symlink to the modem's /dev/cdc-wdm* device.
+const defaultControlDevice = "/dev/UsbModemControl"
+
+// ControlConfig is read from the "modemd-control" config section.
+type ControlConfig struct {
+	Profiles map[string]ControlProfile `mapstructure:"profiles"` // Keyed by the modem name, e.g "qualcomm".
+}
+
+// ControlProfile sets how a modem is controlled, empty fields keep the modem's defaults. QMI and MBIM need
+// the modem in a USB composition with that interface, on SIMCom modems QMI is product ID 9001 with the "wwan0" netdev.
+type ControlProfile struct {
+	Backend   string `mapstructure:"backend"`    // "at", "qmi" or "mbim".
+	Device    string `mapstructure:"device"`     // Control device for QMI or MBIM.
+	ProductID string `mapstructure:"product-id"` // USB composition the modem is switched to.
+	NetDev    string `mapstructure:"netdev"`
+}
+
+func DefaultControlConfig() ControlConfig {
+	return ControlConfig{}
+}
+
+func (c ControlConfig) validate() error {
+	for name, profile := range c.Profiles {
+		switch profile.Backend {
+		case "", controlAT, controlQMI, controlMBIM:
+		default:
+			return fmt.Errorf("invalid control backend '%s' for modem '%s'", profile.Backend, name)
+		}
+	}
+	return nil
+}
+
+// apply changes the modem config by its profile, if it has one.
+func (c ControlConfig) apply(m ModemConfig) ModemConfig {
+	for name, profile := range c.Profiles {
+		if !strings.EqualFold(name, m.Name) {
+			continue
+		}
+		if profile.Backend != "" {
+			m.Control = profile.Backend
+		}
+		if profile.Device != "" {
+			m.ControlDevice = profile.Device
+		}
+		if profile.ProductID != "" {
+			m.ProductID = profile.ProductID
+		}
+		if profile.NetDev != "" {
+			m.NetDev = profile.NetDev
+		}
+	}
+	if (m.Control == controlQMI || m.Control == controlMBIM) && m.ControlDevice == "" {
+		m.ControlDevice = defaultControlDevice
+	}
+	return m
+}
+
+// controlBackend queries the modem and starts its data session. AT commands are always available and are
+// used whenever another backend fails.
+type controlBackend interface {
+	Name() string
+	SIMStatus() (string, error) // "READY" when the SIM can be used, otherwise why it can't, like AT+CPIN?.
+	Signal() (controlSignal, error)
+	Registration() (int, error) // The status as AT+CREG? reports it.
+	StartData(context PDPContext) error
+	StopData() error
+	Close() error
+}
+
+// controlSignal is the signal strength as AT+CSQ reports it, with the LTE metrics if the backend has them.
+type controlSignal struct {
+	CSQ           int
+	BitErrorRate  int
+	HasLTEMetrics bool
+	RSRP          float64 // dBm
+	RSRQ          float64 // dB
+	SINR          float64 // dB
+}
+
+// rssiToCSQ converts the RSSI in dBm to the 0-31 AT+CSQ scale.
+func rssiToCSQ(rssi int) int {
+	return min(max((rssi+113)/2, 0), 31)
+}
+
+// atControl uses AT commands over the serial port. In RNDIS/ECM mode the modem brings up the netdev
+// itself, on the context activated here.
+type atControl struct {
+	mc *ModemController
+}
+
+func (c atControl) Name() string {
+	return controlAT
+}
+
+func (c atControl) SIMStatus() (string, error) {
+	return c.mc.atSIMStatus()
+}
+
+func (c atControl) Signal() (controlSignal, error) {
+	csq, bitErrorRate, err := c.mc.atSignalStrength()
+	return controlSignal{CSQ: csq, BitErrorRate: bitErrorRate}, err
+}
+
+func (c atControl) Registration() (int, error) {
+	return c.mc.atRegistration()
+}
+
+// StartData activates the context, which does nothing if it is already active.
+func (c atControl) StartData(context PDPContext) error {
+	_, err := c.mc.RunATCommand(fmt.Sprintf("AT+CGACT=1,%d", context.CID), 15000, 1)
+	return err
+}
+
+func (c atControl) StopData() error {
+	return nil
+}
+
+func (c atControl) Close() error {
+	return nil
+}
+
+// useControl calls f with the modem's control backend, falling back to AT commands if the modem only
+// has AT or the backend fails.
+func useControl[T any](mc *ModemController, what string, f func(controlBackend) (T, error)) (T, error) {
+	if mc.Modem != nil && mc.Modem.control != nil {
+		v, err := f(mc.Modem.control)
+		if err == nil {
+			return v, nil
+		}
+		log.Debugf("Failed to read %s over %s, using AT commands: %v", what, mc.Modem.control.Name(), err)
+	}
+	return f(atControl{mc})
+}
+
+// openControl opens the modem's control backend. AT commands are used if that is the modem's backend
+// or the device can't be opened.
+func (mc *ModemController) openControl() {
+	m := mc.Modem
+	var backend controlBackend
+	var err error
+	switch m.Control {
+	case controlQMI:
+		backend, err = newQMIControl(m.ControlDevice, mc)
+	case controlMBIM:
+		backend, err = newMBIMControl(m.ControlDevice, mc)
+	default:
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to open %s control device '%s', using AT commands: %v", m.Control, m.ControlDevice, err)
+		return
+	}
+	log.Infof("Controlling the modem with %s over '%s'.", backend.Name(), m.ControlDevice)
+	m.control = backend
+}
+
+// closeControl ends the data session and closes the control backend.
+func (mc *ModemController) closeControl() {
+	if mc.Modem == nil || mc.Modem.control == nil {
+		return
+	}
+	control := mc.Modem.control
+	mc.Modem.control = nil
+	if err := control.StopData(); err != nil {
+		log.Errorf("Failed to stop the %s data session: %v", control.Name(), err)
+	}
+	if err := control.Close(); err != nil {
+		log.Errorf("Failed to close the %s control device: %v", control.Name(), err)
+	}
+}
+
+// startDataSession starts the data session on the default PDP context.
+func (mc *ModemController) startDataSession() error {
+	if mc.Modem == nil {
+		return nil
+	}
+	var control controlBackend = atControl{mc}
+	if mc.Modem.control != nil {
+		control = mc.Modem.control
+	}
+	context, err := mc.dataContext()
+	if err != nil {
+		return err
+	}
+	log.Infof("Starting %s data session on PDP context %d '%s' %s.", control.Name(), context.CID, context.APN, context.Type)
+	return control.StartData(context)
+}
+
+// dataContext returns the default PDP context with the credentials from the config, as they can't be
+// read back from the modem.
+func (mc *ModemController) dataContext() (PDPContext, error) {
+	context, err := mc.getPDPContext(mc.defaultCID())
+	if err != nil {
+		return PDPContext{}, err
+	}
+	for _, configured := range mc.PDP.Contexts {
+		if configured.CID == context.CID {
+			context.Username = configured.Username
+			context.Password = configured.Password
+		}
+	}
+	return context, nil
+}
+
+// controlName is the backend used to control the modem.
+func (m *Modem) controlName() string {
+	if m.control == nil {
+		return controlAT
+	}
+	return m.control.Name()
+}
+
+// configureNetdev brings up the modem's interface with the session's addresses and an IPv4 default route,
+// for the backends where the modem doesn't run DHCP. IPv6 default routes are left to router advertisements.
+func (mc *ModemController) configureNetdev(addrs []net.IPNet, ipv4Gateway net.IP) error {
+	link, err := net.InterfaceByName(mc.Modem.Netdev)
+	if err != nil {
+		return err
+	}
+	if err := setLinkUp(link.Index); err != nil {
+		return fmt.Errorf("failed to bring up '%s': %w", link.Name, err)
+	}
+	for _, addr := range addrs {
+		log.Infof("Adding address %s to '%s'.", addr.String(), link.Name)
+		if err := addAddress(link.Index, addr); err != nil {
+			return fmt.Errorf("failed to add address %s to '%s': %w", addr.String(), link.Name, err)
+		}
+	}
+	if ipv4Gateway == nil {
+		return nil
+	}
+	metric := uint32(0)
+	if mc.Routing.enabled() {
+		metric = mc.Routing.ModemMetric
+	}
+	err = addRoute(route{
+		Table:    unix.RT_TABLE_MAIN,
+		Gateway:  ipv4Gateway,
+		OifIndex: link.Index,
+		Metric:   metric,
+		Protocol: unix.RTPROT_STATIC,
+		Scope:    unix.RT_SCOPE_UNIVERSE,
+		Type:     unix.RTN_UNICAST,
+	}, unix.NLM_F_EXCL)
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to add default route via %s: %w", ipv4Gateway, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package modemd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed 5 field cron expression "minute hour day-of-month month day-of-week".
+// Each field supports '*', single values, ranges 'a-b', steps '*/n', 'a-b/n' or 'a/n', which is 'a-max/n',
+// and comma separated lists.
+type cronSchedule struct {
+	minutes     uint64
+	hours       uint64
+	daysOfMonth uint64
+	months      uint64
+	daysOfWeek  uint64
+	domStar     bool
+	dowStar     bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression '%s', expected 5 fields", expr)
+	}
+	var err error
+	// Like cron, a field starting with '*', such as '*/2', counts as a star for matching the day.
+	c := &cronSchedule{
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}
+	if c.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute in cron expression '%s': %v", expr, err)
+	}
+	if c.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour in cron expression '%s': %v", expr, err)
+	}
+	if c.daysOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day of month in cron expression '%s': %v", expr, err)
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month in cron expression '%s': %v", expr, err)
+	}
+	if c.daysOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid day of week in cron expression '%s': %v", expr, err)
+	}
+	// Both 0 and 7 are Sunday.
+	if c.daysOfWeek&(1<<7) != 0 {
+		c.daysOfWeek |= 1
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step, hasStep := 1, false
+		if i := strings.Index(part, "/"); i != -1 {
+			hasStep = true
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step '%s'", part)
+			}
+			part = part[:i]
+		}
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", part)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value '%s'", part)
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matchesDay checks if the schedule can trigger on the given day.
+// Like cron, if both day of month and day of week are restricted then either one matching is enough.
+func (c *cronSchedule) matchesDay(day time.Time) bool {
+	if c.months&(1<<uint(day.Month())) == 0 {
+		return false
+	}
+	domMatch := c.daysOfMonth&(1<<uint(day.Day())) != 0
+	dowMatch := c.daysOfWeek&(1<<uint(day.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// startsOnDay returns the times the schedule triggers on the given day.
+func (c *cronSchedule) startsOnDay(day time.Time) []time.Time {
+	if !c.matchesDay(day) {
+		return nil
+	}
+	y, m, d := day.Date()
+	var starts []time.Time
+	for h := 0; h < 24; h++ {
+		if c.hours&(1<<uint(h)) == 0 {
+			continue
+		}
+		for min := 0; min < 60; min++ {
+			if c.minutes&(1<<uint(min)) != 0 {
+				starts = append(starts, time.Date(y, m, d, h, min, 0, 0, day.Location()))
+			}
+		}
+	}
+	return starts
+}
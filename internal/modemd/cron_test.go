@@ -0,0 +1,115 @@
+package modemd
+
+import (
+	"testing"
+	"time"
+)
+
+func bitsOf(values ...int) uint64 {
+	var bits uint64
+	for _, v := range values {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field string
+		min   int
+		max   int
+		want  uint64
+	}{
+		{"*", 0, 6, bitsOf(0, 1, 2, 3, 4, 5, 6)},
+		{"5", 0, 59, bitsOf(5)},
+		{"1-3", 1, 12, bitsOf(1, 2, 3)},
+		{"*/15", 0, 59, bitsOf(0, 15, 30, 45)},
+		{"10-20/5", 0, 59, bitsOf(10, 15, 20)},
+		{"5/15", 0, 59, bitsOf(5, 20, 35, 50)},
+		{"1,3,5-6", 0, 7, bitsOf(1, 3, 5, 6)},
+		{"*/2", 1, 31, bitsOf(1, 3, 5, 7, 9, 11, 13, 15, 17, 19, 21, 23, 25, 27, 29, 31)},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.field, tt.min, tt.max)
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", tt.field, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCronField(%q) got %b, want %b", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronFieldInvalid(t *testing.T) {
+	for _, field := range []string{"60", "a", "5-1", "*/0", "*/x", "1-", "-1", ""} {
+		if _, err := parseCronField(field, 0, 59); err == nil {
+			t.Errorf("parseCronField(%q) expected an error", field)
+		}
+	}
+	if _, err := parseCron("0 6 * *"); err == nil {
+		t.Error("expected an error for 4 fields")
+	}
+}
+
+func TestCronMatchesDay(t *testing.T) {
+	// 2025-06-01 is a Sunday.
+	sunday1st := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	monday2nd := time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC)
+	tuesday3rd := time.Date(2025, 6, 3, 0, 0, 0, 0, time.UTC)
+	friday13th := time.Date(2025, 6, 13, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expr string
+		day  time.Time
+		want bool
+	}{
+		{"0 6 * * *", monday2nd, true},
+		{"0 6 * * 1-5", monday2nd, true},
+		{"0 6 * * 1-5", sunday1st, false},
+		{"0 6 * * 7", sunday1st, true},
+		{"0 6 * 7 *", sunday1st, false},
+		// Both restricted, either matching is enough.
+		{"0 6 13 * 5", monday2nd, false},
+		{"0 6 1 * 5", sunday1st, true},
+		{"0 6 13 * 5", friday13th, true},
+		// A step from '*' still counts as a star, so both have to match.
+		{"0 6 */2 * 1", monday2nd, false},
+		{"0 6 */2 * 1", sunday1st, false},
+		{"0 6 */2 * 2", tuesday3rd, true},
+		{"0 6 1 * */2", sunday1st, true},
+		{"0 6 2 * */2", monday2nd, false},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.matchesDay(tt.day); got != tt.want {
+			t.Errorf("'%s' matchesDay(%s) got %t, want %t", tt.expr, tt.day.Format("Mon 2 Jan"), got, tt.want)
+		}
+	}
+}
+
+func TestCronStartsOnDay(t *testing.T) {
+	c, err := parseCron("0,30 6-7 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC)
+	starts := c.startsOnDay(day)
+	want := []time.Time{
+		day.Add(6 * time.Hour),
+		day.Add(6*time.Hour + 30*time.Minute),
+		day.Add(7 * time.Hour),
+		day.Add(7*time.Hour + 30*time.Minute),
+	}
+	if len(starts) != len(want) {
+		t.Fatalf("got starts %v, want %v", starts, want)
+	}
+	for i := range want {
+		if !starts[i].Equal(want[i]) {
+			t.Errorf("got starts %v, want %v", starts, want)
+			break
+		}
+	}
+}
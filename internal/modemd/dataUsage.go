@@ -0,0 +1,338 @@
+package modemd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+const DataUsageKey = "modemd-data-usage"
+
+// DataUsageConfig is read from the "modemd-data-usage" config section.
+type DataUsageConfig struct {
+	BillingDay     int           `mapstructure:"billing-day"` // Day of the month the data plan resets, clamped to the end of shorter months.
+	SoftCapMB      int           `mapstructure:"soft-cap-mb"` // Above this only on windows, requests to stay on and MaxOffDuration turn the modem on. 0 to disable.
+	HardCapMB      int           `mapstructure:"hard-cap-mb"` // Above this the modem is kept off unless requested to stay on. 0 to disable.
+	SampleInterval time.Duration `mapstructure:"sample-interval"`
+	File           string        `mapstructure:"file"`
+}
+
+func DefaultDataUsageConfig() DataUsageConfig {
+	return DataUsageConfig{
+		BillingDay:     1,
+		SampleInterval: time.Minute,
+		File:           "/var/lib/modemd/data-usage.json",
+	}
+}
+
+const bytesPerMB = 1000 * 1000
+
+// Number of previous billing periods that are kept.
+const dataUsagePeriodsKept = 3
+
+type dataUsagePeriod struct {
+	Start           time.Time `json:"start"`
+	RxBytes         uint64    `json:"rxBytes"`
+	TxBytes         uint64    `json:"txBytes"`
+	SoftCapReported bool      `json:"softCapReported"`
+	HardCapReported bool      `json:"hardCapReported"`
+}
+
+func (p dataUsagePeriod) total() uint64 {
+	return p.RxBytes + p.TxBytes
+}
+
+// netdevCounters are the last counter values read from the interface. The counters are only
+// continued from if it is the same interface in the same boot, otherwise they were reset.
+type netdevCounters struct {
+	BootID  string `json:"bootID"`
+	Netdev  string `json:"netdev"`
+	IfIndex int    `json:"ifIndex"`
+	RxBytes uint64 `json:"rxBytes"`
+	TxBytes uint64 `json:"txBytes"`
+}
+
+type dataUsageState struct {
+	Current  dataUsagePeriod   `json:"current"`
+	Previous []dataUsagePeriod `json:"previous"`
+	Counters netdevCounters    `json:"counters"`
+}
+
+// DataUsage accumulates the bytes sent and received by the modem over each billing period.
+type DataUsage struct {
+	DataUsageConfig
+	mc *ModemController
+
+	mu    sync.Mutex
+	state dataUsageState
+}
+
+func NewDataUsage(conf DataUsageConfig, mc *ModemController) *DataUsage {
+	d := &DataUsage{DataUsageConfig: conf, mc: mc}
+	if err := d.load(); err != nil {
+		log.Errorf("Failed to load data usage: %v", err)
+	}
+	return d
+}
+
+func (d *DataUsage) softCapBytes() uint64 {
+	return uint64(d.SoftCapMB) * bytesPerMB
+}
+
+func (d *DataUsage) hardCapBytes() uint64 {
+	return uint64(d.HardCapMB) * bytesPerMB
+}
+
+func (d *DataUsage) used() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state.Current.total()
+}
+
+func (d *DataUsage) softCapReached() bool {
+	return d != nil && d.SoftCapMB > 0 && d.used() >= d.softCapBytes()
+}
+
+func (d *DataUsage) hardCapReached() bool {
+	return d != nil && d.HardCapMB > 0 && d.used() >= d.hardCapBytes()
+}
+
+// hasRoomFor is true if the bytes can be used without reaching the soft cap, or the hard cap if there is
+// no soft cap.
+func (d *DataUsage) hasRoomFor(bytes uint64) bool {
+	if d == nil {
+		return true
+	}
+	capMB := d.SoftCapMB
+	if capMB <= 0 {
+		capMB = d.HardCapMB
+	}
+	return capMB <= 0 || d.used()+bytes < uint64(capMB)*bytesPerMB
+}
+
+// Run samples the interface counters every SampleInterval.
+func (d *DataUsage) Run() {
+	for {
+		if err := d.sample(); err != nil {
+			log.Errorf("Failed to update data usage: %v", err)
+		}
+		time.Sleep(d.SampleInterval)
+	}
+}
+
+func (d *DataUsage) sample() error {
+	now := time.Now()
+	d.mu.Lock()
+	changed := d.rollOver(now)
+	if netdev := d.mc.netdev(); netdev != "" {
+		counters, err := readNetdevCounters(netdev)
+		if err == nil {
+			changed = d.addCounters(counters) || changed
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Debugf("Failed to read '%s' counters: %v", netdev, err)
+		}
+	}
+	d.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	d.checkCaps()
+	return d.save()
+}
+
+// rollOver starts a new billing period if the current one has ended. Returns true if it did.
+func (d *DataUsage) rollOver(now time.Time) bool {
+	if now.Before(minValidTime) {
+		return false // Can't tell what billing period it is until the clock is set.
+	}
+	start := billingPeriodStart(now, d.BillingDay)
+	if !d.state.Current.Start.Before(start) {
+		return false
+	}
+	if !d.state.Current.Start.IsZero() {
+		previous := d.state.Current
+		log.Infof("Data usage for billing period starting %s was %.1fMB.", previous.Start.Format(time.DateOnly), float64(previous.total())/bytesPerMB)
+		d.state.Previous = append([]dataUsagePeriod{previous}, d.state.Previous...)
+		if len(d.state.Previous) > dataUsagePeriodsKept {
+			d.state.Previous = d.state.Previous[:dataUsagePeriodsKept]
+		}
+		if err := eventclient.AddEvent(eventclient.Event{
+			Timestamp: now,
+			Type:      "dataUsagePeriodEnded",
+			Details: map[string]interface{}{
+				"periodStart": previous.Start.Format(time.DateOnly),
+				"rxBytes":     previous.RxBytes,
+				"txBytes":     previous.TxBytes,
+			},
+		}); err != nil {
+			log.Errorf("Failed to make dataUsagePeriodEnded event: %v", err)
+		}
+	}
+	d.state.Current = dataUsagePeriod{Start: start}
+	return true
+}
+
+// addCounters adds the bytes since the last reading, handling the counters being reset when the interface reappears.
+func (d *DataUsage) addCounters(c netdevCounters) bool {
+	last := d.state.Counters
+	rx, tx := c.RxBytes, c.TxBytes
+	if c.BootID == last.BootID && c.Netdev == last.Netdev && c.IfIndex == last.IfIndex &&
+		c.RxBytes >= last.RxBytes && c.TxBytes >= last.TxBytes {
+		rx -= last.RxBytes
+		tx -= last.TxBytes
+	}
+	d.state.Counters = c
+	d.state.Current.RxBytes += rx
+	d.state.Current.TxBytes += tx
+	return rx > 0 || tx > 0 || c != last
+}
+
+// checkCaps makes an event the first time a cap is passed in a billing period.
+func (d *DataUsage) checkCaps() {
+	d.mu.Lock()
+	used := d.state.Current.total()
+	reportSoft := d.SoftCapMB > 0 && used >= d.softCapBytes() && !d.state.Current.SoftCapReported
+	reportHard := d.HardCapMB > 0 && used >= d.hardCapBytes() && !d.state.Current.HardCapReported
+	d.state.Current.SoftCapReported = d.state.Current.SoftCapReported || reportSoft
+	d.state.Current.HardCapReported = d.state.Current.HardCapReported || reportHard
+	d.mu.Unlock()
+	if reportSoft {
+		reportDataCap("dataUsageSoftCap", used, d.softCapBytes())
+	}
+	if reportHard {
+		reportDataCap("dataUsageHardCap", used, d.hardCapBytes())
+	}
+}
+
+func reportDataCap(eventType string, used, capBytes uint64) {
+	log.Infof("Data usage %.1fMB is over the cap of %.1fMB.", float64(used)/bytesPerMB, float64(capBytes)/bytesPerMB)
+	if err := eventclient.AddEvent(eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      eventType,
+		Details: map[string]interface{}{
+			"usedBytes": used,
+			"capBytes":  capBytes,
+		},
+	}); err != nil {
+		log.Errorf("Failed to make %s event: %v", eventType, err)
+	}
+}
+
+// billingPeriodStart returns the start of the billing period that t is in.
+func billingPeriodStart(t time.Time, billingDay int) time.Time {
+	start := billingDayIn(t.Year(), t.Month(), billingDay, t.Location())
+	if t.Before(start) {
+		start = billingDayIn(t.Year(), t.Month()-1, billingDay, t.Location())
+	}
+	return start
+}
+
+func billingDayIn(year int, month time.Month, billingDay int, loc *time.Location) time.Time {
+	firstOfMonth := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	daysInMonth := firstOfMonth.AddDate(0, 1, -1).Day()
+	return firstOfMonth.AddDate(0, 0, min(max(billingDay, 1), daysInMonth)-1)
+}
+
+func readNetdevCounters(netdev string) (netdevCounters, error) {
+	dir := filepath.Join("/sys/class/net", netdev)
+	ifIndex, err := readSysfsUint(filepath.Join(dir, "ifindex"))
+	if err != nil {
+		return netdevCounters{}, err
+	}
+	rx, err := readSysfsUint(filepath.Join(dir, "statistics", "rx_bytes"))
+	if err != nil {
+		return netdevCounters{}, err
+	}
+	tx, err := readSysfsUint(filepath.Join(dir, "statistics", "tx_bytes"))
+	if err != nil {
+		return netdevCounters{}, err
+	}
+	return netdevCounters{
+		BootID:  bootID(),
+		Netdev:  netdev,
+		IfIndex: int(ifIndex),
+		RxBytes: rx,
+		TxBytes: tx,
+	}, nil
+}
+
+func readSysfsUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (d *DataUsage) save() error {
+	if d.File == "" {
+		return nil
+	}
+	d.mu.Lock()
+	data, err := json.Marshal(d.state)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.File), 0755); err != nil {
+		return err
+	}
+	tmp := d.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.File)
+}
+
+func (d *DataUsage) load() error {
+	if d.File == "" {
+		return nil
+	}
+	data, err := os.ReadFile(d.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &d.state)
+}
+
+func (d *DataUsage) ToDBusMap() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current := d.state.Current
+	m := map[string]interface{}{
+		"periodStart":    current.Start.Format(time.RFC3339),
+		"rxBytes":        current.RxBytes,
+		"txBytes":        current.TxBytes,
+		"totalBytes":     current.total(),
+		"softCapBytes":   d.softCapBytes(),
+		"hardCapBytes":   d.hardCapBytes(),
+		"softCapReached": d.SoftCapMB > 0 && current.total() >= d.softCapBytes(),
+		"hardCapReached": d.HardCapMB > 0 && current.total() >= d.hardCapBytes(),
+	}
+	if !current.Start.IsZero() {
+		m["periodEnd"] = billingDayIn(current.Start.Year(), current.Start.Month()+1, d.BillingDay, current.Start.Location()).Format(time.RFC3339)
+	}
+	previous := map[string]interface{}{}
+	for _, p := range d.state.Previous {
+		previous[p.Start.Format(time.DateOnly)] = p.total()
+	}
+	if len(previous) > 0 {
+		m["previousPeriods"] = previous
+	}
+	return m
+}
+
+func (d *DataUsage) usageReason() string {
+	return fmt.Sprintf("%.1fMB", float64(d.used())/bytesPerMB)
+}
@@ -0,0 +1,162 @@
+package modemd
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+const FailureRecoveryKey = "modemd-failure-recovery"
+
+// FailureRecoveryConfig is read from the "modemd-failure-recovery" config section.
+// It sets how modemd retries after failing to find the modem or the SIM card.
+// The first retry for finding the modem is after RetryFindModemInterval from the modemd config.
+type FailureRecoveryConfig struct {
+	RetrySimCardInterval time.Duration `mapstructure:"retry-sim-card-interval"`
+	BackoffMultiplier    float64       `mapstructure:"backoff-multiplier"`
+	MaxRetryInterval     time.Duration `mapstructure:"max-retry-interval"`
+	MaxRetriesPerDay     int           `mapstructure:"max-retries-per-day"`
+	PowerCycle           bool          `mapstructure:"power-cycle"` // Power cycle the modem before retrying if it is on.
+}
+
+func DefaultFailureRecoveryConfig() FailureRecoveryConfig {
+	return FailureRecoveryConfig{
+		RetrySimCardInterval: time.Hour,
+		BackoffMultiplier:    2,
+		MaxRetryInterval:     24 * time.Hour,
+		MaxRetriesPerDay:     6,
+		PowerCycle:           true,
+	}
+}
+
+// failureRecovery tracks the retries for one type of failure.
+type failureRecovery struct {
+	FailedAt      time.Time `json:"failedAt"`
+	Attempts      int       `json:"attempts"` // Retries since the last success.
+	Day           string    `json:"day"`
+	AttemptsToday int       `json:"attemptsToday"`
+}
+
+func (fr *failureRecovery) failed(now time.Time) {
+	fr.FailedAt = now
+}
+
+func (fr *failureRecovery) reset() {
+	*fr = failureRecovery{}
+}
+
+// nextRetry returns when the next retry can happen, increasing the interval after each failed attempt.
+func (fr *failureRecovery) nextRetry(conf FailureRecoveryConfig, interval time.Duration) time.Time {
+	backoff := float64(interval) * math.Pow(math.Max(conf.BackoffMultiplier, 1), float64(fr.Attempts))
+	if conf.MaxRetryInterval > 0 && backoff > float64(conf.MaxRetryInterval) {
+		backoff = float64(conf.MaxRetryInterval)
+	}
+	next := fr.FailedAt.Add(time.Duration(backoff))
+
+	if conf.MaxRetriesPerDay > 0 && fr.Day == next.Format(time.DateOnly) && fr.AttemptsToday >= conf.MaxRetriesPerDay {
+		// Reached the cap for the day, wait until the start of the next day.
+		y, m, d := next.Date()
+		next = time.Date(y, m, d+1, 0, 0, 0, 0, next.Location())
+	}
+	return next
+}
+
+func (fr *failureRecovery) due(conf FailureRecoveryConfig, interval time.Duration, now time.Time) bool {
+	return interval > 0 && !now.Before(fr.nextRetry(conf, interval))
+}
+
+func (fr *failureRecovery) startAttempt(now time.Time) {
+	day := now.Format(time.DateOnly)
+	if fr.Day != day {
+		fr.Day = day
+		fr.AttemptsToday = 0
+	}
+	fr.Attempts++
+	fr.AttemptsToday++
+}
+
+func (mc *ModemController) setFailedToFindModem() {
+	mc.failedToFindModem = true
+	mc.findModemRecovery.failed(time.Now())
+}
+
+func (mc *ModemController) setFailedToFindSimCard() {
+	mc.failedToFindSimCard = true
+	mc.simCardRecovery.failed(time.Now())
+}
+
+func (mc *ModemController) findModemRetryDue() bool {
+	return mc.findModemRecovery.due(mc.FailureRecovery, mc.RetryFindModemInterval, time.Now())
+}
+
+func (mc *ModemController) simCardRetryDue() bool {
+	return mc.simCardRecovery.due(mc.FailureRecovery, mc.FailureRecovery.RetrySimCardInterval, time.Now())
+}
+
+// retryFailure clears the failure so the setup step will be run again, power cycling the modem first if configured.
+func (mc *ModemController) retryFailure(failure string, fr *failureRecovery) error {
+	fr.startAttempt(time.Now())
+	log.Infof("Retrying after failing to find the %s, attempt %d (%d today).", failure, fr.Attempts, fr.AttemptsToday)
+	err := eventclient.AddEvent(eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      "modemFailureRetry",
+		Details: map[string]interface{}{
+			"failure":       failure,
+			"attempt":       fr.Attempts,
+			"attemptsToday": fr.AttemptsToday,
+		},
+	})
+	if err != nil {
+		log.Errorf("Failed to make modemFailureRetry event: %v", err)
+	}
+
+	// Keep the modem on while the setup steps are run again.
+	mc.failureRetryUntil = time.Now().Add(mc.FindModemDuration + 5*time.Minute)
+
+	// If the modem has only just been powered on then it has already had a power cycle.
+	if mc.FailureRecovery.PowerCycle && mc.IsPowered && time.Since(mc.poweredOnTime) > time.Minute {
+		log.Info("Power cycling modem before retrying.")
+		if err := mc.CycleModemPower(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetFailures clears the failures and retry counters so the modem will be tried again straight away.
+func (mc *ModemController) ResetFailures() error {
+	log.Info("Resetting modem failures.")
+	mc.failedToFindModem = false
+	mc.failedToFindSimCard = false
+	mc.findModemRecovery.reset()
+	mc.simCardRecovery.reset()
+	if mc.Modem != nil && mc.Modem.SimCardStatus == SimCardFailed {
+		mc.Modem.SimCardStatus = SimCardFinding
+	}
+	if err := mc.saveState(); err != nil {
+		log.Errorf("Failed to save modem state: %v", err)
+	}
+	return nil
+}
+
+func (mc *ModemController) failureRetryReason(failure string, fr *failureRecovery, interval time.Duration) string {
+	if interval <= 0 {
+		return fmt.Sprintf("Modem should be off because it could not find the %s.", failure)
+	}
+	next := fr.nextRetry(mc.FailureRecovery, interval)
+	return fmt.Sprintf("Modem should be off because it could not find the %s. Will retry at %s.", failure, next.Format("2006-01-02 15:04:05"))
+}
+
+func (mc *ModemController) failureRecoveryStatus(fr *failureRecovery, interval time.Duration) map[string]interface{} {
+	status := map[string]interface{}{
+		"failedAt":      fr.FailedAt.Format(time.RFC1123Z),
+		"attempts":      fr.Attempts,
+		"attemptsToday": fr.AttemptsToday,
+	}
+	if interval > 0 {
+		status["nextRetry"] = fr.nextRetry(mc.FailureRecovery, interval).Format(time.RFC1123Z)
+	}
+	return status
+}
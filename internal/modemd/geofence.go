@@ -0,0 +1,228 @@
+package modemd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+const GeofenceKey = "modemd-geofence"
+
+// GeofenceConfig is read from the "modemd-geofence" config section.
+type GeofenceConfig struct {
+	Fences []GeofenceAreaConfig `mapstructure:"fences"`
+	// Report the device as moved when it is this far from where it was, 0 to disable the movement detector.
+	MoveDistance float64 `mapstructure:"move-distance"` // meters
+	// Number of fixes in a row that have to be outside a fence, or moved, before it is reported.
+	// This stops a single bad fix from triggering an event.
+	ConsecutiveFixes int `mapstructure:"consecutive-fixes"`
+	// Fixes with a HDOP above this are ignored, 0 to use every fix.
+	MaxHDOP float64 `mapstructure:"max-hdop"`
+	// Keep the modem on for this long after a breach so the device can keep reporting, 0 to disable.
+	StayOnDuration time.Duration `mapstructure:"stay-on-duration"`
+}
+
+// GeofenceAreaConfig is either a circle or a polygon. A circle without a center uses the device location from the config.
+type GeofenceAreaConfig struct {
+	Name      string      `mapstructure:"name"`
+	Latitude  float64     `mapstructure:"latitude"`
+	Longitude float64     `mapstructure:"longitude"`
+	Radius    float64     `mapstructure:"radius"`  // meters
+	Polygon   [][]float64 `mapstructure:"polygon"` // List of [latitude, longitude] points.
+}
+
+func DefaultGeofenceConfig() GeofenceConfig {
+	return GeofenceConfig{
+		MoveDistance:     0,
+		ConsecutiveFixes: 3,
+		MaxHDOP:          5,
+		StayOnDuration:   0,
+	}
+}
+
+type geoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type geofenceArea struct {
+	name    string
+	center  geoPoint
+	radius  float64
+	polygon []geoPoint
+	outside int // Consecutive fixes outside the fence.
+	inside  bool
+}
+
+func parseGeofenceArea(conf GeofenceAreaConfig, deviceLat, deviceLon float64) (*geofenceArea, error) {
+	area := &geofenceArea{name: conf.Name, inside: true}
+	if len(conf.Polygon) > 0 {
+		if len(conf.Polygon) < 3 {
+			return nil, fmt.Errorf("geofence '%s' polygon needs at least 3 points", conf.Name)
+		}
+		for _, p := range conf.Polygon {
+			if len(p) != 2 {
+				return nil, fmt.Errorf("geofence '%s' polygon points must be [latitude, longitude]", conf.Name)
+			}
+			area.polygon = append(area.polygon, geoPoint{Latitude: p[0], Longitude: p[1]})
+		}
+		return area, nil
+	}
+	if conf.Radius <= 0 {
+		return nil, fmt.Errorf("geofence '%s' needs a radius or a polygon", conf.Name)
+	}
+	area.radius = conf.Radius
+	area.center = geoPoint{Latitude: conf.Latitude, Longitude: conf.Longitude}
+	if conf.Latitude == 0 && conf.Longitude == 0 {
+		if deviceLat == 0 && deviceLon == 0 {
+			return nil, fmt.Errorf("geofence '%s' has no center and the device location isn't set", conf.Name)
+		}
+		area.center = geoPoint{Latitude: deviceLat, Longitude: deviceLon}
+	}
+	return area, nil
+}
+
+func (a *geofenceArea) contains(p geoPoint) bool {
+	if a.polygon == nil {
+		return distanceMeters(a.center.Latitude, a.center.Longitude, p.Latitude, p.Longitude) <= a.radius
+	}
+	// Ray casting, fine for the small areas that fences cover.
+	in := false
+	for i, j := 0, len(a.polygon)-1; i < len(a.polygon); j, i = i, i+1 {
+		pi, pj := a.polygon[i], a.polygon[j]
+		if (pi.Latitude > p.Latitude) != (pj.Latitude > p.Latitude) &&
+			p.Longitude < (pj.Longitude-pi.Longitude)*(p.Latitude-pi.Latitude)/(pj.Latitude-pi.Latitude)+pi.Longitude {
+			in = !in
+		}
+	}
+	return in
+}
+
+// Geofence checks each GPS fix against the fences and for the device moving.
+type Geofence struct {
+	GeofenceConfig
+	mc *ModemController
+
+	mu     sync.Mutex
+	areas  []*geofenceArea
+	anchor *geoPoint // Where the device was last settled, kept in the saved state.
+	moved  int       // Consecutive fixes away from the anchor.
+}
+
+func NewGeofence(conf GeofenceConfig, areas []*geofenceArea, mc *ModemController) *Geofence {
+	return &Geofence{GeofenceConfig: conf, areas: areas, mc: mc}
+}
+
+func (g *Geofence) enabled() bool {
+	return g != nil && (len(g.areas) > 0 || g.MoveDistance > 0)
+}
+
+func (g *Geofence) getAnchor() *geoPoint {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.anchor == nil {
+		return nil
+	}
+	a := *g.anchor
+	return &a
+}
+
+func (g *Geofence) setAnchor(anchor *geoPoint) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.anchor = anchor
+}
+
+// onGPSFix is called with each new GPS fix.
+func (g *Geofence) onGPSFix(fix GPSFix) {
+	if g.MaxHDOP > 0 && fix.HDOP > g.MaxHDOP {
+		return
+	}
+	p := geoPoint{Latitude: fix.Latitude, Longitude: fix.Longitude}
+
+	g.mu.Lock()
+	type breach struct {
+		eventType string
+		details   map[string]interface{}
+	}
+	breaches := []breach{}
+	for _, area := range g.areas {
+		if area.contains(p) {
+			area.outside = 0
+			area.inside = true
+			continue
+		}
+		area.outside++
+		if area.inside && area.outside >= g.ConsecutiveFixes {
+			area.inside = false
+			breaches = append(breaches, breach{"geofenceExit", map[string]interface{}{
+				"fence":     area.name,
+				"latitude":  p.Latitude,
+				"longitude": p.Longitude,
+			}})
+		}
+	}
+	if g.MoveDistance > 0 {
+		if g.anchor == nil {
+			g.anchor = &p
+		}
+		distance := distanceMeters(g.anchor.Latitude, g.anchor.Longitude, p.Latitude, p.Longitude)
+		if distance <= g.MoveDistance {
+			g.moved = 0
+		} else if g.moved++; g.moved >= g.ConsecutiveFixes {
+			breaches = append(breaches, breach{"deviceMoved", map[string]interface{}{
+				"fromLatitude":  g.anchor.Latitude,
+				"fromLongitude": g.anchor.Longitude,
+				"latitude":      p.Latitude,
+				"longitude":     p.Longitude,
+				"distance":      distance,
+			}})
+			g.anchor = &p
+			g.moved = 0
+		}
+	}
+	g.mu.Unlock()
+
+	for _, b := range breaches {
+		log.Infof("Geofence breach '%s': %v", b.eventType, b.details)
+		if err := eventclient.AddEvent(eventclient.Event{
+			Timestamp: time.Now(),
+			Type:      b.eventType,
+			Details:   b.details,
+		}); err != nil {
+			log.Errorf("Failed to make %s event: %v", b.eventType, err)
+		}
+		if err := sendGeofenceSignal(b.eventType, b.details); err != nil {
+			log.Errorf("Failed to send geofence signal: %v", err)
+		}
+	}
+	// This also cancels any request to stay off, so a device that is being moved can report where it is.
+	if until := time.Now().Add(g.StayOnDuration); len(breaches) > 0 && g.StayOnDuration > 0 && g.mc.stayOnUntil.Before(until) {
+		g.mc.StayOnUntil(until)
+	}
+}
+
+func (g *Geofence) Status() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fences := map[string]interface{}{}
+	for _, area := range g.areas {
+		fences[area.name] = area.inside
+	}
+	status := map[string]interface{}{"insideFences": fences}
+	if g.anchor != nil {
+		status["anchor"] = map[string]interface{}{
+			"latitude":  g.anchor.Latitude,
+			"longitude": g.anchor.Longitude,
+		}
+	}
+	return status
+}
@@ -0,0 +1,413 @@
+package modemd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const GPSKey = "modemd-gps"
+
+// GPSConfig is read from the "modemd-gps" config section.
+type GPSConfig struct {
+	Enabled      bool          `mapstructure:"enabled"` // Turn the GPS on when the modem starts instead of disabling it.
+	PollInterval time.Duration `mapstructure:"poll-interval"`
+	FixFile      string        `mapstructure:"fix-file"`     // Where the last known fix is kept.
+	NMEAPort     string        `mapstructure:"nmea-port"`    // Serial port with the NMEA stream, "" to only use AT+CGPSINFO.
+	GPSDAddress  string        `mapstructure:"gpsd-address"` // Address for the gpsd compatible server, e.g "127.0.0.1:2947", "" to disable.
+}
+
+func DefaultGPSConfig() GPSConfig {
+	return GPSConfig{
+		Enabled:      false,
+		PollInterval: 10 * time.Second,
+		FixFile:      "/var/lib/modemd/gps-fix.json",
+		NMEAPort:     "/dev/UsbModemNMEA",
+	}
+}
+
+var ErrNoGPSFix = errors.New("no GPS fix available")
+
+// GPSFix is a location reported by the modem's GPS.
+type GPSFix struct {
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	Altitude   float64   `json:"altitude"`
+	Speed      float64   `json:"speed"`  // km/h
+	Course     float64   `json:"course"` // Degrees
+	UTCTime    time.Time `json:"utcTime"`
+	ReceivedAt time.Time `json:"receivedAt"`
+
+	// Only available from the NMEA stream.
+	FixQuality       int     `json:"fixQuality,omitempty"`
+	FixMode          int     `json:"fixMode,omitempty"`
+	Satellites       int     `json:"satellites,omitempty"`
+	SatellitesInView int     `json:"satellitesInView,omitempty"`
+	PDOP             float64 `json:"pdop,omitempty"`
+	HDOP             float64 `json:"hdop,omitempty"`
+	VDOP             float64 `json:"vdop,omitempty"`
+}
+
+// ToDBusMap converts the fix to a map that is compatible with DBus.
+func (f *GPSFix) ToDBusMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"latitude":   f.Latitude,
+		"longitude":  f.Longitude,
+		"altitude":   f.Altitude,
+		"speed":      f.Speed,
+		"course":     f.Course,
+		"utcTime":    f.UTCTime.Format(time.RFC3339),
+		"receivedAt": f.ReceivedAt.Format(time.RFC3339),
+	}
+	if f.FixQuality != 0 {
+		m["fixQuality"] = f.FixQuality
+		m["fixMode"] = f.FixMode
+		m["satellites"] = f.Satellites
+		m["satellitesInView"] = f.SatellitesInView
+		m["pdop"] = f.PDOP
+		m["hdop"] = f.HDOP
+		m["vdop"] = f.VDOP
+	}
+	return m
+}
+
+// GPS manages the GPS in the modem. All commands go through the modem's AT manager.
+type GPS struct {
+	GPSConfig
+	mc *ModemController
+
+	mu        sync.Mutex
+	enabled   bool // If the GPS should be on.
+	modemOn   bool // If the GPS has been turned on in the modem since it was powered on.
+	lastFix   *GPSFix
+	onFixFunc []func(GPSFix)
+	nmea      *nmeaReader
+}
+
+func NewGPS(conf GPSConfig, mc *ModemController) *GPS {
+	g := &GPS{
+		GPSConfig: conf,
+		mc:        mc,
+		enabled:   conf.Enabled,
+	}
+	if conf.NMEAPort != "" {
+		g.nmea = newNMEAReader(conf.NMEAPort)
+	}
+	if err := g.loadFix(); err != nil {
+		log.Errorf("Failed to load last GPS fix: %v", err)
+	}
+	return g
+}
+
+// OnFix adds a function that is called with each new GPS fix.
+func (g *GPS) OnFix(f func(GPSFix)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.onFixFunc = append(g.onFixFunc, f)
+}
+
+func (g *GPS) Enabled() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.enabled
+}
+
+func (g *GPS) LastFix() *GPSFix {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.lastFix
+}
+
+// SetEnabled turns the GPS on or off. The setting is applied to the modem straight away if it is ready,
+// otherwise it will be applied when the modem is next ready.
+func (g *GPS) SetEnabled(enabled bool) error {
+	g.mu.Lock()
+	g.enabled = enabled
+	g.mu.Unlock()
+	if !g.modemReady() {
+		return nil
+	}
+	if enabled {
+		return g.turnOn()
+	}
+	return g.turnOff()
+}
+
+// Setup is run when the modem starts, turning the GPS on or off as configured.
+func (g *GPS) Setup() error {
+	g.mu.Lock()
+	g.modemOn = false
+	enabled := g.enabled
+	g.mu.Unlock()
+	if enabled {
+		return g.turnOn()
+	}
+	return g.turnOff()
+}
+
+// ColdStart restarts the GPS without using any previous satellite data.
+func (g *GPS) ColdStart() error {
+	_, err := g.mc.RunATCommand("AT+CGPSCOLD", 2000, 1)
+	return err
+}
+
+// HotStart restarts the GPS using the previous satellite data.
+func (g *GPS) HotStart() error {
+	_, err := g.mc.RunATCommand("AT+CGPSHOT", 2000, 1)
+	return err
+}
+
+func (g *GPS) modemReady() bool {
+	return g.mc.Modem != nil && g.mc.Modem.ATReady
+}
+
+func (g *GPS) turnOn() error {
+	out, err := g.mc.RunATCommand("AT+CGPS?", 1000, 1)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(out) != "+CGPS: 1,1" {
+		log.Info("Turning on GPS.")
+		if _, err := g.mc.RunATCommand("AT+CGPS=1", 1000, 1); err != nil {
+			return err
+		}
+	}
+	g.mu.Lock()
+	g.modemOn = true
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *GPS) turnOff() error {
+	g.mu.Lock()
+	g.modemOn = false
+	g.mu.Unlock()
+	_, err := g.mc.RunATCommand("AT+CGPS=0", 1000, 1)
+	return err
+}
+
+// Run polls the GPS for a fix while the GPS is enabled and the modem is ready.
+// If the NMEA stream is available the fix is taken from that instead of polling with AT+CGPSINFO.
+func (g *GPS) Run() {
+	if g.nmea != nil {
+		go g.nmea.run(func() bool { return g.Enabled() && g.modemReady() })
+		if g.GPSDAddress != "" {
+			go func() {
+				if err := newGPSDServer(g.GPSDAddress, g.NMEAPort, g.nmea).run(); err != nil {
+					log.Errorf("Failed to run gpsd server: %v", err)
+				}
+			}()
+		}
+	}
+	for {
+		time.Sleep(g.PollInterval)
+		if !g.Enabled() || !g.modemReady() {
+			continue
+		}
+		g.mu.Lock()
+		modemOn := g.modemOn
+		g.mu.Unlock()
+		if !modemOn {
+			if err := g.turnOn(); err != nil {
+				log.Errorf("Failed to turn on GPS: %v", err)
+				continue
+			}
+		}
+
+		if g.nmea != nil {
+			state := g.nmea.current()
+			if time.Since(state.fixUpdatedAt) < 3*g.PollInterval {
+				if fix, ok := state.fix(); ok {
+					g.newFix(fix)
+				} else {
+					log.Debugf("No GPS fix yet, %d satellites in view.", state.satellitesInView)
+				}
+				continue
+			}
+		}
+
+		fix, err := g.readFix()
+		if errors.Is(err, ErrNoGPSFix) {
+			log.Debug("No GPS fix yet.")
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to read GPS: %v", err)
+			continue
+		}
+		g.newFix(*fix)
+	}
+}
+
+func (g *GPS) readFix() (*GPSFix, error) {
+	out, err := g.mc.RunATCommand("AT+CGPSINFO", 1000, 1)
+	if err != nil {
+		return nil, err
+	}
+	return parseCGPSINFO(out)
+}
+
+func (g *GPS) newFix(fix GPSFix) {
+	g.mu.Lock()
+	g.lastFix = &fix
+	onFixFuncs := append([]func(GPSFix){}, g.onFixFunc...)
+	g.mu.Unlock()
+
+	log.Debugf("New GPS fix: %+v", fix)
+	if err := g.saveFix(fix); err != nil {
+		log.Errorf("Failed to save GPS fix: %v", err)
+	}
+	if err := sendLocationUpdatedSignal(fix); err != nil {
+		log.Errorf("Failed to send location updated signal: %v", err)
+	}
+	for _, f := range onFixFuncs {
+		f(fix)
+	}
+}
+
+func (g *GPS) saveFix(fix GPSFix) error {
+	if g.FixFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(fix)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(g.FixFile), 0755); err != nil {
+		return err
+	}
+	tmpFile := g.FixFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, g.FixFile)
+}
+
+func (g *GPS) loadFix() error {
+	if g.FixFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(g.FixFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fix := &GPSFix{}
+	if err := json.Unmarshal(data, fix); err != nil {
+		return err
+	}
+	g.lastFix = fix
+	return nil
+}
+
+func (g *GPS) Status() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	status := map[string]interface{}{
+		"enabled": g.enabled,
+		"on":      g.modemOn,
+	}
+	if g.lastFix != nil {
+		status["lastFix"] = g.lastFix.ReceivedAt.Format(time.RFC1123Z)
+	}
+	if g.nmea != nil {
+		state := g.nmea.current()
+		if !state.updatedAt.IsZero() {
+			status["nmeaUpdated"] = state.updatedAt.Format(time.RFC1123Z)
+			status["fixQuality"] = state.fixQuality
+			status["satellites"] = state.satellites
+			status["satellitesInView"] = state.satellitesInView
+			status["hdop"] = state.hdop
+		}
+	}
+	return status
+}
+
+// parseCGPSINFO parses the output of AT+CGPSINFO, returning ErrNoGPSFix if there is no fix.
+// Output is like "+CGPSINFO: 4333.256890,S,17237.550876,E,100823,033054.0,10.2,0.0,"
+func parseCGPSINFO(out string) (*GPSFix, error) {
+	out = strings.TrimSpace(out)
+	out = strings.TrimPrefix(out, "+CGPSINFO:")
+	out = strings.TrimSpace(out)
+	parts := strings.Split(out, ",")
+	if len(parts) < 9 {
+		return nil, fmt.Errorf("invalid CGPSINFO format '%s'", out)
+	}
+	if parts[0] == "" {
+		return nil, ErrNoGPSFix
+	}
+
+	latitude, err := parseNMEACoordinate(parts[0], parts[1], 2)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latitude '%s': %v", out, err)
+	}
+	longitude, err := parseNMEACoordinate(parts[2], parts[3], 3)
+	if err != nil {
+		return nil, fmt.Errorf("invalid longitude '%s': %v", out, err)
+	}
+
+	const layout = "020106-150405.0" // format DDMMYY-hhmmss.s
+	utcTime, err := time.Parse(layout, parts[4]+"-"+parts[5])
+	if err != nil {
+		return nil, err
+	}
+
+	fix := &GPSFix{
+		Latitude:   latitude,
+		Longitude:  longitude,
+		UTCTime:    utcTime,
+		ReceivedAt: time.Now(),
+	}
+	if fix.Altitude, err = parseOptionalFloat(parts[6]); err != nil {
+		return nil, fmt.Errorf("invalid altitude '%s': %v", out, err)
+	}
+	speedKnots, err := parseOptionalFloat(parts[7])
+	if err != nil {
+		return nil, fmt.Errorf("invalid speed '%s': %v", out, err)
+	}
+	fix.Speed = speedKnots * knotsToKmh
+	if fix.Course, err = parseOptionalFloat(parts[8]); err != nil {
+		return nil, fmt.Errorf("invalid course '%s': %v", out, err)
+	}
+	return fix, nil
+}
+
+// parseNMEACoordinate converts a coordinate in the format (d)ddmm.mmmm with a N/S/E/W direction to degrees.
+func parseNMEACoordinate(value, direction string, degreeDigits int) (float64, error) {
+	if len(value) < degreeDigits+3 || value[degreeDigits+2] != '.' {
+		return 0, fmt.Errorf("invalid coordinate format '%s'", value)
+	}
+	degrees, err := strconv.ParseFloat(value[:degreeDigits], 64)
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.ParseFloat(value[degreeDigits:], 64)
+	if err != nil {
+		return 0, err
+	}
+	degrees += minutes / 60
+	switch direction {
+	case "S", "W":
+		degrees *= -1
+	case "N", "E":
+	default:
+		return 0, fmt.Errorf("invalid direction '%s'", direction)
+	}
+	return degrees, nil
+}
+
+func parseOptionalFloat(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
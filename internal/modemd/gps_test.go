@@ -0,0 +1,87 @@
+package modemd
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseCGPSINFO(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    GPSFix
+		wantErr error
+	}{
+		{
+			name: "fix",
+			out:  "+CGPSINFO: 3113.343286,N,12121.234064,E,250311,072809.3,44.1,10.0,271.5\r\n",
+			want: GPSFix{
+				Latitude:  31.2223881,
+				Longitude: 121.3539011,
+				Altitude:  44.1,
+				Speed:     18.52,
+				Course:    271.5,
+				UTCTime:   time.Date(2011, 3, 25, 7, 28, 9, 300000000, time.UTC),
+			},
+		},
+		{
+			name: "southern and western hemispheres",
+			out:  "+CGPSINFO: 4117.554000,S,17446.386000,W,010124,235959.0,12.0,0.0,0.0",
+			want: GPSFix{
+				Latitude:  -41.2925667,
+				Longitude: -174.7731,
+				Altitude:  12,
+				UTCTime:   time.Date(2024, 1, 1, 23, 59, 59, 0, time.UTC),
+			},
+		},
+		{
+			name: "empty optional fields",
+			out:  "+CGPSINFO: 3113.343286,N,12121.234064,E,250311,072809.3,,,",
+			want: GPSFix{
+				Latitude:  31.2223881,
+				Longitude: 121.3539011,
+				UTCTime:   time.Date(2011, 3, 25, 7, 28, 9, 300000000, time.UTC),
+			},
+		},
+		{name: "no fix", out: "+CGPSINFO: ,,,,,,,,", wantErr: ErrNoGPSFix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fix, err := parseCGPSINFO(tt.out)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []float64{fix.Latitude, fix.Longitude, fix.Altitude, fix.Speed, fix.Course}
+			want := []float64{tt.want.Latitude, tt.want.Longitude, tt.want.Altitude, tt.want.Speed, tt.want.Course}
+			for i := range got {
+				if math.Abs(got[i]-want[i]) > 1e-6 {
+					t.Errorf("got %v, want %v", got, want)
+					break
+				}
+			}
+			if !fix.UTCTime.Equal(tt.want.UTCTime) {
+				t.Errorf("got time %s, want %s", fix.UTCTime, tt.want.UTCTime)
+			}
+		})
+	}
+}
+
+func TestParseCGPSINFOInvalid(t *testing.T) {
+	for _, out := range []string{
+		"+CGPSINFO: 3113.343286,N,12121.234064,E",
+		"+CGPSINFO: 311.3,N,12121.234064,E,250311,072809.3,,,",
+		"+CGPSINFO: 3113.343286,N,12121.234064,E,250311,072809.3,high,,",
+	} {
+		if _, err := parseCGPSINFO(out); err == nil || errors.Is(err, ErrNoGPSFix) {
+			t.Errorf("parseCGPSINFO(%q) got error %v, want a format error", out, err)
+		}
+	}
+}
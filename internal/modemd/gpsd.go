@@ -0,0 +1,208 @@
+package modemd
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gpsdServer serves the GPS data with a subset of the gpsd JSON protocol so GIS tools on the device can use it.
+// Clients get a VERSION banner, and after a ?WATCH command get either the raw NMEA sentences ("nmea": true)
+// or TPV and SKY reports ("json": true). ?POLL returns the latest TPV and SKY reports.
+type gpsdServer struct {
+	address string
+	device  string
+	nmea    *nmeaReader
+}
+
+type gpsdWatch struct {
+	Enable *bool `json:"enable"`
+	JSON   *bool `json:"json"`
+	NMEA   *bool `json:"nmea"`
+	Raw    *int  `json:"raw"`
+}
+
+func newGPSDServer(address, device string, nmea *nmeaReader) *gpsdServer {
+	return &gpsdServer{address: address, device: device, nmea: nmea}
+}
+
+func (s *gpsdServer) run() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	log.Infof("Serving GPS data on '%s'.", s.address)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Errorf("Failed to accept gpsd connection: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *gpsdServer) handle(conn net.Conn) {
+	defer conn.Close()
+	var writeMu sync.Mutex
+	write := func(v interface{}) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		var data []byte
+		if str, ok := v.(string); ok {
+			data = []byte(str)
+		} else {
+			var err error
+			if data, err = json.Marshal(v); err != nil {
+				return err
+			}
+		}
+		_, err := conn.Write(append(data, '\r', '\n'))
+		return err
+	}
+
+	if err := write(map[string]interface{}{
+		"class":       "VERSION",
+		"release":     version,
+		"rev":         version,
+		"proto_major": 3,
+		"proto_minor": 14,
+	}); err != nil {
+		return
+	}
+
+	sentences := s.nmea.subscribe()
+	defer s.nmea.unsubscribe(sentences)
+	var watchMu sync.Mutex
+	watching, sendJSON, sendNMEA := false, false, false
+
+	go func() {
+		for sentence := range sentences {
+			watchMu.Lock()
+			w, j, n := watching, sendJSON, sendNMEA
+			watchMu.Unlock()
+			if !w {
+				continue
+			}
+			var err error
+			if n {
+				err = write(sentence)
+			} else if j && (strings.HasSuffix(sentenceType(sentence), "RMC")) {
+				// Sending a report once per epoch, using RMC as it is sent once per fix.
+				state := s.nmea.current()
+				if err = write(s.tpv(state)); err == nil {
+					err = write(s.sky(state))
+				}
+			}
+			if err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(splitGPSDCommands)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(cmd, "?WATCH"):
+			watch := gpsdWatch{}
+			if arg := strings.TrimPrefix(cmd, "?WATCH="); arg != cmd {
+				if err := json.Unmarshal([]byte(arg), &watch); err != nil {
+					write(map[string]interface{}{"class": "ERROR", "message": "invalid WATCH"})
+					continue
+				}
+			}
+			watchMu.Lock()
+			watching = watch.Enable == nil || *watch.Enable
+			sendJSON = watch.JSON != nil && *watch.JSON
+			sendNMEA = (watch.NMEA != nil && *watch.NMEA) || (watch.Raw != nil && *watch.Raw > 0)
+			if watching && !sendJSON && !sendNMEA {
+				sendJSON = true
+			}
+			response := map[string]interface{}{"class": "WATCH", "enable": watching, "json": sendJSON, "nmea": sendNMEA}
+			watchMu.Unlock()
+			write(map[string]interface{}{
+				"class":   "DEVICES",
+				"devices": []map[string]interface{}{{"class": "DEVICE", "path": s.device, "driver": "NMEA0183"}},
+			})
+			write(response)
+		case strings.HasPrefix(cmd, "?POLL"):
+			state := s.nmea.current()
+			write(map[string]interface{}{
+				"class":  "POLL",
+				"time":   time.Now().UTC().Format(time.RFC3339Nano),
+				"active": 1,
+				"tpv":    []interface{}{s.tpv(state)},
+				"sky":    []interface{}{s.sky(state)},
+			})
+		case strings.HasPrefix(cmd, "?VERSION"):
+			write(map[string]interface{}{"class": "VERSION", "release": version, "rev": version, "proto_major": 3, "proto_minor": 14})
+		case strings.HasPrefix(cmd, "?DEVICES"):
+			write(map[string]interface{}{
+				"class":   "DEVICES",
+				"devices": []map[string]interface{}{{"class": "DEVICE", "path": s.device, "driver": "NMEA0183"}},
+			})
+		}
+	}
+}
+
+func (s *gpsdServer) tpv(state nmeaState) map[string]interface{} {
+	mode := state.fixMode
+	if mode == 0 {
+		mode = 1
+	}
+	tpv := map[string]interface{}{
+		"class":  "TPV",
+		"device": s.device,
+		"mode":   mode,
+	}
+	if state.valid {
+		tpv["time"] = state.utcTime.UTC().Format(time.RFC3339Nano)
+		tpv["lat"] = state.latitude
+		tpv["lon"] = state.longitude
+		tpv["speed"] = state.speed / 3.6 // gpsd uses m/s
+		tpv["track"] = state.course
+		if mode == 3 {
+			tpv["alt"] = state.altitude
+		}
+	}
+	return tpv
+}
+
+func (s *gpsdServer) sky(state nmeaState) map[string]interface{} {
+	return map[string]interface{}{
+		"class":  "SKY",
+		"device": s.device,
+		"hdop":   state.hdop,
+		"vdop":   state.vdop,
+		"pdop":   state.pdop,
+		"nSat":   state.satellitesInView,
+		"uSat":   state.satellites,
+	}
+}
+
+func sentenceType(sentence string) string {
+	if i := strings.Index(sentence, ","); i != -1 {
+		return sentence[:i]
+	}
+	return sentence
+}
+
+// splitGPSDCommands splits the client input into commands, which are terminated with ';' or a new line.
+func splitGPSDCommands(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i, b := range data {
+		if b == ';' || b == '\n' {
+			return i + 1, data[:i], nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
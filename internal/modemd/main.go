@@ -19,20 +19,17 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package modemd
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
 	"github.com/TheCacophonyProject/go-config"
 	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/modemd/usb"
 	arg "github.com/alexflint/go-arg"
 	"periph.io/x/periph/host"
 )
@@ -41,6 +38,7 @@ type Args struct {
 	ConfigDir    string `arg:"-c,--config" help:"path to configuration directory"`
 	Timestamps   bool   `arg:"-t,--timestamps" help:"include timestamps in log output"`
 	RestartModem bool   `arg:"-r,--restart" help:"cycle the power to the USB port"`
+	StateFile    string `arg:"--state-file" help:"file for keeping the modem state across restarts"`
 	logging.LogArgs
 }
 
@@ -48,6 +46,7 @@ var version = "<not set>"
 var log = logging.NewLogger("info")
 var defaultArgs = Args{
 	ConfigDir: config.DefaultConfigDir,
+	StateFile: defaultStateFile,
 }
 
 func (Args) Version() string {
@@ -113,7 +112,7 @@ func Run(inputArgs []string, ver string) error {
 
 	// For now we are just loading this one modem, ignoring the ones set in the config.
 	m := []ModemConfig{
-		{Name: "Qualcomm", NetDev: "usb0", VendorID: "1e0e", ProductID: "9018"},
+		conf.Control.apply(ModemConfig{Name: "Qualcomm", NetDev: "usb0", VendorID: "1e0e", ProductID: "9018"}),
 	}
 
 	mc := ModemController{
@@ -133,8 +132,52 @@ func Run(inputArgs []string, ver string) error {
 		RetryFindModemInterval: conf.RetryFindModemInterval,
 		MinConnDuration:        conf.MinConnDuration,
 		MaxOffDuration:         conf.MaxOffDuration,
+		OnWindows:              conf.OnWindows,
+		PowerPolicy:            NewPowerPolicy(conf.PowerPolicy),
+		StateFile:              args.StateFile,
+		FailureRecovery:        conf.FailureRecovery,
+		Connectivity:           conf.Connectivity,
+		PDP:                    conf.PDP,
+		CellLocator:            NewCellLocator(conf.CellLocation),
 	}
 
+	mc.Geofence = NewGeofence(conf.Geofence, conf.GeofenceAreas, &mc)
+
+	if err := mc.loadState(); err != nil {
+		log.Errorf("Failed to load modem state: %v", err)
+	}
+	go mc.persistStateLoop()
+
+	mc.GPS = NewGPS(conf.GPS, &mc)
+	if mc.Geofence.enabled() {
+		mc.GPS.OnFix(mc.Geofence.onGPSFix)
+	}
+	go mc.GPS.Run()
+
+	mc.TimeSync = NewTimeSync(conf.TimeSync, &mc)
+	go mc.TimeSync.Run()
+
+	mc.SignalHistory = NewSignalHistory(conf.SignalHistory, &mc)
+	go mc.SignalHistory.Run()
+
+	mc.Quality = NewConnectionQuality(conf.Quality, &mc)
+	mc.Routing = NewRouting(conf.Routing, &mc)
+	go mc.Routing.Run()
+
+	mc.PPP = NewPPP(conf.PPP, &mc)
+	mc.USBPower = NewUSBPower(conf.Board.USBPower)
+	mc.Power, err = NewPowerControl(conf.Board.Power)
+	if err != nil {
+		return err
+	}
+
+	mc.DataUsage = NewDataUsage(conf.DataUsage, &mc)
+	go mc.DataUsage.Run()
+
+	mc.runMetrics(conf.Metrics)
+
+	go mc.watchUSB()
+
 	log.Println("Starting dbus service.")
 	if err := startService(&mc); err != nil {
 		return err
@@ -152,10 +195,12 @@ MainModemLoop:
 		// =========== Power off modem if it shouldn't be on then wait until it should be on ===========
 		if !mc.ShouldBeOn() {
 			log.Println("Powering off USB modem.")
+			mc.PPP.Stop()
+			mc.closeControl()
 			if err := mc.SetModemPower(false); err != nil {
 				return err
 			}
-			mc.Modem = nil
+			mc.setModem(nil)
 			// Wait until the modem no longer should be off
 			for !mc.ShouldBeOn() {
 				time.Sleep(time.Second)
@@ -169,76 +214,72 @@ MainModemLoop:
 		}
 
 		// =========== Finding modem ===========
-		// Failed to find the modem so we shouldn't try to find it again.
+		// Failed to find the modem so we shouldn't try to find it again until a retry is due.
 		if mc.failedToFindModem {
-			log.Info("Failed to find the USB modem. Not trying to find it again.")
-			// Wait until the modem doesn't need to be on again.
+			log.Info("Failed to find the USB modem. Not trying to find it again until a retry is due.")
+			// Wait until the modem doesn't need to be on again, a retry is due, or the failures are reset.
 			// We just wait here so the modem status can still be queried.
-			for {
+			for mc.failedToFindModem && !mc.findModemRetryDue() {
 				if !mc.ShouldBeOn() {
 					continue MainModemLoop
 				}
 				time.Sleep(time.Second)
 			}
+			if mc.failedToFindModem {
+				if err := mc.retryFailure("modem", &mc.findModemRecovery); err != nil {
+					return err
+				}
+				mc.failedToFindModem = false
+			}
 		}
 		printSetupStep(2, "Finding USB modem.")
 		findingModemTimeout := time.Now().Add(mc.FindModemDuration)
-		productID := ""
-	FindModemLoop:
-		for {
-			vendorProductIDs, err := getUSBVendorProductIDs()
-			if err != nil {
-				log.Errorf("Failed to list usb devices: %v", err)
-			}
-
+		var modemConfig ModemConfig
+		device, found := waitForUSBDevice(func(d usb.Device) bool {
 			// Loop through the different modems that we support (just the one for now) to see if we can find the modem
-			for _, modemConfig := range mc.ModemsConfig {
-				for _, vendorProductID := range vendorProductIDs {
-					if modemConfig.VendorID == vendorProductID.VendorID {
-						log.Infof("Found modem with vendorID '%s'", modemConfig.VendorID)
-						mc.Modem = NewModem(modemConfig)
-						productID = vendorProductID.ProductID
-						break FindModemLoop
-					}
+			for _, c := range mc.ModemsConfig {
+				if d.Matches(c.VendorID, "") {
+					modemConfig = c
+					return true
 				}
 			}
-
-			// Timeout for finding the modem through USB
-			if time.Now().After(findingModemTimeout) {
-				// Log the devices found on lsusb. This is simply to help debug modem issues.
-				log.Infof("Failed to find modem in given time '%s', here are the usb devices on the system:", mc.FindModemDuration)
-				out, err := exec.Command("lsusb").CombinedOutput()
-				if err != nil {
-					log.Errorf("Failed to list usb devices: %v", err)
-				}
-				for _, line := range strings.Split(string(out), "\n") {
-					line := strings.TrimSpace(line)
-					if line != "" {
-						log.Infof("\t%s", line)
-					}
-				}
-
-				// Set that it failed to find the modem and return to the start of the main loop.
-				mc.failedToFindModem = true
-				log.Println("Making noModemFound event.")
-				err = eventclient.AddEvent(eventclient.Event{
-					Timestamp: time.Now(),
-					Type:      "noModemFound",
-				})
-				if err != nil {
-					log.Errorf("Failed to make noModemFound event: %v", err)
-				}
-				continue MainModemLoop
+			return false
+		}, time.Until(findingModemTimeout))
+
+		// Timeout for finding the modem through USB
+		if !found {
+			// Log the USB devices. This is simply to help debug modem issues.
+			log.Infof("Failed to find modem in given time '%s', here are the usb devices on the system:", mc.FindModemDuration)
+			logUSBDevices()
+
+			// Set that it failed to find the modem and return to the start of the main loop.
+			mc.setFailedToFindModem()
+			log.Println("Making noModemFound event.")
+			err := eventclient.AddEvent(eventclient.Event{
+				Timestamp: time.Now(),
+				Type:      "noModemFound",
+			})
+			if err != nil {
+				log.Errorf("Failed to make noModemFound event: %v", err)
 			}
+			continue MainModemLoop
 		}
+		log.Infof("Found modem with vendorID '%s' at USB device '%s'", modemConfig.VendorID, device.Name)
+		logUSBInterfaces(device)
+		mc.PPP.Stop()
+		mc.closeControl()
+		mc.setModem(NewModem(modemConfig))
+		mc.Modem.USBDevice = device.Name
+		mc.findModemRecovery.reset()
+		productID := device.ProductID
 
 		// ========== Checking for AT response from modem. =============
 		printSetupStep(3, "Checking for AT response from modem.")
 		checkATTimeout := time.Now().Add(time.Minute)
-		mc.Modem.ATManager = newATManager()
+		mc.setATManager()
 		for {
 			// Try to see if AT command is available yet
-			_, err := mc.Modem.ATManager.request("AT", 1000, 0)
+			_, err := mc.RunATCommand("AT", 1000, 0)
 			if err == nil {
 				log.Println("AT command responding.")
 				mc.Modem.ATReady = true
@@ -255,21 +296,25 @@ MainModemLoop:
 				if err != nil {
 					log.Errorf("Failed to make noModemATCommandResponse event: %v", err)
 				}
-				// TODO, if AT command is not responding then what?
-				// If it is in the correct USB mode then just continue? if not then how should I handle this?
-				// If it is not in the correct mode or does't have the USB0 up and running then we should reset the modem?
-				break // For now we just continue to the next step
-
+				if !mc.recoverModem(faultATNotResponding, rungIndex("reopenATPort"), mc.atResponding) {
+					mc.lastFailedConnection = time.Now()
+					continue MainModemLoop
+				}
+				mc.Modem.ATReady = true
+				break
 			}
 			time.Sleep(time.Second)
 		}
 
-		printSetupStep(4, "Disabling GPS.")
-		err := mc.DisableGPS()
+		printSetupStep(4, "Setting up GPS and network time.")
+		err := mc.GPS.Setup()
 		if err != nil {
-			log.Error("Failed to disable GPS: ", err)
+			log.Error("Failed to set up GPS: ", err)
 			// Not a critical error so will continue to next step.
-			// TODO, if disabling GPS failed, then we should try again?
+			// If the GPS is enabled it will be turned on again when it is next polled.
+		}
+		if err := mc.TimeSync.Setup(); err != nil {
+			log.Errorf("Failed to enable network time updates: %v", err)
 		}
 
 		// ========== Checking that the modem is in the correct mode ==========
@@ -291,40 +336,43 @@ MainModemLoop:
 			}
 
 			// Wait for modem to go offline then back online with the correct product ID
-			modemOffBackUpTimeout := time.Now().Add(time.Minute)
-			for {
-				if time.Now().After(modemOffBackUpTimeout) {
-					log.Error("Failed to find modem in given time after changing USB mode.")
-					// TODO, how should I try to recover from this?
-					continue MainModemLoop
-				}
-
-				vendorProductIDs, err := getUSBVendorProductIDs()
-				if err != nil {
-					log.Errorf("Failed to get USB vendor product IDs: %v", err)
-					time.Sleep(time.Second)
-					continue
-				}
-				for _, vendorProductID := range vendorProductIDs {
-					if vendorProductID.VendorID == mc.Modem.VendorID && vendorProductID.ProductID == mc.Modem.ProductID {
-						log.Infof("Modem is back online with correct product ID. '%s'", mc.Modem.ProductID)
-						continue MainModemLoop
-					}
-				}
+			_, found := waitForUSBDevice(func(d usb.Device) bool {
+				return d.Matches(mc.Modem.VendorID, mc.Modem.ProductID)
+			}, time.Minute)
+			if found {
+				log.Infof("Modem is back online with correct product ID. '%s'", mc.Modem.ProductID)
+				continue MainModemLoop
+			}
+			log.Error("Failed to find modem in given time after changing USB mode.")
+			// The modem isn't on USB so the AT commands can't be used, start with power cycling the modem.
+			if !mc.recoverModem(faultUSBModeChange, rungIndex("gpioPowerCycle"), mc.usbModePresent) {
+				mc.lastFailedConnection = time.Now()
 			}
+			continue MainModemLoop
 		}
 
+		mc.openControl()
+
 		// =========== Checking SIM card in modem ===========
-		// If the modem failed to find a SIM card, then we shouldn't try to find it again.
+		// If the modem failed to find a SIM card, then we shouldn't try to find it again until a retry is due.
 		if mc.failedToFindSimCard {
-			log.Info("Modem failed to find a SIM card. Will not try to find it again.")
+			log.Info("Modem failed to find a SIM card. Will not try to find it again until a retry is due.")
 			// We just wait here so the modem status can still be queried.
-			for {
+			for mc.failedToFindSimCard && !mc.simCardRetryDue() {
 				if !mc.ShouldBeOn() {
 					continue MainModemLoop
 				}
 				time.Sleep(time.Second)
 			}
+			if mc.failedToFindSimCard {
+				if err := mc.retryFailure("SIM card", &mc.simCardRecovery); err != nil {
+					return err
+				}
+				mc.failedToFindSimCard = false
+				mc.Modem.SimCardStatus = SimCardFinding
+				// The modem could have been power cycled so go through the setup steps again.
+				continue MainModemLoop
+			}
 		}
 		printSetupStep(6, "Checking SIM card.")
 		for retries := 30; retries > 0; retries-- {
@@ -343,11 +391,16 @@ MainModemLoop:
 		if mc.Modem.SimCardStatus != SimCardReady {
 			mc.Modem.SimCardStatus = SimCardFailed
 			makeModemEvent("noModemSimCard", &mc)
-			mc.failedToFindSimCard = true
+			mc.setFailedToFindSimCard()
 			continue MainModemLoop // Go back to start of main loop.
 		}
 		mc.failedToFindSimCard = false
+		mc.simCardRecovery.reset()
+		mc.failureRetryUntil = time.Time{}
 		log.Info("SIM card ready.")
+		if err := mc.setupPDPContexts(); err != nil {
+			log.Errorf("Failed to set up the PDP contexts: %v", err)
+		}
 
 		// ========== Checking signal strength ===========
 		printSetupStep(7, "Checking signal strength.")
@@ -374,7 +427,12 @@ MainModemLoop:
 
 		// ========== Checking that the network is up ===========
 		printSetupStep(8, "Checking that the network is up.")
-		networkUpTimeout := time.Now().Add(2 * time.Minute)
+		networkUpStart := time.Now()
+		networkUpTimeout := networkUpStart.Add(2 * time.Minute)
+		if err := mc.startDataSession(); err != nil {
+			log.Errorf("Failed to start the data session: %v", err)
+		}
+		ipv6Enabled := false
 		for {
 			if time.Now().After(networkUpTimeout) {
 				// Took too long to find the network, try from the start again.
@@ -384,26 +442,44 @@ MainModemLoop:
 			}
 
 			iface, err := net.InterfaceByName(mc.Modem.Netdev)
+			if err != nil && mc.PPP.enabled() && !mc.PPP.started() && time.Since(networkUpStart) > mc.PPP.FallbackAfter {
+				log.Infof("'%s' hasn't appeared after %s, starting PPP on '%s'.", mc.Modem.Netdev, mc.PPP.FallbackAfter, mc.PPP.Device)
+				if err := mc.startPPP(); err != nil {
+					log.Errorf("Failed to start PPP: %v", err)
+				} else {
+					// Give the PPP session the full time to come up.
+					networkUpTimeout = time.Now().Add(2 * time.Minute)
+				}
+			}
 			if err != nil {
 				log.Debugf("Network interface not found, waiting a second then looking again. Error: %v", err)
 				// Network is not up yet, wait a second then look again.
 				time.Sleep(time.Second)
 				continue
 			}
-			addrs, err := iface.Addrs()
+			// The interface only exists once the modem is up, so IPv6 is enabled when it is first found.
+			if !ipv6Enabled && pdpTypeHasIPv6(mc.Modem.PDPType) {
+				if err := enableIPv6(mc.Modem.Netdev); err != nil {
+					log.Errorf("Failed to enable IPv6 on '%s': %v", mc.Modem.Netdev, err)
+				}
+				ipv6Enabled = true
+			}
+			ready, reason, err := networkReady(mc.Modem.Netdev, mc.Modem.PDPType)
 			if err != nil {
 				log.Errorf("Failed to get network addresses: %v", err)
 				time.Sleep(time.Second)
 				continue
 			}
-			if len(addrs) == 0 {
-				log.Error("No network addresses found, waiting a second then looking again.")
+			if !ready {
+				log.Errorf("Network not ready for PDP type '%s', %s. Waiting a second then looking again.", mc.Modem.PDPType, reason)
 				time.Sleep(time.Second)
 				continue
 			}
+			addrs, _ := iface.Addrs()
 			for _, addr := range addrs {
 				log.Infof("Network address: %s", addr.String())
 			}
+			log.Infof("Network ready for PDP type '%s', %s.", mc.Modem.PDPType, reason)
 			break
 		}
 
@@ -425,9 +501,12 @@ MainModemLoop:
 				continue MainModemLoop
 			}
 
-			if mc.PingTest(5000) { // This ping test run the ping test through the modem, not the wifi if available.
+			if mc.PingTest() {
 				log.Info("Modem has connected to a network.")
 				mc.connectedTime = time.Now()
+				if mc.Quality.enabled() {
+					mc.Quality.measure()
+				}
 				makeModemEvent("modemConnectedToNetwork", &mc)
 				sendModemConnectedSignal() // This send a dbus signal that allows programs to trigger events when the modem connects.
 				break
@@ -441,18 +520,48 @@ MainModemLoop:
 		// ========== Running regular ping tests =============
 		log.Infof("Running ping tests every %s.", mc.TestInterval)
 		pingFailCount := 0
+		nextPingTest := time.Now().Add(mc.TestInterval)
+		nextQualityTest := time.Now().Add(mc.Quality.Interval)
 		for {
-			time.Sleep(mc.TestInterval)
+			time.Sleep(time.Second)
+			// Only the forced conditions are checked here, the others (e.g. MinConnDuration) leave the
+			// modem up until the pings fail, as before.
+			if forced, on, _, reason := mc.forcedOnOff(time.Now()); forced && !on {
+				log.Infof("Modem should no longer be on. %s", reason)
+				continue MainModemLoop
+			}
+			if mc.Modem.removed.Load() {
+				makeModemEvent("modemRemoved", &mc)
+				mc.lastFailedConnection = time.Now()
+				continue MainModemLoop
+			}
+			if time.Now().Before(nextPingTest) {
+				continue
+			}
+			nextPingTest = time.Now().Add(mc.TestInterval)
 			log.Debug("Running a regular ping test.")
-			if mc.PingTest(5000) {
+			if mc.PingTest() {
 				mc.lastSuccessfulPing = time.Now()
 				pingFailCount = 0
+				if mc.Quality.enabled() && time.Now().After(nextQualityTest) {
+					mc.Quality.measure()
+					nextQualityTest = time.Now().Add(mc.Quality.Interval)
+				}
 			} else {
 				pingFailCount++
 				log.Infof("Ping test failed %d times in a row.", pingFailCount)
 			}
 
 			if pingFailCount > 3 {
+				log.Infof("Ping test failed %d times in a row. Trying to recover the modem.", pingFailCount)
+				pingHealthy := func() bool { return mc.PingTest() }
+				if mc.recoverModem(faultPingFailures, rungIndex("cfunToggle"), pingHealthy) {
+					mc.lastSuccessfulPing = time.Now()
+					pingFailCount = 0
+					// Pings are working again so the modem is back if a recovery step removed it from USB.
+					mc.Modem.removed.Store(false)
+					continue
+				}
 				log.Infof("Ping test failed %d times in a row. Reporting failure.", pingFailCount)
 				mc.lastFailedConnection = time.Now()
 				continue MainModemLoop
@@ -491,22 +600,35 @@ func makeModemEvent(eventType string, mc *ModemController) {
 	if err != nil {
 		log.Printf("Failed to get iccid: %s", err)
 	}
+	cellFingerprint, cellLocation := mc.recordCellFingerprint()
+
+	details := map[string]interface{}{
+		"signalStatus":     status,
+		"signalStrengthDB": bitErrorRate,
+		"signalStrength":   signalStrength,
+		"band":             band,
+		"simStatus":        simStatus,
+		"apn":              apn,
+		"provider":         provider,
+		"accessTechnology": accessTechnology,
+		"simProvider":      simProvider,
+		"iccid":            iccid,
+	}
+	if cellFingerprint != nil {
+		details["cell"] = cellFingerprint.ToDBusMap()
+	}
+	if cellLocation != nil {
+		details["cellLocation"] = cellLocation.ToDBusMap()
+	}
+	// Before connecting to the network this will be from the previous connection.
+	if quality, ok := mc.Quality.latest(); ok {
+		details["connectionQuality"] = quality.ToDBusMap()
+	}
 
 	eventclient.AddEvent(eventclient.Event{
 		Timestamp: time.Now(),
 		Type:      eventType,
-		Details: map[string]interface{}{
-			"signalStatus":     status,
-			"signalStrengthDB": bitErrorRate,
-			"signalStrength":   signalStrength,
-			"band":             band,
-			"simStatus":        simStatus,
-			"apn":              apn,
-			"provider":         provider,
-			"accessTechnology": accessTechnology,
-			"simProvider":      simProvider,
-			"iccid":            iccid,
-		},
+		Details:   details,
 	})
 }
 
@@ -521,39 +643,3 @@ func rpiUptime() (time.Duration, error) {
 func printSetupStep(i int, text string) {
 	log.Infof("Modem set up step (%d/%d): %s", i, modemSetupSteps, text)
 }
-
-type VendorProductID struct {
-	VendorID  string
-	ProductID string
-}
-
-func getUSBVendorProductIDs() ([]VendorProductID, error) {
-	out, err := exec.Command("lsusb").Output()
-	if err != nil {
-		return nil, err
-	}
-
-	var vendorProductIDs []VendorProductID
-	scanner := bufio.NewScanner(bytes.NewReader(out))
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Lines look like:  "Bus 001 Device 006: ID 1e0e:9011 Qualcomm / Option"
-		parts := strings.Fields(line)
-		for i, tok := range parts {
-			if tok == "ID" && i+1 < len(parts) {
-				ids := strings.SplitN(parts[i+1], ":", 2)
-				if len(ids) == 2 {
-					vendorProductIDs = append(vendorProductIDs, VendorProductID{
-						VendorID:  ids[0],
-						ProductID: ids[1],
-					})
-				}
-				break
-			}
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-	return vendorProductIDs, nil
-}
@@ -0,0 +1,135 @@
+package modemd
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/TheCacophonyProject/modemd/mbim"
+)
+
+// mbimControl controls the modem with MBIM over its /dev/cdc-wdm* device.
+type mbimControl struct {
+	dev *mbim.Device
+	mc  *ModemController
+
+	mu        sync.Mutex
+	connected bool
+}
+
+func newMBIMControl(path string, mc *ModemController) (*mbimControl, error) {
+	dev, err := mbim.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mbimControl{dev: dev, mc: mc}, nil
+}
+
+func (c *mbimControl) Name() string {
+	return controlMBIM
+}
+
+func (c *mbimControl) SIMStatus() (string, error) {
+	s, err := c.dev.SubscriberReadyStatus()
+	if err != nil {
+		return "", err
+	}
+	switch s.ReadyState {
+	case mbim.ReadyInitialized:
+		return "READY", nil
+	case mbim.ReadyDeviceLocked:
+		return "SIM PIN", nil
+	case mbim.ReadySIMNotInserted:
+		return "NOT INSERTED", nil
+	case mbim.ReadyBadSIM:
+		return "BAD SIM", nil
+	case mbim.ReadyNotActivated:
+		return "NOT ACTIVATED", nil
+	case mbim.ReadyFailure:
+		return "FAILED", nil
+	}
+	return "NOT READY", nil
+}
+
+func (c *mbimControl) Signal() (controlSignal, error) {
+	s, err := c.dev.SignalState()
+	if err != nil {
+		return controlSignal{}, err
+	}
+	return controlSignal{CSQ: s.RSSI, BitErrorRate: s.ErrorRate}, nil
+}
+
+func (c *mbimControl) Registration() (int, error) {
+	r, err := c.dev.RegisterState()
+	if err != nil {
+		return 0, err
+	}
+	switch r.State {
+	case mbim.RegisterDeregistered:
+		return 0, nil
+	case mbim.RegisterHome:
+		return 1, nil
+	case mbim.RegisterSearching:
+		return 2, nil
+	case mbim.RegisterDenied:
+		return 3, nil
+	case mbim.RegisterRoaming, mbim.RegisterPartner:
+		return 5, nil
+	}
+	return 4, nil
+}
+
+// StartData connects with the PDP context's APN and credentials then sets the addresses on the
+// network interface, as MBIM modems don't run DHCP.
+func (c *mbimControl) StartData(context PDPContext) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.dev.Attach(); err != nil {
+		log.Debugf("Failed to attach to the packet service: %v", err)
+	}
+	opts := mbim.ConnectOptions{
+		APN:      context.APN,
+		Username: context.Username,
+		Password: context.Password,
+	}
+	switch context.Auth {
+	case "pap":
+		opts.Auth = mbim.AuthPAP
+	case "chap":
+		opts.Auth = mbim.AuthCHAP
+	}
+	switch context.Type {
+	case pdpTypeIPv4:
+		opts.IPType = mbim.IPTypeIPv4
+	case pdpTypeIPv6:
+		opts.IPType = mbim.IPTypeIPv6
+	case pdpTypeDual:
+		opts.IPType = mbim.IPTypeIPv4v6
+	}
+	state, err := c.dev.Connect(opts)
+	if err != nil {
+		return err
+	}
+	if state != mbim.ActivationActivated {
+		return fmt.Errorf("MBIM connection activation state is %d", state)
+	}
+	c.connected = true
+	config, err := c.dev.IPConfiguration(opts.SessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get the IP configuration: %w", err)
+	}
+	return c.mc.configureNetdev(append(config.IPv4, config.IPv6...), config.IPv4Gateway)
+}
+
+func (c *mbimControl) StopData() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return nil
+	}
+	c.connected = false
+	return c.dev.Disconnect(0)
+}
+
+func (c *mbimControl) Close() error {
+	return c.dev.Close()
+}
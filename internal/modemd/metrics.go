@@ -0,0 +1,254 @@
+package modemd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MetricsKey = "modemd-metrics"
+
+// MetricsConfig is read from the "modemd-metrics" config section.
+type MetricsConfig struct {
+	Address          string        `mapstructure:"address"`  // Address for the /metrics HTTP endpoint, e.g "127.0.0.1:9617", "" to disable.
+	Textfile         string        `mapstructure:"textfile"` // .prom file for the node-exporter textfile collector, "" to disable.
+	TextfileInterval time.Duration `mapstructure:"textfile-interval"`
+}
+
+func DefaultMetricsConfig() MetricsConfig {
+	return MetricsConfig{
+		Address:          "",
+		Textfile:         "",
+		TextfileInterval: time.Minute,
+	}
+}
+
+// counters that are not kept anywhere else in the ModemController.
+type counters struct {
+	mu                sync.Mutex
+	atCommands        map[string]uint64 // Keyed by result, "ok" or "error".
+	atDurationSeconds float64
+	powerOns          uint64
+	powerOffs         uint64
+}
+
+var modemdCounters = &counters{atCommands: map[string]uint64{}}
+
+func (c *counters) atCommand(d time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.atCommands["error"]++
+	} else {
+		c.atCommands["ok"]++
+	}
+	c.atDurationSeconds += d.Seconds()
+}
+
+func (c *counters) power(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if on {
+		c.powerOns++
+	} else {
+		c.powerOffs++
+	}
+}
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *metricsWriter) metric(name, metricType, help string, samples ...metricSample) {
+	if len(samples) == 0 {
+		return
+	}
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	for _, s := range samples {
+		fmt.Fprintf(&w.buf, "%s%s %g\n", name, s.labels, s.value)
+	}
+}
+
+// summary writes a summary with only the sum and count.
+func (w *metricsWriter) summary(name, help string, sum float64, count uint64) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s summary\n%s_sum %g\n%s_count %d\n", name, help, name, name, sum, name, count)
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+func value(v float64) metricSample {
+	return metricSample{value: v}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelled makes a sample with labels from pairs of names and values.
+func labelled(v float64, nameValues ...string) metricSample {
+	labels := []string{}
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, nameValues[i], labelEscaper.Replace(nameValues[i+1])))
+	}
+	return metricSample{labels: "{" + strings.Join(labels, ",") + "}", value: v}
+}
+
+func boolValue(b bool) metricSample {
+	if b {
+		return value(1)
+	}
+	return value(0)
+}
+
+// writeMetrics collects the metrics from what the ModemController already knows, it doesn't run any AT commands.
+func (mc *ModemController) writeMetrics(out io.Writer) error {
+	w := &metricsWriter{}
+	w.metric("modemd_modem_powered", "gauge", "If the modem is powered on.", boolValue(mc.IsPowered))
+	w.metric("modemd_on_off_reason_info", "gauge", "Why the modem is on or off.", labelled(1, "reason", mc.onOffReasonCode))
+	w.metric("modemd_failed_to_find_modem", "gauge", "If modemd has given up finding the modem until the next retry.", boolValue(mc.failedToFindModem))
+	w.metric("modemd_failed_to_find_sim_card", "gauge", "If modemd has given up finding the SIM card until the next retry.", boolValue(mc.failedToFindSimCard))
+
+	if mc.Modem != nil {
+		w.metric("modemd_at_ready", "gauge", "If the modem is responding to AT commands.", boolValue(mc.Modem.ATReady))
+		if mc.IsPowered && mc.connectedTime.After(mc.poweredOnTime) {
+			w.metric("modemd_connection_uptime_seconds", "gauge", "Time since the modem connected to the network.", value(time.Since(mc.connectedTime).Seconds()))
+		}
+		if mc.Modem.LastPingRTT > 0 {
+			w.metric("modemd_ping_rtt_seconds", "gauge", "Round trip time of the last successful ping test.", value(mc.Modem.LastPingRTT.Seconds()))
+		}
+	}
+	if !mc.lastSuccessfulPing.IsZero() {
+		w.metric("modemd_last_successful_ping_timestamp_seconds", "gauge", "Unix time of the last successful ping test.", value(float64(mc.lastSuccessfulPing.Unix())))
+	}
+
+	if s, ok := mc.SignalHistory.latest(); ok {
+		w.metric("modemd_signal_sample_timestamp_seconds", "gauge", "Unix time of the latest signal sample.", value(float64(s.Time)))
+		if s.CSQ != unknownInt8 && s.CSQ != 99 {
+			w.metric("modemd_signal_csq", "gauge", "Signal quality from AT+CSQ, 0-31.", value(float64(s.CSQ)))
+			w.metric("modemd_signal_rssi_dbm", "gauge", "Received signal strength.", value(float64(-113+2*int(s.CSQ))))
+		}
+		if s.RSRP != unknownInt16 {
+			w.metric("modemd_signal_rsrp_dbm", "gauge", "LTE reference signal received power.", value(float64(s.RSRP)/10))
+		}
+		if s.RSRQ != unknownInt16 {
+			w.metric("modemd_signal_rsrq_db", "gauge", "LTE reference signal received quality.", value(float64(s.RSRQ)/10))
+		}
+		if s.SINR != unknownInt8 {
+			w.metric("modemd_signal_sinr_db", "gauge", "LTE signal to interference plus noise ratio.", value(float64(s.SINR)))
+		}
+		if s.Registration >= 0 {
+			w.metric("modemd_registration_status", "gauge", "Network registration status from AT+CEREG?/AT+CREG?, 1 is home and 5 is roaming.", value(float64(s.Registration)))
+		}
+		if s.Temp != unknownInt8 {
+			w.metric("modemd_modem_temperature_celsius", "gauge", "Modem temperature.", value(float64(s.Temp)))
+		}
+		if s.Voltage != unknownInt16 {
+			w.metric("modemd_modem_voltage_volts", "gauge", "Modem supply voltage.", value(float64(s.Voltage)/1000))
+		}
+	}
+
+	if q, ok := mc.Quality.latest(); ok {
+		w.metric("modemd_connection_quality_timestamp_seconds", "gauge", "Unix time of the latest connection quality measurement.", value(float64(q.Time.Unix())))
+		w.metric("modemd_connection_packet_loss_ratio", "gauge", "Packet loss in the latest connection quality measurement.", value(q.Loss()))
+		if q.Received > 0 {
+			w.metric("modemd_connection_rtt_seconds", "gauge", "Round trip times in the latest connection quality measurement.",
+				labelled(q.RTTMedian.Seconds(), "quantile", "0.5"), labelled(q.RTTP95.Seconds(), "quantile", "0.95"))
+		}
+		if q.ThroughputBps > 0 {
+			w.metric("modemd_connection_throughput_bits_per_second", "gauge", "Download throughput in the latest connection quality measurement.", value(q.ThroughputBps))
+		}
+		w.metric("modemd_connection_class_info", "gauge", "If the link is usable, degraded or unusable.", labelled(1, "class", q.Class))
+	}
+
+	c := modemdCounters
+	c.mu.Lock()
+	atCommands := []metricSample{}
+	var atCount uint64
+	for _, result := range []string{"ok", "error"} {
+		atCommands = append(atCommands, labelled(float64(c.atCommands[result]), "result", result))
+		atCount += c.atCommands[result]
+	}
+	w.metric("modemd_at_commands_total", "counter", "AT commands run, by result.", atCommands...)
+	w.summary("modemd_at_command_duration_seconds", "Time taken to run AT commands, including time in the queue.", c.atDurationSeconds, atCount)
+	w.metric("modemd_modem_power_on_total", "counter", "Times the modem has been powered on.", value(float64(c.powerOns)))
+	w.metric("modemd_modem_power_off_total", "counter", "Times the modem has been powered off.", value(float64(c.powerOffs)))
+	c.mu.Unlock()
+
+	recoveryStats := mc.getRecoveryStats()
+	keys := make([]string, 0, len(recoveryStats))
+	for key := range recoveryStats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attempts, fixed := []metricSample{}, []metricSample{}
+	for _, key := range keys {
+		fault, rung, _ := strings.Cut(key, "/")
+		stat := recoveryStats[key]
+		attempts = append(attempts, labelled(float64(stat.Attempts), "fault", fault, "rung", rung))
+		fixed = append(fixed, labelled(float64(stat.Fixed), "fault", fault, "rung", rung))
+	}
+	w.metric("modemd_recovery_attempts_total", "counter", "Times each recovery step was tried for a fault.", attempts...)
+	w.metric("modemd_recovery_fixed_total", "counter", "Times each recovery step fixed a fault.", fixed...)
+
+	_, err := out.Write(w.buf.Bytes())
+	return err
+}
+
+// runMetrics serves the metrics over HTTP and/or writes them to the textfile, as configured.
+func (mc *ModemController) runMetrics(conf MetricsConfig) {
+	if conf.Address != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				if err := mc.writeMetrics(w); err != nil {
+					log.Debugf("Failed to write metrics: %v", err)
+				}
+			})
+			log.Infof("Serving metrics on 'http://%s/metrics'.", conf.Address)
+			if err := http.ListenAndServe(conf.Address, mux); err != nil {
+				log.Errorf("Failed to serve metrics: %v", err)
+			}
+		}()
+	}
+	if conf.Textfile != "" {
+		go func() {
+			for {
+				if err := mc.writeMetricsTextfile(conf.Textfile); err != nil {
+					log.Errorf("Failed to write metrics to '%s': %v", conf.Textfile, err)
+				}
+				time.Sleep(conf.TextfileInterval)
+			}
+		}()
+	}
+}
+
+// writeMetricsTextfile writes to a temporary file then renames it so the collector never reads a partial file.
+func (mc *ModemController) writeMetricsTextfile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// The collector only reads *.prom files so the temporary file is ignored.
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := mc.writeMetrics(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
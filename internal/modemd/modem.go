@@ -1,9 +1,9 @@
 package modemd
 
 import (
-	"fmt"
-	"os/exec"
-	"strings"
+	"net"
+	"sync/atomic"
+	"time"
 )
 
 type Modem struct {
@@ -14,6 +14,13 @@ type Modem struct {
 	ATReady       bool
 	SimCardStatus SimCardStatus
 	ATManager     *atManager
+	LastPingRTT   time.Duration  // Average round trip time of the last successful ping.
+	PDPType       string         // PDP type of the first PDP context, "" until it is read.
+	Control       string         // Backend used to control the modem, "at", "qmi" or "mbim".
+	ControlDevice string         // Control device for QMI or MBIM.
+	control       controlBackend // nil when only AT commands are used.
+	USBDevice     string         // Name of the modem's USB device in sysfs, e.g "1-1.3".
+	removed       atomic.Bool    // Set when the modem's USB device is removed.
 }
 
 type SimCardStatus string
@@ -31,41 +38,25 @@ func NewModem(config ModemConfig) *Modem {
 		Netdev:        config.NetDev,
 		VendorID:      config.VendorID,
 		ProductID:     config.ProductID,
+		Control:       config.Control,
+		ControlDevice: config.ControlDevice,
 		SimCardStatus: SimCardFinding,
 	}
 	return m
 }
 
-// PingTest will try connecting to one of the provides hosts
-func (m *Modem) PingTest(timeoutSec int, hosts []string) bool {
-	for _, host := range hosts {
-		cmd := exec.Command(
-			"ping",
-			"-I",
-			m.Netdev,
-			"-n",
-			"-q",
-			"-c1",
-			fmt.Sprintf("-w%d", timeoutSec),
-			host)
-		if err := cmd.Run(); err == nil {
-			return true
-		}
-	}
-	return false
-}
-
-// IsDefaultRoute will check if the USB modem is connected
+// IsDefaultRoute will check if there is a default route through the USB modem
 func (m *Modem) IsDefaultRoute() (bool, error) {
-	outByte, err := exec.Command("ip", "route").Output()
+	link, err := net.InterfaceByName(m.Netdev)
+	if err != nil {
+		return false, err
+	}
+	defaults, err := defaultRoutes()
 	if err != nil {
 		return false, err
 	}
-	out := string(outByte)
-	lines := strings.Split(out, "\n")
-	search := fmt.Sprintf(" dev %s ", m.Netdev)
-	for _, line := range lines {
-		if strings.HasPrefix(line, "default") && strings.Contains(line, search) {
+	for _, r := range defaults {
+		if r.OifIndex == link.Index {
 			return true, nil
 		}
 	}
@@ -26,12 +26,11 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
 	"github.com/TheCacophonyProject/go-utils/saltutil"
-	"periph.io/x/periph/conn/gpio"
-	"periph.io/x/periph/conn/gpio/gpioreg"
 )
 
 type ModemController struct {
@@ -51,24 +50,52 @@ type ModemController struct {
 	RetryFindModemInterval time.Duration
 	MaxOffDuration         time.Duration
 	MinConnDuration        time.Duration
+	OnWindows              []*OnWindow
+	PowerPolicy            *PowerPolicy
+	StateFile              string
+	FailureRecovery        FailureRecoveryConfig
+	Connectivity           ConnectivityConfig
+	PDP                    PDPConfig
 
 	lastOnRequestTime    time.Time
 	lastSuccessfulPing   time.Time
 	lastFailedConnection time.Time
 	//lastFailedFindModem  time.Time
-	connectedTime time.Time
-	stayOnUntil   time.Time
-	stayOffUntil  time.Time
-	onOffReason   string
-	IsPowered     bool
+	connectedTime   time.Time
+	stayOnUntil     time.Time
+	stayOffUntil    time.Time
+	onOffReason     string
+	onOffReasonCode string
+	IsPowered       bool
 
 	failedToFindModem   bool
 	failedToFindSimCard bool
+	findModemRecovery   failureRecovery
+	simCardRecovery     failureRecovery
+	failureRetryUntil   time.Time
+	recoveryStatsMu     sync.Mutex
+	modemMu             sync.Mutex              // For the Modem and its netdev, which are read by the data usage goroutine.
+	recoveryStats       map[string]recoveryStat // Keyed by "fault/rung", use the accessors as it is read from other goroutines.
+	GPS                 *GPS
+	TimeSync            *TimeSync
+	CellLocator         *CellLocator
+	Geofence            *Geofence
+	SignalHistory       *SignalHistory
+	DataUsage           *DataUsage
+	Quality             *ConnectionQuality
+	Routing             *Routing
+	PPP                 *PPP
+	USBPower            *USBPower
+	Power               *PowerControl
+	probeResults        probeResults
+	defaultPDPCID       int // Set over D-Bus, 0 to use the configured default.
+	poweredOnTime       time.Time
+
+	stateMu       sync.Mutex // Held while saving the state, for savedState and the state file.
+	stateRestored bool       // False until the clock is set and the saved state has been restored.
+	savedState    controllerState
 }
 
-const PinEnableModem = "GPIO22"
-const PinPowerModem = "GPIO20"
-
 func (mc *ModemController) NewOnRequest() {
 	mc.lastOnRequestTime = time.Now()
 }
@@ -77,185 +104,80 @@ func (mc *ModemController) StayOnUntil(onUntil time.Time) error {
 	mc.stayOnUntil = onUntil
 	mc.stayOffUntil = time.Time{}
 	log.Println("dbus request to keep modem on until", onUntil.Format(time.DateTime))
+	if err := mc.saveState(); err != nil {
+		log.Errorf("Failed to save modem state: %v", err)
+	}
 	return nil
 }
 
 func (mc *ModemController) StayOffUntil(offUntil time.Time) error {
 	mc.stayOffUntil = offUntil
 	mc.stayOnUntil = time.Time{}
+	if err := mc.saveState(); err != nil {
+		log.Errorf("Failed to save modem state: %v", err)
+	}
 	return nil
 }
 
-/*
-func (mc *ModemController) gpsEnabled() (bool, error) {
-	out, err := mc.RunATCommand("AT+CGPS?")
-	log.Println(out)
-	return out == "+CGPS: 1,1", err
-}
-*/
-
-/*
-func (mc *ModemController) EnableGPS() error {
-	enabled, err := mc.gpsEnabled()
-	if err != nil {
-		return err
+func (mc *ModemController) GetStatus() (map[string]interface{}, error) {
+	status := make(map[string]interface{})
+	status["timestamp"] = time.Now().Format(time.RFC1123Z)
+	status["powered"] = mc.IsPowered
+	status["onOffReason"] = mc.onOffReason
+	status["power"] = mc.Power.Status()
+	status["failedToFindModem"] = mc.failedToFindModem
+	status["failedToFindSimCard"] = mc.failedToFindSimCard
+	if mc.failedToFindModem {
+		status["findModemRetry"] = mc.failureRecoveryStatus(&mc.findModemRecovery, mc.RetryFindModemInterval)
 	}
-	if enabled {
-		return nil
+	if mc.failedToFindSimCard {
+		status["simCardRetry"] = mc.failureRecoveryStatus(&mc.simCardRecovery, mc.FailureRecovery.RetrySimCardInterval)
 	}
-	_, err = mc.RunATCommand("AT+CGPS=1")
-	return err
-}
-*/
-
-func (mc *ModemController) DisableGPS() error {
-	_, err := mc.RunATCommand("AT+CGPS=0", 1000, 1)
-	return err
-}
-
-/*
-type gpsData struct {
-	latitude    float64
-	longitude   float64
-	utcDateTime time.Time
-	altitude    float64
-	speed       float64
-	course      float64
-}
-
-// Convert to a map that is compatible with DBus
-func (g *gpsData) ToDBusMap() map[string]interface{} {
-	return map[string]interface{}{
-		"latitude":    g.latitude,
-		"longitude":   g.longitude,
-		"utcDateTime": g.utcDateTime.Format("2006-01-02 15:04:05"),
-		"altitude":    g.altitude,
-		"speed":       g.speed,
-		"course":      g.course,
+	if window, interval := mc.activeWindow(time.Now()); window != nil {
+		status["activeWindow"] = map[string]interface{}{
+			"name": window.Name,
+			"mode": window.modeStr(),
+			"end":  interval.end.Format(time.RFC1123Z),
+		}
 	}
-}
-*/
-
-/*
-func (mc *ModemController) GetGPSStatus() (*gpsData, error) {
-	out, err := mc.RunATCommand("AT+CGPSINFO")
-	if err != nil {
-		return nil, err
+	if mc.GPS != nil {
+		status["gps"] = mc.GPS.Status()
 	}
-	//log.Println(out)
-	out = strings.TrimSpace(out)
-	out = strings.TrimPrefix(out, "+CGPSINFO:")
-	out = strings.TrimSpace(out)
-	parts := strings.Split(out, ",")
-	if len(parts) < 8 {
-		return nil, fmt.Errorf("invalid GPS format")
-	}
-	latRaw := parts[0]
-	latNSRaw := parts[1]
-	longRaw := parts[2]
-	longEWRaw := parts[3]
-	utcDateRaw := parts[4]
-	utcTimeRaw := parts[5]
-	altitudeRaw := parts[6]
-	speedRaw := parts[7]
-	courseRaw := parts[8]
-	//log.Println("latRaw:", latRaw)
-	//log.Println("latNSRaw:", latNSRaw)
-	//log.Println("longRaw:", longRaw)
-	//log.Println("longEW:", longEWRaw)
-	//log.Println("utcDateRaw:", utcDateRaw)
-	//log.Println("utcTimeRaw:", utcTimeRaw)
-	//log.Println("altitude:", altitudeRaw)
-	//log.Println("speed:", speedRaw)
-	//log.Println("course:", courseRaw)
-
-	if latRaw == "" {
-		return nil, fmt.Errorf("no GPS data available")
-	}
-	if string(latRaw[4]) != "." {
-		return nil, fmt.Errorf("invalid latitude")
-	}
-	latDeg, err := strconv.ParseFloat(latRaw[:2], 64)
-	if err != nil {
-		return nil, err
+	if mc.CellLocator != nil {
+		status["cell"] = mc.CellLocator.Status()
 	}
-	latMinute, err := strconv.ParseFloat(latRaw[2:], 64)
-	if err != nil {
-		return nil, err
+	if mc.Geofence.enabled() {
+		status["geofence"] = mc.Geofence.Status()
 	}
-	latDeg += latMinute / 60
-	if latNSRaw == "S" {
-		latDeg *= -1
-	} else if latNSRaw != "N" {
-		return nil, fmt.Errorf("invalid latitude direction")
+	status["probes"] = mc.probeResults.ToDBusMap()
+	if mc.Routing != nil {
+		status["routing"] = mc.Routing.Status()
 	}
-	//log.Println("latDeg:", latDeg)
-
-	if string(longRaw[5]) != "." {
-		return nil, fmt.Errorf("invalid longitude")
+	if m, ok := mc.Quality.latest(); ok {
+		status["connectionQuality"] = m.ToDBusMap()
 	}
-	longDeg, err := strconv.ParseFloat(longRaw[:3], 64)
-	if err != nil {
-		return nil, err
+	if mc.PPP.enabled() {
+		status["ppp"] = mc.PPP.Status()
 	}
-	longMinute, err := strconv.ParseFloat(longRaw[3:], 64)
-	if err != nil {
-		return nil, err
+	if mc.DataUsage != nil {
+		status["dataUsage"] = mc.DataUsage.ToDBusMap()
 	}
-	longDeg += longMinute / 60
-	if longEWRaw == "W" {
-		latDeg *= -1
-	} else if longEWRaw != "E" {
-		return nil, fmt.Errorf("invalid longitude direction")
+	if mc.TimeSync.enabled() {
+		status["timeSync"] = mc.TimeSync.Status()
 	}
-	//log.Println("longDeg:", longDeg)
-
-	const layout = "020106-150405.0" // format DDMMYY-hhmmss.s
-	dateTime, err := time.Parse(layout, utcDateRaw+"-"+utcTimeRaw)
-	//log.Println(dateTime.Local().Format("2006-01-02 15:04:05"))
-	if err != nil {
-		return nil, err
+	if stats := mc.recoveryStatsStatus(); len(stats) > 0 {
+		status["recoveryStats"] = stats
 	}
-
-	altitude, err := strconv.ParseFloat(altitudeRaw, 64)
-	if err != nil {
-		return nil, err
-	}
-	//log.Println(altitude)
-
-	speed, err := strconv.ParseFloat(speedRaw, 64)
-	if err != nil {
-		return nil, err
+	if mc.PowerPolicy.enabled() {
+		status["powerPolicy"] = mc.PowerPolicy.status()
 	}
-	//log.Println(speed)
-
-	var course float64
-	if courseRaw != "" {
-		course, err = strconv.ParseFloat(courseRaw, 64)
-		if err != nil {
-			return nil, err
+	if window, boundary := mc.nextWindowBoundary(time.Now()); window != nil {
+		status["nextWindowBoundary"] = map[string]interface{}{
+			"name": window.Name,
+			"mode": window.modeStr(),
+			"time": boundary.Format(time.RFC1123Z),
 		}
 	}
-	//log.Println(course)
-
-	return &gpsData{
-		latitude:    latDeg,
-		longitude:   longDeg,
-		utcDateTime: dateTime,
-		altitude:    altitude,
-		speed:       speed,
-		course:      course,
-	}, nil
-}
-*/
-
-func (mc *ModemController) GetStatus() (map[string]interface{}, error) {
-	status := make(map[string]interface{})
-	status["timestamp"] = time.Now().Format(time.RFC1123Z)
-	status["powered"] = mc.IsPowered
-	status["onOffReason"] = mc.onOffReason
-	status["failedToFindModem"] = mc.failedToFindModem
-	status["failedToFindSimCard"] = mc.failedToFindSimCard
 
 	if mc.Modem != nil {
 		// Set details for modem
@@ -263,7 +185,9 @@ func (mc *ModemController) GetStatus() (map[string]interface{}, error) {
 		modem["name"] = mc.Modem.Name
 		modem["netdev"] = mc.Modem.Netdev
 		modem["vendor"] = mc.Modem.VendorID + ":" + mc.Modem.ProductID
+		modem["usbDevice"] = mc.Modem.USBDevice
 		modem["atReady"] = mc.Modem.ATReady
+		modem["control"] = mc.Modem.controlName()
 		modem["connectedTime"] = mc.connectedTime.Format(time.RFC1123Z)
 		if mc.Modem.ATReady {
 			modem["voltage"] = valueOrErrorStr(mc.readVoltage())
@@ -272,6 +196,8 @@ func (mc *ModemController) GetStatus() (map[string]interface{}, error) {
 			modem["model"] = valueOrErrorStr(mc.getModel())
 			modem["serial"] = valueOrErrorStr(mc.getSerialNumber())
 			modem["apn"] = valueOrErrorStr(mc.getAPN())
+			modem["pdpType"] = mc.Modem.PDPType
+			modem["pdpContext"] = mc.defaultCID()
 		}
 		status["modem"] = modem
 
@@ -449,38 +375,32 @@ func (mc *ModemController) getSerialNumber() (string, error) {
 // Firmware upgrades?
 
 func (mc *ModemController) getAPN() (string, error) {
-	out, err := mc.RunATCommand("AT+CGDCONT?", 1000, 1)
-	if err != nil {
-		return "", err
-	}
-	out = strings.TrimPrefix(out, "+CGDCONT:")
-	out = strings.TrimSpace(out)
-	parts := strings.Split(out, ",")
-	if len(parts) < 3 {
-		return "", fmt.Errorf("invalid CGDCONT format %s", out)
-	}
-	apn := parts[2]
-	apn = strings.TrimPrefix(apn, "\"")
-	apn = strings.TrimSuffix(apn, "\"")
-	return apn, nil
+	context, err := mc.getPDPContext(mc.defaultCID())
+	return context.APN, err
 }
 
+// setAPN sets the APN with the PDP type configured for it. The context's current type is kept when no
+// type is configured.
 func (mc *ModemController) setAPN(apn string) error {
-	_, err := mc.RunATCommand(fmt.Sprintf("AT+CGDCONT=1,\"IP\",\"%s\"", apn), 1000, 1)
-	if err != nil {
-		return err
-	}
-	readAPN, err := mc.getAPN()
-	if err != nil {
-		return err
-	}
-	if readAPN != apn {
-		return fmt.Errorf("failed to set APN, APN is '%s' when it was set as '%s'", readAPN, apn)
+	pdpType := mc.PDP.typeForAPN(apn)
+	if pdpType == "" {
+		context, err := mc.getPDPContext(mc.defaultCID())
+		if err != nil {
+			log.Debugf("Failed to read PDP context, using %s: %v", pdpTypeIPv4, err)
+			pdpType = pdpTypeIPv4
+		} else {
+			pdpType = context.Type
+		}
 	}
-	return err
+	return mc.setPDPContext(apn, pdpType)
 }
 
+// CheckSimCard returns "READY" if the SIM card can be used, otherwise why it can't.
 func (mc *ModemController) CheckSimCard() (string, error) {
+	return useControl(mc, "SIM status", controlBackend.SIMStatus)
+}
+
+func (mc *ModemController) atSIMStatus() (string, error) {
 	// Enable verbose error messages.
 	_, err := mc.RunATCommand("AT+CMEE=2", 1000, 1)
 	if err != nil {
@@ -496,10 +416,30 @@ func (mc *ModemController) CheckSimCard() (string, error) {
 }
 
 func (mc *ModemController) signalStrength() (int, int, string, error) {
-	out, err := mc.RunATCommand("AT+CSQ", 1000, 1)
+	signal, err := useControl(mc, "signal strength", controlBackend.Signal)
 	if err != nil {
 		return 0, 0, "", err
 	}
+	return signal.CSQ, signal.BitErrorRate, signalStatus(signal.CSQ, signal.BitErrorRate), nil
+}
+
+func signalStatus(signalStrength, bitErrorRate int) string {
+	if signalStrength == 99 {
+		return "no signal"
+		// TODO update what a "poor" signal is, could be needed to be increases to 15
+	} else if (bitErrorRate > 0 && bitErrorRate != 99) || signalStrength < 15 {
+		return "poor"
+	} else if signalStrength < 19 {
+		return "ok"
+	}
+	return "good"
+}
+
+func (mc *ModemController) atSignalStrength() (int, int, error) {
+	out, err := mc.RunATCommand("AT+CSQ", 1000, 1)
+	if err != nil {
+		return 0, 0, err
+	}
 	out = strings.TrimPrefix(out, "+CSQ:")
 	out = strings.TrimSpace(out)
 
@@ -508,29 +448,16 @@ func (mc *ModemController) signalStrength() (int, int, string, error) {
 		signalStrength, err := strconv.Atoi(strings.TrimSpace(parts[0]))
 		if err != nil {
 			log.Errorf("Failed to convert signal strength to int: %v, Output: %s", err, out)
-			return 0, 0, "", err
+			return 0, 0, err
 		}
 		bitErrorRate, err := strconv.Atoi(strings.TrimSpace(parts[1]))
 		if err != nil {
 			log.Errorf("Failed to convert bit error rate to int: %v, Output: %s", err, out)
-			return 0, 0, "", err
-		}
-		status := ""
-
-		if signalStrength == 99 {
-			status = "no signal"
-			// TODO update what a "poor" signal is, could be needed to be increases to 15
-		} else if (bitErrorRate > 0 && bitErrorRate != 99) || signalStrength < 15 {
-			status = "poor"
-		} else if signalStrength < 19 {
-			status = "ok"
-		} else {
-			status = "good"
+			return 0, 0, err
 		}
-
-		return signalStrength, bitErrorRate, status, nil
+		return signalStrength, bitErrorRate, nil
 	} else {
-		return 0, 0, "", fmt.Errorf("unable to read reception, '%s'", out)
+		return 0, 0, fmt.Errorf("unable to read reception, '%s'", out)
 	}
 }
 
@@ -552,13 +479,11 @@ func (mc *ModemController) readBand() (string, error) {
 }
 
 func (mc *ModemController) RunATCommand(atCommand string, timeoutMsec int, attempts int) (string, error) {
-	if mc.Modem == nil {
-		return "", errors.New("modem not connected")
-	}
-	if mc.Modem.ATManager == nil {
-		return "", errors.New("modem AT manager not ready")
+	am, err := mc.atManager()
+	if err != nil {
+		return "", err
 	}
-	return mc.Modem.ATManager.request(atCommand, timeoutMsec, attempts)
+	return am.request(atCommand, timeoutMsec, attempts)
 }
 
 func (mc *ModemController) SetUSBMode(mode string) error {
@@ -573,108 +498,110 @@ func (mc *ModemController) SetUSBMode(mode string) error {
 //AT+CUSBPIDSWITCH=9018,1,1
 //AT+CUSBPIDSWITCH=9001,1,1
 
-func (mc *ModemController) SetModemPower(on bool) error {
-	pinEn := gpioreg.ByName(PinEnableModem)
-	if pinEn == nil {
-		return fmt.Errorf("failed to init GPIO22 pin")
+// setModem changes the modem, nil when it is powered off. The old modem's AT manager is stopped.
+func (mc *ModemController) setModem(m *Modem) {
+	mc.modemMu.Lock()
+	defer mc.modemMu.Unlock()
+	if mc.Modem != nil && mc.Modem.ATManager != nil {
+		mc.Modem.ATManager.stop()
+	}
+	mc.Modem = m
+}
+
+// setATManager starts a new AT manager for the modem, stopping the previous one.
+func (mc *ModemController) setATManager() error {
+	mc.modemMu.Lock()
+	defer mc.modemMu.Unlock()
+	if mc.Modem == nil {
+		return errors.New("modem not connected")
+	}
+	if mc.Modem.ATManager != nil {
+		mc.Modem.ATManager.stop()
+	}
+	mc.Modem.ATManager = newATManager()
+	return nil
+}
+
+// atManager returns the modem's AT manager.
+func (mc *ModemController) atManager() (*atManager, error) {
+	mc.modemMu.Lock()
+	defer mc.modemMu.Unlock()
+	if mc.Modem == nil {
+		return nil, errors.New("modem not connected")
+	}
+	if mc.Modem.ATManager == nil {
+		return nil, errors.New("modem AT manager not ready")
+	}
+	return mc.Modem.ATManager, nil
+}
+
+// setNetdev changes the modem's network interface.
+func (mc *ModemController) setNetdev(netdev string) {
+	mc.modemMu.Lock()
+	defer mc.modemMu.Unlock()
+	mc.Modem.Netdev = netdev
+}
+
+// netdev returns the modem's network interface, "" if there is no modem.
+func (mc *ModemController) netdev() string {
+	mc.modemMu.Lock()
+	defer mc.modemMu.Unlock()
+	if mc.Modem == nil {
+		return ""
 	}
-	pinPowerEn := gpioreg.ByName(PinPowerModem)
-	if pinPowerEn == nil {
-		return fmt.Errorf("failed to init GPIO20 pin")
+	return mc.Modem.Netdev
+}
+
+func (mc *ModemController) SetModemPower(on bool) error {
+	if !on && mc.DataUsage != nil {
+		// The interface's counters are gone once the modem is off, so the data used since the last sample is
+		// counted now.
+		if err := mc.DataUsage.sample(); err != nil {
+			log.Errorf("Failed to update data usage: %v", err)
+		}
 	}
 	if on {
 		log.Println("Powering on USB modem")
-		if err := pinEn.Out(gpio.High); err != nil {
-			return fmt.Errorf("failed to set modem power pin high: %v", err)
-		}
-		if err := pinPowerEn.Out(gpio.High); err != nil {
-			return fmt.Errorf("failed to enable power for the modem: %v", err)
+		if err := mc.Power.On(); err != nil {
+			return err
 		}
+	} else if !mc.Power.canSwitch() {
+		log.Println("The modem is always powered on this board, leaving it on.")
 	} else {
 		_, _ = mc.RunATCommand("AT+CPOF", 1000, 0)
 		if mc.Modem != nil {
 			mc.Modem.ATReady = false
 		}
 		log.Println("Triggering modem shutdown.")
-		if err := pinEn.Out(gpio.Low); err != nil {
-			return fmt.Errorf("failed to set modem power pin low: %v", err)
+		if err := mc.Power.Shutdown(); err != nil {
+			return err
 		}
-		log.Println("Waiting 30 seconds for modem to shutdown.")
-		time.Sleep(30 * time.Second)
+		log.Printf("Waiting %s for modem to shutdown.", mc.Power.ShutdownWait)
+		time.Sleep(mc.Power.ShutdownWait)
 		if mc.Modem != nil {
-			out, err := exec.Command("lsusb").CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("failed to check if modem is powered off: %v, output: %s", err, out)
-			}
-			if strings.Contains(string(out), mc.Modem.VendorID) {
+			if usbDevicePresent(mc.Modem.VendorID, "") {
 				eventclient.AddEvent(eventclient.Event{
 					Timestamp: time.Now().UTC(),
 					Type:      "failed-modem-shutdown",
 				})
-				log.Printf("Modem is not shutting down, cutting power to modem anyway: %s", out)
+				log.Println("Modem is not shutting down, cutting power to modem anyway.")
 			}
 		}
 		log.Println("Powering off modem.")
-		if err := pinPowerEn.Out(gpio.Low); err != nil {
-			return fmt.Errorf("failed to disable power for the modem: %v", err)
+		if err := mc.Power.CutSupply(); err != nil {
+			return err
 		}
 	}
-	if err := setUSBPower(on); err != nil {
+	if err := mc.USBPower.Set(on); err != nil {
 		return err
 	}
-	mc.IsPowered = on
-	return nil
-}
-
-func setUSBPower(enable bool) error {
-	var writeVal []byte
-	if enable {
-		log.Println("Enabling USB power")
-		writeVal = []byte("1")
-	} else {
-		log.Println("Disabling USB power")
-		writeVal = []byte("0")
+	if on && !mc.IsPowered {
+		mc.poweredOnTime = time.Now()
 	}
-
-	err := os.WriteFile("/sys/devices/platform/soc/3f980000.usb/buspower", writeVal, 0644)
-	if err != nil {
-		enDis := "disable"
-		if enable {
-			enDis = "enable"
-		}
-		return fmt.Errorf("failed to %s USB power: %s", enDis, err)
-	}
-
-	if enable {
-		// Function to disable ethernet port. It will get enabled when the USB hub is turned on.
-		// Turning it off will saves a bit of power.
-		go func() {
-			startTime := time.Now()
-			// Wait for ethernet to be enabled.
-			for {
-				out, err := exec.Command("lsusb").CombinedOutput()
-				if err != nil {
-					log.Println("Failed to check if ethernet is enabled", err)
-					return
-				}
-				if strings.Contains(string(out), "ID 0424:ec00") {
-					log.Println("Ethernet is enabled")
-					break
-				}
-				if time.Since(startTime) > 10*time.Second {
-					return
-				}
-				time.Sleep(100 * time.Millisecond)
-			}
-
-			// Disable ethernet port.
-			err = os.WriteFile("/sys/bus/usb/devices/1-1:1.0/1-1-port1/disable", []byte("1"), 0644) // (thanks uhubctl)
-			if err != nil {
-				log.Println("Failed to disable ethernet port", err)
-			}
-			log.Println("Disabled ethernet port")
-		}()
+	if on != mc.IsPowered {
+		modemdCounters.power(on)
 	}
+	mc.IsPowered = on
 	return nil
 }
 
@@ -685,56 +612,120 @@ func (mc *ModemController) CycleModemPower() error {
 	return mc.SetModemPower(true)
 }
 
-// ShouldBeOff will look at the following factors to determine if the modem should be off.
-// - InitialOnTime: Modem should be on for a set amount of time at the start.
-// - LastOnRequest: Check if the last "StayOn" request was less than 'RequestOnTime' ago.
-// - OnWindow: //TODO
-func (mc *ModemController) shouldBeOnWithReason() (bool, string) {
-	if time.Now().Before(mc.stayOffUntil) {
-		return false, fmt.Sprintf("Modem should be off because it was requested to stay off until %s.", mc.stayOffUntil.Format("2006-01-02 15:04:05"))
+// forcedOnOff checks the conditions that decide if the modem is on no matter what else, the battery cutoff,
+// stay on/off requests, the data hard cap and off windows. These are cheap so they are also checked every
+// second while the modem is connected. forced is false if none of them apply.
+func (mc *ModemController) forcedOnOff(now time.Time) (forced, on bool, code, reason string) {
+	pp := mc.PowerPolicy
+	if pp.enabled() {
+		pp.update(mc)
+		if level, voltage := pp.current(); level == powerLevelCutoff {
+			return true, false, "batteryCutoff", fmt.Sprintf("Modem should be off because battery voltage %.2fV is below the cutoff of %.2fV.", voltage, pp.CutoffBelow)
+		}
+	}
+
+	if now.Before(mc.stayOffUntil) {
+		return true, false, "stayOff", fmt.Sprintf("Modem should be off because it was requested to stay off until %s.", mc.stayOffUntil.Format("2006-01-02 15:04:05"))
+	}
+
+	if now.Before(mc.stayOnUntil) {
+		return true, true, "stayOn", fmt.Sprintf("Modem should be on because it was requested to stay on until %s.", mc.stayOnUntil.Format("2006-01-02 15:04:05"))
+	}
+
+	if mc.DataUsage.hardCapReached() {
+		return true, false, "dataHardCap", fmt.Sprintf("Modem should be off because data usage of %s is over the hard cap of %dMB.", mc.DataUsage.usageReason(), mc.DataUsage.HardCapMB)
 	}
 
-	if time.Now().Before(mc.stayOnUntil) {
-		return true, fmt.Sprintf("Modem should be on because it was requested to stay on until %s.", mc.stayOnUntil.Format("2006-01-02 15:04:05"))
+	if window, windowInterval := mc.activeWindow(now); window != nil && !window.On {
+		return true, false, "offWindow", fmt.Sprintf("Modem should be off because of off window '%s' until %s.", window.Name, windowInterval.end.Format("2006-01-02 15:04:05"))
 	}
+	return false, false, "", ""
+}
 
+// ShouldBeOff will look at the following factors to determine if the modem should be off.
+// - InitialOnTime: Modem should be on for a set amount of time at the start.
+// - LastOnRequest: Check if the last "StayOn" request was less than 'RequestOnTime' ago.
+// - OnWindow: Modem is forced off during an off window, and on during an on window (unless retrying after a failure).
+// StayOn/StayOff requests have priority over windows, and an off window has priority over MaxOffDuration.
+// - PowerPolicy: Below the battery cutoff the modem is always off. At lower levels on windows are shortened
+// and optional connections (initial on, requests, MaxOffDuration, MinConnDuration and salt) are deferred.
+// shouldBeOnWithReason also returns the reason's code, which is one of a fixed set so it can be used as a metric label.
+func (mc *ModemController) shouldBeOnWithReason() (bool, string, string) {
+	now := time.Now()
+	pp := mc.PowerPolicy
+	if forced, on, code, reason := mc.forcedOnOff(now); forced {
+		return on, code, reason
+	}
+
+	window, windowInterval := mc.activeWindow(now)
 	if mc.failedToFindModem {
-		return false, "Modem should be off because it could not be found on boot."
+		if mc.findModemRetryDue() {
+			return true, "findModemRetry", "Modem should be on to retry finding the modem."
+		}
+		return false, "findModemRetry", mc.failureRetryReason("modem", &mc.findModemRecovery, mc.RetryFindModemInterval)
 	}
 
 	if mc.failedToFindSimCard {
-		return false, "Modem should be off because it could not find a SIM card."
+		if mc.simCardRetryDue() {
+			return true, "simCardRetry", "Modem should be on to retry finding the SIM card."
+		}
+		return false, "simCardRetry", mc.failureRetryReason("SIM card", &mc.simCardRecovery, mc.FailureRecovery.RetrySimCardInterval)
+	}
+
+	if now.Before(mc.failureRetryUntil) {
+		return true, "failureRetry", "Modem should be on while retrying after a failure."
 	}
 
 	if mc.Modem != nil && mc.Modem.SimCardStatus == SimCardFailed {
-		return false, fmt.Sprintf("Modem should be off because it failed to find a SIM card. SIM status: %s.", mc.Modem.SimCardStatus)
+		return false, "simCardFailed", fmt.Sprintf("Modem should be off because it failed to find a SIM card. SIM status: %s.", mc.Modem.SimCardStatus)
 	}
 
 	if time.Since(mc.lastFailedConnection) < mc.RetryInterval {
-		return false, fmt.Sprintf("Modem shouldn't retry connection for %v.", mc.RetryInterval)
+		return false, "retryInterval", fmt.Sprintf("Modem shouldn't retry connection for %v.", mc.RetryInterval)
+	}
+
+	level, voltage := pp.current()
+	if window != nil && window.On {
+		if !pp.windowExpired(windowInterval, now) {
+			return true, "onWindow", fmt.Sprintf("Modem should be on because of on window '%s' until %s.", window.Name, windowInterval.end.Format("2006-01-02 15:04:05"))
+		}
+		if level < powerLevelDefer {
+			return false, "windowShortened", fmt.Sprintf("Modem should be off because on window '%s' was shortened to %v as battery voltage is %.2fV.", window.Name, pp.ShortenedWindowDuration, voltage)
+		}
+	}
+
+	if pp.enabled() && level >= powerLevelDefer {
+		return false, "lowBattery", fmt.Sprintf("Modem should be off because battery voltage %.2fV is below %.2fV, deferring optional connections.", voltage, pp.DeferBelow)
+	}
+
+	if mc.DataUsage.softCapReached() {
+		if time.Since(mc.lastSuccessfulPing) > mc.MaxOffDuration {
+			return true, "maxOffDuration", fmt.Sprintf("Modem should be on because modem has been off for over %s.", mc.MaxOffDuration)
+		}
+		return false, "dataSoftCap", fmt.Sprintf("Modem should be off because data usage of %s is over the soft cap of %dMB, deferring optional connections.", mc.DataUsage.usageReason(), mc.DataUsage.SoftCapMB)
 	}
 
 	if time.Since(mc.StartTime) < mc.InitialOnDuration {
-		return true, fmt.Sprintf("Modem should be on for initial %v.", mc.InitialOnDuration)
+		return true, "initialOn", fmt.Sprintf("Modem should be on for initial %v.", mc.InitialOnDuration)
 	}
 
 	if time.Since(mc.lastOnRequestTime) < mc.RequestOnDuration {
-		return true, fmt.Sprintf("Modem should be on because of it being requested in the last %v.", mc.RequestOnDuration)
+		return true, "onRequest", fmt.Sprintf("Modem should be on because of it being requested in the last %v.", mc.RequestOnDuration)
 	}
 
 	if time.Since(mc.lastSuccessfulPing) > mc.MaxOffDuration {
-		return true, fmt.Sprintf("Modem should be on because modem has been off for over %s.", mc.MaxOffDuration)
+		return true, "maxOffDuration", fmt.Sprintf("Modem should be on because modem has been off for over %s.", mc.MaxOffDuration)
 	}
 
 	if time.Since(mc.connectedTime) < mc.MinConnDuration {
-		return true, fmt.Sprintf("Modem should be on because minimum connection duration is %v.", mc.MinConnDuration)
+		return true, "minConnDuration", fmt.Sprintf("Modem should be on because minimum connection duration is %v.", mc.MinConnDuration)
 	}
 
 	if mc.IsPowered && saltCommandsRunning() {
-		return true, fmt.Sprintln("Modem should be on because salt commands are running.")
+		return true, "salt", fmt.Sprintln("Modem should be on because salt commands are running.")
 	}
 
-	return false, "No reason the modem should be on."
+	return false, "none", "No reason the modem should be on."
 }
 
 func saltCommandsRunning() bool {
@@ -761,14 +752,11 @@ func saltCommandsRunning() bool {
 }
 
 func (mc *ModemController) ShouldBeOn() bool {
-	on, reason := mc.shouldBeOnWithReason()
+	on, code, reason := mc.shouldBeOnWithReason()
+	mc.onOffReasonCode = code
 	if mc.onOffReason != reason {
 		mc.onOffReason = reason
 		log.Println(reason)
 	}
 	return on
 }
-
-func (mc *ModemController) PingTest(timeoutSec int) bool {
-	return mc.Modem.PingTest(timeoutSec, mc.TestHosts)
-}
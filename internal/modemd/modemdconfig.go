@@ -26,11 +26,15 @@ import (
 	"github.com/TheCacophonyProject/go-config"
 )
 
+const OnWindowsKey = "modemd-windows"
+
 type ModemConfig struct {
-	Name      string
-	NetDev    string
-	VendorID  string
-	ProductID string
+	Name          string
+	NetDev        string
+	VendorID      string
+	ProductID     string
+	Control       string // "at", "qmi" or "mbim", "" for AT.
+	ControlDevice string
 }
 
 type ModemdConfig struct {
@@ -48,6 +52,24 @@ type ModemdConfig struct {
 	RetryFindModemInterval time.Duration
 	MaxOffDuration         time.Duration
 	MinConnDuration        time.Duration
+	OnWindows              []*OnWindow
+	PowerPolicy            PowerPolicyConfig
+	FailureRecovery        FailureRecoveryConfig
+	GPS                    GPSConfig
+	TimeSync               TimeSyncConfig
+	CellLocation           CellLocationConfig
+	Geofence               GeofenceConfig
+	GeofenceAreas          []*geofenceArea
+	SignalHistory          SignalHistoryConfig
+	Metrics                MetricsConfig
+	DataUsage              DataUsageConfig
+	Connectivity           ConnectivityConfig
+	Quality                QualityConfig
+	Routing                RoutingConfig
+	PDP                    PDPConfig
+	Control                ControlConfig
+	PPP                    PPPConfig
+	Board                  BoardConfig
 }
 
 func ParseModemdConfig(configDir string) (*ModemdConfig, error) {
@@ -71,6 +93,125 @@ func ParseModemdConfig(configDir string) (*ModemdConfig, error) {
 		return nil, err
 	}
 
+	location := config.DefaultWindowLocation()
+	if err := conf.Unmarshal(config.LocationKey, &location); err != nil {
+		return nil, err
+	}
+
+	onWindowsConfig := []OnWindowConfig{}
+	if err := conf.Unmarshal(OnWindowsKey, &onWindowsConfig); err != nil {
+		return nil, err
+	}
+	onWindows := []*OnWindow{}
+	for _, windowConfig := range onWindowsConfig {
+		w, err := parseOnWindow(windowConfig, float64(location.Latitude), float64(location.Longitude))
+		if err != nil {
+			return nil, err
+		}
+		onWindows = append(onWindows, w)
+	}
+
+	powerPolicy := DefaultPowerPolicyConfig()
+	if err := conf.Unmarshal(PowerPolicyKey, &powerPolicy); err != nil {
+		return nil, err
+	}
+	if err := powerPolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	failureRecovery := DefaultFailureRecoveryConfig()
+	if err := conf.Unmarshal(FailureRecoveryKey, &failureRecovery); err != nil {
+		return nil, err
+	}
+
+	gpsConfig := DefaultGPSConfig()
+	if err := conf.Unmarshal(GPSKey, &gpsConfig); err != nil {
+		return nil, err
+	}
+
+	timeSync := DefaultTimeSyncConfig()
+	if err := conf.Unmarshal(TimeSyncKey, &timeSync); err != nil {
+		return nil, err
+	}
+
+	cellLocation := DefaultCellLocationConfig()
+	if err := conf.Unmarshal(CellLocationKey, &cellLocation); err != nil {
+		return nil, err
+	}
+
+	geofence := DefaultGeofenceConfig()
+	if err := conf.Unmarshal(GeofenceKey, &geofence); err != nil {
+		return nil, err
+	}
+	geofenceAreas := []*geofenceArea{}
+	for _, fenceConfig := range geofence.Fences {
+		area, err := parseGeofenceArea(fenceConfig, float64(location.Latitude), float64(location.Longitude))
+		if err != nil {
+			return nil, err
+		}
+		geofenceAreas = append(geofenceAreas, area)
+	}
+
+	signalHistory := DefaultSignalHistoryConfig()
+	if err := conf.Unmarshal(SignalHistoryKey, &signalHistory); err != nil {
+		return nil, err
+	}
+
+	metrics := DefaultMetricsConfig()
+	if err := conf.Unmarshal(MetricsKey, &metrics); err != nil {
+		return nil, err
+	}
+
+	dataUsage := DefaultDataUsageConfig()
+	if err := conf.Unmarshal(DataUsageKey, &dataUsage); err != nil {
+		return nil, err
+	}
+
+	connectivity := DefaultConnectivityConfig()
+	if err := conf.Unmarshal(ConnectivityKey, &connectivity); err != nil {
+		return nil, err
+	}
+
+	quality := DefaultQualityConfig()
+	if err := conf.Unmarshal(QualityKey, &quality); err != nil {
+		return nil, err
+	}
+
+	routing := DefaultRoutingConfig()
+	if err := conf.Unmarshal(RoutingKey, &routing); err != nil {
+		return nil, err
+	}
+
+	pdp := DefaultPDPConfig()
+	if err := conf.Unmarshal(PDPKey, &pdp); err != nil {
+		return nil, err
+	}
+	if err := pdp.validate(); err != nil {
+		return nil, err
+	}
+
+	control := DefaultControlConfig()
+	if err := conf.Unmarshal(ControlKey, &control); err != nil {
+		return nil, err
+	}
+	if err := control.validate(); err != nil {
+		return nil, err
+	}
+
+	ppp := DefaultPPPConfig()
+	if err := conf.Unmarshal(PPPKey, &ppp); err != nil {
+		return nil, err
+	}
+
+	board := DefaultBoardConfig()
+	if err := conf.Unmarshal(BoardKey, &board); err != nil {
+		return nil, err
+	}
+	board, err = board.resolve(gpio.ModemPower)
+	if err != nil {
+		return nil, err
+	}
+
 	modemsConfig := []ModemConfig{}
 
 	for _, m := range mdConf.Modems {
@@ -101,5 +242,23 @@ func ParseModemdConfig(configDir string) (*ModemdConfig, error) {
 		RetryFindModemInterval: mdConf.RetryFindModemInterval,
 		MinConnDuration:        mdConf.MinConnDuration,
 		MaxOffDuration:         mdConf.MaxOffDuration,
+		OnWindows:              onWindows,
+		PowerPolicy:            powerPolicy,
+		FailureRecovery:        failureRecovery,
+		GPS:                    gpsConfig,
+		TimeSync:               timeSync,
+		CellLocation:           cellLocation,
+		Geofence:               geofence,
+		GeofenceAreas:          geofenceAreas,
+		SignalHistory:          signalHistory,
+		Metrics:                metrics,
+		DataUsage:              dataUsage,
+		Connectivity:           connectivity,
+		Quality:                quality,
+		Routing:                routing,
+		PDP:                    pdp,
+		Control:                control,
+		PPP:                    ppp,
+		Board:                  board,
 	}, nil
 }
@@ -0,0 +1,254 @@
+package modemd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// route is an IPv4 route read from or written to the kernel over rtnetlink.
+type route struct {
+	Table    uint32
+	DstLen   uint8
+	Dst      net.IP // nil for the default route.
+	Gateway  net.IP
+	PrefSrc  net.IP
+	OifIndex int
+	Metric   uint32
+	Protocol uint8
+	Scope    uint8
+	Type     uint8
+}
+
+func (r route) isDefault() bool {
+	return r.DstLen == 0
+}
+
+// listRoutes dumps the IPv4 routes in every table.
+func listRoutes() ([]route, error) {
+	data, err := syscall.NetlinkRIB(unix.RTM_GETROUTE, unix.AF_INET)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	routes := []route{}
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWROUTE || len(msg.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		r := route{
+			DstLen:   msg.Data[1],
+			Table:    uint32(msg.Data[4]),
+			Protocol: msg.Data[5],
+			Scope:    msg.Data[6],
+			Type:     msg.Data[7],
+		}
+		for _, attr := range parseNetlinkAttrs(msg.Data[unix.SizeofRtMsg:]) {
+			switch attr.typ {
+			case unix.RTA_TABLE:
+				r.Table = binary.NativeEndian.Uint32(attr.value)
+			case unix.RTA_DST:
+				r.Dst = net.IP(attr.value)
+			case unix.RTA_GATEWAY:
+				r.Gateway = net.IP(attr.value)
+			case unix.RTA_PREFSRC:
+				r.PrefSrc = net.IP(attr.value)
+			case unix.RTA_OIF:
+				r.OifIndex = int(binary.NativeEndian.Uint32(attr.value))
+			case unix.RTA_PRIORITY:
+				r.Metric = binary.NativeEndian.Uint32(attr.value)
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// defaultRoutes returns the default routes in the main table.
+func defaultRoutes() ([]route, error) {
+	routes, err := listRoutes()
+	if err != nil {
+		return nil, err
+	}
+	defaults := []route{}
+	for _, r := range routes {
+		if r.isDefault() && r.Table == unix.RT_TABLE_MAIN && r.Type == unix.RTN_UNICAST {
+			defaults = append(defaults, r)
+		}
+	}
+	return defaults, nil
+}
+
+func addRoute(r route, flags int) error {
+	return routeRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|flags, r)
+}
+
+func deleteRoute(r route) error {
+	return routeRequest(unix.RTM_DELROUTE, 0, r)
+}
+
+func routeRequest(msgType uint16, flags int, r route) error {
+	msg := []byte{unix.AF_INET, r.DstLen, 0, 0, unix.RT_TABLE_UNSPEC, r.Protocol, r.Scope, r.Type, 0, 0, 0, 0}
+	msg = appendNetlinkAttr(msg, unix.RTA_TABLE, nativeUint32(r.Table))
+	if r.Dst != nil {
+		msg = appendNetlinkAttr(msg, unix.RTA_DST, r.Dst.To4())
+	}
+	if r.Gateway != nil {
+		msg = appendNetlinkAttr(msg, unix.RTA_GATEWAY, r.Gateway.To4())
+	}
+	if r.PrefSrc != nil {
+		msg = appendNetlinkAttr(msg, unix.RTA_PREFSRC, r.PrefSrc.To4())
+	}
+	msg = appendNetlinkAttr(msg, unix.RTA_OIF, nativeUint32(uint32(r.OifIndex)))
+	msg = appendNetlinkAttr(msg, unix.RTA_PRIORITY, nativeUint32(r.Metric))
+	return netlinkRequest(msgType, flags, msg)
+}
+
+// addOifRule adds a rule to look up the table for packets going out the interface. It is not an
+// error if the rule already exists.
+func addOifRule(priority, table uint32, iface string) error {
+	// struct fib_rule_hdr has the same layout as struct rtmsg.
+	msg := []byte{unix.AF_INET, 0, 0, 0, unix.RT_TABLE_UNSPEC, 0, 0, unix.FR_ACT_TO_TBL, 0, 0, 0, 0}
+	msg = appendNetlinkAttr(msg, unix.FRA_PRIORITY, nativeUint32(priority))
+	msg = appendNetlinkAttr(msg, unix.FRA_TABLE, nativeUint32(table))
+	msg = appendNetlinkAttr(msg, unix.FRA_OIFNAME, append([]byte(iface), 0))
+	err := netlinkRequest(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, msg)
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	return err
+}
+
+// addAddress adds the address to the interface. It is not an error if the interface already has it.
+func addAddress(ifIndex int, addr net.IPNet) error {
+	family, ip := unix.AF_INET, addr.IP.To4()
+	if ip == nil {
+		family, ip = unix.AF_INET6, addr.IP.To16()
+	}
+	prefixLen, _ := addr.Mask.Size()
+	// struct ifaddrmsg
+	msg := []byte{byte(family), byte(prefixLen), 0, unix.RT_SCOPE_UNIVERSE, 0, 0, 0, 0}
+	binary.NativeEndian.PutUint32(msg[4:], uint32(ifIndex))
+	msg = appendNetlinkAttr(msg, unix.IFA_LOCAL, ip)
+	msg = appendNetlinkAttr(msg, unix.IFA_ADDRESS, ip)
+	err := netlinkRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, msg)
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	return err
+}
+
+// setLinkUp brings the interface up.
+func setLinkUp(ifIndex int) error {
+	return setLinkFlags(ifIndex, unix.IFF_UP)
+}
+
+// setLinkDown takes the interface down.
+func setLinkDown(ifIndex int) error {
+	return setLinkFlags(ifIndex, 0)
+}
+
+// setLinkFlags sets the interface's IFF_UP flag to the flags' value.
+func setLinkFlags(ifIndex int, flags uint32) error {
+	// struct ifinfomsg
+	msg := make([]byte, unix.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(msg[4:], uint32(ifIndex))
+	binary.NativeEndian.PutUint32(msg[8:], flags)
+	binary.NativeEndian.PutUint32(msg[12:], unix.IFF_UP)
+	return netlinkRequest(unix.RTM_NEWLINK, 0, msg)
+}
+
+// netlinkRequest sends a request to the kernel and waits for it to be acknowledged.
+func netlinkRequest(msgType uint16, flags int, data []byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	kernel := &unix.SockaddrNetlink{Family: unix.AF_NETLINK}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	const seq = 1
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(data))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(unix.SizeofNlMsghdr+len(data)))
+	binary.NativeEndian.PutUint16(msg[4:], msgType)
+	binary.NativeEndian.PutUint16(msg[6:], uint16(unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags))
+	binary.NativeEndian.PutUint32(msg[8:], seq)
+	msg = append(msg, data...)
+	if err := unix.Sendto(fd, msg, 0, kernel); err != nil {
+		return err
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Header.Seq != seq || reply.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(reply.Data) < 4 {
+				return fmt.Errorf("short netlink error message")
+			}
+			if errno := int32(binary.NativeEndian.Uint32(reply.Data)); errno != 0 {
+				return unix.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+type netlinkAttr struct {
+	typ   uint16
+	value []byte
+}
+
+func parseNetlinkAttrs(b []byte) []netlinkAttr {
+	attrs := []netlinkAttr{}
+	for len(b) >= unix.SizeofRtAttr {
+		length := int(binary.NativeEndian.Uint16(b))
+		if length < unix.SizeofRtAttr || length > len(b) {
+			break
+		}
+		attrs = append(attrs, netlinkAttr{
+			typ:   binary.NativeEndian.Uint16(b[2:]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER),
+			value: b[unix.SizeofRtAttr:length],
+		})
+		b = b[min(netlinkAlign(length), len(b)):]
+	}
+	return attrs
+}
+
+func appendNetlinkAttr(b []byte, typ uint16, value []byte) []byte {
+	length := unix.SizeofRtAttr + len(value)
+	attr := make([]byte, netlinkAlign(length))
+	binary.NativeEndian.PutUint16(attr, uint16(length))
+	binary.NativeEndian.PutUint16(attr[2:], typ)
+	copy(attr[unix.SizeofRtAttr:], value)
+	return append(b, attr...)
+}
+
+func netlinkAlign(length int) int {
+	return (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
+
+func nativeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
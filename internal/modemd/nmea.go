@@ -0,0 +1,313 @@
+package modemd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const knotsToKmh = 1.852
+
+// nmeaState is built up from the NMEA sentences from the GPS.
+type nmeaState struct {
+	valid            bool // RMC status is 'A'
+	latitude         float64
+	longitude        float64
+	altitude         float64
+	speed            float64 // km/h
+	course           float64
+	utcTime          time.Time
+	fixQuality       int // GGA fix quality, 0 is no fix.
+	satellites       int // Satellites used in the fix.
+	satellitesInView int
+	fixMode          int // GSA mode, 1 no fix, 2 2D, 3 3D
+	pdop             float64
+	hdop             float64
+	vdop             float64
+	updatedAt        time.Time // Last valid sentence of any type.
+	fixUpdatedAt     time.Time // Last GGA or RMC sentence, the ones with the position.
+}
+
+// nmeaReader reads NMEA sentences from the GPS port of the modem.
+type nmeaReader struct {
+	port string
+
+	mu    sync.Mutex
+	state nmeaState
+	subs  []chan string
+}
+
+func newNMEAReader(port string) *nmeaReader {
+	return &nmeaReader{port: port}
+}
+
+// subscribe returns a channel that receives every valid raw NMEA sentence.
+func (r *nmeaReader) subscribe() chan string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := make(chan string, 50)
+	r.subs = append(r.subs, c)
+	return c
+}
+
+// unsubscribe removes and closes the channel, which ends the subscriber's loop over it.
+func (r *nmeaReader) unsubscribe(c chan string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, sub := range r.subs {
+		if sub == c {
+			r.subs = append(r.subs[:i], r.subs[i+1:]...)
+			close(c)
+			return
+		}
+	}
+}
+
+func (r *nmeaReader) current() nmeaState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// run reads from the NMEA port while active returns true.
+func (r *nmeaReader) run(active func() bool) {
+	for {
+		time.Sleep(time.Second)
+		if !active() {
+			continue
+		}
+		if _, err := os.Stat(r.port); err != nil {
+			continue
+		}
+		if err := r.readPort(active); err != nil {
+			log.Debugf("NMEA port read stopped: %v", err)
+		}
+	}
+}
+
+func (r *nmeaReader) readPort(active func() bool) error {
+	s, err := serial.OpenPort(&serial.Config{Name: r.port, Baud: 115200, ReadTimeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	reader := bufio.NewReader(s)
+	for active() {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := r.handleSentence(line); err != nil {
+			log.Debugf("Invalid NMEA sentence '%s': %v", line, err)
+		}
+	}
+	return nil
+}
+
+func (r *nmeaReader) handleSentence(sentence string) error {
+	fields, err := splitNMEASentence(sentence)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.state.update(fields); err != nil {
+		return err
+	}
+	// Sent under the lock so unsubscribe can close the channel. The sends don't block.
+	for _, sub := range r.subs {
+		select {
+		case sub <- sentence:
+		default: // Drop sentences for slow subscribers.
+		}
+	}
+	return nil
+}
+
+// splitNMEASentence checks the checksum and returns the comma separated fields of the sentence.
+func splitNMEASentence(sentence string) ([]string, error) {
+	if !strings.HasPrefix(sentence, "$") {
+		return nil, errors.New("missing '$'")
+	}
+	body := sentence[1:]
+	if i := strings.LastIndex(body, "*"); i != -1 {
+		expected, err := strconv.ParseUint(body[i+1:], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum '%s'", body[i+1:])
+		}
+		body = body[:i]
+		var checksum byte
+		for j := 0; j < len(body); j++ {
+			checksum ^= body[j]
+		}
+		if checksum != byte(expected) {
+			return nil, fmt.Errorf("checksum mismatch, got %02X expected %02X", checksum, expected)
+		}
+	}
+	return strings.Split(body, ","), nil
+}
+
+// update will update the state from a sentence. Any talker ID (GP, GN, GL...) is accepted.
+func (s *nmeaState) update(fields []string) error {
+	if len(fields[0]) < 5 {
+		return fmt.Errorf("invalid sentence type '%s'", fields[0])
+	}
+	var err error
+	sentenceType := fields[0][len(fields[0])-3:]
+	switch sentenceType {
+	case "GGA":
+		err = s.updateGGA(fields)
+	case "RMC":
+		err = s.updateRMC(fields)
+	case "GSA":
+		err = s.updateGSA(fields)
+	case "GSV":
+		err = s.updateGSV(fields)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.updatedAt = time.Now()
+	// GSA and GSV keep coming without GGA or RMC, so they don't make the fix fresh.
+	if sentenceType == "GGA" || sentenceType == "RMC" {
+		s.fixUpdatedAt = s.updatedAt
+	}
+	return nil
+}
+
+// $GPGGA,hhmmss.ss,llll.ll,a,yyyyy.yy,a,quality,numSV,HDOP,alt,M,sep,M,diffAge,diffStation
+func (s *nmeaState) updateGGA(fields []string) error {
+	if len(fields) < 10 {
+		return errors.New("GGA sentence too short")
+	}
+	var err error
+	if s.fixQuality, err = parseOptionalInt(fields[6]); err != nil {
+		return err
+	}
+	if s.satellites, err = parseOptionalInt(fields[7]); err != nil {
+		return err
+	}
+	if s.hdop, err = parseOptionalFloat(fields[8]); err != nil {
+		return err
+	}
+	if s.fixQuality == 0 {
+		return nil
+	}
+	if s.altitude, err = parseOptionalFloat(fields[9]); err != nil {
+		return err
+	}
+	return nil
+}
+
+// $GPRMC,hhmmss.ss,A,llll.ll,a,yyyyy.yy,a,speed,course,ddmmyy,magVar,magVarDir,mode
+func (s *nmeaState) updateRMC(fields []string) error {
+	if len(fields) < 10 {
+		return errors.New("RMC sentence too short")
+	}
+	s.valid = fields[2] == "A"
+	if !s.valid {
+		return nil
+	}
+	var err error
+	if s.latitude, err = parseNMEACoordinate(fields[3], fields[4], 2); err != nil {
+		return err
+	}
+	if s.longitude, err = parseNMEACoordinate(fields[5], fields[6], 3); err != nil {
+		return err
+	}
+	speedKnots, err := parseOptionalFloat(fields[7])
+	if err != nil {
+		return err
+	}
+	s.speed = speedKnots * knotsToKmh
+	if s.course, err = parseOptionalFloat(fields[8]); err != nil {
+		return err
+	}
+	timeStr := fields[1]
+	if !strings.Contains(timeStr, ".") {
+		timeStr += ".0"
+	}
+	if s.utcTime, err = time.Parse("020106 150405.999", fields[9]+" "+timeStr); err != nil {
+		return err
+	}
+	return nil
+}
+
+// $GPGSA,mode,fixMode,sv1,...,sv12,PDOP,HDOP,VDOP
+func (s *nmeaState) updateGSA(fields []string) error {
+	if len(fields) < 18 {
+		return errors.New("GSA sentence too short")
+	}
+	var err error
+	if s.fixMode, err = parseOptionalInt(fields[2]); err != nil {
+		return err
+	}
+	if s.pdop, err = parseOptionalFloat(fields[15]); err != nil {
+		return err
+	}
+	if s.hdop, err = parseOptionalFloat(fields[16]); err != nil {
+		return err
+	}
+	if s.vdop, err = parseOptionalFloat(fields[17]); err != nil {
+		return err
+	}
+	return nil
+}
+
+// $GPGSV,numMsgs,msgNum,satsInView,...
+func (s *nmeaState) updateGSV(fields []string) error {
+	if len(fields) < 4 {
+		return errors.New("GSV sentence too short")
+	}
+	inView, err := parseOptionalInt(fields[3])
+	if err != nil {
+		return err
+	}
+	s.satellitesInView = inView
+	return nil
+}
+
+// fix returns the GPS fix from the NMEA state, ok is false if there is no valid fix.
+func (s *nmeaState) fix() (GPSFix, bool) {
+	if !s.valid {
+		return GPSFix{}, false
+	}
+	return GPSFix{
+		Latitude:         s.latitude,
+		Longitude:        s.longitude,
+		Altitude:         s.altitude,
+		Speed:            s.speed,
+		Course:           s.course,
+		UTCTime:          s.utcTime,
+		ReceivedAt:       s.fixUpdatedAt,
+		FixQuality:       s.fixQuality,
+		FixMode:          s.fixMode,
+		Satellites:       s.satellites,
+		SatellitesInView: s.satellitesInView,
+		PDOP:             s.pdop,
+		HDOP:             s.hdop,
+		VDOP:             s.vdop,
+	}, true
+}
+
+func parseOptionalInt(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
@@ -0,0 +1,156 @@
+package modemd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSplitNMEASentence(t *testing.T) {
+	tests := []struct {
+		sentence string
+		fields   int
+		valid    bool
+	}{
+		{"$GPGGA,092750.000,5321.6802,N,00630.3372,W,1,8,1.03,61.7,M,55.2,M,,*76", 15, true},
+		{"$GNRMC,021530.00,A,4112.345678,S,17446.123456,E,5.4,72.3,150625,,,A*60", 13, true},
+		{"$GNRMC,021530.00,A,4112.345678,S,17446.123456,E,5.4,72.3,150625,,,A*61", 0, false},
+		{"$GNRMC,021530.00,A,4112.345678,S,17446.123456,E,5.4,72.3,150626,,,A*60", 0, false},
+		{"$GPGGA,092750.000,5321.6802,N,00630.3372,W,1,8,1.03,61.7,M,55.2,M,,*ZZ", 0, false},
+		{"GPGGA,092750.000,5321.6802,N,00630.3372,W,1,8,1.03,61.7,M,55.2,M,,*76", 0, false},
+		// The checksum is optional.
+		{"$GPGSV,3,1,11,05,46,285,38", 8, true},
+	}
+	for _, tt := range tests {
+		fields, err := splitNMEASentence(tt.sentence)
+		if (err == nil) != tt.valid {
+			t.Errorf("splitNMEASentence(%q) got error %v, want valid %t", tt.sentence, err, tt.valid)
+			continue
+		}
+		if tt.valid && len(fields) != tt.fields {
+			t.Errorf("splitNMEASentence(%q) got %d fields, want %d", tt.sentence, len(fields), tt.fields)
+		}
+	}
+}
+
+func TestNMEAState(t *testing.T) {
+	r := newNMEAReader("")
+	sentences := []string{
+		"$GNGGA,021530.00,4112.345678,S,17446.123456,E,1,09,0.8,35.2,M,19.0,M,,*5D",
+		"$GNRMC,021530.00,A,4112.345678,S,17446.123456,E,5.4,72.3,150625,,,A*60",
+		"$GNGSA,A,3,05,13,15,18,20,23,24,,,,,,1.6,0.8,1.3*2E",
+		"$GPGSV,3,1,11,05,46,285,38,13,62,108,41,15,34,053,36,18,12,320,29*72",
+		"$GLGSV,2,1,07,65,32,210,30,72,18,088,,73,55,145,33,74,40,012,28*65",
+		// Other sentence types are ignored.
+		"$GPVTG,72.3,T,,M,5.4,N,10.0,K,A*0B",
+	}
+	for _, sentence := range sentences {
+		if err := r.handleSentence(sentence); err != nil {
+			t.Fatalf("handleSentence(%q): %v", sentence, err)
+		}
+	}
+	state := r.current()
+	fix, ok := state.fix()
+	if !ok {
+		t.Fatal("expected a fix")
+	}
+	floatTests := []struct {
+		name      string
+		got, want float64
+	}{
+		{"latitude", fix.Latitude, -(41 + 12.345678/60)},
+		{"longitude", fix.Longitude, 174 + 46.123456/60},
+		{"altitude", fix.Altitude, 35.2},
+		{"speed", fix.Speed, 5.4 * knotsToKmh},
+		{"course", fix.Course, 72.3},
+		{"pdop", fix.PDOP, 1.6},
+		{"hdop", fix.HDOP, 0.8},
+		{"vdop", fix.VDOP, 1.3},
+	}
+	for _, tt := range floatTests {
+		if math.Abs(tt.got-tt.want) > 1e-6 {
+			t.Errorf("got %s %f, want %f", tt.name, tt.got, tt.want)
+		}
+	}
+	if want := time.Date(2025, 6, 15, 2, 15, 30, 0, time.UTC); !fix.UTCTime.Equal(want) {
+		t.Errorf("got UTC time %s, want %s", fix.UTCTime, want)
+	}
+	if fix.FixQuality != 1 || fix.FixMode != 3 || fix.Satellites != 9 {
+		t.Errorf("got fix quality %d, mode %d, satellites %d, want 1, 3, 9", fix.FixQuality, fix.FixMode, fix.Satellites)
+	}
+	// The last GSV sentence was from GLONASS.
+	if fix.SatellitesInView != 7 {
+		t.Errorf("got %d satellites in view, want 7", fix.SatellitesInView)
+	}
+	if fix.ReceivedAt.IsZero() {
+		t.Error("fix has no received time")
+	}
+
+	// Losing the fix.
+	for _, sentence := range []string{
+		"$GPGGA,021531.00,,,,,0,00,99.99,,,,,,*62",
+		"$GPRMC,021531.00,V,,,,,,,150625,,,N*7C",
+	} {
+		if err := r.handleSentence(sentence); err != nil {
+			t.Fatalf("handleSentence(%q): %v", sentence, err)
+		}
+	}
+	state = r.current()
+	if _, ok := state.fix(); ok {
+		t.Error("expected no fix after an invalid RMC sentence")
+	}
+	if state.fixQuality != 0 || state.satellites != 0 {
+		t.Errorf("got fix quality %d and %d satellites, want 0", state.fixQuality, state.satellites)
+	}
+}
+
+func TestNMEAStateInvalid(t *testing.T) {
+	tests := [][]string{
+		{"GP"},
+		{"GPGGA", "021530.00", "4112.345678", "S"},
+		{"GPGGA", "021530.00", "4112.345678", "S", "17446.123456", "E", "x", "09", "0.8", "35.2"},
+		{"GPRMC", "021530.00", "A", "411.3", "S", "17446.123456", "E", "5.4", "72.3", "150625"},
+		{"GPRMC", "021530.00", "A", "4112.345678", "S", "17446.123456", "E", "5.4", "72.3", "311325"},
+		{"GPGSA", "A", "3"},
+		{"GPGSV", "3", "1", "x"},
+	}
+	for _, fields := range tests {
+		var s nmeaState
+		if err := s.update(fields); err == nil {
+			t.Errorf("update(%q) expected an error", fields)
+		}
+		if !s.updatedAt.IsZero() || !s.fixUpdatedAt.IsZero() {
+			t.Errorf("update(%q) marked the state as updated", fields)
+		}
+	}
+}
+
+func TestNMEAFixFreshness(t *testing.T) {
+	r := newNMEAReader("")
+	if err := r.handleSentence("$GNRMC,021530.00,A,4112.345678,S,17446.123456,E,5.4,72.3,150625,,,A*60"); err != nil {
+		t.Fatal(err)
+	}
+	fixUpdatedAt := r.current().fixUpdatedAt
+	if fixUpdatedAt.IsZero() {
+		t.Fatal("RMC sentence didn't update the fix time")
+	}
+	time.Sleep(time.Millisecond)
+	for _, sentence := range []string{
+		"$GNGSA,A,3,05,13,15,18,20,23,24,,,,,,1.6,0.8,1.3*2E",
+		"$GPGSV,3,1,11,05,46,285,38,13,62,108,41,15,34,053,36,18,12,320,29*72",
+	} {
+		if err := r.handleSentence(sentence); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := r.current()
+	if !state.fixUpdatedAt.Equal(fixUpdatedAt) {
+		t.Error("GSA and GSV sentences made the fix look fresh")
+	}
+	if !state.updatedAt.After(fixUpdatedAt) {
+		t.Error("GSA and GSV sentences didn't update the NMEA time")
+	}
+	if fix, _ := state.fix(); !fix.ReceivedAt.Equal(fixUpdatedAt) {
+		t.Errorf("got fix received at %s, want %s", fix.ReceivedAt, fixUpdatedAt)
+	}
+}
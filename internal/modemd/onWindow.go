@@ -0,0 +1,262 @@
+package modemd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OnWindowConfig is a recurring window, read from the "modemd-windows" config section, in which the modem
+// is forced on or off. A window is either set by start/end times or by a cron expression and a duration.
+//
+// Start and end can be a local time "15:04", or relative to the sun "sunrise", "sunset+30m", "sunrise-1h".
+// Days is an optional list of weekdays ("mon", "tue"...) the window starts on, all days if empty.
+type OnWindowConfig struct {
+	Name     string        `mapstructure:"name"`
+	Mode     string        `mapstructure:"mode"` // "on" or "off"
+	Start    string        `mapstructure:"start"`
+	End      string        `mapstructure:"end"`
+	Days     []string      `mapstructure:"days"`
+	Cron     string        `mapstructure:"cron"`
+	Duration time.Duration `mapstructure:"duration"`
+}
+
+type OnWindow struct {
+	Name      string
+	On        bool
+	start     windowTime
+	end       windowTime
+	days      [7]bool
+	cron      *cronSchedule
+	duration  time.Duration
+	latitude  float64
+	longitude float64
+}
+
+// windowTime is either a time of day, or an offset from sunrise or sunset.
+type windowTime struct {
+	anchor string // "", "sunrise" or "sunset"
+	hour   int    // Time of day if there is no anchor.
+	minute int
+	offset time.Duration // Offset from the anchor.
+}
+
+type timeInterval struct {
+	start time.Time
+	end   time.Time
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseOnWindow(conf OnWindowConfig, latitude, longitude float64) (*OnWindow, error) {
+	w := &OnWindow{
+		Name:      conf.Name,
+		latitude:  latitude,
+		longitude: longitude,
+	}
+	switch strings.ToLower(conf.Mode) {
+	case "on", "":
+		w.On = true
+	case "off":
+		w.On = false
+	default:
+		return nil, fmt.Errorf("invalid mode '%s' for window '%s'", conf.Mode, conf.Name)
+	}
+
+	if conf.Cron != "" {
+		cron, err := parseCron(conf.Cron)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Duration <= 0 || conf.Duration > 24*time.Hour {
+			return nil, fmt.Errorf("window '%s' needs a duration between 0 and 24h when using cron", conf.Name)
+		}
+		w.cron = cron
+		w.duration = conf.Duration
+		return w, nil
+	}
+
+	var err error
+	if w.start, err = parseWindowTime(conf.Start); err != nil {
+		return nil, fmt.Errorf("invalid start for window '%s': %v", conf.Name, err)
+	}
+	if w.end, err = parseWindowTime(conf.End); err != nil {
+		return nil, fmt.Errorf("invalid end for window '%s': %v", conf.Name, err)
+	}
+	if len(conf.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, day := range conf.Days {
+		dayPrefix := strings.ToLower(strings.TrimSpace(day))
+		if len(dayPrefix) > 3 {
+			dayPrefix = dayPrefix[:3]
+		}
+		weekday, ok := weekdays[dayPrefix]
+		if !ok {
+			return nil, fmt.Errorf("invalid day '%s' for window '%s'", day, conf.Name)
+		}
+		w.days[weekday] = true
+	}
+	return w, nil
+}
+
+func parseWindowTime(s string) (windowTime, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, anchor := range []string{"sunrise", "sunset"} {
+		if !strings.HasPrefix(s, anchor) {
+			continue
+		}
+		wt := windowTime{anchor: anchor}
+		if offset := strings.TrimPrefix(s, anchor); offset != "" {
+			var err error
+			if wt.offset, err = time.ParseDuration(offset); err != nil {
+				return windowTime{}, err
+			}
+		}
+		return wt, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return windowTime{}, fmt.Errorf("could not parse '%s' as a time or sun relative time", s)
+	}
+	return windowTime{hour: t.Hour(), minute: t.Minute()}, nil
+}
+
+// on returns the time for the given day. ok is false if there is no sunrise/sunset on that day.
+func (wt windowTime) on(day time.Time, latitude, longitude float64) (t time.Time, ok bool) {
+	y, m, d := day.Date()
+	if wt.anchor == "" {
+		// Using time.Date so the time of day is kept through daylight saving changes.
+		return time.Date(y, m, d, wt.hour, wt.minute, 0, 0, day.Location()), true
+	}
+	sunrise, sunset, ok := sunriseSunset(day, latitude, longitude)
+	if !ok {
+		return time.Time{}, false
+	}
+	if wt.anchor == "sunrise" {
+		return sunrise.Add(wt.offset), true
+	}
+	return sunset.Add(wt.offset), true
+}
+
+// intervalsStartingOn returns the intervals of the window that start on the given day.
+func (w *OnWindow) intervalsStartingOn(day time.Time) []timeInterval {
+	if w.cron != nil {
+		var intervals []timeInterval
+		for _, start := range w.cron.startsOnDay(day) {
+			intervals = append(intervals, timeInterval{start, start.Add(w.duration)})
+		}
+		return intervals
+	}
+
+	if !w.days[day.Weekday()] {
+		return nil
+	}
+	start, ok := w.start.on(day, w.latitude, w.longitude)
+	if !ok {
+		return nil
+	}
+	end, ok := w.end.on(day, w.latitude, w.longitude)
+	if !ok {
+		return nil
+	}
+	if !end.After(start) {
+		// Window goes past midnight.
+		y, m, d := day.Date()
+		end, ok = w.end.on(time.Date(y, m, d+1, 0, 0, 0, 0, day.Location()), w.latitude, w.longitude)
+		if !ok {
+			return nil
+		}
+	}
+	return []timeInterval{{start, end}}
+}
+
+// intervalsAround returns the window intervals starting from the day before t until the given number of days after t.
+func (w *OnWindow) intervalsAround(t time.Time, daysAfter int) []timeInterval {
+	y, m, d := t.Date()
+	var intervals []timeInterval
+	for i := -1; i <= daysAfter; i++ {
+		intervals = append(intervals, w.intervalsStartingOn(time.Date(y, m, d+i, 0, 0, 0, 0, t.Location()))...)
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start.Before(intervals[j].start) })
+	return intervals
+}
+
+// activeAt returns if the window is active at the given time, and if so the interval that is active.
+// If intervals overlap the returned interval covers all of them.
+func (w *OnWindow) activeAt(t time.Time) (bool, timeInterval) {
+	active := false
+	activeInterval := timeInterval{}
+	for _, interval := range w.intervalsAround(t, 0) {
+		if !t.Before(interval.start) && t.Before(interval.end) {
+			if !active || interval.start.Before(activeInterval.start) {
+				activeInterval.start = interval.start
+			}
+			if interval.end.After(activeInterval.end) {
+				activeInterval.end = interval.end
+			}
+			active = true
+		}
+	}
+	return active, activeInterval
+}
+
+// nextBoundary returns the next time after t that the window will start or end.
+func (w *OnWindow) nextBoundary(t time.Time) (time.Time, bool) {
+	if active, interval := w.activeAt(t); active {
+		return interval.end, true
+	}
+	for _, interval := range w.intervalsAround(t, 8) {
+		if interval.start.After(t) {
+			return interval.start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (w *OnWindow) modeStr() string {
+	if w.On {
+		return "on"
+	}
+	return "off"
+}
+
+// activeWindow returns the window that is currently active, an active off window has priority over an on window.
+func (mc *ModemController) activeWindow(now time.Time) (*OnWindow, timeInterval) {
+	var active *OnWindow
+	var activeInterval timeInterval
+	for _, w := range mc.OnWindows {
+		isActive, interval := w.activeAt(now)
+		if !isActive {
+			continue
+		}
+		if active == nil || (active.On && !w.On) {
+			active = w
+			activeInterval = interval
+		}
+	}
+	return active, activeInterval
+}
+
+// nextWindowBoundary returns the window that will next start or end after now.
+func (mc *ModemController) nextWindowBoundary(now time.Time) (*OnWindow, time.Time) {
+	var next *OnWindow
+	var nextTime time.Time
+	for _, w := range mc.OnWindows {
+		t, ok := w.nextBoundary(now)
+		if ok && (next == nil || t.Before(nextTime)) {
+			next = w
+			nextTime = t
+		}
+	}
+	return next, nextTime
+}
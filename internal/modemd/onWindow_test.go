@@ -0,0 +1,162 @@
+package modemd
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustParseOnWindow(t *testing.T, conf OnWindowConfig) *OnWindow {
+	t.Helper()
+	w, err := parseOnWindow(conf, -36.85, 174.76)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func auckland(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestActiveWindowAcrossMidnight(t *testing.T) {
+	night := mustParseOnWindow(t, OnWindowConfig{Name: "night", Mode: "off", Start: "22:00", End: "06:00"})
+	morning := mustParseOnWindow(t, OnWindowConfig{Name: "morning", Mode: "on", Start: "05:00", End: "08:00"})
+	mc := &ModemController{OnWindows: []*OnWindow{night, morning}}
+	day := time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		at        time.Duration
+		want      *OnWindow
+		wantStart time.Duration
+		wantEnd   time.Duration
+	}{
+		{at: 21 * time.Hour},
+		{at: 23 * time.Hour, want: night, wantStart: 22 * time.Hour, wantEnd: 30 * time.Hour},
+		// Started the day before.
+		{at: 2 * time.Hour, want: night, wantStart: -2 * time.Hour, wantEnd: 6 * time.Hour},
+		// The off window has priority while they overlap.
+		{at: 5*time.Hour + 30*time.Minute, want: night, wantStart: -2 * time.Hour, wantEnd: 6 * time.Hour},
+		{at: 6 * time.Hour, want: morning, wantStart: 5 * time.Hour, wantEnd: 8 * time.Hour},
+		{at: 8 * time.Hour},
+	}
+	for _, tt := range tests {
+		w, interval := mc.activeWindow(day.Add(tt.at))
+		if w != tt.want {
+			t.Errorf("at %s got window %v, want %v", tt.at, w, tt.want)
+			continue
+		}
+		if w != nil && (!interval.start.Equal(day.Add(tt.wantStart)) || !interval.end.Equal(day.Add(tt.wantEnd))) {
+			t.Errorf("at %s got interval %s to %s", tt.at, interval.start, interval.end)
+		}
+	}
+}
+
+func TestNextWindowBoundary(t *testing.T) {
+	night := mustParseOnWindow(t, OnWindowConfig{Name: "night", Mode: "off", Start: "22:00", End: "06:00"})
+	weekly := mustParseOnWindow(t, OnWindowConfig{Name: "weekly", Start: "12:00", End: "13:00", Days: []string{"wednesday"}})
+	mc := &ModemController{OnWindows: []*OnWindow{night, weekly}}
+	// 2025-06-02 is a Monday.
+	day := time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		at   time.Duration
+		want *OnWindow
+		next time.Duration
+	}{
+		{at: 7 * time.Hour, want: night, next: 22 * time.Hour},
+		{at: 23 * time.Hour, want: night, next: 30 * time.Hour},
+		{at: 2 * 24 * time.Hour, want: night, next: 2*24*time.Hour + 6*time.Hour},
+		{at: 2*24*time.Hour + 7*time.Hour, want: weekly, next: 2*24*time.Hour + 12*time.Hour},
+		{at: 2*24*time.Hour + 12*time.Hour, want: weekly, next: 2*24*time.Hour + 13*time.Hour},
+	}
+	for _, tt := range tests {
+		w, next := mc.nextWindowBoundary(day.Add(tt.at))
+		if w != tt.want || !next.Equal(day.Add(tt.next)) {
+			t.Errorf("at %s got %v at %s, want %v at %s", tt.at, w, next, tt.want, day.Add(tt.next))
+		}
+	}
+
+	if w, _ := (&ModemController{}).nextWindowBoundary(day); w != nil {
+		t.Error("got a boundary without any windows")
+	}
+}
+
+func TestWindowDaylightSaving(t *testing.T) {
+	loc := auckland(t)
+	w := mustParseOnWindow(t, OnWindowConfig{Name: "morning", Start: "07:00", End: "09:00"})
+	overnight := mustParseOnWindow(t, OnWindowConfig{Name: "overnight", Start: "01:00", End: "05:00"})
+
+	// Daylight saving started at 02:00 on 2025-09-28 and ended at 03:00 on 2025-04-06.
+	for _, day := range []time.Time{
+		time.Date(2025, 9, 28, 0, 0, 0, 0, loc),
+		time.Date(2025, 4, 6, 0, 0, 0, 0, loc),
+	} {
+		intervals := w.intervalsStartingOn(day)
+		if len(intervals) != 1 {
+			t.Fatalf("got intervals %v", intervals)
+		}
+		start, end := intervals[0].start, intervals[0].end
+		if start.Hour() != 7 || start.Minute() != 0 || end.Hour() != 9 {
+			t.Errorf("%s: got %s to %s, want 07:00 to 09:00 local time", day.Format(time.DateOnly), start, end)
+		}
+		if end.Sub(start) != 2*time.Hour {
+			t.Errorf("%s: got length %s, want 2h", day.Format(time.DateOnly), end.Sub(start))
+		}
+	}
+
+	// The overnight window loses an hour when the clocks go forward and gains one when they go back.
+	for day, want := range map[time.Time]time.Duration{
+		time.Date(2025, 9, 28, 0, 0, 0, 0, loc): 3 * time.Hour,
+		time.Date(2025, 4, 6, 0, 0, 0, 0, loc):  5 * time.Hour,
+	} {
+		intervals := overnight.intervalsStartingOn(day)
+		if len(intervals) != 1 || intervals[0].end.Sub(intervals[0].start) != want {
+			t.Errorf("%s: got intervals %v, want one of %s", day.Format(time.DateOnly), intervals, want)
+		}
+	}
+
+	// The active window is found by wall clock time on the change day.
+	mc := &ModemController{OnWindows: []*OnWindow{w}}
+	at := time.Date(2025, 9, 28, 7, 30, 0, 0, loc)
+	if active, _ := mc.activeWindow(at); active != w {
+		t.Errorf("window not active at %s", at)
+	}
+	at = time.Date(2025, 9, 28, 6, 30, 0, 0, loc)
+	if active, _ := mc.activeWindow(at); active != nil {
+		t.Errorf("window active at %s", at)
+	}
+}
+
+func TestCronWindowDaylightSaving(t *testing.T) {
+	loc := auckland(t)
+	w := mustParseOnWindow(t, OnWindowConfig{Name: "cron", Cron: "0 7 * * *", Duration: time.Hour})
+	day := time.Date(2025, 9, 28, 0, 0, 0, 0, loc)
+	_, next := (&ModemController{OnWindows: []*OnWindow{w}}).nextWindowBoundary(day)
+	if want := time.Date(2025, 9, 28, 7, 0, 0, 0, loc); !next.Equal(want) {
+		t.Errorf("got next boundary %s, want %s", next, want)
+	}
+}
+
+func TestSunWindow(t *testing.T) {
+	loc := auckland(t)
+	w := mustParseOnWindow(t, OnWindowConfig{Name: "sun", Start: "sunrise-30m", End: "sunset+1h"})
+	day := time.Date(2025, 6, 21, 0, 0, 0, 0, loc)
+	intervals := w.intervalsStartingOn(day)
+	if len(intervals) != 1 {
+		t.Fatalf("got intervals %v", intervals)
+	}
+	// Auckland's midwinter sunrise is about 07:33 and sunset about 17:11.
+	start, end := intervals[0].start.In(loc), intervals[0].end.In(loc)
+	if want := time.Date(2025, 6, 21, 7, 3, 0, 0, loc); start.Sub(want).Abs() > 10*time.Minute {
+		t.Errorf("got start %s, want about %s", start, want)
+	}
+	if want := time.Date(2025, 6, 21, 18, 11, 0, 0, loc); end.Sub(want).Abs() > 10*time.Minute {
+		t.Errorf("got end %s, want about %s", end, want)
+	}
+}
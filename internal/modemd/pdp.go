@@ -0,0 +1,425 @@
+package modemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const PDPKey = "modemd-pdp"
+
+// PDP context types.
+const (
+	pdpTypeIPv4 = "IP"
+	pdpTypeIPv6 = "IPV6"
+	pdpTypeDual = "IPV4V6"
+)
+
+// Authentication types for AT+CGAUTH, by their index.
+var pdpAuthTypes = []string{"none", "pap", "chap"}
+
+// PDPConfig is read from the "modemd-pdp" config section.
+type PDPConfig struct {
+	DefaultType   string            `mapstructure:"default-type"`    // PDP type for APNs not in APNTypes, "IP", "IPV6" or "IPV4V6". Empty keeps the modem's type.
+	APNTypes      map[string]string `mapstructure:"apn-types"`       // PDP type for each APN.
+	IPv6TestHosts []string          `mapstructure:"ipv6-test-hosts"` // Pinged instead of the test hosts on IPv6 only connections, and after them on dual stack.
+	DefaultCID    int               `mapstructure:"default-cid"`     // Context used for the data connection, can be changed over D-Bus.
+	Contexts      []PDPContext      `mapstructure:"contexts"`        // Contexts set on the modem at startup.
+}
+
+// PDPContext is a PDP context on the modem. The username and password are never logged or sent over D-Bus.
+type PDPContext struct {
+	CID      int    `mapstructure:"cid"`
+	Type     string `mapstructure:"type"`
+	APN      string `mapstructure:"apn"`
+	Auth     string `mapstructure:"auth"` // "none", "pap" or "chap".
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+func (c PDPContext) ToDBusMap(defaultCID int) map[string]interface{} {
+	return map[string]interface{}{
+		"cid":            c.CID,
+		"type":           c.Type,
+		"apn":            c.APN,
+		"auth":           c.Auth,
+		"hasCredentials": c.hasCredentials(),
+		"default":        c.CID == defaultCID,
+	}
+}
+
+// hasCredentials is true when the context uses PAP or CHAP, which need a username and password, as the
+// credentials themselves can't be read back from the modem.
+func (c PDPContext) hasCredentials() bool {
+	authIndex, _ := pdpAuthIndex(c.Auth)
+	return authIndex != 0 || c.Username != "" || c.Password != ""
+}
+
+func DefaultPDPConfig() PDPConfig {
+	return PDPConfig{
+		APNTypes:      map[string]string{},
+		IPv6TestHosts: []string{"2001:4860:4860::8888", "2606:4700:4700::1111"},
+		DefaultCID:    1,
+	}
+}
+
+func (c PDPConfig) validate() error {
+	if c.DefaultType != "" {
+		if _, err := normalizePDPType(c.DefaultType); err != nil {
+			return err
+		}
+	}
+	for apn, pdpType := range c.APNTypes {
+		if _, err := normalizePDPType(pdpType); err != nil {
+			return fmt.Errorf("APN '%s': %w", apn, err)
+		}
+	}
+	if err := validateCID(c.DefaultCID); err != nil {
+		return err
+	}
+	for _, context := range c.Contexts {
+		if err := context.validate(); err != nil {
+			return fmt.Errorf("PDP context %d: %w", context.CID, err)
+		}
+	}
+	return nil
+}
+
+func (c PDPContext) validate() error {
+	if err := validateCID(c.CID); err != nil {
+		return err
+	}
+	if _, err := normalizePDPType(c.Type); err != nil {
+		return err
+	}
+	if _, err := pdpAuthIndex(c.Auth); err != nil {
+		return err
+	}
+	for _, value := range []string{c.APN, c.Username, c.Password} {
+		if strings.ContainsAny(value, "\"\r\n") {
+			return errors.New("APN, username and password can't contain quotes or new lines")
+		}
+	}
+	return nil
+}
+
+// validateCID checks the context ID is in the range supported by SIMCom modems.
+func validateCID(cid int) error {
+	if cid < 1 || cid > 24 {
+		return fmt.Errorf("invalid PDP context ID %d, should be 1 to 24", cid)
+	}
+	return nil
+}
+
+func pdpAuthIndex(auth string) (int, error) {
+	if auth == "" {
+		return 0, nil
+	}
+	for i, name := range pdpAuthTypes {
+		if strings.EqualFold(auth, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid authentication type '%s', should be none, pap or chap", auth)
+}
+
+func normalizePDPType(pdpType string) (string, error) {
+	switch t := strings.ToUpper(strings.TrimSpace(pdpType)); t {
+	case pdpTypeIPv4, pdpTypeIPv6, pdpTypeDual:
+		return t, nil
+	case "IPV4":
+		return pdpTypeIPv4, nil
+	}
+	return "", fmt.Errorf("invalid PDP type '%s', should be IP, IPV6 or IPV4V6", pdpType)
+}
+
+// typeForAPN returns the configured PDP type for the APN, or "" if no type is configured for it. Viper
+// lowercases map keys so the APN is matched ignoring case.
+func (c PDPConfig) typeForAPN(apn string) string {
+	for configAPN, pdpType := range c.APNTypes {
+		if strings.EqualFold(configAPN, apn) {
+			t, _ := normalizePDPType(pdpType)
+			return t
+		}
+	}
+	if c.DefaultType == "" {
+		return ""
+	}
+	t, _ := normalizePDPType(c.DefaultType)
+	return t
+}
+
+func pdpTypeHasIPv4(pdpType string) bool {
+	return pdpType == pdpTypeIPv4 || pdpType == pdpTypeDual
+}
+
+func pdpTypeHasIPv6(pdpType string) bool {
+	return pdpType == pdpTypeIPv6 || pdpType == pdpTypeDual
+}
+
+// listPDPContexts reads the contexts from "+CGDCONT: 1,"IPV4V6","apn","0.0.0.0",0,0,0,0" lines and their
+// authentication type from "+CGAUTH: 1,1" lines. The credentials can't be read back from the modem.
+func (mc *ModemController) listPDPContexts() ([]PDPContext, error) {
+	out, err := mc.RunATCommand("AT+CGDCONT?", 1000, 1)
+	if err != nil {
+		return nil, err
+	}
+	contexts := []PDPContext{}
+	for _, parts := range atResponseLines(out, "+CGDCONT:") {
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("invalid CGDCONT format %s", out)
+		}
+		cid, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid CGDCONT format %s", out)
+		}
+		contexts = append(contexts, PDPContext{CID: cid, Type: parts[1], APN: parts[2], Auth: pdpAuthTypes[0]})
+	}
+
+	out, err = mc.RunATCommand("AT+CGAUTH?", 1000, 1)
+	if err != nil {
+		log.Debugf("Failed to read PDP authentication: %v", err)
+		return contexts, nil
+	}
+	for _, parts := range atResponseLines(out, "+CGAUTH:") {
+		if len(parts) < 2 {
+			continue
+		}
+		cid, err1 := strconv.Atoi(parts[0])
+		auth, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil || auth < 0 || auth >= len(pdpAuthTypes) {
+			continue
+		}
+		for i := range contexts {
+			if contexts[i].CID == cid {
+				contexts[i].Auth = pdpAuthTypes[auth]
+			}
+		}
+	}
+	return contexts, nil
+}
+
+// atResponseLines returns the comma separated values, without quotes, of each line with the prefix.
+func atResponseLines(out, prefix string) [][]string {
+	lines := [][]string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, prefix)), ",")
+		for i := range parts {
+			parts[i] = strings.Trim(strings.TrimSpace(parts[i]), "\"")
+		}
+		lines = append(lines, parts)
+	}
+	return lines
+}
+
+func (mc *ModemController) getPDPContext(cid int) (PDPContext, error) {
+	contexts, err := mc.listPDPContexts()
+	if err != nil {
+		return PDPContext{}, err
+	}
+	for _, context := range contexts {
+		if context.CID == cid {
+			return context, nil
+		}
+	}
+	return PDPContext{}, fmt.Errorf("PDP context %d is not defined", cid)
+}
+
+// defaultCID is the context used for the data connection.
+func (mc *ModemController) defaultCID() int {
+	if mc.defaultPDPCID != 0 {
+		return mc.defaultPDPCID
+	}
+	return mc.PDP.DefaultCID
+}
+
+func (mc *ModemController) setDefaultPDPContext(cid int) error {
+	if _, err := mc.getPDPContext(cid); err != nil {
+		return err
+	}
+	mc.defaultPDPCID = cid
+	if err := mc.saveState(); err != nil {
+		log.Errorf("Failed to save modem state: %v", err)
+	}
+	return mc.ensurePDPType()
+}
+
+// definePDPContext creates or changes a context. The authentication is set if context.Auth is not "".
+func (mc *ModemController) definePDPContext(context PDPContext) error {
+	if err := context.validate(); err != nil {
+		return err
+	}
+	context.Type, _ = normalizePDPType(context.Type)
+	_, err := mc.RunATCommand(fmt.Sprintf("AT+CGDCONT=%d,\"%s\",\"%s\"", context.CID, context.Type, context.APN), 1000, 1)
+	if err != nil {
+		return err
+	}
+	if context.Auth != "" {
+		if err := mc.setPDPAuth(context.CID, context.Auth, context.Username, context.Password); err != nil {
+			return err
+		}
+	}
+	read, err := mc.getPDPContext(context.CID)
+	if err != nil {
+		return err
+	}
+	if read.APN != context.APN || read.Type != context.Type {
+		return fmt.Errorf("failed to set PDP context %d, it is '%s' %s when it was set as '%s' %s", context.CID, read.APN, read.Type, context.APN, context.Type)
+	}
+	if context.CID == mc.defaultCID() {
+		mc.Modem.PDPType = context.Type
+	}
+	return nil
+}
+
+// setPDPAuth sets the authentication with SIMCom's parameter order, AT+CGAUTH=<cid>,<type>,"<password>","<user>".
+func (mc *ModemController) setPDPAuth(cid int, auth, username, password string) error {
+	context := PDPContext{CID: cid, Type: pdpTypeIPv4, Auth: auth, Username: username, Password: password}
+	if err := context.validate(); err != nil {
+		return err
+	}
+	authIndex, _ := pdpAuthIndex(auth)
+	cmd := fmt.Sprintf("AT+CGAUTH=%d,%d", cid, authIndex)
+	if authIndex != 0 {
+		cmd += fmt.Sprintf(",\"%s\",\"%s\"", password, username)
+	}
+	_, err := mc.RunATCommand(cmd, 1000, 1)
+	return err
+}
+
+func (mc *ModemController) deletePDPContext(cid int) error {
+	if cid == mc.defaultCID() {
+		return fmt.Errorf("can't delete PDP context %d as it is the default context", cid)
+	}
+	if err := validateCID(cid); err != nil {
+		return err
+	}
+	_, err := mc.RunATCommand(fmt.Sprintf("AT+CGDCONT=%d", cid), 1000, 1)
+	return err
+}
+
+// setPDPContext sets the APN and PDP type of the default context, keeping its authentication.
+func (mc *ModemController) setPDPContext(apn, pdpType string) error {
+	return mc.definePDPContext(PDPContext{CID: mc.defaultCID(), Type: pdpType, APN: apn})
+}
+
+// setupPDPContexts sets the contexts from the config then makes sure the default context has the
+// PDP type configured for its APN.
+func (mc *ModemController) setupPDPContexts() error {
+	for _, context := range mc.PDP.Contexts {
+		if context.Auth == "" {
+			context.Auth = pdpAuthTypes[0]
+		}
+		log.Infof("Setting PDP context %d to '%s' %s with %s authentication.", context.CID, context.APN, context.Type, context.Auth)
+		if err := mc.definePDPContext(context); err != nil {
+			return err
+		}
+	}
+	return mc.ensurePDPType()
+}
+
+// ensurePDPType changes the PDP type of the default context if it is not the type configured for its APN.
+// The modem's type is kept when no type is configured.
+func (mc *ModemController) ensurePDPType() error {
+	context, err := mc.getPDPContext(mc.defaultCID())
+	if err != nil {
+		return err
+	}
+	want := mc.PDP.typeForAPN(context.APN)
+	for _, configured := range mc.PDP.Contexts {
+		if configured.CID == context.CID {
+			want, _ = normalizePDPType(configured.Type)
+		}
+	}
+	if want == "" || context.Type == want {
+		mc.Modem.PDPType = context.Type
+		return nil
+	}
+	log.Infof("Changing PDP type for APN '%s' from %s to %s.", context.APN, context.Type, want)
+	context.Type = want
+	context.Auth = ""
+	return mc.definePDPContext(context)
+}
+
+// testHosts returns the hosts to ping for the PDP type.
+func (mc *ModemController) testHosts() []string {
+	pdpType := pdpTypeIPv4
+	if mc.Modem != nil && mc.Modem.PDPType != "" {
+		pdpType = mc.Modem.PDPType
+	}
+	switch pdpType {
+	case pdpTypeIPv6:
+		return mc.PDP.IPv6TestHosts
+	case pdpTypeDual:
+		return append(append([]string{}, mc.TestHosts...), mc.PDP.IPv6TestHosts...)
+	}
+	return mc.TestHosts
+}
+
+// networkReady checks the interface has the addresses needed for the PDP type. An IPv6 connection needs a
+// global address, which comes from a router advertisement. Dual stack, or unknown, connections need either.
+func networkReady(netdev, pdpType string) (bool, string, error) {
+	iface, err := net.InterfaceByName(netdev)
+	if err != nil {
+		return false, "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false, "", err
+	}
+	hasIPv4, hasIPv6 := false, false
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			hasIPv4 = true
+		} else if ipNet.IP.IsGlobalUnicast() {
+			hasIPv6 = true
+		}
+	}
+	switch {
+	case pdpType == pdpTypeIPv6 && !hasIPv6:
+		return false, "no global IPv6 address, waiting for a router advertisement", nil
+	case pdpType == pdpTypeIPv4 && !hasIPv4:
+		return false, "no IPv4 address", nil
+	case !hasIPv4 && !hasIPv6:
+		return false, "no IPv4 or global IPv6 address", nil
+	}
+	return true, fmt.Sprintf("IPv4: %t, IPv6: %t", hasIPv4, hasIPv6), nil
+}
+
+// enableIPv6 makes sure the kernel has IPv6 enabled on the interface and accepts router advertisements,
+// which are needed to get an address on IPv6 connections.
+func enableIPv6(netdev string) error {
+	dir := filepath.Join("/proc/sys/net/ipv6/conf", netdev)
+	settings := []struct{ name, value string }{
+		{"disable_ipv6", "0"},
+		{"accept_ra", "1"},
+	}
+	for _, setting := range settings {
+		path := filepath.Join(dir, setting.name)
+		current, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// accept_ra of 2 also accepts router advertisements, when forwarding is enabled.
+		if value := strings.TrimSpace(string(current)); value == setting.value || (setting.name == "accept_ra" && value == "2") {
+			continue
+		}
+		log.Infof("Setting %s to %s for '%s'.", setting.name, setting.value, netdev)
+		if err := os.WriteFile(path, []byte(setting.value), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
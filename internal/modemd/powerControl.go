@@ -0,0 +1,242 @@
+package modemd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/modemd/gpiod"
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpioreg"
+)
+
+// Power control backends.
+const (
+	powerGPIO      = "gpio"      // GPIO through periph.
+	powerGPIOD     = "gpiod"     // GPIO through the /dev/gpiochip* character device.
+	powerNone      = "none"      // For boards where the modem is always powered.
+	powerSimulated = "simulated" // Keeps the pin states in memory, for trying modemd without the hardware.
+)
+
+// PowerControlConfig sets how the modem is powered on and off. Empty fields are taken from the board profile.
+type PowerControlConfig struct {
+	Backend      string        `mapstructure:"backend"`       // "gpio", "gpiod", "none" or "simulated".
+	Chip         string        `mapstructure:"chip"`          // For "gpiod", e.g "/dev/gpiochip0".
+	EnablePin    PinConfig     `mapstructure:"enable-pin"`    // Turns the modem on, it shuts down when this goes off.
+	SupplyPin    PinConfig     `mapstructure:"supply-pin"`    // Switches the modem's power supply.
+	SupplyDelay  time.Duration `mapstructure:"supply-delay"`  // From turning on the enable pin to turning on the supply.
+	ShutdownWait time.Duration `mapstructure:"shutdown-wait"` // For the modem to shut down before its supply is cut.
+}
+
+// PinConfig is a GPIO pin. A pin is set as a whole, so a pin in the config replaces the board profile's.
+type PinConfig struct {
+	Name      string `mapstructure:"name"` // e.g "GPIO22". For "gpiod" also a line offset or name.
+	ActiveLow bool   `mapstructure:"active-low"`
+}
+
+// withDefaults fills in the config from the board profile. The modem power pin from the "gpio" config
+// section is used as the enable pin for periph when no enable pin is set here.
+func (c PowerControlConfig) withDefaults(profile PowerControlConfig, modemPowerPin string) PowerControlConfig {
+	if c.Backend == "" {
+		c.Backend = profile.Backend
+	}
+	if c.Chip == "" {
+		c.Chip = profile.Chip
+	}
+	if c.EnablePin.Name == "" && c.Backend == powerGPIO && modemPowerPin != "" {
+		c.EnablePin = PinConfig{Name: modemPowerPin}
+	}
+	if c.EnablePin.Name == "" {
+		c.EnablePin = profile.EnablePin
+	}
+	if c.SupplyPin.Name == "" {
+		c.SupplyPin = profile.SupplyPin
+	}
+	if c.SupplyDelay == 0 {
+		c.SupplyDelay = profile.SupplyDelay
+	}
+	if c.ShutdownWait == 0 {
+		c.ShutdownWait = profile.ShutdownWait
+	}
+	return c
+}
+
+func (c PowerControlConfig) validate() error {
+	switch c.Backend {
+	case powerGPIO, powerSimulated:
+	case powerGPIOD:
+		if c.Chip == "" {
+			return fmt.Errorf("power control backend '%s' needs the GPIO chip", c.Backend)
+		}
+	case powerNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid power control backend '%s'", c.Backend)
+	}
+	if c.EnablePin.Name == "" && c.SupplyPin.Name == "" {
+		return fmt.Errorf("power control backend '%s' needs an enable or supply pin", c.Backend)
+	}
+	return nil
+}
+
+// powerPin drives a pin, on is the pin's active level.
+type powerPin interface {
+	Set(on bool) error
+}
+
+type periphPin struct {
+	pin       gpio.PinIO
+	activeLow bool
+}
+
+func (p *periphPin) Set(on bool) error {
+	return p.pin.Out(gpio.Level(on != p.activeLow))
+}
+
+// gpiodPin requests its line when it is first set, so the line starts at that value.
+type gpiodPin struct {
+	chip      *gpiod.Chip
+	offset    int
+	activeLow bool
+	line      *gpiod.Line
+}
+
+func (p *gpiodPin) Set(on bool) error {
+	if p.line != nil {
+		return p.line.Set(on)
+	}
+	line, err := p.chip.RequestOutput(p.offset, p.activeLow, on)
+	if err != nil {
+		return err
+	}
+	p.line = line
+	return nil
+}
+
+type simulatedPin struct {
+	name string
+}
+
+func (p *simulatedPin) Set(on bool) error {
+	log.Infof("Simulated pin '%s' set to %t.", p.name, on)
+	return nil
+}
+
+// PowerControl switches the modem's power with its enable and supply pins.
+type PowerControl struct {
+	PowerControlConfig
+
+	mu       sync.Mutex
+	enable   powerPin // nil if the board doesn't have the pin.
+	supply   powerPin
+	enableOn bool
+	supplyOn bool
+}
+
+func NewPowerControl(conf PowerControlConfig) (*PowerControl, error) {
+	p := &PowerControl{PowerControlConfig: conf}
+	var chip *gpiod.Chip
+	if conf.Backend == powerGPIOD {
+		var err error
+		if chip, err = gpiod.Open(conf.Chip); err != nil {
+			return nil, err
+		}
+	}
+	openPin := func(pin PinConfig) (powerPin, error) {
+		if pin.Name == "" || conf.Backend == powerNone {
+			return nil, nil
+		}
+		switch conf.Backend {
+		case powerGPIO:
+			p := gpioreg.ByName(pin.Name)
+			if p == nil {
+				return nil, fmt.Errorf("failed to init %s pin", pin.Name)
+			}
+			return &periphPin{pin: p, activeLow: pin.ActiveLow}, nil
+		case powerGPIOD:
+			offset, err := chip.LineOffset(pin.Name)
+			if err != nil {
+				return nil, err
+			}
+			return &gpiodPin{chip: chip, offset: offset, activeLow: pin.ActiveLow}, nil
+		}
+		return &simulatedPin{name: pin.Name}, nil
+	}
+	var err error
+	if p.enable, err = openPin(conf.EnablePin); err != nil {
+		return nil, err
+	}
+	if p.supply, err = openPin(conf.SupplyPin); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// canSwitch is false when the modem is always powered.
+func (p *PowerControl) canSwitch() bool {
+	return p.Backend != powerNone
+}
+
+// On turns on the enable pin then the supply.
+func (p *PowerControl) On() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.set(p.enable, &p.enableOn, true); err != nil {
+		return fmt.Errorf("failed to set modem power pin high: %v", err)
+	}
+	if p.enable != nil && p.supply != nil {
+		time.Sleep(p.SupplyDelay)
+	}
+	if err := p.set(p.supply, &p.supplyOn, true); err != nil {
+		return fmt.Errorf("failed to enable power for the modem: %v", err)
+	}
+	return nil
+}
+
+// Shutdown turns off the enable pin, which has the modem shut down.
+func (p *PowerControl) Shutdown() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.set(p.enable, &p.enableOn, false); err != nil {
+		return fmt.Errorf("failed to set modem power pin low: %v", err)
+	}
+	return nil
+}
+
+// CutSupply turns off the modem's power supply.
+func (p *PowerControl) CutSupply() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.set(p.supply, &p.supplyOn, false); err != nil {
+		return fmt.Errorf("failed to disable power for the modem: %v", err)
+	}
+	return nil
+}
+
+func (p *PowerControl) set(pin powerPin, state *bool, on bool) error {
+	if pin == nil {
+		return nil
+	}
+	if err := pin.Set(on); err != nil {
+		return err
+	}
+	*state = on
+	return nil
+}
+
+func (p *PowerControl) Status() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := map[string]interface{}{
+		"backend": p.Backend,
+	}
+	if p.enable != nil {
+		status["enablePin"] = p.EnablePin.Name
+		status["enableOn"] = p.enableOn
+	}
+	if p.supply != nil {
+		status["supplyPin"] = p.SupplyPin.Name
+		status["supplyOn"] = p.supplyOn
+	}
+	return status
+}
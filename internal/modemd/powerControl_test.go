@@ -0,0 +1,143 @@
+package modemd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPowerControlSimulated(t *testing.T) {
+	p, err := NewPowerControl(PowerControlConfig{
+		Backend:   powerSimulated,
+		EnablePin: PinConfig{Name: "GPIO22"},
+		SupplyPin: PinConfig{Name: "GPIO20"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPins := func(step string, enableOn, supplyOn bool) {
+		t.Helper()
+		status := p.Status()
+		if status["enableOn"] != enableOn || status["supplyOn"] != supplyOn {
+			t.Errorf("after %s got enable %v supply %v, want %t %t", step, status["enableOn"], status["supplyOn"], enableOn, supplyOn)
+		}
+	}
+	checkPins("start", false, false)
+	if err := p.On(); err != nil {
+		t.Fatal(err)
+	}
+	checkPins("On", true, true)
+	if err := p.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	checkPins("Shutdown", false, true)
+	if err := p.CutSupply(); err != nil {
+		t.Fatal(err)
+	}
+	checkPins("CutSupply", false, false)
+}
+
+func TestPowerControlMissingPin(t *testing.T) {
+	// Boards with only a supply pin are powered by it alone.
+	p, err := NewPowerControl(PowerControlConfig{Backend: powerSimulated, SupplyPin: PinConfig{Name: "GPIO20"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.On(); err != nil {
+		t.Fatal(err)
+	}
+	status := p.Status()
+	if _, ok := status["enableOn"]; ok {
+		t.Error("status has an enable pin the board doesn't have")
+	}
+	if status["supplyOn"] != true {
+		t.Errorf("got supply %v after On, want true", status["supplyOn"])
+	}
+}
+
+func TestPowerControlNone(t *testing.T) {
+	p, err := NewPowerControl(PowerControlConfig{Backend: powerNone, EnablePin: PinConfig{Name: "GPIO22"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.canSwitch() {
+		t.Error("modem that is always powered can be switched")
+	}
+	if err := p.On(); err != nil {
+		t.Fatal(err)
+	}
+	if status := p.Status(); len(status) != 1 {
+		t.Errorf("got status %v, want only the backend", status)
+	}
+}
+
+func TestPowerControlWithDefaults(t *testing.T) {
+	tests := []struct {
+		name          string
+		conf          PowerControlConfig
+		modemPowerPin string
+		wantEnable    string
+		wantBackend   string
+	}{
+		{"profile", PowerControlConfig{}, "", "GPIO22", powerGPIO},
+		{"gpio section pin", PowerControlConfig{}, "GPIO5", "GPIO5", powerGPIO},
+		{"config pin", PowerControlConfig{EnablePin: PinConfig{Name: "GPIO6"}}, "GPIO5", "GPIO6", powerGPIO},
+		// The gpio section's pin is a periph pin name, so isn't used by the other backends.
+		{"gpiod ignores gpio section pin", PowerControlConfig{Backend: powerGPIOD}, "GPIO5", "GPIO22", powerGPIOD},
+		{"simulated ignores gpio section pin", PowerControlConfig{Backend: powerSimulated}, "GPIO5", "GPIO22", powerSimulated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.conf.withDefaults(piModemPower, tt.modemPowerPin)
+			if got.Backend != tt.wantBackend || got.EnablePin.Name != tt.wantEnable {
+				t.Errorf("got backend '%s' enable pin '%s', want '%s' '%s'", got.Backend, got.EnablePin.Name, tt.wantBackend, tt.wantEnable)
+			}
+			if got.SupplyPin != piModemPower.SupplyPin || got.Chip != piModemPower.Chip || got.ShutdownWait != piModemPower.ShutdownWait {
+				t.Errorf("profile defaults not used, got %+v", got)
+			}
+		})
+	}
+
+	conf := PowerControlConfig{SupplyPin: PinConfig{Name: "GPIO21", ActiveLow: true}, ShutdownWait: time.Minute}
+	got := conf.withDefaults(piModemPower, "")
+	if got.SupplyPin != conf.SupplyPin || got.ShutdownWait != time.Minute {
+		t.Errorf("config not kept over the profile, got %+v", got)
+	}
+}
+
+func TestPowerControlValidate(t *testing.T) {
+	tests := []struct {
+		conf  PowerControlConfig
+		valid bool
+	}{
+		{piModemPower, true},
+		{PowerControlConfig{Backend: powerNone}, true},
+		{PowerControlConfig{Backend: powerSimulated, SupplyPin: PinConfig{Name: "GPIO20"}}, true},
+		{PowerControlConfig{Backend: powerSimulated}, false},
+		{PowerControlConfig{Backend: powerGPIOD, EnablePin: PinConfig{Name: "GPIO22"}}, false},
+		{PowerControlConfig{Backend: powerGPIOD, Chip: "/dev/gpiochip0", EnablePin: PinConfig{Name: "GPIO22"}}, true},
+		{PowerControlConfig{Backend: "relay", EnablePin: PinConfig{Name: "GPIO22"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.conf.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate(%+v) got error %v, want valid %t", tt.conf, err, tt.valid)
+		}
+	}
+}
+
+func TestBoardResolve(t *testing.T) {
+	conf := BoardConfig{Profile: boardPi4, Power: PowerControlConfig{Backend: powerSimulated}}
+	got, err := conf.resolve("GPIO5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Power.Backend != powerSimulated || got.Power.EnablePin.Name != "GPIO22" {
+		t.Errorf("got power %+v, want the simulated backend with the profile's pins", got.Power)
+	}
+	if got.USBPower.Backend != usbPowerHub || got.USBPower.Hub != "1-1" || len(got.USBPower.ExtraHubs) != 1 {
+		t.Errorf("got USB power %+v, want the Pi 4 profile", got.USBPower)
+	}
+
+	if _, err := (BoardConfig{Profile: "pi5"}).resolve(""); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
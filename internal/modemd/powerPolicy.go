@@ -0,0 +1,244 @@
+package modemd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+const PowerPolicyKey = "modemd-power-policy"
+
+// powerPolicyDBusTimeout is how long to wait for the battery voltage over D-Bus, it is read while deciding if
+// the modem should be on so mustn't hang.
+const powerPolicyDBusTimeout = 5 * time.Second
+
+// PowerPolicyConfig is read from the "modemd-power-policy" config section.
+// Thresholds are in volts, a threshold of 0 disables that part of the policy.
+type PowerPolicyConfig struct {
+	Source                  string        `mapstructure:"source"`      // "modem", "sysfs" or "dbus"
+	SysfsPath               string        `mapstructure:"sysfs-path"`  // e.g. /sys/class/power_supply/battery/voltage_now
+	SysfsScale              float64       `mapstructure:"sysfs-scale"` // Multiplier to convert the sysfs value to volts.
+	DBusDest                string        `mapstructure:"dbus-dest"`   // The D-Bus method needs to return the voltage as a float64.
+	DBusPath                string        `mapstructure:"dbus-path"`
+	DBusMethod              string        `mapstructure:"dbus-method"`
+	ReadInterval            time.Duration `mapstructure:"read-interval"`
+	MaxReadingAge           time.Duration `mapstructure:"max-reading-age"`
+	Hysteresis              float64       `mapstructure:"hysteresis"`
+	DeferBelow              float64       `mapstructure:"defer-below"`   // Optional connections are deferred below this voltage.
+	ShortenBelow            float64       `mapstructure:"shorten-below"` // On windows are shortened below this voltage.
+	ShortenedWindowDuration time.Duration `mapstructure:"shortened-window-duration"`
+	CutoffBelow             float64       `mapstructure:"cutoff-below"` // The modem won't be powered below this voltage.
+}
+
+func DefaultPowerPolicyConfig() PowerPolicyConfig {
+	return PowerPolicyConfig{
+		Source:                  "modem",
+		SysfsScale:              0.000001,
+		ReadInterval:            time.Minute,
+		MaxReadingAge:           time.Hour,
+		Hysteresis:              0.1,
+		ShortenedWindowDuration: 10 * time.Minute,
+	}
+}
+
+// validate checks the thresholds that are set go up from the cutoff, otherwise levels would be skipped.
+func (c PowerPolicyConfig) validate() error {
+	thresholds := []struct {
+		name  string
+		value float64
+	}{
+		{"cutoff-below", c.CutoffBelow},
+		{"defer-below", c.DeferBelow},
+		{"shorten-below", c.ShortenBelow},
+	}
+	lower := -1
+	for i, t := range thresholds {
+		if t.value < 0 {
+			return fmt.Errorf("power policy %s can't be negative", t.name)
+		}
+		if t.value == 0 {
+			continue
+		}
+		if lower >= 0 && t.value <= thresholds[lower].value {
+			return fmt.Errorf("power policy %s of %.2fV should be above %s of %.2fV", t.name, t.value, thresholds[lower].name, thresholds[lower].value)
+		}
+		lower = i
+	}
+	return nil
+}
+
+type powerLevel int
+
+const (
+	powerLevelNormal powerLevel = iota
+	powerLevelShorten
+	powerLevelDefer
+	powerLevelCutoff
+)
+
+func (l powerLevel) String() string {
+	switch l {
+	case powerLevelShorten:
+		return "shorten-windows"
+	case powerLevelDefer:
+		return "defer-optional"
+	case powerLevelCutoff:
+		return "cutoff"
+	}
+	return "normal"
+}
+
+type PowerPolicy struct {
+	PowerPolicyConfig
+
+	mu          sync.Mutex // update is called from the modem loop while status is read over D-Bus.
+	voltage     float64
+	readingTime time.Time
+	lastRead    time.Time
+	level       powerLevel
+}
+
+func NewPowerPolicy(conf PowerPolicyConfig) *PowerPolicy {
+	return &PowerPolicy{PowerPolicyConfig: conf}
+}
+
+func (pp *PowerPolicy) enabled() bool {
+	return pp != nil && (pp.DeferBelow > 0 || pp.ShortenBelow > 0 || pp.CutoffBelow > 0)
+}
+
+// update will read the battery voltage if the last reading is older than ReadInterval and update the power level.
+// The voltage is read without the lock held as it can take a while.
+func (pp *PowerPolicy) update(mc *ModemController) {
+	if !pp.enabled() {
+		return
+	}
+	pp.mu.Lock()
+	if time.Since(pp.lastRead) < pp.ReadInterval {
+		pp.mu.Unlock()
+		return
+	}
+	pp.lastRead = time.Now()
+	pp.mu.Unlock()
+	voltage, err := pp.readVoltage(mc)
+
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if err != nil {
+		log.Debugf("Failed to read battery voltage: %v", err)
+	} else {
+		pp.voltage = voltage
+		pp.readingTime = time.Now()
+	}
+
+	if pp.readingTime.IsZero() {
+		// Without any reading we can't make a decision so don't restrict the modem.
+		pp.level = powerLevelNormal
+		return
+	}
+	if !pp.hasReading() {
+		// Keep the last level until there is a fresh reading. With the "modem" source there are no readings while
+		// the modem is off, so going back to normal would power it on just to find the battery is still low.
+		return
+	}
+	newLevel := pp.levelFor(pp.voltage)
+	if newLevel < pp.level {
+		// Voltage needs to rise above the threshold plus the hysteresis before the level is lowered.
+		newLevel = min(pp.level, pp.levelFor(pp.voltage-pp.Hysteresis))
+	}
+	if newLevel != pp.level {
+		log.Infof("Battery power level changed from '%s' to '%s', voltage: %.2fV", pp.level, newLevel, pp.voltage)
+	}
+	pp.level = newLevel
+}
+
+func (pp *PowerPolicy) hasReading() bool {
+	return !pp.readingTime.IsZero() && time.Since(pp.readingTime) < pp.MaxReadingAge
+}
+
+func (pp *PowerPolicy) levelFor(voltage float64) powerLevel {
+	switch {
+	case pp.CutoffBelow > 0 && voltage < pp.CutoffBelow:
+		return powerLevelCutoff
+	case pp.DeferBelow > 0 && voltage < pp.DeferBelow:
+		return powerLevelDefer
+	case pp.ShortenBelow > 0 && voltage < pp.ShortenBelow:
+		return powerLevelShorten
+	}
+	return powerLevelNormal
+}
+
+func (pp *PowerPolicy) readVoltage(mc *ModemController) (float64, error) {
+	switch pp.Source {
+	case "modem", "":
+		// When the modem is off there is no reading, the last reading will be used until it is too old.
+		if mc.Modem == nil || !mc.Modem.ATReady {
+			return 0, fmt.Errorf("modem not ready for AT commands")
+		}
+		return mc.readVoltage()
+	case "sysfs":
+		raw, err := os.ReadFile(pp.SysfsPath)
+		if err != nil {
+			return 0, err
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(raw)), 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse voltage from '%s': %v", pp.SysfsPath, err)
+		}
+		return value * pp.SysfsScale, nil
+	case "dbus":
+		conn, err := dbus.SystemBus()
+		if err != nil {
+			return 0, err
+		}
+		call := conn.Object(pp.DBusDest, dbus.ObjectPath(pp.DBusPath)).Go(pp.DBusMethod, 0, make(chan *dbus.Call, 1))
+		select {
+		case <-call.Done:
+		case <-time.After(powerPolicyDBusTimeout):
+			return 0, fmt.Errorf("timeout calling '%s' on '%s'", pp.DBusMethod, pp.DBusDest)
+		}
+		var voltage float64
+		err = call.Store(&voltage)
+		return voltage, err
+	}
+	return 0, fmt.Errorf("unknown battery voltage source '%s'", pp.Source)
+}
+
+// current returns the power level and the voltage it is from.
+func (pp *PowerPolicy) current() (powerLevel, float64) {
+	if pp == nil {
+		return powerLevelNormal, 0
+	}
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.level, pp.voltage
+}
+
+// windowExpired checks if an on window should be treated as finished because of a low battery.
+func (pp *PowerPolicy) windowExpired(interval timeInterval, now time.Time) bool {
+	if !pp.enabled() {
+		return false
+	}
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.level >= powerLevelShorten && now.Sub(interval.start) > pp.ShortenedWindowDuration
+}
+
+func (pp *PowerPolicy) status() map[string]interface{} {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	status := map[string]interface{}{
+		"source": pp.Source,
+		"level":  pp.level.String(),
+	}
+	if !pp.readingTime.IsZero() {
+		status["voltage"] = pp.voltage
+		status["readingTime"] = pp.readingTime.Format(time.RFC1123Z)
+		status["readingStale"] = !pp.hasReading()
+	}
+	return status
+}
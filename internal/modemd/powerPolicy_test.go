@@ -0,0 +1,71 @@
+package modemd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPowerPolicyValidate(t *testing.T) {
+	tests := []struct {
+		cutoff, deferBelow, shorten float64
+		valid                       bool
+	}{
+		{0, 0, 0, true},
+		{11.5, 11.8, 12.1, true},
+		{11.5, 0, 12.1, true},
+		{0, 11.8, 0, true},
+		{11.8, 11.5, 12.1, false},
+		{11.5, 12.1, 11.8, false},
+		{12.1, 0, 11.5, false},
+		{11.5, 11.5, 0, false},
+		{-1, 0, 0, false},
+	}
+	for _, tt := range tests {
+		conf := DefaultPowerPolicyConfig()
+		conf.CutoffBelow, conf.DeferBelow, conf.ShortenBelow = tt.cutoff, tt.deferBelow, tt.shorten
+		if err := conf.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate(cutoff %.1f, defer %.1f, shorten %.1f) got error %v, want valid %t", tt.cutoff, tt.deferBelow, tt.shorten, err, tt.valid)
+		}
+	}
+}
+
+func TestPowerPolicyLevels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "voltage_now")
+	conf := DefaultPowerPolicyConfig()
+	conf.Source = "sysfs"
+	conf.SysfsPath = path
+	conf.ReadInterval = 0
+	conf.CutoffBelow, conf.DeferBelow, conf.ShortenBelow = 11.5, 11.8, 12.1
+	pp := NewPowerPolicy(conf)
+
+	steps := []struct {
+		microvolts string
+		want       powerLevel
+	}{
+		{"12500000", powerLevelNormal},
+		{"12000000", powerLevelShorten},
+		{"11600000", powerLevelDefer},
+		{"11400000", powerLevelCutoff},
+		// Has to rise above the threshold plus the hysteresis to go up a level.
+		{"11550000", powerLevelCutoff},
+		{"11650000", powerLevelDefer},
+		{"12300000", powerLevelNormal},
+	}
+	for _, step := range steps {
+		if err := os.WriteFile(path, []byte(step.microvolts+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pp.update(&ModemController{})
+		if level, voltage := pp.current(); level != step.want {
+			t.Errorf("at %.2fV got level '%s', want '%s'", voltage, level, step.want)
+		}
+	}
+
+	// A failed read keeps the last level.
+	os.Remove(path)
+	pp.update(&ModemController{})
+	if level, _ := pp.current(); level != powerLevelNormal {
+		t.Errorf("got level '%s' after a failed read, want it kept", level)
+	}
+}
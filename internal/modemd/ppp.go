@@ -0,0 +1,332 @@
+package modemd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+const PPPKey = "modemd-ppp"
+
+// Name of the peer file pppd is run with, the chat script is "<name>-chat" next to it.
+const pppPeerName = "modemd"
+
+// pppStableDuration is how long a session has to stay up for its restarts to be forgotten.
+const pppStableDuration = 5 * time.Minute
+
+// PPPConfig is read from the "modemd-ppp" config section.
+type PPPConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	FallbackAfter time.Duration `mapstructure:"fallback-after"` // PPP is started when the modem's netdev hasn't appeared this long into setup.
+	Device        string        `mapstructure:"device"`         // Serial port for the data, not the one used for AT commands.
+	Baud          int           `mapstructure:"baud"`
+	Unit          int           `mapstructure:"unit"` // The interface is "ppp<unit>".
+	Pppd          string        `mapstructure:"pppd"`
+	Chat          string        `mapstructure:"chat"`
+	PeersDir      string        `mapstructure:"peers-dir"`
+	RestartDelay  time.Duration `mapstructure:"restart-delay"`
+	MaxRestarts   int           `mapstructure:"max-restarts"` // Restarts in a row before giving up until the modem is set up again.
+}
+
+func DefaultPPPConfig() PPPConfig {
+	return PPPConfig{
+		Enabled:       false,
+		FallbackAfter: 45 * time.Second,
+		Device:        "/dev/UsbModemAT2",
+		Baud:          115200,
+		Unit:          0,
+		Pppd:          "/usr/sbin/pppd",
+		Chat:          "/usr/sbin/chat",
+		PeersDir:      "/etc/ppp/peers",
+		RestartDelay:  10 * time.Second,
+		MaxRestarts:   5,
+	}
+}
+
+// pppExitReasons are the meanings of pppd's exit codes.
+var pppExitReasons = map[int]string{
+	1:  "fatal error",
+	2:  "invalid options",
+	3:  "not run as root",
+	4:  "no kernel PPP support",
+	5:  "terminated by a signal",
+	6:  "serial port locked",
+	7:  "failed to open the serial port",
+	8:  "connect script failed",
+	10: "PPP negotiation failed",
+	11: "peer failed to authenticate",
+	15: "link idle or dead",
+	16: "modem hung up",
+	19: "authentication failed",
+}
+
+// PPP runs pppd over the modem's data port, for when the modem doesn't bring up its network interface.
+type PPP struct {
+	PPPConfig
+	mc *ModemController
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	wanted    bool
+	stop      chan struct{} // Closed to stop the supervisor, nil if it isn't running.
+	done      chan struct{} // Closed when the supervisor has exited.
+	startedAt time.Time
+	restarts  int
+	lastError string
+}
+
+func NewPPP(conf PPPConfig, mc *ModemController) *PPP {
+	return &PPP{PPPConfig: conf, mc: mc}
+}
+
+func (p *PPP) enabled() bool {
+	return p != nil && p.Enabled
+}
+
+func (p *PPP) netdev() string {
+	return fmt.Sprintf("ppp%d", p.Unit)
+}
+
+// started is true from when the session is started until it is stopped, even while pppd is restarting.
+func (p *PPP) started() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stop != nil
+}
+
+// startPPP starts a PPP session on the default PDP context and uses its interface as the modem's netdev.
+func (mc *ModemController) startPPP() error {
+	context, err := mc.dataContext()
+	if err != nil {
+		return err
+	}
+	if err := mc.PPP.Start(context); err != nil {
+		return err
+	}
+	log.Infof("Using '%s' as the modem's network interface.", mc.PPP.netdev())
+	mc.setNetdev(mc.PPP.netdev())
+	if err := eventclient.AddEvent(eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      "modemPPPFallback",
+		Details: map[string]interface{}{
+			"device": mc.PPP.Device,
+			"netdev": mc.PPP.netdev(),
+		},
+	}); err != nil {
+		log.Errorf("Failed to make modemPPPFallback event: %v", err)
+	}
+	return nil
+}
+
+// Start writes the peer and chat files for the PDP context then runs pppd, restarting it when it exits.
+func (p *PPP) Start(context PDPContext) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		return nil
+	}
+	if err := p.writeConfig(context); err != nil {
+		return fmt.Errorf("failed to write the PPP config: %w", err)
+	}
+	p.wanted = true
+	p.restarts = 0
+	p.lastError = ""
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.supervise(p.stop, p.done)
+	return nil
+}
+
+// Stop stops pppd and waits for it to exit.
+func (p *PPP) Stop() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.stop == nil {
+		p.mu.Unlock()
+		return
+	}
+	p.wanted = false
+	close(p.stop)
+	p.stop = nil
+	cmd, done := p.cmd, p.done
+	p.mu.Unlock()
+
+	log.Info("Stopping PPP.")
+	if cmd != nil {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		log.Error("pppd didn't exit, killing it.")
+		if cmd != nil {
+			cmd.Process.Kill()
+		}
+		<-done
+	}
+}
+
+func (p *PPP) supervise(stop, done chan struct{}) {
+	defer close(done)
+	for {
+		p.mu.Lock()
+		if !p.wanted {
+			p.mu.Unlock()
+			return
+		}
+		cmd := exec.Command(p.Pppd, "file", filepath.Join(p.PeersDir, pppPeerName), "nodetach")
+		err := cmd.Start()
+		if err == nil {
+			log.Infof("Started pppd on '%s'.", p.Device)
+			p.cmd = cmd
+			p.startedAt = time.Now()
+		}
+		p.mu.Unlock()
+		if err == nil {
+			err = cmd.Wait()
+		}
+
+		p.mu.Lock()
+		p.cmd = nil
+		if !p.wanted {
+			p.mu.Unlock()
+			return
+		}
+		p.lastError = pppExitReason(err)
+		if time.Since(p.startedAt) > pppStableDuration {
+			p.restarts = 0
+		}
+		p.restarts++
+		restarts, reason := p.restarts, p.lastError
+		if restarts > p.MaxRestarts {
+			p.wanted = false
+			p.mu.Unlock()
+			log.Errorf("pppd exited %d times in a row, giving up: %s", restarts, reason)
+			if err := eventclient.AddEvent(eventclient.Event{
+				Timestamp: time.Now(),
+				Type:      "pppFailed",
+				Details:   map[string]interface{}{"reason": reason},
+			}); err != nil {
+				log.Errorf("Failed to make pppFailed event: %v", err)
+			}
+			return
+		}
+		p.mu.Unlock()
+		log.Errorf("pppd exited: %s. Restarting in %s.", reason, p.RestartDelay)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(p.RestartDelay):
+		}
+	}
+}
+
+func pppExitReason(err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if reason, ok := pppExitReasons[exitErr.ExitCode()]; ok {
+			return reason
+		}
+	}
+	if err == nil {
+		return "exited"
+	}
+	return err.Error()
+}
+
+// writeConfig writes the peer file and chat script that dial the PDP context. The peer file has the
+// credentials so is only readable by root.
+func (p *PPP) writeConfig(context PDPContext) error {
+	if err := os.MkdirAll(p.PeersDir, 0755); err != nil {
+		return err
+	}
+	chatFile := filepath.Join(p.PeersDir, pppPeerName+"-chat")
+	chat := strings.Join([]string{
+		`ABORT "NO CARRIER"`,
+		`ABORT "ERROR"`,
+		`ABORT "BUSY"`,
+		`TIMEOUT 30`,
+		`"" "AT"`,
+		`OK "ATE0"`,
+		fmt.Sprintf(`OK "ATD*99***%d#"`, context.CID),
+		`CONNECT ""`,
+	}, "\n") + "\n"
+	if err := writeFileAtomic(chatFile, []byte(chat), 0644); err != nil {
+		return err
+	}
+
+	options := []string{
+		"# Generated by modemd.",
+		p.Device,
+		fmt.Sprint(p.Baud),
+		fmt.Sprintf("unit %d", p.Unit),
+		fmt.Sprintf(`connect "%s -v -f %s"`, p.Chat, chatFile),
+		"noauth",
+		"local",
+		"defaultroute",
+		"usepeerdns",
+		"noipdefault",
+		"ipcp-accept-local",
+		"ipcp-accept-remote",
+		"lcp-echo-interval 30",
+		"lcp-echo-failure 4",
+		"novj",
+	}
+	if context.Type == pdpTypeIPv6 {
+		options = append(options, "noip")
+	}
+	if pdpTypeHasIPv6(context.Type) {
+		options = append(options, "+ipv6")
+	}
+	if context.Username != "" || context.Password != "" {
+		options = append(options,
+			fmt.Sprintf(`user "%s"`, pppQuote(context.Username)),
+			fmt.Sprintf(`password "%s"`, pppQuote(context.Password)))
+	}
+	switch context.Auth {
+	case "pap":
+		options = append(options, "refuse-chap")
+	case "chap":
+		options = append(options, "refuse-pap")
+	}
+	return writeFileAtomic(filepath.Join(p.PeersDir, pppPeerName), []byte(strings.Join(options, "\n")+"\n"), 0600)
+}
+
+// pppQuote escapes the backslashes in a value for a quoted pppd option. Quotes and new lines aren't
+// allowed in the PDP context.
+func pppQuote(s string) string {
+	return strings.ReplaceAll(s, `\`, `\\`)
+}
+
+func (p *PPP) Status() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := map[string]interface{}{
+		"started":  p.stop != nil,
+		"running":  p.cmd != nil,
+		"device":   p.Device,
+		"netdev":   p.netdev(),
+		"restarts": p.restarts,
+	}
+	if !p.startedAt.IsZero() {
+		status["startedAt"] = p.startedAt.Format(time.RFC1123Z)
+	}
+	if p.lastError != "" {
+		status["lastError"] = p.lastError
+	}
+	return status
+}
@@ -0,0 +1,191 @@
+package modemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/TheCacophonyProject/modemd/qmi"
+)
+
+// qmiControl controls the modem with QMI over its /dev/cdc-wdm* device.
+type qmiControl struct {
+	dev *qmi.Device
+	mc  *ModemController
+
+	mu     sync.Mutex
+	handle uint32 // Of the data session started, 0 if none.
+}
+
+func newQMIControl(path string, mc *ModemController) (*qmiControl, error) {
+	dev, err := qmi.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// Check the modem responds so AT commands are used from the start if it doesn't.
+	if _, err := dev.SIMState(); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return &qmiControl{dev: dev, mc: mc}, nil
+}
+
+func (c *qmiControl) Name() string {
+	return controlQMI
+}
+
+func (c *qmiControl) SIMStatus() (string, error) {
+	state, err := c.dev.SIMState()
+	if err != nil {
+		return "", err
+	}
+	switch state {
+	case qmi.SIMInitialized:
+	case qmi.SIMNotPresent:
+		return "NOT INSERTED", nil
+	case qmi.SIMFailed:
+		return "FAILED", nil
+	default:
+		return "NOT READY", nil
+	}
+	pin, _, err := c.dev.PIN1Status()
+	if err != nil {
+		return "", err
+	}
+	switch pin {
+	case qmi.PINNotVerified:
+		return "SIM PIN", nil
+	case qmi.PINBlocked, qmi.PINPermanentlyBlocked:
+		return "SIM PUK", nil
+	}
+	return "READY", nil
+}
+
+func (c *qmiControl) Signal() (controlSignal, error) {
+	info, err := c.dev.SignalInfo()
+	if err != nil {
+		return controlSignal{}, err
+	}
+	signal := controlSignal{CSQ: 99, BitErrorRate: 99}
+	if info.Radio != qmi.RadioNone {
+		signal.CSQ = rssiToCSQ(info.RSSI)
+	}
+	if info.Radio == qmi.RadioLTE {
+		signal.HasLTEMetrics = true
+		signal.RSRP = info.RSRP
+		signal.RSRQ = info.RSRQ
+		signal.SINR = info.SNR
+	}
+	return signal, nil
+}
+
+func (c *qmiControl) Registration() (int, error) {
+	s, err := c.dev.ServingSystem()
+	if err != nil {
+		return 0, err
+	}
+	switch s.Registration {
+	case qmi.Registered:
+		if s.Roaming {
+			return 5, nil
+		}
+		return 1, nil
+	case qmi.NotRegistered:
+		return 0, nil
+	case qmi.Searching:
+		return 2, nil
+	case qmi.RegistrationDenied:
+		return 3, nil
+	}
+	return 4, nil
+}
+
+// StartData starts a data session with the PDP context as the profile, so its APN and authentication are used,
+// then sets the session's addresses on the network interface as no DHCP client is run on it.
+// A client can only have one session, so dual stack contexts get an IPv4 session.
+func (c *qmiControl) StartData(context PDPContext) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.setRawIP(); err != nil {
+		return err
+	}
+	if status, err := c.dev.PacketServiceStatus(); err == nil && status == qmi.Connected {
+		return c.configureNetdev()
+	}
+	family := qmi.IPv4
+	if context.Type == pdpTypeIPv6 {
+		family = qmi.IPv6
+	}
+	handle, err := c.dev.StartNetwork(qmi.StartNetworkOptions{
+		ProfileIndex: uint8(context.CID),
+		IPFamily:     family,
+	})
+	if qmi.IsCode(err, qmi.CodeNoEffect) {
+		return c.configureNetdev() // Already connected.
+	}
+	if err != nil {
+		return err
+	}
+	c.handle = handle
+	return c.configureNetdev()
+}
+
+// setRawIP has qmi_wwan pass IP packets without an ethernet header, which is all most modems support.
+// It can only be changed while the interface is down.
+func (c *qmiControl) setRawIP() error {
+	netdev := c.mc.Modem.Netdev
+	path := filepath.Join("/sys/class/net", netdev, "qmi", "raw_ip")
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read raw IP mode of '%s': %w", netdev, err)
+	}
+	if strings.TrimSpace(string(current)) == "Y" {
+		return nil
+	}
+	link, err := net.InterfaceByName(netdev)
+	if err != nil {
+		return err
+	}
+	if err := setLinkDown(link.Index); err != nil {
+		return fmt.Errorf("failed to take down '%s': %w", netdev, err)
+	}
+	log.Infof("Setting '%s' to raw IP mode.", netdev)
+	return os.WriteFile(path, []byte("Y"), 0644)
+}
+
+// configureNetdev sets the data session's addresses on the network interface.
+func (c *qmiControl) configureNetdev() error {
+	settings, err := c.dev.RuntimeSettings()
+	if err != nil {
+		return fmt.Errorf("failed to get the runtime settings: %w", err)
+	}
+	addrs := []net.IPNet{}
+	for _, addr := range []*net.IPNet{settings.IPv4, settings.IPv6} {
+		if addr != nil {
+			addrs = append(addrs, *addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return errors.New("data session has no address")
+	}
+	return c.mc.configureNetdev(addrs, settings.IPv4Gateway)
+}
+
+func (c *qmiControl) StopData() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handle == 0 {
+		return nil
+	}
+	handle := c.handle
+	c.handle = 0
+	return c.dev.StopNetwork(handle)
+}
+
+func (c *qmiControl) Close() error {
+	return c.dev.Close()
+}
@@ -0,0 +1,330 @@
+package modemd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/modemd/probe"
+)
+
+const QualityKey = "modemd-quality"
+
+// QualityConfig is read from the "modemd-quality" config section.
+type QualityConfig struct {
+	Interval               time.Duration `mapstructure:"interval"`    // Time between measurements while connected, 0 to disable.
+	BurstCount             int           `mapstructure:"burst-count"` // Echo requests sent to measure the RTT and packet loss.
+	BurstInterval          time.Duration `mapstructure:"burst-interval"`
+	ThroughputURL          string        `mapstructure:"throughput-url"`      // URL to download to measure the throughput, "" to skip.
+	ThroughputInterval     time.Duration `mapstructure:"throughput-interval"` // Time between throughput tests, as each one uses data.
+	ThroughputBytes        int64         `mapstructure:"throughput-bytes"`
+	ThroughputTimeout      time.Duration `mapstructure:"throughput-timeout"`
+	DegradedLoss           float64       `mapstructure:"degraded-loss"` // Packet loss, 0-1, above which the link is degraded.
+	DegradedRTT            time.Duration `mapstructure:"degraded-rtt"`  // Median RTT above which the link is degraded.
+	DegradedThroughputKbps float64       `mapstructure:"degraded-throughput-kbps"`
+	HistorySize            int           `mapstructure:"history-size"`
+	File                   string        `mapstructure:"file"` // "" to only keep the history in memory.
+}
+
+func DefaultQualityConfig() QualityConfig {
+	return QualityConfig{
+		Interval:           15 * time.Minute,
+		BurstCount:         20,
+		BurstInterval:      200 * time.Millisecond,
+		ThroughputInterval: 24 * time.Hour,
+		ThroughputBytes:    1000 * 1000,
+		ThroughputTimeout:  30 * time.Second,
+		DegradedLoss:       0.1,
+		DegradedRTT:        time.Second,
+		HistorySize:        96,
+		File:               "/var/lib/modemd/quality-history.json",
+	}
+}
+
+// Time to wait for replies after the last echo request of a burst.
+const qualityReplyWait = 5 * time.Second
+
+// Link classes.
+const (
+	linkUsable   = "usable"
+	linkDegraded = "degraded"
+	linkUnusable = "unusable"
+)
+
+// QualityMeasurement is one measurement of the connection through the modem.
+type QualityMeasurement struct {
+	Time            time.Time     `json:"time"`
+	Host            string        `json:"host"`
+	Sent            int           `json:"sent"`
+	Received        int           `json:"received"`
+	RTTMin          time.Duration `json:"rttMin"`
+	RTTMedian       time.Duration `json:"rttMedian"`
+	RTTP95          time.Duration `json:"rttP95"`
+	RTTMax          time.Duration `json:"rttMax"`
+	Jitter          time.Duration `json:"jitter"`                    // Mean difference between consecutive RTTs.
+	ThroughputBps   float64       `json:"throughputBps,omitempty"`   // 0 if not measured.
+	ThroughputError string        `json:"throughputError,omitempty"` // Why the throughput test failed.
+	Class           string        `json:"class"`
+	Reason          string        `json:"reason,omitempty"` // Why the link is not usable.
+}
+
+func (q QualityMeasurement) Loss() float64 {
+	if q.Sent == 0 {
+		return 0
+	}
+	return float64(q.Sent-q.Received) / float64(q.Sent)
+}
+
+func (q QualityMeasurement) ToDBusMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"time":     q.Time.Format(time.RFC3339),
+		"host":     q.Host,
+		"sent":     q.Sent,
+		"received": q.Received,
+		"loss":     q.Loss(),
+		"class":    q.Class,
+	}
+	if q.Received > 0 {
+		m["rttMinMs"] = durationMs(q.RTTMin)
+		m["rttMedianMs"] = durationMs(q.RTTMedian)
+		m["rttP95Ms"] = durationMs(q.RTTP95)
+		m["rttMaxMs"] = durationMs(q.RTTMax)
+		m["jitterMs"] = durationMs(q.Jitter)
+	}
+	if q.ThroughputBps > 0 {
+		m["throughputKbps"] = q.ThroughputBps / 1000
+	}
+	if q.ThroughputError != "" {
+		m["throughputError"] = q.ThroughputError
+	}
+	if q.Reason != "" {
+		m["reason"] = q.Reason
+	}
+	return m
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// ConnectionQuality measures the RTT, packet loss and throughput through the modem and keeps a history.
+type ConnectionQuality struct {
+	QualityConfig
+	mc *ModemController
+
+	mu      sync.Mutex
+	history []QualityMeasurement // Oldest first.
+}
+
+func NewConnectionQuality(conf QualityConfig, mc *ModemController) *ConnectionQuality {
+	q := &ConnectionQuality{QualityConfig: conf, mc: mc}
+	if !q.enabled() {
+		return q
+	}
+	if err := q.load(); err != nil {
+		log.Errorf("Failed to load connection quality history: %v", err)
+	}
+	return q
+}
+
+func (q *ConnectionQuality) enabled() bool {
+	return q != nil && q.Interval > 0 && q.BurstCount > 0
+}
+
+// measure runs the measurement, classifies the link and adds it to the history.
+func (q *ConnectionQuality) measure() QualityMeasurement {
+	opts := probe.Options{
+		Interface: q.mc.Modem.Netdev,
+		Interval:  q.BurstInterval,
+		Timeout:   time.Duration(q.BurstCount)*q.BurstInterval + qualityReplyWait,
+	}
+	m := QualityMeasurement{Time: time.Now()}
+	for _, host := range q.mc.testHosts() {
+		r := probe.ICMP(host, q.BurstCount, opts)
+		m.Host, m.Sent, m.Received = host, r.Sent, r.Received
+		if r.OK() {
+			m.addRTTs(r.RTTs)
+			break
+		}
+	}
+
+	if q.ThroughputURL != "" && m.Received > 0 && q.throughputDue(m.Time) {
+		opts := probe.Options{Interface: q.mc.Modem.Netdev, Timeout: q.ThroughputTimeout}
+		r := probe.Download(q.ThroughputURL, q.ThroughputBytes, opts)
+		if r.OK() {
+			m.ThroughputBps = r.Throughput()
+		} else {
+			m.ThroughputError = r.Err.Error()
+		}
+	}
+
+	m.Class, m.Reason = q.classify(m)
+	log.Infof("Connection quality: %s", qualitySummary(m))
+	previous, hasPrevious := q.latest()
+	if hasPrevious && previous.Class != m.Class {
+		log.Infof("Connection changed from %s to %s.", previous.Class, m.Class)
+		details := m.ToDBusMap()
+		details["previousClass"] = previous.Class
+		if err := eventclient.AddEvent(eventclient.Event{
+			Timestamp: m.Time,
+			Type:      "connectionQualityChanged",
+			Details:   details,
+		}); err != nil {
+			log.Errorf("Failed to make connectionQualityChanged event: %v", err)
+		}
+	}
+	if err := q.add(m); err != nil {
+		log.Errorf("Failed to save connection quality history: %v", err)
+	}
+	return m
+}
+
+// throughputDue is true when the throughput hasn't been tested within ThroughputInterval and the download
+// won't take the data usage over its caps.
+func (q *ConnectionQuality) throughputDue(now time.Time) bool {
+	if !q.mc.DataUsage.hasRoomFor(uint64(q.ThroughputBytes)) {
+		log.Debug("Skipping the throughput test as the data usage is near its cap.")
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := len(q.history) - 1; i >= 0; i-- {
+		m := q.history[i]
+		if m.ThroughputBps > 0 || m.ThroughputError != "" {
+			return now.Sub(m.Time) >= q.ThroughputInterval || now.Before(m.Time)
+		}
+	}
+	return true
+}
+
+// addRTTs sets the RTT statistics from the round trip time of each reply.
+func (m *QualityMeasurement) addRTTs(rtts []time.Duration) {
+	if len(rtts) == 0 {
+		return
+	}
+	var jitterSum time.Duration
+	for i := 1; i < len(rtts); i++ {
+		jitterSum += (rtts[i] - rtts[i-1]).Abs()
+	}
+	if len(rtts) > 1 {
+		m.Jitter = jitterSum / time.Duration(len(rtts)-1)
+	}
+	sorted := append([]time.Duration{}, rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	m.RTTMin = sorted[0]
+	m.RTTMax = sorted[len(sorted)-1]
+	m.RTTMedian = percentile(sorted, 0.5)
+	m.RTTP95 = percentile(sorted, 0.95)
+}
+
+// percentile uses the nearest rank of the sorted values.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+func (q *ConnectionQuality) classify(m QualityMeasurement) (string, string) {
+	if m.Received == 0 {
+		return linkUnusable, "no replies"
+	}
+	reasons := []string{}
+	if m.Loss() > q.DegradedLoss {
+		reasons = append(reasons, fmt.Sprintf("%.0f%% packet loss", m.Loss()*100))
+	}
+	if q.DegradedRTT > 0 && m.RTTMedian > q.DegradedRTT {
+		reasons = append(reasons, fmt.Sprintf("median RTT of %s", m.RTTMedian.Round(time.Millisecond)))
+	}
+	if m.ThroughputError != "" {
+		reasons = append(reasons, "throughput test failed")
+	} else if q.DegradedThroughputKbps > 0 && m.ThroughputBps > 0 && m.ThroughputBps < q.DegradedThroughputKbps*1000 {
+		reasons = append(reasons, fmt.Sprintf("throughput of %.0fkbps", m.ThroughputBps/1000))
+	}
+	if len(reasons) > 0 {
+		return linkDegraded, strings.Join(reasons, ", ")
+	}
+	return linkUsable, ""
+}
+
+func qualitySummary(m QualityMeasurement) string {
+	s := fmt.Sprintf("%s, %d/%d replies from %s", m.Class, m.Received, m.Sent, m.Host)
+	if m.Received > 0 {
+		s += fmt.Sprintf(", RTT min/median/p95/max %s/%s/%s/%s, jitter %s",
+			m.RTTMin.Round(time.Millisecond), m.RTTMedian.Round(time.Millisecond), m.RTTP95.Round(time.Millisecond),
+			m.RTTMax.Round(time.Millisecond), m.Jitter.Round(time.Millisecond))
+	}
+	if m.ThroughputBps > 0 {
+		s += fmt.Sprintf(", %.0fkbps", m.ThroughputBps/1000)
+	}
+	if m.Reason != "" {
+		s += " (" + m.Reason + ")"
+	}
+	return s + "."
+}
+
+func (q *ConnectionQuality) latest() (QualityMeasurement, bool) {
+	if !q.enabled() {
+		return QualityMeasurement{}, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.history) == 0 {
+		return QualityMeasurement{}, false
+	}
+	return q.history[len(q.history)-1], true
+}
+
+// Since returns the measurements taken after the given time, oldest first.
+func (q *ConnectionQuality) Since(since time.Time) []QualityMeasurement {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	measurements := []QualityMeasurement{}
+	for _, m := range q.history {
+		if m.Time.After(since) {
+			measurements = append(measurements, m)
+		}
+	}
+	return measurements
+}
+
+func (q *ConnectionQuality) add(m QualityMeasurement) error {
+	q.mu.Lock()
+	q.history = append(q.history, m)
+	if len(q.history) > q.HistorySize {
+		q.history = q.history[len(q.history)-q.HistorySize:]
+	}
+	data, err := json.Marshal(q.history)
+	q.mu.Unlock()
+	if err != nil || q.File == "" {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.File), 0755); err != nil {
+		return err
+	}
+	tmp := q.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.File)
+}
+
+func (q *ConnectionQuality) load() error {
+	if q.File == "" {
+		return nil
+	}
+	data, err := os.ReadFile(q.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &q.history)
+}
@@ -0,0 +1,178 @@
+package modemd
+
+import (
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+// Faults that the recovery ladder can try to fix.
+const (
+	faultATNotResponding = "atNotResponding"
+	faultUSBModeChange   = "usbModeChange"
+	faultPingFailures    = "pingFailures"
+)
+
+// recoveryRung is one step of the recovery ladder. Each rung is more disruptive than the previous one.
+type recoveryRung struct {
+	name          string
+	run           func(mc *ModemController) error
+	healthTimeout time.Duration // How long to wait for the modem to be healthy after running this rung.
+}
+
+var recoveryLadder = []recoveryRung{
+	{name: "reopenATPort", run: (*ModemController).reopenATPort, healthTimeout: 10 * time.Second},
+	{name: "cfunToggle", run: (*ModemController).toggleCFUN, healthTimeout: time.Minute},
+	{name: "creset", run: (*ModemController).resetModem, healthTimeout: 90 * time.Second},
+	{name: "gpioPowerCycle", run: (*ModemController).CycleModemPower, healthTimeout: 2 * time.Minute},
+	{name: "usbPowerCycle", run: (*ModemController).cycleUSBPower, healthTimeout: 2 * time.Minute},
+}
+
+// recoveryStat counts how many times a rung was tried for a fault and how many times it fixed it.
+type recoveryStat struct {
+	Attempts int `json:"attempts"`
+	Fixed    int `json:"fixed"`
+}
+
+// recoverModem will go up the recovery ladder, starting at the given rung, until the health check passes.
+// Returns true if the modem was recovered.
+func (mc *ModemController) recoverModem(fault string, startRung int, healthy func() bool) bool {
+	for i := startRung; i < len(recoveryLadder); i++ {
+		rung := recoveryLadder[i]
+		if !mc.ShouldBeOn() {
+			log.Info("Stopping modem recovery as modem should be off.")
+			return false
+		}
+		log.Infof("Trying to recover modem from '%s' with '%s' (step %d/%d).", fault, rung.name, i+1, len(recoveryLadder))
+
+		err := rung.run(mc)
+		if err != nil {
+			log.Errorf("Recovery step '%s' failed: %v", rung.name, err)
+		}
+		fixed := err == nil && waitUntilHealthy(healthy, rung.healthTimeout)
+
+		mc.addRecoveryStat(fault+"/"+rung.name, fixed)
+
+		details := map[string]interface{}{
+			"fault": fault,
+			"rung":  rung.name,
+			"step":  i + 1,
+			"fixed": fixed,
+		}
+		if err != nil {
+			details["error"] = err.Error()
+		}
+		if err := eventclient.AddEvent(eventclient.Event{
+			Timestamp: time.Now(),
+			Type:      "modemRecoveryEscalation",
+			Details:   details,
+		}); err != nil {
+			log.Errorf("Failed to make modemRecoveryEscalation event: %v", err)
+		}
+
+		if fixed {
+			log.Infof("Modem recovered from '%s' with '%s'.", fault, rung.name)
+			return true
+		}
+	}
+	log.Errorf("Failed to recover modem from '%s'.", fault)
+	return false
+}
+
+func waitUntilHealthy(healthy func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if healthy() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// rungIndex returns the position of the named rung in the recovery ladder.
+func rungIndex(name string) int {
+	for i, rung := range recoveryLadder {
+		if rung.name == name {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("unknown recovery rung '%s'", name))
+}
+
+func (mc *ModemController) reopenATPort() error {
+	return mc.setATManager()
+}
+
+func (mc *ModemController) toggleCFUN() error {
+	if _, err := mc.RunATCommand("AT+CFUN=0", 10000, 1); err != nil {
+		return err
+	}
+	time.Sleep(2 * time.Second)
+	_, err := mc.RunATCommand("AT+CFUN=1", 10000, 1)
+	return err
+}
+
+func (mc *ModemController) resetModem() error {
+	_, err := mc.RunATCommand("AT+CRESET", 2000, 3)
+	return err
+}
+
+func (mc *ModemController) cycleUSBPower() error {
+	if err := mc.USBPower.Set(false); err != nil {
+		return err
+	}
+	time.Sleep(5 * time.Second)
+	return mc.USBPower.Set(true)
+}
+
+func (mc *ModemController) atResponding() bool {
+	_, err := mc.RunATCommand("AT", 1000, 0)
+	return err == nil
+}
+
+func (mc *ModemController) usbModePresent() bool {
+	if mc.Modem == nil {
+		return false
+	}
+	return usbDevicePresent(mc.Modem.VendorID, mc.Modem.ProductID)
+}
+
+func (mc *ModemController) addRecoveryStat(key string, fixed bool) {
+	mc.recoveryStatsMu.Lock()
+	defer mc.recoveryStatsMu.Unlock()
+	if mc.recoveryStats == nil {
+		mc.recoveryStats = map[string]recoveryStat{}
+	}
+	stat := mc.recoveryStats[key]
+	stat.Attempts++
+	if fixed {
+		stat.Fixed++
+	}
+	mc.recoveryStats[key] = stat
+}
+
+// getRecoveryStats returns a copy of the recovery stats.
+func (mc *ModemController) getRecoveryStats() map[string]recoveryStat {
+	mc.recoveryStatsMu.Lock()
+	defer mc.recoveryStatsMu.Unlock()
+	return maps.Clone(mc.recoveryStats)
+}
+
+func (mc *ModemController) setRecoveryStats(stats map[string]recoveryStat) {
+	mc.recoveryStatsMu.Lock()
+	defer mc.recoveryStatsMu.Unlock()
+	mc.recoveryStats = stats
+}
+
+func (mc *ModemController) recoveryStatsStatus() map[string]interface{} {
+	stats := map[string]interface{}{}
+	for key, stat := range mc.getRecoveryStats() {
+		stats[key] = fmt.Sprintf("%d/%d fixed", stat.Fixed, stat.Attempts)
+	}
+	return stats
+}
@@ -0,0 +1,278 @@
+package modemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"golang.org/x/sys/unix"
+)
+
+const RoutingKey = "modemd-routing"
+
+// RoutingConfig is read from the "modemd-routing" config section.
+type RoutingConfig struct {
+	Interval       time.Duration `mapstructure:"interval"`        // How often the routes are checked, 0 to not manage the routes or DNS.
+	ModemMetric    uint32        `mapstructure:"modem-metric"`    // Metric of the modem's default route, higher than the wifi's so wifi is preferred when it is up. 0 to leave it.
+	PolicyTable    uint32        `mapstructure:"policy-table"`    // Routing table with a default route through the modem for packets sent out the modem, 0 to disable.
+	PolicyPriority uint32        `mapstructure:"policy-priority"` // Priority of the rule to use the PolicyTable.
+	ResolvConf     string        `mapstructure:"resolv-conf"`     // File to write the modem's DNS servers to while it is the uplink, "" to leave DNS alone.
+	DNSServers     []string      `mapstructure:"dns-servers"`     // Used if the network doesn't give any DNS servers.
+}
+
+func DefaultRoutingConfig() RoutingConfig {
+	return RoutingConfig{
+		Interval:       10 * time.Second,
+		ModemMetric:    1000,
+		PolicyTable:    0,
+		PolicyPriority: 1000,
+		ResolvConf:     "",
+	}
+}
+
+const resolvConfHeader = "# Generated by modemd while the modem is the uplink.\n"
+
+// Routing keeps the modem's default route behind wifi, sets up policy routing so the modem can always
+// be reached by binding to its interface, and switches DNS servers when the modem is the uplink.
+type Routing struct {
+	RoutingConfig
+	mc *ModemController
+
+	mu                 sync.Mutex
+	uplink             string
+	originalResolvConf []byte // What was in ResolvConf before modemd wrote to it, nil if it hasn't.
+}
+
+func NewRouting(conf RoutingConfig, mc *ModemController) *Routing {
+	return &Routing{RoutingConfig: conf, mc: mc}
+}
+
+func (r *Routing) enabled() bool {
+	return r != nil && r.Interval > 0
+}
+
+func (r *Routing) Run() {
+	if !r.enabled() {
+		return
+	}
+	for {
+		if err := r.update(); err != nil {
+			log.Errorf("Failed to update routing: %v", err)
+		}
+		time.Sleep(r.Interval)
+	}
+}
+
+func (r *Routing) update() error {
+	if r.mc.Modem == nil {
+		return nil
+	}
+	netdev := r.mc.Modem.Netdev
+	link, err := net.InterfaceByName(netdev)
+	if err != nil {
+		return r.restoreDNS()
+	}
+	defaults, err := defaultRoutes()
+	if err != nil {
+		return err
+	}
+
+	if r.ModemMetric != 0 {
+		for _, rt := range defaults {
+			if rt.OifIndex != link.Index || rt.Metric == r.ModemMetric {
+				continue
+			}
+			if err := r.setMetric(rt, r.ModemMetric); err != nil {
+				return fmt.Errorf("failed to set metric of default route on '%s': %w", netdev, err)
+			}
+			log.Infof("Changed metric of the default route on '%s' from %d to %d.", netdev, rt.Metric, r.ModemMetric)
+		}
+		if defaults, err = defaultRoutes(); err != nil {
+			return err
+		}
+	}
+
+	if r.PolicyTable != 0 {
+		if err := r.updatePolicyRouting(link, defaults); err != nil {
+			return fmt.Errorf("failed to update policy routing: %w", err)
+		}
+	}
+
+	uplink := uplinkName(defaults)
+	r.mu.Lock()
+	previous := r.uplink
+	r.uplink = uplink
+	r.mu.Unlock()
+	if uplink != previous {
+		log.Infof("Uplink changed from '%s' to '%s'.", previous, uplink)
+		if err := eventclient.AddEvent(eventclient.Event{
+			Timestamp: time.Now(),
+			Type:      "uplinkChanged",
+			Details:   map[string]interface{}{"from": previous, "to": uplink},
+		}); err != nil {
+			log.Errorf("Failed to make uplinkChanged event: %v", err)
+		}
+	}
+
+	if uplink == netdev {
+		return r.writeDNS()
+	}
+	return r.restoreDNS()
+}
+
+// setMetric replaces the route with one with the new metric. The new one is added first so there is
+// always a default route through the modem.
+func (r *Routing) setMetric(rt route, metric uint32) error {
+	newRoute := rt
+	newRoute.Metric = metric
+	if err := addRoute(newRoute, unix.NLM_F_EXCL); err != nil && !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	return deleteRoute(rt)
+}
+
+// updatePolicyRouting copies the modem's default route into the PolicyTable and makes packets sent out
+// the modem's interface use it, so probes bound to the interface work when wifi is the uplink.
+func (r *Routing) updatePolicyRouting(link *net.Interface, defaults []route) error {
+	for _, rt := range defaults {
+		if rt.OifIndex != link.Index {
+			continue
+		}
+		policyRoute := rt
+		policyRoute.Table = r.PolicyTable
+		policyRoute.Metric = 0
+		if err := addRoute(policyRoute, unix.NLM_F_REPLACE); err != nil {
+			return err
+		}
+		return addOifRule(r.PolicyPriority, r.PolicyTable, link.Name)
+	}
+	return nil
+}
+
+// uplinkName returns the interface of the default route with the lowest metric.
+func uplinkName(defaults []route) string {
+	var best *route
+	for i := range defaults {
+		if best == nil || defaults[i].Metric < best.Metric {
+			best = &defaults[i]
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	iface, err := net.InterfaceByIndex(best.OifIndex)
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
+
+func (r *Routing) writeDNS() error {
+	if r.ResolvConf == "" {
+		return nil
+	}
+	servers := r.mc.networkDNSServers()
+	if len(servers) == 0 {
+		servers = r.DNSServers
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	content := resolvConfHeader
+	for _, server := range servers {
+		content += "nameserver " + server + "\n"
+	}
+	current, err := os.ReadFile(r.ResolvConf)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if string(current) == content {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.originalResolvConf == nil && !strings.HasPrefix(string(current), resolvConfHeader) {
+		r.originalResolvConf = append([]byte{}, current...)
+	}
+	log.Infof("Setting DNS servers in '%s' to %s.", r.ResolvConf, strings.Join(servers, ", "))
+	return writeFileAtomic(r.ResolvConf, []byte(content), 0644)
+}
+
+func (r *Routing) restoreDNS() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ResolvConf == "" || r.originalResolvConf == nil {
+		return nil
+	}
+	log.Infof("Restoring '%s'.", r.ResolvConf)
+	if err := writeFileAtomic(r.ResolvConf, r.originalResolvConf, 0644); err != nil {
+		return err
+	}
+	r.originalResolvConf = nil
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// networkDNSServers returns the DNS servers the network gave for the default PDP context, from
+// "+CGCONTRDP: 1,5,"apn","10.1.2.3.255.255.255.0","10.1.2.1","8.8.8.8","8.8.4.4"".
+func (mc *ModemController) networkDNSServers() []string {
+	if mc.Modem == nil || !mc.Modem.ATReady {
+		return nil
+	}
+	out, err := mc.RunATCommand(fmt.Sprintf("AT+CGCONTRDP=%d", mc.defaultCID()), 1000, 1)
+	if err != nil {
+		log.Debugf("Failed to read DNS servers from the modem: %v", err)
+		return nil
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "+CGCONTRDP:")), ",")
+	servers := []string{}
+	for i := 5; i < len(parts) && i < 7; i++ {
+		server := strings.Trim(strings.TrimSpace(parts[i]), "\"")
+		if ip := net.ParseIP(server); ip != nil && !ip.IsUnspecified() {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// Status returns the current uplink and default routes.
+func (r *Routing) Status() map[string]interface{} {
+	status := map[string]interface{}{}
+	defaults, err := defaultRoutes()
+	if err != nil {
+		status["error"] = err.Error()
+		return status
+	}
+	status["uplink"] = uplinkName(defaults)
+	routes := map[string]interface{}{}
+	for _, rt := range defaults {
+		name := fmt.Sprint(rt.OifIndex)
+		if iface, err := net.InterfaceByIndex(rt.OifIndex); err == nil {
+			name = iface.Name
+		}
+		routes[name] = map[string]interface{}{
+			"gateway": rt.Gateway.String(),
+			"metric":  rt.Metric,
+		}
+	}
+	status["defaultRoutes"] = routes
+	if r.enabled() {
+		r.mu.Lock()
+		status["dnsManaged"] = r.originalResolvConf != nil
+		r.mu.Unlock()
+	}
+	return status
+}
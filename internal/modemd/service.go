@@ -45,6 +45,23 @@ func sendModemConnectedSignal() error {
 	return nil
 }
 
+func sendLocationUpdatedSignal(fix GPSFix) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	return conn.Emit(dbusPath, dbusName+".LocationUpdated", fix.ToDBusMap())
+}
+
+// sendGeofenceSignal sends a "GeofenceEvent" signal with the event type ("geofenceExit" or "deviceMoved") and its details.
+func sendGeofenceSignal(eventType string, details map[string]interface{}) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	return conn.Emit(dbusPath, dbusName+".GeofenceEvent", eventType, details)
+}
+
 func startService(mc *ModemController) error {
 	conn, err := dbus.SystemBus()
 	if err != nil {
@@ -98,6 +115,14 @@ func (s service) StayOffFor(minutes int) *dbus.Error {
 	return nil
 }
 
+// ResetFailures clears the "failed to find modem" and "no SIM card" failures so the modem will be tried again.
+func (s service) ResetFailures() *dbus.Error {
+	if err := s.mc.ResetFailures(); err != nil {
+		return makeDbusError("ResetFailures", err)
+	}
+	return nil
+}
+
 func (s service) GetStatus() (map[string]interface{}, *dbus.Error) {
 	status, err := s.mc.GetStatus()
 	if err != nil {
@@ -117,6 +142,68 @@ func (s service) SetAPN(apn string) *dbus.Error {
 	return nil
 }
 
+// SetPDPContext sets the APN and PDP type, "IP", "IPV6" or "IPV4V6".
+func (s service) SetPDPContext(apn, pdpType string) *dbus.Error {
+	log.Printf("Setting APN to %s with PDP type %s", apn, pdpType)
+	if err := s.mc.setPDPContext(apn, pdpType); err != nil {
+		log.Println(err)
+		return makeDbusError("SetPDPContext", err)
+	}
+	return nil
+}
+
+// ListPDPContexts returns the PDP contexts on the modem, without their credentials.
+func (s service) ListPDPContexts() ([]map[string]interface{}, *dbus.Error) {
+	contexts, err := s.mc.listPDPContexts()
+	if err != nil {
+		return nil, makeDbusError("ListPDPContexts", err)
+	}
+	maps := []map[string]interface{}{}
+	for _, context := range contexts {
+		maps = append(maps, context.ToDBusMap(s.mc.defaultCID()))
+	}
+	return maps, nil
+}
+
+// DefinePDPContext creates or changes a PDP context, keeping its authentication.
+func (s service) DefinePDPContext(cid int, pdpType, apn string) *dbus.Error {
+	log.Printf("Setting PDP context %d to '%s' %s", cid, apn, pdpType)
+	if err := s.mc.definePDPContext(PDPContext{CID: cid, Type: pdpType, APN: apn}); err != nil {
+		log.Println(err)
+		return makeDbusError("DefinePDPContext", err)
+	}
+	return nil
+}
+
+func (s service) DeletePDPContext(cid int) *dbus.Error {
+	log.Printf("Deleting PDP context %d", cid)
+	if err := s.mc.deletePDPContext(cid); err != nil {
+		log.Println(err)
+		return makeDbusError("DeletePDPContext", err)
+	}
+	return nil
+}
+
+// SetPDPAuth sets the authentication for a PDP context, auth is "none", "pap" or "chap".
+func (s service) SetPDPAuth(cid int, auth, username, password string) *dbus.Error {
+	log.Printf("Setting PDP context %d authentication to %s", cid, auth)
+	if err := s.mc.setPDPAuth(cid, auth, username, password); err != nil {
+		log.Println(err)
+		return makeDbusError("SetPDPAuth", err)
+	}
+	return nil
+}
+
+// SetDefaultPDPContext sets the PDP context used for the data connection.
+func (s service) SetDefaultPDPContext(cid int) *dbus.Error {
+	log.Printf("Setting default PDP context to %d", cid)
+	if err := s.mc.setDefaultPDPContext(cid); err != nil {
+		log.Println(err)
+		return makeDbusError("SetDefaultPDPContext", err)
+	}
+	return nil
+}
+
 func (s service) RunATCommand(atCommand string) (string, string, *dbus.Error) {
 	if s.mc.Modem != nil && !s.mc.Modem.ATReady {
 		return "", "", makeDbusError("RunATCommand", errors.New("modem not ready for AT commands"))
@@ -133,24 +220,91 @@ func (s service) RunATCommand(atCommand string) (string, string, *dbus.Error) {
 	return totalOut, out, nil
 }
 
-/*
 func (s service) GPSOn() *dbus.Error {
-	err := s.mc.EnableGPS()
-	if err != nil {
+	if err := s.mc.GPS.SetEnabled(true); err != nil {
 		return makeDbusError("GPSOn", err)
 	}
 	return nil
 }
-*/
-/*
+
 func (s service) GPSOff() *dbus.Error {
-	err := s.mc.DisableGPS()
-	if err != nil {
+	if err := s.mc.GPS.SetEnabled(false); err != nil {
 		return makeDbusError("GPSOff", err)
 	}
 	return nil
 }
-*/
+
+// GPSColdStart restarts the GPS without using any previously downloaded satellite data.
+func (s service) GPSColdStart() *dbus.Error {
+	if err := s.mc.GPS.ColdStart(); err != nil {
+		return makeDbusError("GPSColdStart", err)
+	}
+	return nil
+}
+
+// GPSHotStart restarts the GPS using the previously downloaded satellite data.
+func (s service) GPSHotStart() *dbus.Error {
+	if err := s.mc.GPS.HotStart(); err != nil {
+		return makeDbusError("GPSHotStart", err)
+	}
+	return nil
+}
+
+// GetLocation returns the last known GPS fix.
+func (s service) GetLocation() (map[string]interface{}, *dbus.Error) {
+	fix := s.mc.GPS.LastFix()
+	if fix == nil {
+		return nil, makeDbusError("GetLocation", ErrNoGPSFix)
+	}
+	return fix.ToDBusMap(), nil
+}
+
+// GetCellLocation returns the approximate location from the serving cell.
+func (s service) GetCellLocation() (map[string]interface{}, *dbus.Error) {
+	location, err := s.mc.CellLocator.Location()
+	if err != nil {
+		return nil, makeDbusError("GetCellLocation", err)
+	}
+	return location.ToDBusMap(), nil
+}
+
+// GetSignal returns the current signal metrics from the modem.
+func (s service) GetSignal() (map[string]interface{}, *dbus.Error) {
+	reading, err := s.mc.readSignal()
+	if err != nil {
+		return nil, makeDbusError("GetSignal", err)
+	}
+	return reading.ToDBusMap(), nil
+}
+
+// GetSignalHistory returns the signal samples taken after the given unix time, oldest first.
+func (s service) GetSignalHistory(since int64) ([]map[string]interface{}, *dbus.Error) {
+	if !s.mc.SignalHistory.enabled() {
+		return nil, makeDbusError("GetSignalHistory", errors.New("signal history is disabled"))
+	}
+	history := []map[string]interface{}{}
+	for _, sample := range s.mc.SignalHistory.Since(time.Unix(since, 0)) {
+		history = append(history, sample.ToDBusMap())
+	}
+	return history, nil
+}
+
+// GetConnectionQuality returns the connection quality measurements taken after the given unix time, oldest first.
+func (s service) GetConnectionQuality(since int64) ([]map[string]interface{}, *dbus.Error) {
+	if !s.mc.Quality.enabled() {
+		return nil, makeDbusError("GetConnectionQuality", errors.New("connection quality measurements are disabled"))
+	}
+	measurements := []map[string]interface{}{}
+	for _, m := range s.mc.Quality.Since(time.Unix(since, 0)) {
+		measurements = append(measurements, m.ToDBusMap())
+	}
+	return measurements, nil
+}
+
+// GetDataUsage returns the data used in the current billing period.
+func (s service) GetDataUsage() (map[string]interface{}, *dbus.Error) {
+	return s.mc.DataUsage.ToDBusMap(), nil
+}
 
 func makeDbusError(name string, err error) *dbus.Error {
 	return &dbus.Error{
@@ -0,0 +1,117 @@
+package modemd
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrModemNotReady = errors.New("modem is not ready")
+
+// SignalReading is a snapshot of the signal metrics reported by the modem.
+type SignalReading struct {
+	Time             time.Time
+	CSQ              int // 0-31, 99 if not known.
+	BitErrorRate     int
+	Status           string // "no signal", "poor", "ok" or "good"
+	Operator         string
+	AccessTechnology string
+	Band             string
+	Cell             *CellFingerprint
+	// Only available when on LTE.
+	HasLTEMetrics bool
+	RSRP          float64 // dBm
+	RSRQ          float64 // dB
+	SINR          float64 // dB
+}
+
+// RSSI converts the CSQ to dBm, ok is false if the signal strength is not known.
+func (r SignalReading) RSSI() (float64, bool) {
+	if r.CSQ < 0 || r.CSQ > 31 {
+		return 0, false
+	}
+	return float64(-113 + 2*r.CSQ), true
+}
+
+func (r SignalReading) ToDBusMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"time":             r.Time.Format(time.RFC3339),
+		"csq":              r.CSQ,
+		"bitErrorRate":     r.BitErrorRate,
+		"status":           r.Status,
+		"operator":         r.Operator,
+		"accessTechnology": r.AccessTechnology,
+		"band":             r.Band,
+	}
+	if rssi, ok := r.RSSI(); ok {
+		m["rssi"] = rssi
+	}
+	if r.Cell != nil {
+		m["cell"] = r.Cell.ToDBusMap()
+	}
+	if r.HasLTEMetrics {
+		m["rsrp"] = r.RSRP
+		m["rsrq"] = r.RSRQ
+		m["sinr"] = r.SINR
+	}
+	return m
+}
+
+// readSignal reads the signal metrics from the modem. Only the signal strength is required,
+// the other values are left empty if they can't be read.
+func (mc *ModemController) readSignal() (SignalReading, error) {
+	if mc.Modem == nil || !mc.Modem.ATReady {
+		return SignalReading{}, ErrModemNotReady
+	}
+	reading := SignalReading{Time: time.Now()}
+	signal, err := useControl(mc, "signal strength", controlBackend.Signal)
+	if err != nil {
+		return SignalReading{}, err
+	}
+	reading.CSQ, reading.BitErrorRate = signal.CSQ, signal.BitErrorRate
+	reading.Status = signalStatus(signal.CSQ, signal.BitErrorRate)
+	reading.HasLTEMetrics = signal.HasLTEMetrics
+	reading.RSRP, reading.RSRQ, reading.SINR = signal.RSRP, signal.RSRQ, signal.SINR
+	reading.Operator, reading.AccessTechnology, err = mc.readProvider()
+	if err != nil {
+		log.Debugf("Failed to read provider: %v", err)
+	}
+	out, err := mc.RunATCommand("AT+CPSI?", 1000, 1)
+	if err != nil {
+		log.Debugf("Failed to read serving cell: %v", err)
+		return reading, nil
+	}
+	if fp, err := parseCPSI(out); err == nil {
+		reading.Cell = &fp
+	}
+	parseCPSIMetrics(out, &reading)
+	return reading, nil
+}
+
+// parseCPSIMetrics reads the band, and for LTE the RSRQ, RSRP and SINR, from AT+CPSI?.
+// The LTE RSRQ and RSRP are reported in tenths of a dB.
+// +CPSI: LTE,Online,530-05,0x2F3A,27447297,275,EUTRAN-BAND28,9410,5,5,-94,-1022,-734,11
+func parseCPSIMetrics(out string, reading *SignalReading) {
+	parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(out), "+CPSI:")), ",")
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if strings.Contains(part, "BAND") {
+			reading.Band = part
+			break
+		}
+	}
+	if strings.TrimSpace(parts[0]) != "LTE" || len(parts) < 14 {
+		return
+	}
+	rsrq, err1 := strconv.ParseFloat(strings.TrimSpace(parts[10]), 64)
+	rsrp, err2 := strconv.ParseFloat(strings.TrimSpace(parts[11]), 64)
+	sinr, err3 := strconv.ParseFloat(strings.TrimSpace(parts[13]), 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return
+	}
+	reading.HasLTEMetrics = true
+	reading.RSRQ = rsrq / 10
+	reading.RSRP = rsrp / 10
+	reading.SINR = sinr
+}
@@ -0,0 +1,333 @@
+package modemd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SignalHistoryKey = "modemd-signal-history"
+
+// SignalHistoryConfig is read from the "modemd-signal-history" config section.
+type SignalHistoryConfig struct {
+	Interval time.Duration `mapstructure:"interval"` // 0 to disable the history.
+	Size     int           `mapstructure:"size"`     // Number of samples kept.
+	File     string        `mapstructure:"file"`     // "" to only keep the history in memory.
+}
+
+func DefaultSignalHistoryConfig() SignalHistoryConfig {
+	return SignalHistoryConfig{
+		Interval: time.Minute,
+		Size:     7 * 24 * 60, // A week of samples at the default interval.
+		File:     "/var/lib/modemd/signal-history.bin",
+	}
+}
+
+// Values used in a historySample when the value couldn't be read.
+const (
+	unknownInt8  = math.MinInt8
+	unknownInt16 = math.MinInt16
+)
+
+// accessTechnologies are the access technology names from readProvider, stored as their index.
+var accessTechnologies = []string{"", "GSM", "GSM Compact", "3G", "4G", "CDMA/HDR"}
+
+// registrationNames are the registration status names from AT+CEREG?/AT+CREG?.
+var registrationNames = []string{"not registered", "home", "searching", "denied", "unknown", "roaming"}
+
+// historySample is a fixed size record so the history file can be written as it is in memory.
+type historySample struct {
+	Time             int64 // Unix seconds.
+	RSRP             int16 // Tenths of a dBm.
+	RSRQ             int16 // Tenths of a dB.
+	Voltage          int16 // mV
+	CSQ              int8
+	SINR             int8 // dB
+	Temp             int8 // °C
+	Registration     int8
+	AccessTechnology uint8
+	_                [3]byte
+}
+
+var historySampleSize = binary.Size(historySample{})
+
+func (s historySample) ToDBusMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"time": time.Unix(s.Time, 0).Format(time.RFC3339),
+	}
+	if s.CSQ != unknownInt8 {
+		m["csq"] = int(s.CSQ)
+	}
+	if s.RSRP != unknownInt16 {
+		m["rsrp"] = float64(s.RSRP) / 10
+	}
+	if s.RSRQ != unknownInt16 {
+		m["rsrq"] = float64(s.RSRQ) / 10
+	}
+	if s.SINR != unknownInt8 {
+		m["sinr"] = int(s.SINR)
+	}
+	if s.Temp != unknownInt8 {
+		m["temp"] = int(s.Temp)
+	}
+	if s.Voltage != unknownInt16 {
+		m["voltage"] = float64(s.Voltage) / 1000
+	}
+	if s.Registration >= 0 && int(s.Registration) < len(registrationNames) {
+		m["registration"] = registrationNames[s.Registration]
+	}
+	if int(s.AccessTechnology) < len(accessTechnologies) && s.AccessTechnology != 0 {
+		m["accessTechnology"] = accessTechnologies[s.AccessTechnology]
+	}
+	return m
+}
+
+// SignalHistory keeps a ring buffer of signal samples, appended to a file so it survives restarts.
+type SignalHistory struct {
+	SignalHistoryConfig
+	mc *ModemController
+
+	mu          sync.Mutex
+	samples     []historySample // Ring buffer.
+	next        int             // Where the next sample goes.
+	full        bool
+	fileSamples int // Number of samples in the file, it is compacted when it gets to twice the size.
+}
+
+func NewSignalHistory(conf SignalHistoryConfig, mc *ModemController) *SignalHistory {
+	h := &SignalHistory{SignalHistoryConfig: conf, mc: mc}
+	if !h.enabled() {
+		return h
+	}
+	h.samples = make([]historySample, conf.Size)
+	if err := h.load(); err != nil {
+		log.Errorf("Failed to load signal history: %v", err)
+	}
+	return h
+}
+
+func (h *SignalHistory) enabled() bool {
+	return h != nil && h.Interval > 0 && h.Size > 0
+}
+
+// Run samples the signal every Interval while the modem is ready.
+func (h *SignalHistory) Run() {
+	if !h.enabled() {
+		return
+	}
+	for {
+		time.Sleep(h.Interval)
+		if h.mc.Modem == nil || !h.mc.Modem.ATReady {
+			continue
+		}
+		s, err := h.mc.readHistorySample()
+		if err != nil {
+			log.Debugf("Failed to sample signal: %v", err)
+			continue
+		}
+		if err := h.add(s); err != nil {
+			log.Errorf("Failed to save signal history: %v", err)
+		}
+	}
+}
+
+func (h *SignalHistory) add(s historySample) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.push(s)
+	if h.File == "" {
+		return nil
+	}
+	if h.fileSamples >= 2*h.Size {
+		return h.compact()
+	}
+	f, err := os.OpenFile(h.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := binary.Write(f, binary.LittleEndian, s); err != nil {
+		return err
+	}
+	h.fileSamples++
+	return nil
+}
+
+func (h *SignalHistory) push(s historySample) {
+	h.samples[h.next] = s
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// ordered returns the samples from oldest to newest.
+func (h *SignalHistory) ordered() []historySample {
+	if !h.full {
+		return append([]historySample{}, h.samples[:h.next]...)
+	}
+	return append(append([]historySample{}, h.samples[h.next:]...), h.samples[:h.next]...)
+}
+
+// latest returns the most recent sample, ok is false if there are none.
+func (h *SignalHistory) latest() (historySample, bool) {
+	if !h.enabled() {
+		return historySample{}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full && h.next == 0 {
+		return historySample{}, false
+	}
+	return h.samples[(h.next+len(h.samples)-1)%len(h.samples)], true
+}
+
+// Since returns the samples taken after the given time, oldest first.
+func (h *SignalHistory) Since(since time.Time) []historySample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	samples := []historySample{}
+	for _, s := range h.ordered() {
+		if s.Time > since.Unix() {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// compact rewrites the file with only the samples in the ring buffer.
+func (h *SignalHistory) compact() error {
+	samples := h.ordered()
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, samples); err != nil {
+		return err
+	}
+	tmp := h.File + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.File); err != nil {
+		return err
+	}
+	h.fileSamples = len(samples)
+	return nil
+}
+
+func (h *SignalHistory) load() error {
+	if h.File == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(h.File), 0755); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(h.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(data)
+	for {
+		s := historySample{}
+		err := binary.Read(r, binary.LittleEndian, &s)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break // A partly written sample at the end is ignored.
+		}
+		if err != nil {
+			return err
+		}
+		h.push(s)
+		h.fileSamples++
+	}
+	if len(data)%historySampleSize != 0 {
+		// Rewrite the file so new samples are not appended after the partial one.
+		return h.compact()
+	}
+	return nil
+}
+
+func (mc *ModemController) readHistorySample() (historySample, error) {
+	reading, err := mc.readSignal()
+	if err != nil {
+		return historySample{}, err
+	}
+	s := historySample{
+		Time:         reading.Time.Unix(),
+		CSQ:          int8(reading.CSQ),
+		RSRP:         unknownInt16,
+		RSRQ:         unknownInt16,
+		SINR:         unknownInt8,
+		Temp:         unknownInt8,
+		Voltage:      unknownInt16,
+		Registration: -1,
+	}
+	if reading.HasLTEMetrics {
+		s.RSRP = int16(math.Round(reading.RSRP * 10))
+		s.RSRQ = int16(math.Round(reading.RSRQ * 10))
+		s.SINR = int8(max(min(reading.SINR, math.MaxInt8), math.MinInt8+1))
+	}
+	for i, name := range accessTechnologies {
+		if name == reading.AccessTechnology {
+			s.AccessTechnology = uint8(i)
+		}
+	}
+	if temp, err := mc.readTemp(); err == nil {
+		s.Temp = int8(max(min(temp, math.MaxInt8), math.MinInt8+1))
+	}
+	if voltage, err := mc.readVoltage(); err == nil {
+		s.Voltage = int16(math.Round(voltage * 1000))
+	}
+	if registration, err := mc.readRegistration(); err == nil {
+		s.Registration = int8(registration)
+	}
+	return s, nil
+}
+
+// readRegistration returns the network registration status, as AT+CREG? reports it.
+func (mc *ModemController) readRegistration() (int, error) {
+	return useControl(mc, "registration", controlBackend.Registration)
+}
+
+// atRegistration returns the network registration status, using the EPS registration if available.
+func (mc *ModemController) atRegistration() (int, error) {
+	stat, err := mc.readRegistrationStatus("CEREG")
+	if err == nil && stat != 0 {
+		return stat, nil
+	}
+	// Only fall back to the CS registration if the EPS registration has nothing.
+	cregStat, cregErr := mc.readRegistrationStatus("CREG")
+	if cregErr == nil {
+		return cregStat, nil
+	}
+	if err == nil {
+		return stat, nil
+	}
+	return 0, cregErr
+}
+
+// readRegistrationStatus reads the status from AT+CEREG? or AT+CREG?, e.g "+CEREG: 0,1".
+func (mc *ModemController) readRegistrationStatus(cmd string) (int, error) {
+	out, err := mc.RunATCommand("AT+"+cmd+"?", 1000, 1)
+	if err != nil {
+		return 0, err
+	}
+	parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(out), "+"+cmd+":")), ",")
+	if len(parts) < 2 {
+		return 0, fmt.Errorf("invalid %s format '%s'", cmd, out)
+	}
+	stat, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s format '%s'", cmd, out)
+	}
+	return stat, nil
+}
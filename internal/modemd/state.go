@@ -0,0 +1,216 @@
+package modemd
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const defaultStateFile = "/var/lib/modemd/state.json"
+
+// Timestamps before this are from a clock that hasn't been set yet.
+var minValidTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// controllerState is the part of the ModemController that is kept across modemd restarts.
+type controllerState struct {
+	SavedAt              time.Time               `json:"savedAt"`
+	BootID               string                  `json:"bootID"`
+	StayOnUntil          time.Time               `json:"stayOnUntil"`
+	StayOffUntil         time.Time               `json:"stayOffUntil"`
+	LastFailedConnection time.Time               `json:"lastFailedConnection"`
+	LastSuccessfulPing   time.Time               `json:"lastSuccessfulPing"`
+	FailedToFindModem    bool                    `json:"failedToFindModem"`
+	FailedToFindSimCard  bool                    `json:"failedToFindSimCard"`
+	FindModemRecovery    failureRecovery         `json:"findModemRecovery"`
+	SimCardRecovery      failureRecovery         `json:"simCardRecovery"`
+	RecoveryStats        map[string]recoveryStat `json:"recoveryStats"`
+	MovementAnchor       *geoPoint               `json:"movementAnchor,omitempty"`
+	DefaultPDPCID        int                     `json:"defaultPDPCID,omitempty"`
+}
+
+func (mc *ModemController) currentState() controllerState {
+	return controllerState{
+		StayOnUntil:          mc.stayOnUntil,
+		StayOffUntil:         mc.stayOffUntil,
+		LastFailedConnection: mc.lastFailedConnection,
+		LastSuccessfulPing:   mc.lastSuccessfulPing,
+		FailedToFindModem:    mc.failedToFindModem,
+		FailedToFindSimCard:  mc.failedToFindSimCard,
+		FindModemRecovery:    mc.findModemRecovery,
+		SimCardRecovery:      mc.simCardRecovery,
+		RecoveryStats:        mc.getRecoveryStats(),
+		MovementAnchor:       mc.Geofence.getAnchor(),
+		DefaultPDPCID:        mc.defaultPDPCID,
+	}
+}
+
+// saveState writes the state to a temporary file then renames it so the state file is never partially written.
+// It is called from the D-Bus methods as well as the state loop so is serialized by stateMu.
+func (mc *ModemController) saveState() error {
+	if mc.StateFile == "" {
+		return nil
+	}
+	mc.stateMu.Lock()
+	defer mc.stateMu.Unlock()
+	if !mc.stateRestored {
+		log.Debug("Not saving the modem state until the clock is set and the saved state is restored.")
+		return nil
+	}
+	saved := mc.currentState()
+	state := saved
+	state.SavedAt = time.Now()
+	state.BootID = bootID()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(mc.StateFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(mc.StateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), mc.StateFile); err != nil {
+		return err
+	}
+	mc.savedState = saved
+	return nil
+}
+
+// loadState restores the state saved by a previous run of modemd.
+func (mc *ModemController) loadState() error {
+	return mc.loadStateAt(time.Now())
+}
+
+// loadStateAt restores the state, with now as the time. Timestamps that don't make sense because of the clock
+// jumping are discarded. If the clock isn't set the state is left to be restored, and isn't saved, until it is.
+func (mc *ModemController) loadStateAt(now time.Time) error {
+	if mc.StateFile == "" {
+		return nil
+	}
+	if now.Before(minValidTime) {
+		log.Info("System clock is not set, not restoring the saved modem state until it is.")
+		return nil
+	}
+	defer mc.setStateRestored()
+	data, err := os.ReadFile(mc.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := controllerState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	// Not affected by the clock. It is kept if it was set over D-Bus while waiting for the clock.
+	if mc.defaultPDPCID == 0 {
+		mc.defaultPDPCID = state.DefaultPDPCID
+	}
+
+	if state.SavedAt.Before(minValidTime) {
+		log.Info("Saved modem state was made when the clock was not set, not restoring it.")
+		return nil
+	}
+	if state.SavedAt.After(now) {
+		// The clock has jumped backwards since the state was saved. We can't tell how long modemd was stopped
+		// for so only keep the time remaining on the requests from when the state was saved.
+		log.Infof("Clock has jumped backwards since the modem state was saved at %s.", state.SavedAt.Format(time.DateTime))
+		state.StayOnUntil = now.Add(state.StayOnUntil.Sub(state.SavedAt))
+		state.StayOffUntil = now.Add(state.StayOffUntil.Sub(state.SavedAt))
+		state.LastFailedConnection = time.Time{}
+		state.LastSuccessfulPing = now
+	}
+
+	mc.stayOnUntil = validPastOrFuture(state.StayOnUntil)
+	mc.stayOffUntil = validPastOrFuture(state.StayOffUntil)
+	mc.lastFailedConnection = validPast(state.LastFailedConnection, now)
+	mc.lastSuccessfulPing = validPast(state.LastSuccessfulPing, now)
+	// A reboot could fix the modem or SIM card issues so only restore these if it is the same boot.
+	if state.BootID != "" && state.BootID == bootID() {
+		mc.failedToFindModem = state.FailedToFindModem
+		mc.failedToFindSimCard = state.FailedToFindSimCard
+	}
+	// The retry counters are kept across reboots so the daily retry cap still applies.
+	mc.findModemRecovery = state.FindModemRecovery
+	mc.simCardRecovery = state.SimCardRecovery
+	mc.setRecoveryStats(state.RecoveryStats)
+	mc.Geofence.setAnchor(state.MovementAnchor)
+	log.Infof("Restored modem state saved at %s.", state.SavedAt.Format(time.DateTime))
+	return nil
+}
+
+func validPastOrFuture(t time.Time) time.Time {
+	if t.Before(minValidTime) {
+		return time.Time{}
+	}
+	return t
+}
+
+func validPast(t, now time.Time) time.Time {
+	if t.Before(minValidTime) || t.After(now) {
+		return time.Time{}
+	}
+	return t
+}
+
+// setStateRestored marks the state as restored, so it is saved when it changes from here.
+func (mc *ModemController) setStateRestored() {
+	mc.stateMu.Lock()
+	defer mc.stateMu.Unlock()
+	mc.stateRestored = true
+	mc.savedState = mc.currentState()
+}
+
+// persistStateLoop saves the state whenever it changes.
+func (mc *ModemController) persistStateLoop() {
+	for {
+		time.Sleep(5 * time.Second)
+		if err := mc.persistState(time.Now()); err != nil {
+			log.Errorf("Failed to save modem state: %v", err)
+		}
+	}
+}
+
+// persistState saves the state if it has changed. The saved state is restored first once the clock is set.
+func (mc *ModemController) persistState(now time.Time) error {
+	mc.stateMu.Lock()
+	restored := mc.stateRestored
+	changed := !reflect.DeepEqual(mc.currentState(), mc.savedState)
+	mc.stateMu.Unlock()
+	if !restored {
+		return mc.loadStateAt(now)
+	}
+	if !changed {
+		return nil
+	}
+	return mc.saveState()
+}
+
+func bootID() string {
+	id, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
@@ -0,0 +1,87 @@
+package modemd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeStateFile(t *testing.T, state controllerState) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "state.json")
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadStateClockNotSet(t *testing.T) {
+	savedAt := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	recovery := failureRecovery{FailedAt: savedAt, Attempts: 3, Day: "2025-06-01", AttemptsToday: 3}
+	path := writeStateFile(t, controllerState{
+		SavedAt:           savedAt,
+		FindModemRecovery: recovery,
+		DefaultPDPCID:     2,
+	})
+	before, _ := os.ReadFile(path)
+
+	mc := &ModemController{StateFile: path}
+	unset := time.Date(1970, 1, 1, 0, 0, 30, 0, time.UTC)
+	if err := mc.loadStateAt(unset); err != nil {
+		t.Fatal(err)
+	}
+	// Changes made while waiting for the clock mustn't overwrite the saved state.
+	mc.stayOnUntil = unset.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if err := mc.persistState(unset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mc.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatalf("state file was changed before the clock was set:\n%s", after)
+	}
+	if mc.findModemRecovery.Attempts != 0 {
+		t.Error("state restored before the clock was set")
+	}
+
+	// Once the clock is set the state is restored.
+	if err := mc.persistState(savedAt.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if mc.findModemRecovery != recovery || mc.defaultPDPCID != 2 {
+		t.Errorf("state not restored once the clock was set, got %+v cid %d", mc.findModemRecovery, mc.defaultPDPCID)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("state file was changed by restoring it")
+	}
+}
+
+func TestLoadStateClockJumpedBack(t *testing.T) {
+	savedAt := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	path := writeStateFile(t, controllerState{
+		SavedAt:            savedAt,
+		StayOnUntil:        savedAt.Add(time.Hour),
+		LastSuccessfulPing: savedAt.Add(-time.Minute),
+	})
+	mc := &ModemController{StateFile: path}
+	now := savedAt.Add(-24 * time.Hour)
+	if err := mc.loadStateAt(now); err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(time.Hour); !mc.stayOnUntil.Equal(want) {
+		t.Errorf("got stay on until %s, want %s", mc.stayOnUntil, want)
+	}
+	if !mc.lastSuccessfulPing.Equal(now) {
+		t.Errorf("got last successful ping %s, want %s", mc.lastSuccessfulPing, now)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+modemd - Communicates with USB modems
+Copyright (C) 2019, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package modemd
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	julianUnixEpoch = 2440587.5 // Julian date of 1970-01-01 00:00 UTC
+	julianJ2000     = 2451545.0 // Julian date of 2000-01-01 12:00 UTC
+)
+
+// sunriseSunset calculates the sunrise and sunset for the given day at the given location using
+// the sunrise equation. ok will be false if the sun doesn't rise or set on that day (polar day/night).
+func sunriseSunset(day time.Time, latitude, longitude float64) (sunrise, sunset time.Time, ok bool) {
+	y, m, d := day.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	n := math.Round(toJulian(noon) - julianJ2000 + 0.0008)
+
+	// Mean solar time, solar mean anomaly, equation of the center and ecliptic longitude.
+	meanSolarTime := n - longitude/360
+	meanAnomaly := math.Mod(357.5291+0.98560028*meanSolarTime, 360)
+	center := 1.9148*sinDeg(meanAnomaly) + 0.02*sinDeg(2*meanAnomaly) + 0.0003*sinDeg(3*meanAnomaly)
+	eclipticLongitude := math.Mod(meanAnomaly+center+180+102.9372, 360)
+
+	transit := julianJ2000 + meanSolarTime + 0.0053*sinDeg(meanAnomaly) - 0.0069*sinDeg(2*eclipticLongitude)
+	sinDeclination := sinDeg(eclipticLongitude) * sinDeg(23.4397)
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+
+	cosHourAngle := (sinDeg(-0.833) - sinDeg(latitude)*sinDeclination) / (cosDeg(latitude) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	loc := day.Location()
+	sunrise = fromJulian(transit - hourAngle/360).In(loc)
+	sunset = fromJulian(transit + hourAngle/360).In(loc)
+	return sunrise, sunset, true
+}
+
+func toJulian(t time.Time) float64 {
+	return float64(t.Unix())/86400 + julianUnixEpoch
+}
+
+func fromJulian(j float64) time.Time {
+	return time.Unix(int64(math.Round((j-julianUnixEpoch)*86400)), 0)
+}
+
+func sinDeg(deg float64) float64 {
+	return math.Sin(deg * math.Pi / 180)
+}
+
+func cosDeg(deg float64) float64 {
+	return math.Cos(deg * math.Pi / 180)
+}
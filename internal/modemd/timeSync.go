@@ -0,0 +1,372 @@
+package modemd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"golang.org/x/sys/unix"
+)
+
+const TimeSyncKey = "modemd-time-sync"
+
+const (
+	timeSyncOff       = "off"
+	timeSyncReport    = "report" // Only reports the offset in the status, the clock is left alone.
+	timeSyncSetClock  = "set-clock"
+	timeSyncChronySHM = "chrony-shm"
+
+	timeSourceGPS     = "gps"
+	timeSourceNetwork = "network"
+)
+
+// Times after this are treated as invalid, along with times before minValidTime.
+var maxValidTime = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// TimeSyncConfig is read from the "modemd-time-sync" config section.
+type TimeSyncConfig struct {
+	Mode                string        `mapstructure:"mode"`    // "off", "report", "set-clock" or "chrony-shm"
+	Sources             []string      `mapstructure:"sources"` // "gps" and/or "network", in order of preference.
+	CheckInterval       time.Duration `mapstructure:"check-interval"`
+	MaxSampleAge        time.Duration `mapstructure:"max-sample-age"`         // Ignore GPS times older than this.
+	MinOffset           time.Duration `mapstructure:"min-offset"`             // Only set the clock when it is off by more than this.
+	OnlyWhenNTPUnsynced bool          `mapstructure:"only-when-ntp-unsynced"` // Leave the clock alone when NTP has synchronised it.
+	ChronySHMUnit       int           `mapstructure:"chrony-shm-unit"`        // Matches "refclock SHM <unit>" in chrony.conf.
+}
+
+func DefaultTimeSyncConfig() TimeSyncConfig {
+	return TimeSyncConfig{
+		Mode:                timeSyncReport, // Changing the clock has to be chosen.
+		Sources:             []string{timeSourceGPS, timeSourceNetwork},
+		CheckInterval:       time.Minute,
+		MaxSampleAge:        30 * time.Second,
+		MinOffset:           2 * time.Second,
+		OnlyWhenNTPUnsynced: true,
+		ChronySHMUnit:       2,
+	}
+}
+
+// timeSample is a time from a source paired with the system time when it was read.
+// receivedAt keeps its monotonic reading so the sample can be aged correctly even after the clock is changed.
+type timeSample struct {
+	source     string
+	time       time.Time
+	receivedAt time.Time
+}
+
+// now returns what the time is now according to the sample.
+func (s timeSample) now() time.Time {
+	return s.time.Add(time.Since(s.receivedAt))
+}
+
+// TimeSync sets the system clock, or feeds chrony, from the GPS or network time when NTP isn't available.
+type TimeSync struct {
+	TimeSyncConfig
+	mc *ModemController
+
+	mu         sync.Mutex
+	gpsSample  *timeSample
+	source     string
+	offset     time.Duration
+	checkedAt  time.Time
+	clockSetAt time.Time
+	ntpSynced  bool
+	shm        *chronySHM
+}
+
+func NewTimeSync(conf TimeSyncConfig, mc *ModemController) *TimeSync {
+	return &TimeSync{TimeSyncConfig: conf, mc: mc}
+}
+
+func (ts *TimeSync) enabled() bool {
+	return ts != nil && ts.Mode != timeSyncOff && ts.Mode != ""
+}
+
+// Setup is run when the modem starts, enabling NITZ so the modem clock is updated from the network.
+func (ts *TimeSync) Setup() error {
+	if !ts.enabled() || !ts.useSource(timeSourceNetwork) {
+		return nil
+	}
+	_, err := ts.mc.RunATCommand("AT+CTZU=1", 1000, 1)
+	return err
+}
+
+func (ts *TimeSync) useSource(source string) bool {
+	for _, s := range ts.Sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// onGPSFix is called with each new GPS fix.
+func (ts *TimeSync) onGPSFix(fix GPSFix) {
+	if !validTime(fix.UTCTime) {
+		return
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.gpsSample = &timeSample{source: timeSourceGPS, time: fix.UTCTime, receivedAt: fix.ReceivedAt}
+}
+
+// Run checks the time sources every CheckInterval.
+func (ts *TimeSync) Run() {
+	if !ts.enabled() {
+		return
+	}
+	switch ts.Mode {
+	case timeSyncReport, timeSyncSetClock, timeSyncChronySHM:
+	default:
+		log.Errorf("Unknown time sync mode '%s', not syncing the time.", ts.Mode)
+		return
+	}
+	if ts.mc.GPS != nil && ts.useSource(timeSourceGPS) {
+		ts.mc.GPS.OnFix(ts.onGPSFix)
+	}
+	for {
+		time.Sleep(ts.CheckInterval)
+		if err := ts.check(); err != nil {
+			log.Errorf("Failed to sync time: %v", err)
+		}
+	}
+}
+
+func (ts *TimeSync) check() error {
+	sample, err := ts.sample()
+	if err != nil || sample == nil {
+		return err
+	}
+	offset := sample.now().Sub(time.Now())
+
+	ts.mu.Lock()
+	ts.source = sample.source
+	ts.offset = offset
+	ts.checkedAt = time.Now()
+	ts.mu.Unlock()
+
+	switch ts.Mode {
+	case timeSyncReport:
+		return nil
+	case timeSyncChronySHM:
+		return ts.publishToChrony(*sample)
+	}
+	return ts.setClock(*sample, offset)
+}
+
+// sample returns the best time sample from the configured sources, or nil if none are available.
+func (ts *TimeSync) sample() (*timeSample, error) {
+	for _, source := range ts.Sources {
+		switch source {
+		case timeSourceGPS:
+			ts.mu.Lock()
+			sample := ts.gpsSample
+			ts.mu.Unlock()
+			if sample != nil && time.Since(sample.receivedAt) < ts.MaxSampleAge {
+				return sample, nil
+			}
+		case timeSourceNetwork:
+			if ts.mc.Modem == nil || !ts.mc.Modem.ATReady {
+				continue
+			}
+			sample, err := ts.readNetworkTime()
+			if err != nil {
+				log.Debugf("No network time: %v", err)
+				continue
+			}
+			return sample, nil
+		default:
+			return nil, fmt.Errorf("unknown time source '%s'", source)
+		}
+	}
+	return nil, nil
+}
+
+func (ts *TimeSync) readNetworkTime() (*timeSample, error) {
+	out, err := ts.mc.RunATCommand("AT+CCLK?", 1000, 1)
+	if err != nil {
+		return nil, err
+	}
+	receivedAt := time.Now()
+	t, err := parseCCLK(out)
+	if err != nil {
+		return nil, err
+	}
+	// Before the network has sent the time the modem clock starts from its default date, which fails here.
+	if !validTime(t) {
+		return nil, fmt.Errorf("modem clock not set by network, '%s'", t.Format(time.RFC3339))
+	}
+	return &timeSample{source: timeSourceNetwork, time: t, receivedAt: receivedAt}, nil
+}
+
+func (ts *TimeSync) setClock(sample timeSample, offset time.Duration) error {
+	synced, err := ntpSynced()
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	ts.ntpSynced = synced
+	ts.mu.Unlock()
+
+	if synced && ts.OnlyWhenNTPUnsynced && validTime(time.Now()) {
+		return nil
+	}
+	if offset.Abs() <= ts.MinOffset {
+		return nil
+	}
+
+	newTime := sample.now()
+	tv := unix.NsecToTimeval(newTime.UnixNano())
+	if err := unix.Settimeofday(&tv); err != nil {
+		return err
+	}
+	log.Infof("Set system clock from %s time, offset was %s.", sample.source, offset)
+
+	ts.mu.Lock()
+	ts.clockSetAt = time.Now()
+	ts.mu.Unlock()
+
+	if err := eventclient.AddEvent(eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      "systemClockSet",
+		Details: map[string]interface{}{
+			"source": sample.source,
+			"offset": offset.Seconds(),
+		},
+	}); err != nil {
+		log.Errorf("Failed to make systemClockSet event: %v", err)
+	}
+	return nil
+}
+
+func (ts *TimeSync) publishToChrony(sample timeSample) error {
+	if ts.shm == nil {
+		shm, err := openChronySHM(ts.ChronySHMUnit)
+		if err != nil {
+			return err
+		}
+		ts.shm = shm
+	}
+	// GPS time from the NMEA/AT interface is only good to about half a second, the network time to a second.
+	precision := int32(-1)
+	if sample.source == timeSourceNetwork {
+		precision = 0
+	}
+	ts.shm.write(sample.now(), time.Now(), precision)
+	return nil
+}
+
+func (ts *TimeSync) Status() map[string]interface{} {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	status := map[string]interface{}{
+		"mode":      ts.Mode,
+		"ntpSynced": ts.ntpSynced,
+	}
+	if !ts.checkedAt.IsZero() {
+		status["source"] = ts.source
+		status["offset"] = ts.offset.Seconds()
+		status["checkedAt"] = ts.checkedAt.Format(time.RFC1123Z)
+	}
+	if !ts.clockSetAt.IsZero() {
+		status["clockSetAt"] = ts.clockSetAt.Format(time.RFC1123Z)
+	}
+	return status
+}
+
+func validTime(t time.Time) bool {
+	return t.After(minValidTime) && t.Before(maxValidTime)
+}
+
+// STA_UNSYNC from linux/timex.h, set when the kernel clock is not synchronised by NTP.
+const staUnsync = 0x40
+
+// ntpSynced checks with the kernel if the clock has been synchronised by NTP (chrony or timesyncd).
+func ntpSynced() (bool, error) {
+	var tx unix.Timex
+	state, err := unix.Adjtimex(&tx)
+	if err != nil {
+		return false, err
+	}
+	return state != unix.TIME_ERROR && tx.Status&staUnsync == 0, nil
+}
+
+// parseCCLK parses the modem clock, e.g `+CCLK: "26/10/18,06:33:00+52"`, where the time zone is in quarter hours.
+func parseCCLK(out string) (time.Time, error) {
+	raw := strings.TrimSpace(out)
+	value := strings.TrimPrefix(raw, "+CCLK:")
+	value = strings.Trim(strings.TrimSpace(value), "\"")
+	if len(value) != 20 {
+		return time.Time{}, fmt.Errorf("invalid CCLK format '%s'", raw)
+	}
+	local, err := time.Parse("06/01/02,15:04:05", value[:17])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid CCLK format '%s'", raw)
+	}
+	quarterHours, err := strconv.Atoi(value[17:])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid CCLK time zone '%s'", raw)
+	}
+	return local.Add(-time.Duration(quarterHours) * 15 * time.Minute), nil
+}
+
+// chronySHMTime matches the shmTime struct used by ntpd, chrony and gpsd for SHM reference clocks.
+type chronySHMTime struct {
+	Mode                 int32
+	Count                int32
+	ClockTimeStampSec    int // time_t
+	ClockTimeStampUSec   int32
+	ReceiveTimeStampSec  int // time_t
+	ReceiveTimeStampUSec int32
+	Leap                 int32
+	Precision            int32
+	Nsamples             int32
+	Valid                int32
+	ClockTimeStampNSec   uint32
+	ReceiveTimeStampNSec uint32
+	Dummy                [8]int32
+}
+
+// chronySHMKey is the SysV shared memory key for unit 0, "NTP0".
+const chronySHMKey = 0x4e545030
+
+type chronySHM struct {
+	shm *chronySHMTime
+}
+
+func openChronySHM(unit int) (*chronySHM, error) {
+	size := int(unsafe.Sizeof(chronySHMTime{}))
+	id, err := unix.SysvShmGet(chronySHMKey+unit, size, unix.IPC_CREAT|0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chrony SHM segment: %w", err)
+	}
+	data, err := unix.SysvShmAttach(id, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach chrony SHM segment: %w", err)
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("chrony SHM segment too small, %d < %d", len(data), size)
+	}
+	return &chronySHM{shm: (*chronySHMTime)(unsafe.Pointer(&data[0]))}, nil
+}
+
+// write updates the sample using mode 1, the count is incremented before and after so chrony can detect a partial write.
+func (c *chronySHM) write(clockTime, receiveTime time.Time, precision int32) {
+	c.shm.Valid = 0
+	c.shm.Mode = 1
+	c.shm.Count++
+	c.shm.ClockTimeStampSec = int(clockTime.Unix())
+	c.shm.ClockTimeStampUSec = int32(clockTime.Nanosecond() / 1000)
+	c.shm.ClockTimeStampNSec = uint32(clockTime.Nanosecond())
+	c.shm.ReceiveTimeStampSec = int(receiveTime.Unix())
+	c.shm.ReceiveTimeStampUSec = int32(receiveTime.Nanosecond() / 1000)
+	c.shm.ReceiveTimeStampNSec = uint32(receiveTime.Nanosecond())
+	c.shm.Leap = 0
+	c.shm.Precision = precision
+	c.shm.Count++
+	c.shm.Valid = 1
+}
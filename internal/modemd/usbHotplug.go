@@ -0,0 +1,173 @@
+package modemd
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/modemd/usb"
+)
+
+var usbBus = usb.NewBus(usb.DefaultSysfsRoot)
+
+// usbEvents passes on the kernel's USB uevents to whatever is waiting for a USB device.
+var usbEvents = &usbHotplug{waiters: map[chan usb.Event]struct{}{}}
+
+type usbHotplug struct {
+	mu      sync.Mutex
+	waiters map[chan usb.Event]struct{}
+}
+
+func (h *usbHotplug) subscribe() chan usb.Event {
+	ch := make(chan usb.Event, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.waiters[ch] = struct{}{}
+	return ch
+}
+
+func (h *usbHotplug) unsubscribe(ch chan usb.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.waiters, ch)
+}
+
+// publish sends the event to the waiters. Waiters only rescan sysfs on an event, so if a waiter hasn't
+// taken the last event yet it doesn't need this one.
+func (h *usbHotplug) publish(e usb.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.waiters {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// watchUSB passes on USB uevents and notices when the modem is removed. If uevents can't be received,
+// waiting for USB devices falls back to scanning sysfs every second.
+func (mc *ModemController) watchUSB() {
+	w, err := usb.Watch()
+	if err != nil {
+		log.Errorf("Failed to watch for USB devices: %v", err)
+		return
+	}
+	defer w.Close()
+	for {
+		e, err := w.Next()
+		if errors.Is(err, usb.ErrEventsLost) {
+			log.Infof("USB events were lost, checking the USB devices again.")
+			mc.rescanModemUSB()
+			// Waiters rescan sysfs on any event.
+			usbEvents.publish(usb.Event{Action: "rescan"})
+			continue
+		}
+		if usb.IsClosed(err) {
+			log.Errorf("Stopped watching for USB devices: %v", err)
+			return
+		}
+		if err != nil {
+			log.Errorf("Failed to receive USB event: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if e.Subsystem != "usb" {
+			continue
+		}
+		if e.IsUSBDevice() {
+			vendorID, productID, _ := e.VendorProductID()
+			log.Debugf("USB device %s %s %s:%s", e.Name(), e.Action, vendorID, productID)
+			modem := mc.Modem
+			if modem != nil && e.Name() == modem.USBDevice {
+				switch e.Action {
+				case "remove":
+					log.Infof("Modem was removed from USB.")
+					modem.removed.Store(true)
+				case "add":
+					// Recovery steps power cycle or reset the modem, so it coming back is expected.
+					if modem.removed.Swap(false) {
+						log.Infof("Modem is back on USB.")
+					}
+				}
+			}
+		}
+		usbEvents.publish(e)
+	}
+}
+
+// rescanModemUSB checks if the modem is on USB, for when its remove or add event might have been lost.
+func (mc *ModemController) rescanModemUSB() {
+	modem := mc.Modem
+	if modem == nil || modem.USBDevice == "" {
+		return
+	}
+	_, err := usbBus.Device(modem.USBDevice)
+	present := err == nil
+	if !present && !modem.removed.Swap(true) {
+		log.Infof("Modem was removed from USB.")
+	} else if present && modem.removed.Swap(false) {
+		log.Infof("Modem is back on USB.")
+	}
+}
+
+// waitForUSBDevice waits until a USB device matches or the timeout. sysfs is scanned again on every USB
+// event, or every second in case uevents aren't being received.
+func waitForUSBDevice(match func(usb.Device) bool, timeout time.Duration) (usb.Device, bool) {
+	events := usbEvents.subscribe()
+	defer usbEvents.unsubscribe(events)
+	deadline := time.Now().Add(timeout)
+	for {
+		devices, err := usbBus.Devices()
+		if err != nil {
+			log.Errorf("Failed to list USB devices: %v", err)
+		}
+		for _, d := range devices {
+			if match(d) {
+				return d, true
+			}
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return usb.Device{}, false
+		}
+		select {
+		case <-events:
+		case <-time.After(min(remaining, time.Second)):
+		}
+	}
+}
+
+// usbDevicePresent is true if a USB device has the vendor ID, and product ID if it isn't "".
+func usbDevicePresent(vendorID, productID string) bool {
+	_, found, err := usbBus.Find(vendorID, productID)
+	if err != nil {
+		log.Errorf("Failed to list USB devices: %v", err)
+	}
+	return found
+}
+
+// logUSBDevices logs the USB devices on the system, to help debug modem issues.
+func logUSBDevices() {
+	devices, err := usbBus.Devices()
+	if err != nil {
+		log.Errorf("Failed to list USB devices: %v", err)
+		return
+	}
+	for _, d := range devices {
+		log.Infof("\t%s %s:%s %s %s", d.Name, d.VendorID, d.ProductID, d.Manufacturer, d.Product)
+	}
+}
+
+// logUSBInterfaces logs the modem's interfaces and the devices the kernel made for them.
+func logUSBInterfaces(d usb.Device) {
+	for _, intf := range d.Interfaces {
+		children := append(append(append([]string{}, intf.TTYs...), intf.NetDevs...), intf.USBMisc...)
+		driver := intf.Driver
+		if driver == "" {
+			driver = "no driver"
+		}
+		log.Infof("\tInterface %d (class %02x, %s): %s", intf.Number, intf.Class, driver, strings.Join(children, " "))
+	}
+}
@@ -0,0 +1,154 @@
+package modemd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/TheCacophonyProject/modemd/usb"
+)
+
+// USB power backends.
+const (
+	usbPowerBus  = "buspower" // Switches the whole bus, e.g the Pi 3's "buspower" file.
+	usbPowerPort = "port"     // Disables the hub's ports through sysfs.
+	usbPowerHub  = "uhubctl"  // Switches the power of the hub's ports with control transfers, like uhubctl.
+	usbPowerNone = "none"
+)
+
+// USBPowerConfig sets how the power to the modem's USB port is switched. Empty fields are taken from
+// the board profile.
+type USBPowerConfig struct {
+	Backend      string   `mapstructure:"backend"`        // "buspower", "port", "uhubctl" or "none".
+	BusPowerPath string   `mapstructure:"bus-power-path"` // For "buspower".
+	Hub          string   `mapstructure:"hub"`            // USB device name of the hub, e.g "1-1".
+	ExtraHubs    []string `mapstructure:"extra-hubs"`     // Other hubs with the same ports switched, e.g the USB 3 root hub "usb2".
+	Ports        []int    `mapstructure:"ports"`          // Hub ports switched for "port" and "uhubctl".
+	OffPorts     []int    `mapstructure:"off-ports"`      // Ports of the hub disabled whenever USB is powered on, to save power.
+}
+
+func (c USBPowerConfig) withDefaults(profile USBPowerConfig) USBPowerConfig {
+	if c.Backend == "" {
+		c.Backend = profile.Backend
+	}
+	if c.BusPowerPath == "" {
+		c.BusPowerPath = profile.BusPowerPath
+	}
+	if c.Hub == "" {
+		c.Hub = profile.Hub
+	}
+	if c.ExtraHubs == nil {
+		c.ExtraHubs = profile.ExtraHubs
+	}
+	if c.Ports == nil {
+		c.Ports = profile.Ports
+	}
+	if c.OffPorts == nil {
+		c.OffPorts = profile.OffPorts
+	}
+	return c
+}
+
+func (c USBPowerConfig) validate() error {
+	switch c.Backend {
+	case usbPowerBus:
+		if c.BusPowerPath == "" {
+			return fmt.Errorf("USB power backend '%s' needs the bus power path", c.Backend)
+		}
+	case usbPowerPort, usbPowerHub:
+		if c.Hub == "" || len(c.Ports) == 0 {
+			return fmt.Errorf("USB power backend '%s' needs the hub and ports", c.Backend)
+		}
+	case usbPowerNone:
+	default:
+		return fmt.Errorf("invalid USB power backend '%s'", c.Backend)
+	}
+	if (len(c.OffPorts) > 0 || len(c.ExtraHubs) > 0) && c.Hub == "" {
+		return fmt.Errorf("USB ports to turn off and extra hubs need the hub")
+	}
+	return nil
+}
+
+// USBPower switches the power to the modem's USB port.
+type USBPower struct {
+	USBPowerConfig
+}
+
+func NewUSBPower(conf USBPowerConfig) *USBPower {
+	return &USBPower{USBPowerConfig: conf}
+}
+
+// Set switches the USB power. The ports that aren't needed are turned off once USB is back on.
+func (p *USBPower) Set(on bool) error {
+	if p == nil || p.Backend == usbPowerNone {
+		return nil
+	}
+	if on {
+		log.Println("Enabling USB power")
+	} else {
+		log.Println("Disabling USB power")
+	}
+
+	var err error
+	switch p.Backend {
+	case usbPowerBus:
+		err = os.WriteFile(p.BusPowerPath, []byte(boolToDigit(on)), 0644)
+	case usbPowerPort:
+		err = p.forEachPort(func(hub string, port int) error {
+			return usbBus.SetPortDisabled(hub, port, !on)
+		})
+	case usbPowerHub:
+		err = p.forEachPort(func(hub string, port int) error {
+			return usbBus.SetPortPower(hub, port, on)
+		})
+	}
+	if err != nil {
+		enDis := "disable"
+		if on {
+			enDis = "enable"
+		}
+		return fmt.Errorf("failed to %s USB power: %s", enDis, err)
+	}
+
+	if on {
+		for _, port := range p.OffPorts {
+			go p.turnOffPort(port)
+		}
+	}
+	return nil
+}
+
+// forEachPort calls f for the ports of each hub, stopping at the first error.
+func (p *USBPower) forEachPort(f func(hub string, port int) error) error {
+	for _, hub := range append([]string{p.Hub}, p.ExtraHubs...) {
+		for _, port := range p.Ports {
+			if err := f(hub, port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// turnOffPort disables a port that isn't needed. It gets enabled again when the hub is powered on so
+// waits for the device on it to appear first.
+func (p *USBPower) turnOffPort(port int) {
+	name := p.Hub + "." + strconv.Itoa(port)
+	_, found := waitForUSBDevice(func(d usb.Device) bool { return d.Name == name }, 10*time.Second)
+	if !found {
+		return
+	}
+	if err := usbBus.SetPortDisabled(p.Hub, port, true); err != nil {
+		log.Println("Failed to turn off USB port", err)
+		return
+	}
+	log.Printf("Turned off USB port %d of hub '%s'", port, p.Hub)
+}
+
+func boolToDigit(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
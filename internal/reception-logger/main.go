@@ -1,22 +1,29 @@
 package receptionlogger
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/TheCacophonyProject/go-utils/logging"
+	modemcontroller "github.com/TheCacophonyProject/modemd/modem-controller"
 	"github.com/alexflint/go-arg"
-	"github.com/tarm/serial"
 )
 
 var log = logging.NewLogger("info")
 var version = "<not set>"
 
 type Args struct {
+	Output    string        `arg:"-o,--output" help:"file to log the samples to"`
+	Format    string        `arg:"--format" help:"output format: csv, jsonl or geojson"`
+	Interval  time.Duration `arg:"--interval" help:"time between samples"`
+	Label     string        `arg:"--label" help:"label added to each sample, e.g. the antenna position being tested"`
+	MaxFixAge time.Duration `arg:"--max-fix-age" help:"only include the GPS position if the fix is newer than this"`
+	MaxSizeMB int           `arg:"--max-size" help:"rotate the output file when it is larger than this many MB, 0 to disable"`
+	MaxFiles  int           `arg:"--max-files" help:"number of rotated files to keep"`
 	logging.LogArgs
 }
 
@@ -24,7 +31,14 @@ func (Args) Version() string {
 	return version
 }
 
-var defaultArgs = Args{}
+var defaultArgs = Args{
+	Output:    "/var/log/reception/survey.csv",
+	Format:    "csv",
+	Interval:  5 * time.Second,
+	MaxFixAge: 30 * time.Second,
+	MaxSizeMB: 10,
+	MaxFiles:  5,
+}
 
 func procArgs(input []string) (Args, error) {
 	args := defaultArgs
@@ -42,7 +56,13 @@ func procArgs(input []string) (Args, error) {
 		fmt.Println(version)
 		os.Exit(0)
 	}
-	return args, err
+	if err != nil {
+		return Args{}, err
+	}
+	if _, ok := sampleFormats[args.Format]; !ok {
+		return Args{}, fmt.Errorf("unknown format '%s'", args.Format)
+	}
+	return args, nil
 }
 
 func Run(inputArgs []string, ver string) error {
@@ -54,106 +74,50 @@ func Run(inputArgs []string, ver string) error {
 	log = logging.NewLogger(args.LogLevel)
 
 	log.Infof("Running version: %s", version)
-	for {
-		_, err := runATCommand("AT")
-		if err != nil {
-			log.Fatal(err)
-		}
-		reception := readReception()
-		band, _ := readBand()
-		t := time.Now().Format("2006-01-02 15:04:05")
-		out := fmt.Sprintf("%s, %s, %s", t, reception, band)
-		log.Println(out)
-		appendToFile("/home/pi/reception", out)
-		time.Sleep(5 * time.Second)
-	}
-}
-
-func readReception() string {
-	out, err := runATCommand("AT+CSQ")
-	if err != nil {
-		log.Fatal(err)
-	}
-	//log.Println(string(out))
-	out = strings.TrimPrefix(out, "+CSQ:")
-	out = strings.TrimSpace(out)
-
-	parts := strings.Split(out, ",")
-	if len(parts) > 1 {
-		return parts[0]
-	} else {
-		log.Fatal(fmt.Errorf("unable to read reception, '%s'", out))
-	}
-	return out
-}
-
-func readBand() (string, error) {
-	out, err := runATCommand("AT+CPSI?")
-	if err != nil {
-		return "", err
-	}
-	//log.Println(string(out))
-	parts := strings.Split(out, ",")
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if strings.Contains(part, "BAND") {
-			return part, nil
-		}
-	}
 
-	return "", err
-}
-
-func runATCommand(atCommand string) (string, error) {
-	//log.Printf("Running '%s'", atCommand)
-
-	c := &serial.Config{Name: "/dev/UsbModemAT", Baud: 115200, ReadTimeout: 2 * time.Second}
-	s, err := serial.OpenPort(c)
+	out, err := newRotatingFile(args.Output, sampleFormats[args.Format], int64(args.MaxSizeMB)*1024*1024, args.MaxFiles)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer s.Close()
+	defer out.close()
+	log.Infof("Logging reception to '%s' every %s.", args.Output, args.Interval)
 
-	_, err = s.Write([]byte(atCommand + "\r"))
-	if err != nil {
-		log.Fatal(err)
-	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
 
-	// Read and log the response with timestamp
-	reader := bufio.NewReader(s)
-	failed := false
+	ticker := time.NewTicker(args.Interval)
+	defer ticker.Stop()
 	for {
-		line, err := reader.ReadString('\n')
-		line = strings.TrimSpace(line)
+		s, err := takeSample(args.Label, args.MaxFixAge)
 		if err != nil {
-			log.Fatal(err)
-		}
-		if line == "ERROR" {
-			failed = true
-			break
+			// modemd might be restarting the modem, so keep trying.
+			log.Errorf("Failed to read signal: %v", err)
+		} else {
+			log.Println(s.summary())
+			if err := out.write(s); err != nil {
+				return err
+			}
 		}
-		if line == "OK" {
-			break
+		select {
+		case <-interrupt:
+			return nil
+		case <-ticker.C:
 		}
-		if strings.HasPrefix(line, "+") {
-			return line, nil
-		}
-	}
-	if failed {
-		return "", fmt.Errorf("AT command failed")
 	}
-	return "", nil
 }
 
-func appendToFile(filename string, data string) error {
-	// Open the file in append mode or create if it doesn't exist
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+func takeSample(label string, maxFixAge time.Duration) (sample, error) {
+	signal, err := modemcontroller.GetSignal()
 	if err != nil {
-		return err
+		return sample{}, err
 	}
-	defer file.Close()
-
-	// Write the data to the file with a new line
-	_, err = file.WriteString(data + "\n")
-	return err
+	s := newSample(signal, label)
+	location, err := modemcontroller.GetLocation()
+	if err != nil {
+		log.Debugf("No GPS location: %v", err)
+		return s, nil
+	}
+	s.addLocation(location, maxFixAge)
+	return s, nil
 }
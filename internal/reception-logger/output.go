@@ -0,0 +1,219 @@
+package receptionlogger
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// sampleFormat encodes the samples. first is true for the first sample written after the header.
+type sampleFormat interface {
+	header() []byte
+	encode(s sample, first bool) ([]byte, error)
+	footer() []byte
+}
+
+var sampleFormats = map[string]sampleFormat{
+	"csv":     csvFormat{},
+	"jsonl":   jsonLinesFormat{},
+	"geojson": geoJSONFormat{},
+}
+
+var csvColumns = []string{
+	"time", "label", "csq", "rssi", "rsrp", "rsrq", "sinr", "operator", "accessTechnology", "band",
+	"mcc", "mnc", "area", "cellID", "latitude", "longitude", "altitude", "hdop",
+}
+
+type csvFormat struct{}
+
+func (csvFormat) header() []byte {
+	b, _ := csvLine(csvColumns)
+	return b
+}
+
+func (csvFormat) encode(s sample, first bool) ([]byte, error) {
+	fields := s.fields()
+	record := make([]string, len(csvColumns))
+	for i, column := range csvColumns {
+		switch v := fields[column].(type) {
+		case nil:
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return csvLine(record)
+}
+
+func (csvFormat) footer() []byte { return nil }
+
+func csvLine(record []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(record); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+type jsonLinesFormat struct{}
+
+func (jsonLinesFormat) header() []byte { return nil }
+
+func (jsonLinesFormat) encode(s sample, first bool) ([]byte, error) {
+	b, err := json.Marshal(s.fields())
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (jsonLinesFormat) footer() []byte { return nil }
+
+// geoJSONFormat writes a FeatureCollection of points. Samples without a GPS fix have a null geometry.
+// The file is only valid GeoJSON once the footer has been written, when the logger stops or the file is rotated.
+type geoJSONFormat struct{}
+
+func (geoJSONFormat) header() []byte {
+	return []byte(`{"type":"FeatureCollection","features":[` + "\n")
+}
+
+func (geoJSONFormat) encode(s sample, first bool) ([]byte, error) {
+	properties := s.fields()
+	var geometry interface{}
+	if s.hasLocation() {
+		coordinates := []float64{*s.longitude, *s.latitude}
+		if s.altitude != nil {
+			coordinates = append(coordinates, *s.altitude)
+		}
+		geometry = map[string]interface{}{"type": "Point", "coordinates": coordinates}
+		delete(properties, "latitude")
+		delete(properties, "longitude")
+		delete(properties, "altitude")
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"type":       "Feature",
+		"geometry":   geometry,
+		"properties": properties,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !first {
+		b = append([]byte(","), b...)
+	}
+	return append(b, '\n'), nil
+}
+
+func (geoJSONFormat) footer() []byte {
+	return []byte("]}\n")
+}
+
+// rotatingFile writes the samples to a file, moving it to "<path>.1", "<path>.2"... when it gets too large.
+type rotatingFile struct {
+	path     string
+	format   sampleFormat
+	maxSize  int64
+	maxFiles int
+
+	file  *os.File
+	size  int64
+	empty bool // No samples written since the header.
+}
+
+func newRotatingFile(path string, format sampleFormat, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, format: format, maxSize: maxSize, maxFiles: maxFiles}
+	// Formats with a footer can't be appended to, so an existing file is rotated out of the way.
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 && format.footer() != nil {
+		if err := r.rotateFiles(); err != nil {
+			return nil, err
+		}
+	}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.empty = true
+	if r.size == 0 {
+		return r.writeBytes(r.format.header())
+	}
+	r.empty = false
+	return nil
+}
+
+func (r *rotatingFile) write(s sample) error {
+	b, err := r.format.encode(s, r.empty)
+	if err != nil {
+		return err
+	}
+	if err := r.writeBytes(b); err != nil {
+		return err
+	}
+	r.empty = false
+	if r.maxSize > 0 && r.size >= r.maxSize {
+		return r.rotate()
+	}
+	return nil
+}
+
+func (r *rotatingFile) writeBytes(b []byte) error {
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.close(); err != nil {
+		return err
+	}
+	if err := r.rotateFiles(); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// rotateFiles shifts the old files along by one, removing the oldest.
+func (r *rotatingFile) rotateFiles() error {
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if r.maxFiles < 1 {
+		return os.Remove(r.path)
+	}
+	return os.Rename(r.path, r.path+".1")
+}
+
+func (r *rotatingFile) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.writeBytes(r.format.footer())
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	return err
+}
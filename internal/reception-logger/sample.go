@@ -0,0 +1,147 @@
+package receptionlogger
+
+import (
+	"fmt"
+	"time"
+)
+
+// sample is one reading of the signal from modemd, with the GPS position if there is a recent fix.
+type sample struct {
+	time             time.Time
+	label            string
+	csq              int
+	rssi             *float64
+	rsrp             *float64
+	rsrq             *float64
+	sinr             *float64
+	operator         string
+	accessTechnology string
+	band             string
+	mcc              *int
+	mnc              *int
+	area             *int
+	cellID           *int
+	latitude         *float64
+	longitude        *float64
+	altitude         *float64
+	hdop             *float64
+}
+
+func newSample(signal map[string]interface{}, label string) sample {
+	s := sample{
+		time:             time.Now(),
+		label:            label,
+		operator:         mapString(signal, "operator"),
+		accessTechnology: mapString(signal, "accessTechnology"),
+		band:             mapString(signal, "band"),
+		rssi:             mapFloat(signal, "rssi"),
+		rsrp:             mapFloat(signal, "rsrp"),
+		rsrq:             mapFloat(signal, "rsrq"),
+		sinr:             mapFloat(signal, "sinr"),
+	}
+	if csq := mapInt(signal, "csq"); csq != nil {
+		s.csq = *csq
+	}
+	if cell, ok := signal["cell"].(map[string]interface{}); ok {
+		s.mcc = mapInt(cell, "mcc")
+		s.mnc = mapInt(cell, "mnc")
+		s.area = mapInt(cell, "area")
+		s.cellID = mapInt(cell, "cellID")
+	}
+	return s
+}
+
+func (s *sample) addLocation(location map[string]interface{}, maxFixAge time.Duration) {
+	receivedAt, err := time.Parse(time.RFC3339, mapString(location, "receivedAt"))
+	if err != nil || time.Since(receivedAt) > maxFixAge {
+		return
+	}
+	s.latitude = mapFloat(location, "latitude")
+	s.longitude = mapFloat(location, "longitude")
+	s.altitude = mapFloat(location, "altitude")
+	s.hdop = mapFloat(location, "hdop")
+}
+
+func (s sample) hasLocation() bool {
+	return s.latitude != nil && s.longitude != nil
+}
+
+// fields returns the sample as a map, leaving out values that are not known.
+func (s sample) fields() map[string]interface{} {
+	m := map[string]interface{}{
+		"time":             s.time.Format(time.RFC3339),
+		"csq":              s.csq,
+		"operator":         s.operator,
+		"accessTechnology": s.accessTechnology,
+		"band":             s.band,
+	}
+	if s.label != "" {
+		m["label"] = s.label
+	}
+	optional := map[string]interface{}{
+		"rssi":      s.rssi,
+		"rsrp":      s.rsrp,
+		"rsrq":      s.rsrq,
+		"sinr":      s.sinr,
+		"mcc":       s.mcc,
+		"mnc":       s.mnc,
+		"area":      s.area,
+		"cellID":    s.cellID,
+		"latitude":  s.latitude,
+		"longitude": s.longitude,
+		"altitude":  s.altitude,
+		"hdop":      s.hdop,
+	}
+	for key, value := range optional {
+		switch v := value.(type) {
+		case *float64:
+			if v != nil {
+				m[key] = *v
+			}
+		case *int:
+			if v != nil {
+				m[key] = *v
+			}
+		}
+	}
+	return m
+}
+
+func (s sample) summary() string {
+	str := fmt.Sprintf("CSQ: %d, %s %s %s", s.csq, s.operator, s.accessTechnology, s.band)
+	if s.rsrp != nil && s.rsrq != nil && s.sinr != nil {
+		str += fmt.Sprintf(", RSRP: %.1fdBm, RSRQ: %.1fdB, SINR: %.0fdB", *s.rsrp, *s.rsrq, *s.sinr)
+	}
+	if s.hasLocation() {
+		str += fmt.Sprintf(", at %.6f, %.6f", *s.latitude, *s.longitude)
+	}
+	return str
+}
+
+func mapString(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func mapFloat(m map[string]interface{}, key string) *float64 {
+	if f, ok := m[key].(float64); ok {
+		return &f
+	}
+	return nil
+}
+
+// mapInt reads an integer from a D-Bus map, which can be any size of integer.
+func mapInt(m map[string]interface{}, key string) *int {
+	var i int
+	switch v := m[key].(type) {
+	case int32:
+		i = int(v)
+	case int64:
+		i = int(v)
+	case int:
+		i = v
+	default:
+		return nil
+	}
+	return &i
+}
@@ -0,0 +1,280 @@
+package mbim
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Basic connect CIDs.
+const (
+	cidSubscriberReadyStatus = 2
+	cidRegisterState         = 9
+	cidPacketService         = 10
+	cidSignalState           = 11
+	cidConnect               = 12
+	cidIPConfiguration       = 15
+)
+
+// ReadyState is the state of the SIM.
+type ReadyState uint32
+
+const (
+	ReadyNotInitialized ReadyState = 0
+	ReadyInitialized    ReadyState = 1
+	ReadySIMNotInserted ReadyState = 2
+	ReadyBadSIM         ReadyState = 3
+	ReadyFailure        ReadyState = 4
+	ReadyNotActivated   ReadyState = 5
+	ReadyDeviceLocked   ReadyState = 6 // Needs the PIN or PUK.
+)
+
+// SubscriberStatus is the state of the SIM and its identity.
+type SubscriberStatus struct {
+	ReadyState   ReadyState
+	SubscriberID string // IMSI
+	ICCID        string
+}
+
+// SubscriberReadyStatus gets the state of the SIM.
+func (d *Device) SubscriberReadyStatus() (SubscriberStatus, error) {
+	info, err := d.command(UUIDBasicConnect, cidSubscriberReadyStatus, commandQuery, nil)
+	if err != nil {
+		return SubscriberStatus{}, err
+	}
+	r := &infoReader{b: info}
+	s := SubscriberStatus{
+		ReadyState:   ReadyState(r.uint32()),
+		SubscriberID: r.string(),
+		ICCID:        r.string(),
+	}
+	return s, r.err
+}
+
+// RegisterStateValue is the network registration state.
+type RegisterStateValue uint32
+
+const (
+	RegisterUnknown      RegisterStateValue = 0
+	RegisterDeregistered RegisterStateValue = 1
+	RegisterSearching    RegisterStateValue = 2
+	RegisterHome         RegisterStateValue = 3
+	RegisterRoaming      RegisterStateValue = 4
+	RegisterPartner      RegisterStateValue = 5
+	RegisterDenied       RegisterStateValue = 6
+)
+
+// Registration is the network the modem is registered to.
+type Registration struct {
+	State        RegisterStateValue
+	DataClass    uint32 // Current cellular class bitmask, e.g 0x20 for LTE.
+	ProviderID   string // MCC and MNC.
+	ProviderName string
+}
+
+// RegisterState gets the network registration.
+func (d *Device) RegisterState() (Registration, error) {
+	info, err := d.command(UUIDBasicConnect, cidRegisterState, commandQuery, nil)
+	if err != nil {
+		return Registration{}, err
+	}
+	r := &infoReader{b: info}
+	r.uint32() // Network error.
+	reg := Registration{State: RegisterStateValue(r.uint32())}
+	r.uint32() // Register mode.
+	reg.DataClass = r.uint32()
+	r.uint32() // Current cellular class.
+	reg.ProviderID = r.string()
+	reg.ProviderName = r.string()
+	return reg, r.err
+}
+
+// Signal is the signal strength.
+type Signal struct {
+	RSSI      int // 0-31 like AT+CSQ, 99 if not known.
+	ErrorRate int // 0-7, 99 if not known.
+}
+
+// SignalState gets the signal strength.
+func (d *Device) SignalState() (Signal, error) {
+	info, err := d.command(UUIDBasicConnect, cidSignalState, commandQuery, nil)
+	if err != nil {
+		return Signal{}, err
+	}
+	r := &infoReader{b: info}
+	s := Signal{RSSI: int(r.uint32()), ErrorRate: int(r.uint32())}
+	return s, r.err
+}
+
+// Attach attaches to the packet service, which is needed before connecting. Most modems attach automatically.
+func (d *Device) Attach() error {
+	w := newInfoWriter(4)
+	w.uint32(0) // Attach.
+	_, err := d.command(UUIDBasicConnect, cidPacketService, commandSet, w.bytes())
+	return err
+}
+
+// AuthProtocol is the authentication for a connection.
+type AuthProtocol uint32
+
+const (
+	AuthNone AuthProtocol = 0
+	AuthPAP  AuthProtocol = 1
+	AuthCHAP AuthProtocol = 2
+)
+
+// IPType is the IP versions of a connection.
+type IPType uint32
+
+const (
+	IPTypeDefault IPType = 0
+	IPTypeIPv4    IPType = 1
+	IPTypeIPv6    IPType = 2
+	IPTypeIPv4v6  IPType = 3
+)
+
+// ActivationState is the state of a connection.
+type ActivationState uint32
+
+const (
+	ActivationUnknown      ActivationState = 0
+	ActivationActivated    ActivationState = 1
+	ActivationActivating   ActivationState = 2
+	ActivationDeactivated  ActivationState = 3
+	ActivationDeactivating ActivationState = 4
+)
+
+// ConnectOptions are for starting a data session.
+type ConnectOptions struct {
+	SessionID uint32
+	APN       string
+	Auth      AuthProtocol
+	Username  string
+	Password  string
+	IPType    IPType
+}
+
+// Connect starts an internet data session.
+func (d *Device) Connect(opts ConnectOptions) (ActivationState, error) {
+	return d.connect(opts, 1)
+}
+
+// Disconnect ends the data session.
+func (d *Device) Disconnect(sessionID uint32) error {
+	_, err := d.connect(ConnectOptions{SessionID: sessionID}, 0)
+	return err
+}
+
+func (d *Device) connect(opts ConnectOptions, activation uint32) (ActivationState, error) {
+	w := newInfoWriter(60)
+	w.uint32(opts.SessionID)
+	w.uint32(activation)
+	w.string(opts.APN)
+	w.string(opts.Username)
+	w.string(opts.Password)
+	w.uint32(0) // No compression.
+	w.uint32(uint32(opts.Auth))
+	w.uint32(uint32(opts.IPType))
+	w.uuid(UUIDContextInternet)
+	info, err := d.command(UUIDBasicConnect, cidConnect, commandSet, w.bytes())
+	if err != nil {
+		return ActivationUnknown, err
+	}
+	r := &infoReader{b: info}
+	r.uint32() // Session ID.
+	state := ActivationState(r.uint32())
+	return state, r.err
+}
+
+// IPConfig is the addressing of a data session, which has to be set on the network interface
+// as MBIM modems don't run DHCP.
+type IPConfig struct {
+	IPv4        []net.IPNet
+	IPv4Gateway net.IP
+	IPv4DNS     []net.IP
+	IPv6        []net.IPNet
+	IPv6Gateway net.IP
+	IPv6DNS     []net.IP
+	MTU         int // IPv4 MTU, 0 if not given.
+}
+
+// IPConfiguration gets the addressing of the data session.
+func (d *Device) IPConfiguration(sessionID uint32) (IPConfig, error) {
+	query := make([]byte, 60)
+	binary.LittleEndian.PutUint32(query, sessionID)
+	info, err := d.command(UUIDBasicConnect, cidIPConfiguration, commandQuery, query)
+	if err != nil {
+		return IPConfig{}, err
+	}
+	r := &infoReader{b: info}
+	r.uint32() // Session ID.
+	r.uint32() // IPv4 configuration available.
+	r.uint32() // IPv6 configuration available.
+	ipv4Count, ipv4Offset := r.uint32(), r.uint32()
+	ipv6Count, ipv6Offset := r.uint32(), r.uint32()
+	ipv4Gateway, ipv6Gateway := r.uint32(), r.uint32()
+	ipv4DNSCount, ipv4DNSOffset := r.uint32(), r.uint32()
+	ipv6DNSCount, ipv6DNSOffset := r.uint32(), r.uint32()
+	mtu := r.uint32()
+	if r.err != nil {
+		return IPConfig{}, r.err
+	}
+	c := IPConfig{
+		IPv4:        addresses(info, ipv4Count, ipv4Offset, net.IPv4len),
+		IPv4Gateway: ip(info, ipv4Gateway, net.IPv4len),
+		IPv4DNS:     ips(info, ipv4DNSCount, ipv4DNSOffset, net.IPv4len),
+		IPv6:        addresses(info, ipv6Count, ipv6Offset, net.IPv6len),
+		IPv6Gateway: ip(info, ipv6Gateway, net.IPv6len),
+		IPv6DNS:     ips(info, ipv6DNSCount, ipv6DNSOffset, net.IPv6len),
+		MTU:         int(mtu),
+	}
+	return c, nil
+}
+
+// addresses reads an array of prefix length and address elements. Elements with an invalid prefix
+// length are skipped.
+func addresses(b []byte, count, offset uint32, size int) []net.IPNet {
+	nets := []net.IPNet{}
+	if offset == 0 {
+		return nets
+	}
+	for i := 0; i < int(count); i++ {
+		start := int(offset) + i*(4+size)
+		if start+4+size > len(b) {
+			break
+		}
+		prefix := binary.LittleEndian.Uint32(b[start:])
+		if prefix > uint32(size*8) {
+			continue
+		}
+		nets = append(nets, net.IPNet{
+			IP:   net.IP(append([]byte{}, b[start+4:start+4+size]...)),
+			Mask: net.CIDRMask(int(prefix), size*8),
+		})
+	}
+	return nets
+}
+
+// ips reads an array of addresses. The count is capped by the buffer length so a bad count can't
+// make it loop for long.
+func ips(b []byte, count, offset uint32, size int) []net.IP {
+	addrs := []net.IP{}
+	if offset == 0 {
+		return addrs
+	}
+	for i := 0; i < int(count); i++ {
+		start := int(offset) + i*size
+		if start+size > len(b) {
+			break
+		}
+		addrs = append(addrs, net.IP(append([]byte{}, b[start:start+size]...)))
+	}
+	return addrs
+}
+
+// ip reads an address at the offset, nil if the offset is 0 as there is no address.
+func ip(b []byte, offset uint32, size int) net.IP {
+	if offset == 0 || int(offset)+size > len(b) {
+		return nil
+	}
+	return net.IP(append([]byte{}, b[offset:int(offset)+size]...))
+}
@@ -0,0 +1,401 @@
+// Package mbim talks the Mobile Broadband Interface Model protocol to a modem over its /dev/cdc-wdm* control device.
+// Only the basic connect service requests needed to check the SIM, signal and registration and to start a
+// data session are implemented.
+package mbim
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// DefaultTimeout is how long a command waits for its response.
+const DefaultTimeout = 10 * time.Second
+
+// Message types.
+const (
+	msgOpen          = 0x00000001
+	msgClose         = 0x00000002
+	msgCommand       = 0x00000003
+	msgOpenDone      = 0x80000001
+	msgCloseDone     = 0x80000002
+	msgCommandDone   = 0x80000003
+	msgFunctionError = 0x80000004
+	msgIndicate      = 0x80000007
+)
+
+// Command types.
+const (
+	commandQuery = 0
+	commandSet   = 1
+)
+
+const (
+	headerLen          = 12
+	fragmentHeaderLen  = 8
+	maxControlTransfer = 4096
+)
+
+// Status is the status of a command response, it is an error unless it is StatusSuccess.
+type Status uint32
+
+const (
+	StatusSuccess             Status = 0
+	StatusBusy                Status = 1
+	StatusFailure             Status = 2
+	StatusSIMNotInserted      Status = 3
+	StatusBadSIM              Status = 4
+	StatusPINRequired         Status = 5
+	StatusNotRegistered       Status = 7
+	StatusProvidersNotFound   Status = 8
+	StatusNoDeviceSupport     Status = 9
+	StatusPacketSvcDetached   Status = 12
+	StatusMaxActivatedCtx     Status = 13
+	StatusNotInitialized      Status = 14
+	StatusContextNotActivated Status = 16
+	StatusInvalidAccessString Status = 18
+	StatusInvalidUserNamePwd  Status = 19
+	StatusRadioPowerOff       Status = 20
+)
+
+var statusNames = map[Status]string{
+	StatusBusy:                "busy",
+	StatusFailure:             "failure",
+	StatusSIMNotInserted:      "SIM not inserted",
+	StatusBadSIM:              "bad SIM",
+	StatusPINRequired:         "PIN required",
+	StatusNotRegistered:       "not registered",
+	StatusProvidersNotFound:   "providers not found",
+	StatusNoDeviceSupport:     "not supported by the device",
+	StatusPacketSvcDetached:   "packet service detached",
+	StatusMaxActivatedCtx:     "maximum activated contexts",
+	StatusNotInitialized:      "not initialized",
+	StatusContextNotActivated: "context not activated",
+	StatusInvalidAccessString: "invalid access string",
+	StatusInvalidUserNamePwd:  "invalid user name or password",
+	StatusRadioPowerOff:       "radio power off",
+}
+
+func (s Status) Error() string {
+	if name, ok := statusNames[s]; ok {
+		return "MBIM " + name
+	}
+	return fmt.Sprintf("MBIM status %d", uint32(s))
+}
+
+var ErrClosed = errors.New("MBIM device closed")
+
+// UUID identifies a device service or context type, in the byte order it is sent.
+type UUID [16]byte
+
+var (
+	// UUIDBasicConnect is the basic connect service, a289cc33-bcbb-8b4f-b6b0-133ec2aae6df.
+	UUIDBasicConnect = UUID{0xa2, 0x89, 0xcc, 0x33, 0xbc, 0xbb, 0x8b, 0x4f, 0xb6, 0xb0, 0x13, 0x3e, 0xc2, 0xaa, 0xe6, 0xdf}
+	// UUIDContextInternet is the context type for internet access, 7e5e2a7e-4e6f-7272-736b-656e7e5e2a7e.
+	UUIDContextInternet = UUID{0x7e, 0x5e, 0x2a, 0x7e, 0x4e, 0x6f, 0x72, 0x72, 0x73, 0x6b, 0x65, 0x6e, 0x7e, 0x5e, 0x2a, 0x7e}
+)
+
+type response struct {
+	typ    uint32
+	status Status
+	info   []byte
+}
+
+// partial is a command done message still waiting for fragments.
+type partial struct {
+	total uint32
+	next  uint32
+	resp  response
+}
+
+// Device is an open MBIM control device. It is safe to use from multiple goroutines.
+type Device struct {
+	f *os.File
+
+	mu       sync.Mutex
+	txn      uint32
+	pending  map[uint32]chan response
+	partials map[uint32]*partial
+	closed   bool
+	readErr  error
+}
+
+// Open opens the control device, e.g "/dev/cdc-wdm0", and opens the MBIM function on it.
+func Open(path string) (*Device, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return newDevice(f)
+}
+
+// newDevice opens the MBIM function on the device file, closing the file if that fails.
+func newDevice(f *os.File) (*Device, error) {
+	d := &Device{
+		f:        f,
+		pending:  map[uint32]chan response{},
+		partials: map[uint32]*partial{},
+	}
+	go d.readLoop()
+
+	body := make([]byte, 4)
+	binary.LittleEndian.PutUint32(body, maxControlTransfer)
+	resp, err := d.send(msgOpen, body)
+	if err == nil && resp.status != StatusSuccess {
+		err = resp.status
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open MBIM function: %w", err)
+	}
+	return d, nil
+}
+
+// Close closes the MBIM function and the device. The modem ends any data sessions when the function is closed.
+func (d *Device) Close() error {
+	if _, err := d.send(msgClose, nil); err != nil && !errors.Is(err, ErrClosed) {
+		d.f.Close()
+		return err
+	}
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	return d.f.Close()
+}
+
+func (d *Device) readLoop() {
+	buf := make([]byte, maxControlTransfer)
+	for {
+		n, err := d.f.Read(buf)
+		if err != nil {
+			d.mu.Lock()
+			d.readErr = err
+			for txn, ch := range d.pending {
+				close(ch)
+				delete(d.pending, txn)
+			}
+			d.mu.Unlock()
+			return
+		}
+		d.handle(buf[:n])
+	}
+}
+
+// handle reads a message from the device, putting fragmented command responses back together.
+func (d *Device) handle(b []byte) {
+	if len(b) < headerLen {
+		return
+	}
+	typ := binary.LittleEndian.Uint32(b)
+	txn := binary.LittleEndian.Uint32(b[8:])
+	resp := response{typ: typ}
+	switch typ {
+	case msgOpenDone, msgCloseDone, msgFunctionError:
+		if len(b) >= headerLen+4 {
+			resp.status = Status(binary.LittleEndian.Uint32(b[headerLen:]))
+		}
+	case msgCommandDone:
+		if len(b) < headerLen+fragmentHeaderLen {
+			return
+		}
+		total := binary.LittleEndian.Uint32(b[headerLen:])
+		current := binary.LittleEndian.Uint32(b[headerLen+4:])
+		body := b[headerLen+fragmentHeaderLen:]
+		d.mu.Lock()
+		p, ok := d.partials[txn]
+		if current == 0 {
+			// Device service, CID, status, information buffer length.
+			if len(body) < 28 {
+				d.mu.Unlock()
+				return
+			}
+			p = &partial{total: total, resp: response{typ: typ, status: Status(binary.LittleEndian.Uint32(body[20:]))}}
+			p.resp.info = append([]byte{}, body[28:]...)
+		} else if !ok || current != p.next {
+			delete(d.partials, txn)
+			d.mu.Unlock()
+			return
+		} else {
+			p.resp.info = append(p.resp.info, body...)
+		}
+		p.next = current + 1
+		if p.next < p.total {
+			d.partials[txn] = p
+			d.mu.Unlock()
+			return
+		}
+		delete(d.partials, txn)
+		d.mu.Unlock()
+		resp = p.resp
+	case msgIndicate:
+		return // Indications aren't needed, the state is queried when it is wanted.
+	default:
+		return
+	}
+	d.mu.Lock()
+	if ch, ok := d.pending[txn]; ok {
+		ch <- resp
+		delete(d.pending, txn)
+	}
+	d.mu.Unlock()
+}
+
+// send sends a message and waits for the response with the same transaction ID.
+func (d *Device) send(typ uint32, body []byte) (response, error) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return response{}, ErrClosed
+	}
+	if d.readErr != nil {
+		err := d.readErr
+		d.mu.Unlock()
+		return response{}, err
+	}
+	d.txn++
+	txn := d.txn
+	ch := make(chan response, 1)
+	d.pending[txn] = ch
+	d.mu.Unlock()
+
+	msg := make([]byte, headerLen, headerLen+len(body))
+	binary.LittleEndian.PutUint32(msg, typ)
+	binary.LittleEndian.PutUint32(msg[4:], uint32(headerLen+len(body)))
+	binary.LittleEndian.PutUint32(msg[8:], txn)
+	msg = append(msg, body...)
+	if _, err := d.f.Write(msg); err != nil {
+		d.mu.Lock()
+		delete(d.pending, txn)
+		d.mu.Unlock()
+		return response{}, err
+	}
+
+	timer := time.NewTimer(DefaultTimeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return response{}, ErrClosed
+		}
+		if resp.typ == msgFunctionError {
+			// Function errors are protocol errors, e.g the function isn't open, not command statuses.
+			return response{}, fmt.Errorf("MBIM function error %d", uint32(resp.status))
+		}
+		return resp, nil
+	case <-timer.C:
+		d.mu.Lock()
+		delete(d.pending, txn)
+		d.mu.Unlock()
+		return response{}, fmt.Errorf("timed out waiting for MBIM message 0x%08x response", typ)
+	}
+}
+
+// command sends a query or set command, returning the information buffer of the response.
+// The information buffer sent must fit in one fragment.
+func (d *Device) command(service UUID, cid, commandType uint32, info []byte) ([]byte, error) {
+	body := make([]byte, fragmentHeaderLen+28, fragmentHeaderLen+28+len(info))
+	binary.LittleEndian.PutUint32(body, 1) // Total fragments.
+	copy(body[fragmentHeaderLen:], service[:])
+	binary.LittleEndian.PutUint32(body[fragmentHeaderLen+16:], cid)
+	binary.LittleEndian.PutUint32(body[fragmentHeaderLen+20:], commandType)
+	binary.LittleEndian.PutUint32(body[fragmentHeaderLen+24:], uint32(len(info)))
+	body = append(body, info...)
+	resp, err := d.send(msgCommand, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != StatusSuccess {
+		return resp.info, resp.status
+	}
+	return resp.info, nil
+}
+
+// infoReader reads the fields of an information buffer. Once a read fails the rest return zero values.
+type infoReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *infoReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos+4 > len(r.b) {
+		r.err = errors.New("short MBIM information buffer")
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(r.b[r.pos:])
+	r.pos += 4
+	return v
+}
+
+// bytes reads an offset and size pair then returns the data they refer to.
+func (r *infoReader) bytes() []byte {
+	offset, size := int(r.uint32()), int(r.uint32())
+	if r.err != nil || size == 0 {
+		return nil
+	}
+	if offset < 0 || size < 0 || offset+size > len(r.b) {
+		r.err = errors.New("MBIM information buffer offset out of range")
+		return nil
+	}
+	return r.b[offset : offset+size]
+}
+
+// string reads an offset and size pair referring to a UTF-16LE string.
+func (r *infoReader) string() string {
+	b := r.bytes()
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// infoWriter builds an information buffer, with the variable length data after the fixed size fields.
+type infoWriter struct {
+	fixed    []byte
+	fixedLen int
+	data     []byte
+}
+
+func newInfoWriter(fixedLen int) *infoWriter {
+	return &infoWriter{fixedLen: fixedLen}
+}
+
+func (w *infoWriter) uint32(v uint32) {
+	w.fixed = binary.LittleEndian.AppendUint32(w.fixed, v)
+}
+
+func (w *infoWriter) uuid(u UUID) {
+	w.fixed = append(w.fixed, u[:]...)
+}
+
+// string adds an offset and size pair to the fixed fields for the string as UTF-16LE in the data,
+// which is padded to 4 bytes.
+func (w *infoWriter) string(s string) {
+	if s == "" {
+		w.uint32(0)
+		w.uint32(0)
+		return
+	}
+	b := []byte{}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	w.uint32(uint32(w.fixedLen + len(w.data)))
+	w.uint32(uint32(len(b)))
+	w.data = append(w.data, b...)
+	for len(w.data)%4 != 0 {
+		w.data = append(w.data, 0)
+	}
+}
+
+func (w *infoWriter) bytes() []byte {
+	return append(w.fixed, w.data...)
+}
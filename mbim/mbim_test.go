@@ -0,0 +1,375 @@
+package mbim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestInfoRoundTrip(t *testing.T) {
+	w := newInfoWriter(44)
+	w.uint32(7)
+	w.string("internet")
+	w.string("")
+	w.string("Māori")
+	w.uuid(UUIDContextInternet)
+	b := w.bytes()
+	if len(b)%4 != 0 {
+		t.Errorf("information buffer length %d isn't padded to 4 bytes", len(b))
+	}
+
+	r := &infoReader{b: b}
+	if v := r.uint32(); v != 7 {
+		t.Errorf("got %d, want 7", v)
+	}
+	for _, want := range []string{"internet", "", "Māori"} {
+		if s := r.string(); s != want {
+			t.Errorf("got string '%s', want '%s'", s, want)
+		}
+	}
+	if !bytes.Equal(b[r.pos:r.pos+16], UUIDContextInternet[:]) {
+		t.Errorf("got UUID % x", b[r.pos:r.pos+16])
+	}
+	if r.err != nil {
+		t.Error(r.err)
+	}
+}
+
+func TestInfoReaderMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"short value", []byte{0x01, 0x00}},
+		{"short offset and size", []byte{0x10, 0x00, 0x00, 0x00}},
+		{"offset past the end", []byte{0x10, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}},
+		{"size past the end", []byte{0x08, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff}},
+		{"maximum offset", []byte{0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		r := &infoReader{b: tt.b}
+		if s := r.string(); s != "" || r.err == nil {
+			t.Errorf("%s: got '%s' and error %v, want an error", tt.name, s, r.err)
+		}
+		// Once a read fails the rest return zero values.
+		if v := r.uint32(); v != 0 {
+			t.Errorf("%s: got %d after an error", tt.name, v)
+		}
+	}
+
+	// An odd number of bytes drops the last byte rather than failing.
+	r := &infoReader{b: []byte{0x08, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 'o', 0x00, 'k'}}
+	if s := r.string(); s != "o" || r.err != nil {
+		t.Errorf("got '%s' and error %v, want 'o'", s, r.err)
+	}
+}
+
+func TestAddressesBounds(t *testing.T) {
+	b := make([]byte, 8, 24)
+	b = append(b, 24, 0, 0, 0, 10, 1, 2, 3)
+	b = append(b, 33, 0, 0, 0, 10, 1, 2, 4) // Prefix too long for IPv4.
+	if nets := addresses(b, 2, 8, net.IPv4len); len(nets) != 1 || nets[0].String() != "10.1.2.3/24" {
+		t.Errorf("got %v, want [10.1.2.3/24]", nets)
+	}
+	if nets := addresses(b, 0xffffffff, 8, net.IPv4len); len(nets) != 1 {
+		t.Errorf("got %v with a bad count, want one address", nets)
+	}
+	if nets := addresses(b, 1, 0, net.IPv4len); len(nets) != 0 {
+		t.Errorf("got %v with no offset", nets)
+	}
+	if nets := addresses(b, 1, 0xfffffff0, net.IPv4len); len(nets) != 0 {
+		t.Errorf("got %v with an offset past the end", nets)
+	}
+
+	if addrs := ips(b, 0xffffffff, 12, net.IPv4len); len(addrs) != 3 {
+		t.Errorf("got %v with a bad count, want the 3 addresses in the buffer", addrs)
+	}
+	if addrs := ips(b, 4, 0xfffffff0, net.IPv4len); len(addrs) != 0 {
+		t.Errorf("got %v with an offset past the end", addrs)
+	}
+	if addr := ip(b, 12, net.IPv4len); !addr.Equal(net.IPv4(10, 1, 2, 3)) {
+		t.Errorf("got %v, want 10.1.2.3", addr)
+	}
+	if addr := ip(b, 20, net.IPv6len); addr != nil {
+		t.Errorf("got %v past the end", addr)
+	}
+}
+
+// commandDone makes a command done message, split into fragments with a short first fragment so
+// the information buffer is split too.
+func commandDone(txn uint32, cid uint32, status Status, info []byte, fragments int) [][]byte {
+	body := make([]byte, 28, 28+len(info))
+	copy(body, UUIDBasicConnect[:])
+	binary.LittleEndian.PutUint32(body[16:], cid)
+	binary.LittleEndian.PutUint32(body[20:], uint32(status))
+	binary.LittleEndian.PutUint32(body[24:], uint32(len(info)))
+	body = append(body, info...)
+
+	var msgs [][]byte
+	for i := 0; i < fragments; i++ {
+		part := body
+		if i < fragments-1 {
+			part = body[:min(len(body), 30)]
+		}
+		body = body[len(part):]
+		msg := make([]byte, headerLen+fragmentHeaderLen, headerLen+fragmentHeaderLen+len(part))
+		binary.LittleEndian.PutUint32(msg, msgCommandDone)
+		binary.LittleEndian.PutUint32(msg[4:], uint32(cap(msg)))
+		binary.LittleEndian.PutUint32(msg[8:], txn)
+		binary.LittleEndian.PutUint32(msg[12:], uint32(fragments))
+		binary.LittleEndian.PutUint32(msg[16:], uint32(i))
+		msgs = append(msgs, append(msg, part...))
+	}
+	return msgs
+}
+
+type fakeCommand struct {
+	cid         uint32
+	commandType uint32
+	info        []byte
+}
+
+type fakeResponse struct {
+	status    Status
+	info      []byte
+	fragments int
+}
+
+// fakeModem answers the messages a test sends to a device.
+func fakeModem(t *testing.T, f *os.File, respond func(cmd fakeCommand) fakeResponse) {
+	buf := make([]byte, maxControlTransfer)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		b := buf[:n]
+		if len(b) < headerLen || int(binary.LittleEndian.Uint32(b[4:])) != n {
+			t.Errorf("invalid message % x", b)
+			return
+		}
+		typ, txn := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[8:])
+		var msgs [][]byte
+		switch typ {
+		case msgOpen, msgClose:
+			msg := make([]byte, headerLen+4)
+			binary.LittleEndian.PutUint32(msg, typ|0x80000000)
+			binary.LittleEndian.PutUint32(msg[4:], uint32(len(msg)))
+			binary.LittleEndian.PutUint32(msg[8:], txn)
+			msgs = [][]byte{msg}
+		case msgCommand:
+			body := b[headerLen+fragmentHeaderLen:]
+			if !bytes.Equal(body[:16], UUIDBasicConnect[:]) {
+				t.Errorf("got service % x", body[:16])
+			}
+			cmd := fakeCommand{
+				cid:         binary.LittleEndian.Uint32(body[16:]),
+				commandType: binary.LittleEndian.Uint32(body[20:]),
+				info:        body[28:],
+			}
+			if length := int(binary.LittleEndian.Uint32(body[24:])); length != len(cmd.info) {
+				t.Errorf("information buffer length %d, want %d", length, len(cmd.info))
+			}
+			resp := respond(cmd)
+			msgs = commandDone(txn, cmd.cid, resp.status, resp.info, max(resp.fragments, 1))
+		}
+		for _, msg := range msgs {
+			if _, err := f.Write(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func openFakeDevice(t *testing.T, respond func(cmd fakeCommand) fakeResponse) *Device {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modem := os.NewFile(uintptr(fds[1]), "modem")
+	t.Cleanup(func() { modem.Close() })
+	go fakeModem(t, modem, respond)
+	d, err := newDevice(os.NewFile(uintptr(fds[0]), "mbim"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestSubscriberReadyStatus(t *testing.T) {
+	w := newInfoWriter(20)
+	w.uint32(uint32(ReadyInitialized))
+	w.string("530050000000001")
+	w.string("8964050000000000001")
+	info := w.bytes()
+	d := openFakeDevice(t, func(cmd fakeCommand) fakeResponse {
+		if cmd.cid != cidSubscriberReadyStatus || cmd.commandType != commandQuery || len(cmd.info) != 0 {
+			t.Errorf("unexpected command %+v", cmd)
+		}
+		return fakeResponse{info: info, fragments: 3}
+	})
+	s, err := d.SubscriberReadyStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SubscriberStatus{ReadyState: ReadyInitialized, SubscriberID: "530050000000001", ICCID: "8964050000000000001"}
+	if s != want {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	var got fakeCommand
+	d := openFakeDevice(t, func(cmd fakeCommand) fakeResponse {
+		got = cmd
+		return fakeResponse{status: StatusInvalidAccessString}
+	})
+	_, err := d.Connect(ConnectOptions{SessionID: 0, APN: "internet", Auth: AuthPAP, Username: "user", IPType: IPTypeIPv4v6})
+	if !errors.Is(err, StatusInvalidAccessString) {
+		t.Errorf("got error %v, want %v", err, StatusInvalidAccessString)
+	}
+	if got.cid != cidConnect || got.commandType != commandSet {
+		t.Fatalf("unexpected command %+v", got)
+	}
+	r := &infoReader{b: got.info}
+	values := []uint32{r.uint32(), r.uint32()}
+	strings := []string{r.string(), r.string(), r.string()}
+	values = append(values, r.uint32(), r.uint32(), r.uint32())
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if want := []uint32{0, 1, 0, uint32(AuthPAP), uint32(IPTypeIPv4v6)}; !reflect.DeepEqual(values, want) {
+		t.Errorf("got values %v, want %v", values, want)
+	}
+	if want := []string{"internet", "user", ""}; !reflect.DeepEqual(strings, want) {
+		t.Errorf("got strings %q, want %q", strings, want)
+	}
+	if !bytes.Equal(got.info[r.pos:r.pos+16], UUIDContextInternet[:]) {
+		t.Errorf("got context type % x", got.info[r.pos:r.pos+16])
+	}
+}
+
+func TestIPConfiguration(t *testing.T) {
+	info := make([]byte, 60)
+	for i, v := range []uint32{
+		0,     // Session ID
+		0x0f,  // IPv4 configuration available
+		0,     // IPv6 configuration available
+		1, 60, // IPv4 addresses
+		0, 0, // IPv6 addresses
+		68, 0, // IPv4 and IPv6 gateways
+		2, 72, // IPv4 DNS servers
+		0, 0, // IPv6 DNS servers
+		1500, 0, // IPv4 and IPv6 MTU
+	} {
+		binary.LittleEndian.PutUint32(info[i*4:], v)
+	}
+	info = append(info, 30, 0, 0, 0, 10, 64, 64, 64)
+	info = append(info, 10, 64, 64, 65)
+	info = append(info, 8, 8, 8, 8, 8, 8, 4, 4)
+	d := openFakeDevice(t, func(cmd fakeCommand) fakeResponse {
+		if cmd.cid != cidIPConfiguration || len(cmd.info) != 60 {
+			t.Errorf("unexpected command %+v", cmd)
+		}
+		return fakeResponse{info: info, fragments: 2}
+	})
+	c, err := d.IPConfiguration(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.IPv4) != 1 || c.IPv4[0].String() != "10.64.64.64/30" {
+		t.Errorf("got IPv4 %v", c.IPv4)
+	}
+	if !c.IPv4Gateway.Equal(net.IPv4(10, 64, 64, 65)) {
+		t.Errorf("got IPv4 gateway %v", c.IPv4Gateway)
+	}
+	if len(c.IPv4DNS) != 2 || !c.IPv4DNS[0].Equal(net.IPv4(8, 8, 8, 8)) || !c.IPv4DNS[1].Equal(net.IPv4(8, 8, 4, 4)) {
+		t.Errorf("got IPv4 DNS %v", c.IPv4DNS)
+	}
+	if len(c.IPv6) != 0 || c.IPv6Gateway != nil || len(c.IPv6DNS) != 0 {
+		t.Errorf("got IPv6 %v, gateway %v, DNS %v, want none", c.IPv6, c.IPv6Gateway, c.IPv6DNS)
+	}
+	if c.MTU != 1500 {
+		t.Errorf("got MTU %d, want 1500", c.MTU)
+	}
+
+	// The fixed fields cut short.
+	d = openFakeDevice(t, func(cmd fakeCommand) fakeResponse {
+		return fakeResponse{info: info[:40]}
+	})
+	if _, err := d.IPConfiguration(0); err == nil {
+		t.Error("expected an error for a short information buffer")
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	d := &Device{pending: map[uint32]chan response{}, partials: map[uint32]*partial{}}
+	wait := func(txn uint32) chan response {
+		ch := make(chan response, 1)
+		d.pending[txn] = ch
+		return ch
+	}
+	info := []byte("0123456789abcdef0123456789abcdef")
+
+	// No part of a message is taken as the response.
+	ch := wait(1)
+	msg := commandDone(1, cidSignalState, StatusSuccess, info, 1)[0]
+	for i := 0; i < headerLen+fragmentHeaderLen+28; i++ {
+		d.handle(msg[:i])
+	}
+	select {
+	case resp := <-ch:
+		t.Fatalf("got response %+v from part of a message", resp)
+	default:
+	}
+
+	// Fragments out of order are dropped.
+	fragments := commandDone(1, cidSignalState, StatusSuccess, info, 3)
+	d.handle(fragments[0])
+	d.handle(fragments[2])
+	d.handle(fragments[1])
+	select {
+	case resp := <-ch:
+		t.Fatalf("got response %+v from fragments out of order", resp)
+	default:
+	}
+	if len(d.partials) != 0 {
+		t.Errorf("%d partial responses kept", len(d.partials))
+	}
+
+	// A fragment that doesn't continue a response is dropped.
+	d.handle(fragments[1])
+	if len(d.partials) != 0 {
+		t.Errorf("%d partial responses kept", len(d.partials))
+	}
+
+	for _, fragment := range fragments {
+		d.handle(fragment)
+	}
+	select {
+	case resp := <-ch:
+		if !bytes.Equal(resp.info, info) || resp.status != StatusSuccess {
+			t.Errorf("got response %+v", resp)
+		}
+	default:
+		t.Fatal("no response from the fragments")
+	}
+
+	// A response to another transaction isn't taken.
+	ch = wait(2)
+	for _, fragment := range commandDone(3, cidSignalState, StatusSuccess, info, 1) {
+		d.handle(fragment)
+	}
+	select {
+	case resp := <-ch:
+		t.Fatalf("got response %+v for another transaction", resp)
+	default:
+	}
+}
@@ -1,6 +1,9 @@
 package modemcontroller
 
 import (
+	"regexp"
+	"time"
+
 	"github.com/godbus/dbus"
 )
 
@@ -10,6 +13,19 @@ const (
 	methodBase = "org.cacophony.modemd"
 )
 
+// atCommandRedactions hide the credentials in AT commands and responses before they are logged.
+var atCommandRedactions = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(\+CGAUTH[=:]\s*\d+\s*,\s*\d+\s*,).*`),
+}
+
+// RedactATCommand hides the credentials in an AT command or its response, for logging.
+func RedactATCommand(cmd string) string {
+	for _, re := range atCommandRedactions {
+		cmd = re.ReplaceAllString(cmd, "${1}<redacted>")
+	}
+	return cmd
+}
+
 func GetModemStatus() (map[string]interface{}, error) {
 	obj, err := getDbusObj()
 	if err != nil {
@@ -48,6 +64,150 @@ func StayOffFor(minutes int) error {
 	return obj.Call(methodBase+".StayOffFor", 0, minutes).Store()
 }
 
+func ResetFailures() error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".ResetFailures", 0).Store()
+}
+
+func GPSOn() error {
+	return callMethod("GPSOn")
+}
+
+func GPSOff() error {
+	return callMethod("GPSOff")
+}
+
+func GPSColdStart() error {
+	return callMethod("GPSColdStart")
+}
+
+func GPSHotStart() error {
+	return callMethod("GPSHotStart")
+}
+
+// GetLocation returns the last GPS fix from modemd.
+func GetLocation() (map[string]interface{}, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	location := make(map[string]interface{})
+	err = obj.Call(methodBase+".GetLocation", 0).Store(&location)
+	return location, err
+}
+
+// GetCellLocation returns the approximate location from the serving cell.
+func GetCellLocation() (map[string]interface{}, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	location := make(map[string]interface{})
+	err = obj.Call(methodBase+".GetCellLocation", 0).Store(&location)
+	return location, err
+}
+
+// GetSignal returns the current signal metrics from modemd.
+func GetSignal() (map[string]interface{}, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	signal := make(map[string]interface{})
+	err = obj.Call(methodBase+".GetSignal", 0).Store(&signal)
+	return signal, err
+}
+
+// GetSignalHistory returns the signal samples that modemd took after the given time, oldest first.
+func GetSignalHistory(since time.Time) ([]map[string]interface{}, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	history := []map[string]interface{}{}
+	err = obj.Call(methodBase+".GetSignalHistory", 0, since.Unix()).Store(&history)
+	return history, err
+}
+
+// GetConnectionQuality returns the connection quality measurements that modemd took after the given time, oldest first.
+func GetConnectionQuality(since time.Time) ([]map[string]interface{}, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	measurements := []map[string]interface{}{}
+	err = obj.Call(methodBase+".GetConnectionQuality", 0, since.Unix()).Store(&measurements)
+	return measurements, err
+}
+
+// GetDataUsage returns the data used in the current billing period.
+func GetDataUsage() (map[string]interface{}, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]interface{})
+	err = obj.Call(methodBase+".GetDataUsage", 0).Store(&usage)
+	return usage, err
+}
+
+// ListPDPContexts returns the PDP contexts on the modem, without their credentials.
+func ListPDPContexts() ([]map[string]interface{}, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	contexts := []map[string]interface{}{}
+	err = obj.Call(methodBase+".ListPDPContexts", 0).Store(&contexts)
+	return contexts, err
+}
+
+// DefinePDPContext creates or changes a PDP context, pdpType is "IP", "IPV6" or "IPV4V6".
+func DefinePDPContext(cid int, pdpType, apn string) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".DefinePDPContext", 0, cid, pdpType, apn).Store()
+}
+
+func DeletePDPContext(cid int) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".DeletePDPContext", 0, cid).Store()
+}
+
+// SetPDPAuth sets the authentication for a PDP context, auth is "none", "pap" or "chap".
+func SetPDPAuth(cid int, auth, username, password string) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".SetPDPAuth", 0, cid, auth, username, password).Store()
+}
+
+// SetDefaultPDPContext sets the PDP context used for the data connection.
+func SetDefaultPDPContext(cid int) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".SetDefaultPDPContext", 0, cid).Store()
+}
+
+func callMethod(method string) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+"."+method, 0).Store()
+}
+
 func getDbusObj() (dbus.BusObject, error) {
 	conn, err := dbus.SystemBus()
 	if err != nil {
@@ -48,3 +48,76 @@ func GetModemConnectedSignalListener() (chan time.Time, error) {
 
 	return modemConnectedSignals, nil
 }
+
+// GetLocationUpdatedSignalListener returns a channel that receives the GPS fix each time modemd
+// sends a "LocationUpdated" signal on the DBus system bus.
+func GetLocationUpdatedSignalListener() (chan map[string]interface{}, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+
+	rule := fmt.Sprintf("type='signal',interface='%s',path='%s',member='LocationUpdated'", DBusInterface, DBusPath)
+	call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, rule)
+	if call.Err != nil {
+		return nil, call.Err
+	}
+
+	modemSignals := make(chan *dbus.Signal, 10)
+	conn.Signal(modemSignals)
+
+	locations := make(chan map[string]interface{}, 10)
+	go func() {
+		for v := range modemSignals {
+			if v.Path != dbus.ObjectPath(DBusPath) || v.Name != DBusInterface+".LocationUpdated" || len(v.Body) == 0 {
+				continue
+			}
+			location := map[string]interface{}{}
+			if err := dbus.Store(v.Body, &location); err != nil {
+				continue
+			}
+			locations <- location
+		}
+	}()
+
+	return locations, nil
+}
+
+// GeofenceEvent is sent by modemd when the device leaves a geofence ("geofenceExit") or moves ("deviceMoved").
+type GeofenceEvent struct {
+	Type    string
+	Details map[string]interface{}
+}
+
+// GetGeofenceSignalListener returns a channel that receives the "GeofenceEvent" signals from modemd.
+func GetGeofenceSignalListener() (chan GeofenceEvent, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+
+	rule := fmt.Sprintf("type='signal',interface='%s',path='%s',member='GeofenceEvent'", DBusInterface, DBusPath)
+	call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, rule)
+	if call.Err != nil {
+		return nil, call.Err
+	}
+
+	modemSignals := make(chan *dbus.Signal, 10)
+	conn.Signal(modemSignals)
+
+	events := make(chan GeofenceEvent, 10)
+	go func() {
+		for v := range modemSignals {
+			if v.Path != dbus.ObjectPath(DBusPath) || v.Name != DBusInterface+".GeofenceEvent" || len(v.Body) < 2 {
+				continue
+			}
+			event := GeofenceEvent{}
+			if err := dbus.Store(v.Body, &event.Type, &event.Details); err != nil {
+				continue
+			}
+			events <- event
+		}
+	}()
+
+	return events, nil
+}
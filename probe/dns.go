@@ -0,0 +1,35 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS looks up the name, sending the queries out the interface. The server is an IP address, or ""
+// to use the servers in /etc/resolv.conf.
+func DNS(name, server string, opts Options) Result {
+	r := Result{Probe: "dns", Target: name}
+	d := dialer(opts)
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if server != "" {
+				address = net.JoinHostPort(server, "53")
+			}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout())
+	defer cancel()
+	start := time.Now()
+	addrs, err := resolver.LookupHost(ctx, name)
+	r.Latency = time.Since(start)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	r.Detail = strings.Join(addrs, ", ")
+	return r
+}
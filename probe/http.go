@@ -0,0 +1,81 @@
+package probe
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// HTTP requests the URL without following redirects. If expectStatus is 0 any 2xx status passes.
+// Being redirected, or getting a different 2xx status than expected (e.g 200 from a
+// "generate_204" URL), is reported as ErrCaptivePortal.
+func HTTP(url string, expectStatus int, opts Options) Result {
+	r := Result{Probe: "http", Target: url}
+	client := httpClient(opts)
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		r.Latency = time.Since(start)
+		r.Err = err
+		return r
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	r.Latency = time.Since(start)
+	r.Detail = resp.Status
+
+	switch {
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		r.Err = fmt.Errorf("%w, redirected to '%s'", ErrCaptivePortal, resp.Header.Get("Location"))
+	case expectStatus != 0 && resp.StatusCode != expectStatus && resp.StatusCode/100 == 2:
+		r.Err = fmt.Errorf("%w, got status %d instead of %d", ErrCaptivePortal, resp.StatusCode, expectStatus)
+	case expectStatus != 0 && resp.StatusCode != expectStatus, expectStatus == 0 && resp.StatusCode/100 != 2:
+		r.Err = fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+	return r
+}
+
+// Download reads up to maxBytes from the URL to measure the throughput, Bytes / Latency. Latency includes
+// connecting and the request so small downloads will under estimate the throughput.
+func Download(url string, maxBytes int64, opts Options) Result {
+	r := Result{Probe: "download", Target: url}
+	start := time.Now()
+	resp, err := httpClient(opts).Get(url)
+	if err != nil {
+		r.Latency = time.Since(start)
+		r.Err = err
+		return r
+	}
+	defer resp.Body.Close()
+	r.Bytes, err = io.Copy(io.Discard, io.LimitReader(resp.Body, maxBytes))
+	r.Latency = time.Since(start)
+	r.Detail = resp.Status
+	if err != nil {
+		r.Err = err
+	} else if resp.StatusCode/100 != 2 {
+		r.Err = fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+	return r
+}
+
+// Throughput in bits per second of a download.
+func (r Result) Throughput() float64 {
+	if r.Latency <= 0 {
+		return 0
+	}
+	return float64(r.Bytes*8) / r.Latency.Seconds()
+}
+
+func httpClient(opts Options) *http.Client {
+	return &http.Client{
+		Timeout: opts.timeout(),
+		Transport: &http.Transport{
+			DialContext:       dialer(opts).DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,217 @@
+package probe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ICMP echo types.
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// DefaultICMPInterval is the default time between echo requests.
+const DefaultICMPInterval = time.Second
+
+// ICMP sends count echo requests to the host, one every Options.Interval, and waits for the
+// replies until all have arrived or the timeout. It fails if no replies were received.
+//
+// An unprivileged ICMP socket is used if net.ipv4.ping_group_range allows it, otherwise a raw socket,
+// which needs CAP_NET_RAW.
+func ICMP(host string, count int, opts Options) Result {
+	r := Result{Probe: "icmp", Target: host}
+	if count < 1 {
+		count = 1
+	}
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	s, err := newICMPSocket(addr.IP, opts.Interface)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	defer unix.Close(s.fd)
+
+	id := uint16(rand.Intn(0x10000))
+	sentAt := map[uint16]time.Time{}
+	deadline := time.Now().Add(opts.timeout())
+	nextSend := time.Now()
+	buf := make([]byte, 1500)
+	for r.Received < count {
+		now := time.Now()
+		if !now.Before(deadline) {
+			break
+		}
+		if r.Sent < count && !now.Before(nextSend) {
+			seq := uint16(r.Sent)
+			if err := s.send(id, seq); err != nil {
+				r.Err = fmt.Errorf("failed to send echo request: %w", err)
+				return r
+			}
+			sentAt[seq] = time.Now()
+			r.Sent++
+			nextSend = nextSend.Add(opts.interval())
+		}
+
+		wait := time.Until(deadline)
+		if r.Sent < count {
+			wait = min(wait, time.Until(nextSend))
+		}
+		n, from, err := s.recv(buf, wait)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			r.Err = fmt.Errorf("failed to receive echo reply: %w", err)
+			return r
+		}
+		seq, ok := s.parseReply(buf[:n], id)
+		if !ok || (s.raw && !from.Equal(addr.IP)) {
+			continue // Not a reply to this probe.
+		}
+		if t, ok := sentAt[seq]; ok {
+			r.RTTs = append(r.RTTs, time.Since(t))
+			r.Received++
+			r.Detail = from.String()
+			delete(sentAt, seq)
+		}
+	}
+	if r.Received == 0 {
+		r.Err = ErrNoReply
+		return r
+	}
+	var sum time.Duration
+	for _, rtt := range r.RTTs {
+		sum += rtt
+	}
+	r.Latency = sum / time.Duration(r.Received)
+	return r
+}
+
+type icmpSocket struct {
+	fd        int
+	v6        bool
+	raw       bool // Raw sockets receive the replies to every process, with the IP header for IPv4.
+	sockaddr  unix.Sockaddr
+	echoType  byte
+	replyType byte
+}
+
+func newICMPSocket(ip net.IP, iface string) (*icmpSocket, error) {
+	s := &icmpSocket{}
+	family, proto := unix.AF_INET, unix.IPPROTO_ICMP
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &unix.SockaddrInet4{}
+		copy(sa.Addr[:], ip4)
+		s.sockaddr = sa
+		s.echoType, s.replyType = icmpv4EchoRequest, icmpv4EchoReply
+	} else {
+		sa := &unix.SockaddrInet6{}
+		copy(sa.Addr[:], ip.To16())
+		s.sockaddr = sa
+		s.v6 = true
+		family, proto = unix.AF_INET6, unix.IPPROTO_ICMPV6
+		s.echoType, s.replyType = icmpv6EchoRequest, icmpv6EchoReply
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		fd, err = unix.Socket(family, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open ICMP socket: %w", err)
+		}
+		s.raw = true
+	}
+	s.fd = fd
+	if iface != "" {
+		if err := unix.BindToDevice(fd, iface); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to bind to '%s': %w", iface, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *icmpSocket) send(id, seq uint16) error {
+	return unix.Sendto(s.fd, s.echoRequest(id, seq), 0, s.sockaddr)
+}
+
+func (s *icmpSocket) echoRequest(id, seq uint16) []byte {
+	msg := make([]byte, 8+16)
+	msg[0] = s.echoType
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[8:], "modemd probe")
+	if !s.v6 {
+		// The kernel fills in the ICMPv6 checksum.
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	}
+	return msg
+}
+
+func (s *icmpSocket) recv(buf []byte, wait time.Duration) (int, net.IP, error) {
+	// A zero timeout would block forever.
+	tv := unix.NsecToTimeval(max(wait, time.Millisecond).Nanoseconds())
+	if err := unix.SetsockoptTimeval(s.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return 0, nil, err
+	}
+	n, from, err := unix.Recvfrom(s.fd, buf, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch sa := from.(type) {
+	case *unix.SockaddrInet4:
+		return n, net.IP(sa.Addr[:]), nil
+	case *unix.SockaddrInet6:
+		return n, net.IP(sa.Addr[:]), nil
+	}
+	return n, nil, nil
+}
+
+// parseReply returns the sequence number if the message is an echo reply for this probe.
+func (s *icmpSocket) parseReply(msg []byte, id uint16) (uint16, bool) {
+	if s.raw && !s.v6 {
+		if len(msg) < 20 {
+			return 0, false
+		}
+		headerLen := int(msg[0]&0x0f) * 4
+		if headerLen < 20 || headerLen > len(msg) {
+			return 0, false
+		}
+		msg = msg[headerLen:]
+	}
+	if len(msg) < 8 || msg[0] != s.replyType {
+		return 0, false
+	}
+	// The kernel replaces the id on unprivileged sockets and only passes on their own replies.
+	if s.raw && binary.BigEndian.Uint16(msg[4:]) != id {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(msg[6:]), true
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,115 @@
+package probe
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want uint16
+	}{
+		// The example from RFC 1071.
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0x220d},
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6}, 0x2304}, // An odd length is padded with a zero byte.
+		{[]byte{0xff, 0xff, 0xff, 0xff}, 0x0000},
+		{nil, 0xffff},
+	}
+	for _, tt := range tests {
+		if got := checksum(tt.b); got != tt.want {
+			t.Errorf("checksum(% x) got %04x, want %04x", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestEchoRequest(t *testing.T) {
+	payload := append([]byte("modemd probe"), 0, 0, 0, 0)
+	v4 := &icmpSocket{echoType: icmpv4EchoRequest, replyType: icmpv4EchoReply}
+	want := append([]byte{0x08, 0x00, 0xb1, 0x4a, 0x12, 0x34, 0x00, 0x03}, payload...)
+	msg := v4.echoRequest(0x1234, 3)
+	if !bytes.Equal(msg, want) {
+		t.Errorf("got IPv4 echo request % x, want % x", msg, want)
+	}
+	// The checksum of a message with its checksum is 0.
+	if sum := checksum(msg); sum != 0 {
+		t.Errorf("IPv4 echo request doesn't verify, got %04x", sum)
+	}
+
+	// The kernel fills in the ICMPv6 checksum as it covers the IPv6 addresses.
+	v6 := &icmpSocket{v6: true, echoType: icmpv6EchoRequest, replyType: icmpv6EchoReply}
+	want = append([]byte{0x80, 0x00, 0x00, 0x00, 0x12, 0x34, 0x00, 0x03}, payload...)
+	if msg := v6.echoRequest(0x1234, 3); !bytes.Equal(msg, want) {
+		t.Errorf("got IPv6 echo request % x, want % x", msg, want)
+	}
+}
+
+// An echo reply from 8.8.8.8 to id 0x1234 sequence 3, with its IPv4 header as a raw socket receives it.
+var (
+	ipv4Header = []byte{
+		0x45, 0x00, 0x00, 0x2c, 0xbe, 0xef, 0x00, 0x00, 0x75, 0x01, 0x2c, 0x52,
+		0x08, 0x08, 0x08, 0x08, 0x0a, 0x40, 0x40, 0x40,
+	}
+	ipv4EchoReply = []byte{
+		0x00, 0x00, 0xb9, 0x4a, 0x12, 0x34, 0x00, 0x03,
+		0x6d, 0x6f, 0x64, 0x65, 0x6d, 0x64, 0x20, 0x70, 0x72, 0x6f, 0x62, 0x65, 0x00, 0x00, 0x00, 0x00,
+	}
+	// IPv6 raw sockets don't include the IP header.
+	ipv6EchoReply = []byte{
+		0x81, 0x00, 0x5c, 0x1e, 0x12, 0x34, 0x00, 0x03,
+		0x6d, 0x6f, 0x64, 0x65, 0x6d, 0x64, 0x20, 0x70, 0x72, 0x6f, 0x62, 0x65, 0x00, 0x00, 0x00, 0x00,
+	}
+)
+
+func withID(msg []byte, offset int, id uint16) []byte {
+	b := append([]byte{}, msg...)
+	b[offset+4], b[offset+5] = byte(id>>8), byte(id)
+	return b
+}
+
+func TestParseReply(t *testing.T) {
+	v4Raw := &icmpSocket{raw: true, echoType: icmpv4EchoRequest, replyType: icmpv4EchoReply}
+	v4 := &icmpSocket{echoType: icmpv4EchoRequest, replyType: icmpv4EchoReply}
+	v6Raw := &icmpSocket{raw: true, v6: true, echoType: icmpv6EchoRequest, replyType: icmpv6EchoReply}
+	v6 := &icmpSocket{v6: true, echoType: icmpv6EchoRequest, replyType: icmpv6EchoReply}
+	rawReply := append(append([]byte{}, ipv4Header...), ipv4EchoReply...)
+	withOptions := append(append([]byte{0x46}, ipv4Header[1:]...), 0x01, 0x01, 0x01, 0x00)
+	withOptions = append(withOptions, ipv4EchoReply...)
+
+	tests := []struct {
+		name string
+		s    *icmpSocket
+		msg  []byte
+		ok   bool
+	}{
+		{"IPv4 raw", v4Raw, rawReply, true},
+		{"IPv4 raw with IP options", v4Raw, withOptions, true},
+		{"IPv4 raw wrong ID", v4Raw, withID(rawReply, 20, 0x4321), false},
+		{"IPv4 raw echo request", v4Raw, append(append([]byte{}, ipv4Header...), v4Raw.echoRequest(0x1234, 3)...), false},
+		{"IPv4 raw header only", v4Raw, ipv4Header, false},
+		{"IPv4 raw header length past the end", v4Raw, append([]byte{0x4f}, rawReply[1:]...), false},
+		{"IPv4 raw header length too short", v4Raw, append([]byte{0x44}, rawReply[1:]...), false},
+		{"IPv4 raw short", v4Raw, rawReply[:12], false},
+		{"IPv4 raw empty", v4Raw, nil, false},
+		{"IPv4 raw IPv6 reply", v4Raw, append(append([]byte{}, ipv4Header...), ipv6EchoReply...), false},
+		// The kernel sets the ID on datagram sockets and only passes on their replies.
+		{"IPv4 datagram", v4, ipv4EchoReply, true},
+		{"IPv4 datagram other ID", v4, withID(ipv4EchoReply, 0, 0x4321), true},
+		{"IPv4 datagram short", v4, ipv4EchoReply[:7], false},
+		{"IPv6 raw", v6Raw, ipv6EchoReply, true},
+		{"IPv6 raw wrong ID", v6Raw, withID(ipv6EchoReply, 0, 0x4321), false},
+		{"IPv6 raw IPv4 reply", v6Raw, ipv4EchoReply, false},
+		{"IPv6 raw short", v6Raw, ipv6EchoReply[:7], false},
+		{"IPv6 datagram", v6, ipv6EchoReply, true},
+		{"IPv6 datagram other ID", v6, withID(ipv6EchoReply, 0, 0x4321), true},
+		{"IPv6 datagram echo request", v6, v6.echoRequest(0x1234, 3), false},
+	}
+	for _, tt := range tests {
+		seq, ok := tt.s.parseReply(tt.msg, 0x1234)
+		if ok != tt.ok {
+			t.Errorf("%s: got ok %t, want %t", tt.name, ok, tt.ok)
+		} else if ok && seq != 3 {
+			t.Errorf("%s: got sequence %d, want 3", tt.name, seq)
+		}
+	}
+}
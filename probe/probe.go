@@ -0,0 +1,105 @@
+// Package probe checks connectivity over a network interface without running external programs.
+// There are ICMP echo, TCP connect, HTTP, download and DNS probes, each returning the latency or why it failed.
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultTimeout is used when Options.Timeout is 0.
+const DefaultTimeout = 5 * time.Second
+
+var (
+	ErrNoReply       = errors.New("no reply")
+	ErrCaptivePortal = errors.New("captive portal detected")
+)
+
+// Options are common to all the probes.
+type Options struct {
+	Interface string        // Interface to send the probe out of, "" to use the routing table.
+	Timeout   time.Duration // Time allowed for the whole probe.
+	Interval  time.Duration // Time between ICMP echo requests, 0 for DefaultICMPInterval.
+}
+
+func (o Options) interval() time.Duration {
+	if o.Interval <= 0 {
+		return DefaultICMPInterval
+	}
+	return o.Interval
+}
+
+func (o Options) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return o.Timeout
+}
+
+// Result of a probe. The probe succeeded if Err is nil.
+type Result struct {
+	Probe    string          // "icmp", "tcp", "http", "download" or "dns".
+	Target   string          // Host, address, URL or name probed.
+	Latency  time.Duration   // Average round trip time for ICMP, otherwise the time taken.
+	Sent     int             // ICMP echo requests sent.
+	Received int             // ICMP echo replies received.
+	RTTs     []time.Duration // Round trip time of each ICMP echo reply, in the order received.
+	Bytes    int64           // Bytes downloaded.
+	Detail   string          // e.g the address that replied, HTTP status or addresses resolved.
+	Err      error
+}
+
+func (r Result) OK() bool {
+	return r.Err == nil
+}
+
+// Loss is the fraction of ICMP echo requests without a reply.
+func (r Result) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Sent-r.Received) / float64(r.Sent)
+}
+
+func (r Result) String() string {
+	s := fmt.Sprintf("%s %s", r.Probe, r.Target)
+	if r.Sent > 0 {
+		s += fmt.Sprintf(" %d/%d replies", r.Received, r.Sent)
+	}
+	if r.Err != nil {
+		return s + " failed: " + r.Err.Error()
+	}
+	if r.Bytes > 0 {
+		s += fmt.Sprintf(" %d bytes", r.Bytes)
+	}
+	s += fmt.Sprintf(" in %s", r.Latency.Round(time.Microsecond))
+	if r.Detail != "" {
+		s += " (" + r.Detail + ")"
+	}
+	return s
+}
+
+// dialer makes a dialer that binds its sockets to the interface.
+func dialer(opts Options) *net.Dialer {
+	d := &net.Dialer{Timeout: opts.timeout()}
+	if opts.Interface != "" {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var bindErr error
+			if err := c.Control(func(fd uintptr) {
+				bindErr = unix.BindToDevice(int(fd), opts.Interface)
+			}); err != nil {
+				return err
+			}
+			if bindErr != nil {
+				return fmt.Errorf("failed to bind to '%s': %w", opts.Interface, bindErr)
+			}
+			return nil
+		}
+	}
+	return d
+}
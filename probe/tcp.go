@@ -0,0 +1,18 @@
+package probe
+
+import "time"
+
+// TCP connects to the address, "host:port", and closes the connection.
+func TCP(address string, opts Options) Result {
+	r := Result{Probe: "tcp", Target: address}
+	start := time.Now()
+	conn, err := dialer(opts).Dial("tcp", address)
+	r.Latency = time.Since(start)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	r.Detail = conn.RemoteAddr().String()
+	conn.Close()
+	return r
+}
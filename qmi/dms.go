@@ -0,0 +1,69 @@
+package qmi
+
+import "errors"
+
+// DMS messages.
+const (
+	dmsUIMGetPINStatus = 0x002B
+	dmsUIMGetICCID     = 0x003C
+	dmsUIMGetState     = 0x0044
+)
+
+// SIMState is the initialization state of the SIM.
+type SIMState uint8
+
+const (
+	SIMInitialized SIMState = 0x00
+	SIMFailed      SIMState = 0x01
+	SIMNotPresent  SIMState = 0x02
+	SIMUnavailable SIMState = 0xFF
+)
+
+// SIMState gets the initialization state of the SIM.
+func (d *Device) SIMState() (SIMState, error) {
+	resp, err := d.request(ServiceDMS, dmsUIMGetState, tlvs{})
+	if err != nil {
+		return SIMUnavailable, err
+	}
+	if len(resp[0x01]) < 1 {
+		return SIMUnavailable, errors.New("invalid DMS UIM state response")
+	}
+	return SIMState(resp[0x01][0]), nil
+}
+
+// PINStatus is the state of the SIM PIN.
+type PINStatus uint8
+
+const (
+	PINNotInitialized     PINStatus = 0
+	PINNotVerified        PINStatus = 1 // Enabled and needs to be entered.
+	PINVerified           PINStatus = 2
+	PINDisabled           PINStatus = 3
+	PINBlocked            PINStatus = 4 // Needs the PUK.
+	PINPermanentlyBlocked PINStatus = 5
+	PINUnblocked          PINStatus = 6
+	PINChanged            PINStatus = 7
+)
+
+// PIN1Status gets the state of the SIM PIN and the number of times it can still be entered.
+func (d *Device) PIN1Status() (PINStatus, int, error) {
+	resp, err := d.request(ServiceDMS, dmsUIMGetPINStatus, tlvs{})
+	if err != nil {
+		return PINNotInitialized, 0, err
+	}
+	// Status, verify retries left, unblock retries left.
+	v := resp[0x11]
+	if len(v) < 3 {
+		return PINNotInitialized, 0, errors.New("invalid DMS PIN status response")
+	}
+	return PINStatus(v[0]), int(v[1]), nil
+}
+
+// ICCID gets the SIM's ICCID.
+func (d *Device) ICCID() (string, error) {
+	resp, err := d.request(ServiceDMS, dmsUIMGetICCID, tlvs{})
+	if err != nil {
+		return "", err
+	}
+	return string(resp[0x01]), nil
+}
@@ -0,0 +1,136 @@
+package qmi
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// NAS messages.
+const (
+	nasGetServingSystem = 0x0024
+	nasGetSignalInfo    = 0x004F
+)
+
+// RadioInterface is the radio access technology.
+type RadioInterface uint8
+
+const (
+	RadioNone    RadioInterface = 0x00
+	RadioCDMA1x  RadioInterface = 0x01
+	RadioEVDO    RadioInterface = 0x02
+	RadioGSM     RadioInterface = 0x04
+	RadioUMTS    RadioInterface = 0x05
+	RadioLTE     RadioInterface = 0x08
+	RadioTDSCDMA RadioInterface = 0x09
+	RadioNR5G    RadioInterface = 0x0C
+)
+
+func (r RadioInterface) String() string {
+	switch r {
+	case RadioNone:
+		return "none"
+	case RadioCDMA1x:
+		return "CDMA 1x"
+	case RadioEVDO:
+		return "CDMA EV-DO"
+	case RadioGSM:
+		return "GSM"
+	case RadioUMTS:
+		return "UMTS"
+	case RadioLTE:
+		return "LTE"
+	case RadioTDSCDMA:
+		return "TD-SCDMA"
+	case RadioNR5G:
+		return "5G NR"
+	}
+	return "unknown"
+}
+
+// RegistrationState is the registration with the serving system.
+type RegistrationState uint8
+
+const (
+	NotRegistered       RegistrationState = 0
+	Registered          RegistrationState = 1
+	Searching           RegistrationState = 2
+	RegistrationDenied  RegistrationState = 3
+	RegistrationUnknown RegistrationState = 4
+)
+
+// ServingSystem is the network the modem is registered to.
+type ServingSystem struct {
+	Registration    RegistrationState
+	PSAttached      bool // Attached to the packet switched domain, needed for data.
+	Roaming         bool
+	RadioInterfaces []RadioInterface
+	MCC             uint16
+	MNC             uint16
+	Operator        string
+}
+
+// ServingSystem gets the registration state, radio interfaces and operator of the serving system.
+func (d *Device) ServingSystem() (ServingSystem, error) {
+	resp, err := d.request(ServiceNAS, nasGetServingSystem, tlvs{})
+	if err != nil {
+		return ServingSystem{}, err
+	}
+	// Registration state, CS attach state, PS attach state, selected network, radio interfaces.
+	v := resp[0x01]
+	if len(v) < 5 || len(v) < 5+int(v[4]) {
+		return ServingSystem{}, errors.New("invalid NAS serving system response")
+	}
+	s := ServingSystem{
+		Registration: RegistrationState(v[0]),
+		PSAttached:   v[2] == 1,
+	}
+	for _, radio := range v[5 : 5+int(v[4])] {
+		s.RadioInterfaces = append(s.RadioInterfaces, RadioInterface(radio))
+	}
+	// The roaming indicator is 0 when roaming and 1 when not.
+	if roaming := resp[0x10]; len(roaming) >= 1 {
+		s.Roaming = roaming[0] == 0
+	}
+	if plmn := resp[0x12]; len(plmn) >= 5 && len(plmn) >= 5+int(plmn[4]) {
+		s.MCC = binary.LittleEndian.Uint16(plmn)
+		s.MNC = binary.LittleEndian.Uint16(plmn[2:])
+		s.Operator = string(plmn[5 : 5+int(plmn[4])])
+	}
+	return s, nil
+}
+
+// SignalInfo is the signal of the best radio interface in use.
+type SignalInfo struct {
+	Radio RadioInterface // RadioNone if there is no signal.
+	RSSI  int            // dBm
+	// Only set on LTE.
+	RSRQ float64 // dB
+	RSRP float64 // dBm
+	SNR  float64 // dB
+}
+
+// SignalInfo gets the signal of the radio interface in use, preferring LTE, then UMTS, then GSM.
+func (d *Device) SignalInfo() (SignalInfo, error) {
+	resp, err := d.request(ServiceNAS, nasGetSignalInfo, tlvs{})
+	if err != nil {
+		return SignalInfo{}, err
+	}
+	// RSSI, RSRQ, RSRP and SNR in tenths of a dB.
+	if lte := resp[0x14]; len(lte) >= 6 {
+		return SignalInfo{
+			Radio: RadioLTE,
+			RSSI:  int(int8(lte[0])),
+			RSRQ:  float64(int8(lte[1])),
+			RSRP:  float64(int16(binary.LittleEndian.Uint16(lte[2:]))),
+			SNR:   float64(int16(binary.LittleEndian.Uint16(lte[4:]))) / 10,
+		}, nil
+	}
+	// RSSI then ECIO.
+	if umts := resp[0x13]; len(umts) >= 1 {
+		return SignalInfo{Radio: RadioUMTS, RSSI: int(int8(umts[0]))}, nil
+	}
+	if gsm := resp[0x12]; len(gsm) >= 1 {
+		return SignalInfo{Radio: RadioGSM, RSSI: int(int8(gsm[0]))}, nil
+	}
+	return SignalInfo{Radio: RadioNone}, nil
+}
@@ -0,0 +1,380 @@
+// Package qmi talks the Qualcomm MSM Interface protocol to a modem over its /dev/cdc-wdm* control device.
+// Only the requests needed to check the SIM, signal and registration and to start a data session are implemented.
+package qmi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long a request waits for its response.
+const DefaultTimeout = 5 * time.Second
+
+// Service is a QMI service, each request is to a client of a service.
+type Service uint8
+
+const (
+	ServiceCTL Service = 0x00
+	ServiceWDS Service = 0x01 // Wireless data
+	ServiceDMS Service = 0x02 // Device management
+	ServiceNAS Service = 0x03 // Network access
+)
+
+func (s Service) String() string {
+	switch s {
+	case ServiceCTL:
+		return "CTL"
+	case ServiceWDS:
+		return "WDS"
+	case ServiceDMS:
+		return "DMS"
+	case ServiceNAS:
+		return "NAS"
+	}
+	return fmt.Sprintf("service 0x%02x", uint8(s))
+}
+
+// Error codes from the result TLV.
+const (
+	CodeMalformedMessage uint16 = 0x0001
+	CodeInternal         uint16 = 0x0003
+	CodeClientIDsUsed    uint16 = 0x0005
+	CodeInvalidClientID  uint16 = 0x0007
+	CodeNoNetworkFound   uint16 = 0x000D
+	CodeCallFailed       uint16 = 0x000E
+	CodeOutOfCall        uint16 = 0x000F
+	CodeNotProvisioned   uint16 = 0x0010
+	CodeMissingArgument  uint16 = 0x0011
+	CodeNoEffect         uint16 = 0x001A
+)
+
+var errorNames = map[uint16]string{
+	CodeMalformedMessage: "malformed message",
+	CodeInternal:         "internal error",
+	CodeClientIDsUsed:    "no client IDs left",
+	CodeInvalidClientID:  "invalid client ID",
+	CodeNoNetworkFound:   "no network found",
+	CodeCallFailed:       "call failed",
+	CodeOutOfCall:        "out of call",
+	CodeNotProvisioned:   "not provisioned",
+	CodeMissingArgument:  "missing argument",
+	CodeNoEffect:         "no effect",
+}
+
+// Error is a failure reported by the modem in the result of a response.
+type Error struct {
+	Service Service
+	Message uint16
+	Code    uint16
+}
+
+func (e *Error) Error() string {
+	name, ok := errorNames[e.Code]
+	if !ok {
+		name = fmt.Sprintf("error 0x%04x", e.Code)
+	}
+	return fmt.Sprintf("QMI %s message 0x%04x failed: %s", e.Service, e.Message, name)
+}
+
+// IsCode returns true if err is an Error with the code.
+func IsCode(err error, code uint16) bool {
+	var qmiErr *Error
+	return errors.As(err, &qmiErr) && qmiErr.Code == code
+}
+
+var ErrClosed = errors.New("QMI device closed")
+
+// Message flags in the service header.
+const (
+	ctlFlagIndication = 0x02
+	flagIndication    = 0x04
+)
+
+// CTL messages.
+const (
+	ctlGetClientID     = 0x0022
+	ctlReleaseClientID = 0x0023
+)
+
+const (
+	tlvResult    = 0x02
+	maxQMIPacket = 8192
+)
+
+// tlvs are the values of a message by their type.
+type tlvs map[uint8][]byte
+
+type message struct {
+	service Service
+	client  uint8
+	flags   uint8
+	txn     uint16
+	id      uint16
+	tlvs    tlvs
+}
+
+type pendingKey struct {
+	service Service
+	client  uint8
+	txn     uint16
+}
+
+// Device is an open QMI control device. It is safe to use from multiple goroutines.
+//
+// Closing the device releases its clients, which ends any data session it started.
+type Device struct {
+	f       *os.File
+	allocMu sync.Mutex // Held while allocating a client so a service only gets one.
+
+	mu      sync.Mutex
+	clients map[Service]uint8
+	pending map[pendingKey]chan message
+	txn     uint16
+	closed  bool
+	readErr error
+}
+
+// Open opens the control device, e.g "/dev/cdc-wdm0".
+func Open(path string) (*Device, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return newDevice(f), nil
+}
+
+func newDevice(f *os.File) *Device {
+	d := &Device{
+		f:       f,
+		clients: map[Service]uint8{},
+		pending: map[pendingKey]chan message{},
+	}
+	go d.readLoop()
+	return d
+}
+
+// Close releases the clients and closes the device.
+func (d *Device) Close() error {
+	d.mu.Lock()
+	clients := d.clients
+	d.clients = map[Service]uint8{}
+	d.mu.Unlock()
+	for service, client := range clients {
+		d.request(ServiceCTL, ctlReleaseClientID, tlvs{0x01: {uint8(service), client}})
+	}
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	return d.f.Close()
+}
+
+func (d *Device) readLoop() {
+	buf := make([]byte, maxQMIPacket)
+	for {
+		n, err := d.f.Read(buf)
+		if err != nil {
+			d.mu.Lock()
+			d.readErr = err
+			for key, ch := range d.pending {
+				close(ch)
+				delete(d.pending, key)
+			}
+			d.mu.Unlock()
+			return
+		}
+		// The values are used after the next read, so they can't point into the buffer.
+		for _, msg := range parseMessages(append([]byte{}, buf[:n]...)) {
+			if msg.flags&indicationFlag(msg.service) != 0 {
+				continue // Indications aren't subscribed to so are only broadcasts, which aren't needed.
+			}
+			d.mu.Lock()
+			key := pendingKey{msg.service, msg.client, msg.txn}
+			if ch, ok := d.pending[key]; ok {
+				ch <- msg
+				delete(d.pending, key)
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+func indicationFlag(service Service) uint8 {
+	if service == ServiceCTL {
+		return ctlFlagIndication
+	}
+	return flagIndication
+}
+
+// parseMessages reads the QMUX messages in a read from the device, normally there is only one.
+func parseMessages(b []byte) []message {
+	msgs := []message{}
+	for len(b) >= 6 && b[0] == 0x01 {
+		length := int(binary.LittleEndian.Uint16(b[1:])) + 1
+		if length > len(b) || length < 6 {
+			break
+		}
+		msg := message{service: Service(b[4]), client: b[5]}
+		sdu := b[6:length]
+		b = b[length:]
+		var body []byte
+		if msg.service == ServiceCTL {
+			if len(sdu) < 6 {
+				continue
+			}
+			msg.flags = sdu[0]
+			msg.txn = uint16(sdu[1])
+			msg.id = binary.LittleEndian.Uint16(sdu[2:])
+			body = sdu[6:]
+		} else {
+			if len(sdu) < 7 {
+				continue
+			}
+			msg.flags = sdu[0]
+			msg.txn = binary.LittleEndian.Uint16(sdu[1:])
+			msg.id = binary.LittleEndian.Uint16(sdu[3:])
+			body = sdu[7:]
+		}
+		msg.tlvs = parseTLVs(body)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// marshal makes the QMUX packet for the message.
+func (msg message) marshal() []byte {
+	body := msg.tlvs.marshal()
+	var sdu []byte
+	if msg.service == ServiceCTL {
+		sdu = []byte{msg.flags, uint8(msg.txn), 0, 0, 0, 0}
+		binary.LittleEndian.PutUint16(sdu[2:], msg.id)
+		binary.LittleEndian.PutUint16(sdu[4:], uint16(len(body)))
+	} else {
+		sdu = []byte{msg.flags, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint16(sdu[1:], msg.txn)
+		binary.LittleEndian.PutUint16(sdu[3:], msg.id)
+		binary.LittleEndian.PutUint16(sdu[5:], uint16(len(body)))
+	}
+	sdu = append(sdu, body...)
+	packet := []byte{0x01, 0, 0, 0x00, uint8(msg.service), msg.client}
+	binary.LittleEndian.PutUint16(packet[1:], uint16(len(packet)-1+len(sdu)))
+	return append(packet, sdu...)
+}
+
+func parseTLVs(b []byte) tlvs {
+	values := tlvs{}
+	for len(b) >= 3 {
+		length := int(binary.LittleEndian.Uint16(b[1:]))
+		if 3+length > len(b) {
+			break
+		}
+		values[b[0]] = b[3 : 3+length]
+		b = b[3+length:]
+	}
+	return values
+}
+
+func (t tlvs) marshal() []byte {
+	b := []byte{}
+	for typ, value := range t {
+		b = append(b, typ, 0, 0)
+		binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(len(value)))
+		b = append(b, value...)
+	}
+	return b
+}
+
+// clientID returns the client for the service, allocating one the first time it is used.
+func (d *Device) clientID(service Service) (uint8, error) {
+	if service == ServiceCTL {
+		return 0, nil
+	}
+	d.allocMu.Lock()
+	defer d.allocMu.Unlock()
+	d.mu.Lock()
+	client, ok := d.clients[service]
+	d.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+	resp, err := d.request(ServiceCTL, ctlGetClientID, tlvs{0x01: {uint8(service)}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get a %s client: %w", service, err)
+	}
+	allocated := resp[0x01]
+	if len(allocated) < 2 || allocated[0] != uint8(service) {
+		return 0, fmt.Errorf("invalid %s client allocation", service)
+	}
+	d.mu.Lock()
+	d.clients[service] = allocated[1]
+	d.mu.Unlock()
+	return allocated[1], nil
+}
+
+// request sends a request to the service and waits for the response, returning an Error if the
+// result TLV has one.
+func (d *Device) request(service Service, msgID uint16, values tlvs) (tlvs, error) {
+	client, err := d.clientID(service)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if d.readErr != nil {
+		err := d.readErr
+		d.mu.Unlock()
+		return nil, err
+	}
+	d.txn++
+	if service == ServiceCTL {
+		d.txn %= 0x100 // CTL transaction IDs are only one byte.
+	}
+	if d.txn == 0 {
+		d.txn = 1
+	}
+	txn := d.txn
+	key := pendingKey{service, client, txn}
+	ch := make(chan message, 1)
+	d.pending[key] = ch
+	d.mu.Unlock()
+
+	packet := message{service: service, client: client, txn: txn, id: msgID, tlvs: values}.marshal()
+	if _, err := d.f.Write(packet); err != nil {
+		d.mu.Lock()
+		delete(d.pending, key)
+		d.mu.Unlock()
+		return nil, err
+	}
+
+	timer := time.NewTimer(DefaultTimeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if msg.id != msgID {
+			return nil, fmt.Errorf("QMI %s response 0x%04x to message 0x%04x", service, msg.id, msgID)
+		}
+		result := msg.tlvs[tlvResult]
+		if len(result) < 4 {
+			return nil, fmt.Errorf("QMI %s message 0x%04x response has no result", service, msgID)
+		}
+		if binary.LittleEndian.Uint16(result) != 0 {
+			return msg.tlvs, &Error{Service: service, Message: msgID, Code: binary.LittleEndian.Uint16(result[2:])}
+		}
+		return msg.tlvs, nil
+	case <-timer.C:
+		d.mu.Lock()
+		delete(d.pending, key)
+		d.mu.Unlock()
+		return nil, fmt.Errorf("timed out waiting for QMI %s message 0x%04x response", service, msgID)
+	}
+}
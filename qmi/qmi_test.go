@@ -0,0 +1,229 @@
+package qmi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// A CTL get client ID response from a modem, allocating WDS client 2.
+var ctlGetClientIDResponse = []byte{
+	0x01, 0x17, 0x00, 0x80, 0x00, 0x00, // QMUX header
+	0x01, 0x01, 0x22, 0x00, 0x0c, 0x00, // CTL header, transaction 1
+	0x02, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, // Result, success
+	0x01, 0x02, 0x00, 0x01, 0x02, // Service and client ID
+}
+
+func TestParseMessages(t *testing.T) {
+	msgs := parseMessages(ctlGetClientIDResponse)
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	want := message{
+		service: ServiceCTL,
+		flags:   0x01,
+		txn:     1,
+		id:      ctlGetClientID,
+		tlvs:    tlvs{tlvResult: {0, 0, 0, 0}, 0x01: {0x01, 0x02}},
+	}
+	if !reflect.DeepEqual(msgs[0], want) {
+		t.Errorf("got %+v, want %+v", msgs[0], want)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	msgs := []message{
+		{service: ServiceCTL, txn: 0xfe, id: ctlReleaseClientID, tlvs: tlvs{0x01: {uint8(ServiceWDS), 2}}},
+		{service: ServiceWDS, client: 2, txn: 0x1234, id: wdsStartNetwork, tlvs: tlvs{0x14: []byte("internet"), 0x16: {uint8(AuthPAP)}, 0x19: {4}}},
+		{service: ServiceNAS, client: 7, flags: 0x02, txn: 0xffff, id: nasGetSignalInfo, tlvs: tlvs{}},
+	}
+	var all []byte
+	for _, msg := range msgs {
+		packet := msg.marshal()
+		if length := int(binary.LittleEndian.Uint16(packet[1:])) + 1; length != len(packet) {
+			t.Errorf("packet length field %d, want %d", length, len(packet))
+		}
+		parsed := parseMessages(packet)
+		if len(parsed) != 1 || !reflect.DeepEqual(parsed[0], msg) {
+			t.Errorf("got %+v, want %+v", parsed, msg)
+		}
+		all = append(all, packet...)
+	}
+	// A read can have more than one message.
+	if parsed := parseMessages(all); !reflect.DeepEqual(parsed, msgs) {
+		t.Errorf("got %+v, want %+v", parsed, msgs)
+	}
+}
+
+func TestParseMessagesMalformed(t *testing.T) {
+	// No part of a message is parsed as a message.
+	for i := 0; i < len(ctlGetClientIDResponse); i++ {
+		if msgs := parseMessages(ctlGetClientIDResponse[:i]); len(msgs) != 0 {
+			t.Errorf("parsed %+v from the first %d bytes", msgs, i)
+		}
+	}
+
+	withLength := func(packet []byte, length uint16) []byte {
+		b := append([]byte{}, packet...)
+		binary.LittleEndian.PutUint16(b[1:], length)
+		return b
+	}
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"longer than the read", withLength(ctlGetClientIDResponse, 0x0100)},
+		{"maximum length", withLength(ctlGetClientIDResponse, 0xffff)},
+		{"shorter than the header", withLength(ctlGetClientIDResponse, 0x0003)},
+		{"not a QMUX packet", append([]byte{0x02}, ctlGetClientIDResponse[1:]...)},
+		{"CTL header cut short", withLength(ctlGetClientIDResponse, 0x0009)},
+		{"service header cut short", withLength(message{service: ServiceWDS, client: 1, txn: 1, id: 1}.marshal(), 0x000b)},
+	}
+	for _, tt := range tests {
+		if msgs := parseMessages(tt.packet); len(msgs) != 0 {
+			t.Errorf("%s: parsed %+v", tt.name, msgs)
+		}
+	}
+
+	// A good message after a cut short one is still read.
+	short := withLength(message{service: ServiceWDS, client: 1, txn: 1, id: 1}.marshal(), 0x000b)[:12]
+	if msgs := parseMessages(append(short, ctlGetClientIDResponse...)); len(msgs) != 1 || msgs[0].id != ctlGetClientID {
+		t.Errorf("got %+v after a cut short message, want the CTL response", msgs)
+	}
+}
+
+func TestParseTLVs(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want tlvs
+	}{
+		{"empty", nil, tlvs{}},
+		{"values", []byte{0x01, 0x01, 0x00, 0xaa, 0x10, 0x00, 0x00, 0x11, 0x02, 0x00, 0xbb, 0xcc}, tlvs{0x01: {0xaa}, 0x10: {}, 0x11: {0xbb, 0xcc}}},
+		{"value cut short", []byte{0x01, 0x01, 0x00, 0xaa, 0x02, 0x04, 0x00, 0x00, 0x00}, tlvs{0x01: {0xaa}}},
+		{"oversized length", []byte{0x01, 0xff, 0xff, 0xaa}, tlvs{}},
+		{"header cut short", []byte{0x01, 0x01, 0x00, 0xaa, 0x02, 0x01}, tlvs{0x01: {0xaa}}},
+	}
+	for _, tt := range tests {
+		if got := parseTLVs(tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeModem answers the requests a test makes on a device.
+func fakeModem(t *testing.T, f *os.File, respond func(req message) message) {
+	buf := make([]byte, maxQMIPacket)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, req := range parseMessages(buf[:n]) {
+			resp := message{service: req.service, client: req.client, txn: req.txn, id: req.id, flags: 0x02}
+			if req.service == ServiceCTL {
+				resp.flags = 0x01
+				resp.tlvs = tlvs{tlvResult: {0, 0, 0, 0}}
+				if req.id == ctlGetClientID {
+					resp.tlvs[0x01] = []byte{req.tlvs[0x01][0], 2}
+				}
+			} else {
+				// An indication with the same transaction ID is ignored.
+				indication := resp
+				indication.flags = flagIndication
+				indication.tlvs = tlvs{tlvResult: {1, 0, 3, 0}}
+				if _, err := f.Write(indication.marshal()); err != nil {
+					return
+				}
+				resp.tlvs = respond(req).tlvs
+			}
+			if _, err := f.Write(resp.marshal()); err != nil {
+				t.Errorf("failed to write response: %v", err)
+				return
+			}
+		}
+	}
+}
+
+func openFakeDevice(t *testing.T, respond func(req message) message) *Device {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modem := os.NewFile(uintptr(fds[1]), "modem")
+	go fakeModem(t, modem, respond)
+	d := newDevice(os.NewFile(uintptr(fds[0]), "qmi"))
+	t.Cleanup(func() {
+		d.Close()
+		modem.Close()
+	})
+	return d
+}
+
+func TestRuntimeSettings(t *testing.T) {
+	d := openFakeDevice(t, func(req message) message {
+		if req.service != ServiceWDS || req.client != 2 || req.id != wdsGetRuntimeSettings {
+			t.Errorf("unexpected request %+v", req)
+		}
+		if mask := req.tlvs[0x10]; !bytes.Equal(mask, []byte{0x10, 0x23, 0x00, 0x00}) {
+			t.Errorf("got requested settings % x", mask)
+		}
+		ipv6Addr := append(net.ParseIP("2001:db8::1").To16(), 64)
+		return message{tlvs: tlvs{
+			tlvResult: {0, 0, 0, 0},
+			0x1E:      {0x40, 0x40, 0x40, 0x0a}, // 10.64.64.64
+			0x21:      {0xfc, 0xff, 0xff, 0xff}, // 255.255.255.252
+			0x20:      {0x41, 0x40, 0x40, 0x0a}, // 10.64.64.65
+			0x15:      {0x08, 0x08, 0x08, 0x08},
+			0x16:      {0x00, 0x00, 0x00, 0x00}, // No secondary DNS.
+			0x25:      ipv6Addr,
+			0x29:      {0xdc, 0x05, 0x00, 0x00},
+		}}
+	})
+	s, err := d.RuntimeSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.IPv4 == nil || s.IPv4.String() != "10.64.64.64/30" {
+		t.Errorf("got IPv4 %v, want 10.64.64.64/30", s.IPv4)
+	}
+	if !s.IPv4Gateway.Equal(net.IPv4(10, 64, 64, 65)) {
+		t.Errorf("got IPv4 gateway %v", s.IPv4Gateway)
+	}
+	if len(s.IPv4DNS) != 1 || !s.IPv4DNS[0].Equal(net.IPv4(8, 8, 8, 8)) {
+		t.Errorf("got IPv4 DNS %v", s.IPv4DNS)
+	}
+	if s.IPv6 == nil || s.IPv6.String() != "2001:db8::1/64" {
+		t.Errorf("got IPv6 %v, want 2001:db8::1/64", s.IPv6)
+	}
+	if s.IPv6Gateway != nil || s.IPv6DNS != nil {
+		t.Errorf("got IPv6 gateway %v and DNS %v, want none", s.IPv6Gateway, s.IPv6DNS)
+	}
+	if s.MTU != 1500 {
+		t.Errorf("got MTU %d, want 1500", s.MTU)
+	}
+}
+
+func TestRequestError(t *testing.T) {
+	d := openFakeDevice(t, func(req message) message {
+		if apn := string(req.tlvs[0x14]); apn != "internet" {
+			t.Errorf("got APN '%s'", apn)
+		}
+		return message{tlvs: tlvs{
+			tlvResult: {0x01, 0x00, byte(CodeCallFailed), 0x00},
+			0x10:      {0x03, 0x00},
+		}}
+	})
+	_, err := d.StartNetwork(StartNetworkOptions{APN: "internet"})
+	if !IsCode(err, CodeCallFailed) {
+		t.Fatalf("got error %v, want call failed", err)
+	}
+	if want := "QMI WDS message 0x0020 failed: call failed, call end reason 3"; err.Error() != want {
+		t.Errorf("got error '%v', want '%s'", err, want)
+	}
+}
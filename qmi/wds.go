@@ -0,0 +1,185 @@
+package qmi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// WDS messages.
+const (
+	wdsStartNetwork           = 0x0020
+	wdsStopNetwork            = 0x0021
+	wdsGetPacketServiceStatus = 0x0022
+	wdsGetRuntimeSettings     = 0x002D
+)
+
+// Auth is the authentication used when starting a data session, it can be a combination.
+type Auth uint8
+
+const (
+	AuthNone Auth = 0
+	AuthPAP  Auth = 1 << 0
+	AuthCHAP Auth = 1 << 1
+)
+
+// IPFamily is the IP version of a data session.
+type IPFamily uint8
+
+const (
+	IPv4 IPFamily = 4
+	IPv6 IPFamily = 6
+)
+
+// StartNetworkOptions are for starting a data session. With a profile index the APN and
+// authentication are read from the profile, which is the PDP context with that CID, unless they are set here.
+type StartNetworkOptions struct {
+	ProfileIndex uint8 // 0 to not use a profile.
+	APN          string
+	Auth         Auth
+	Username     string
+	Password     string
+	IPFamily     IPFamily // Defaults to IPv4. Each client can only have a session of one family.
+}
+
+// StartNetwork starts a data session, returning the handle that stops it.
+func (d *Device) StartNetwork(opts StartNetworkOptions) (uint32, error) {
+	values := tlvs{}
+	if opts.ProfileIndex != 0 {
+		values[0x31] = []byte{opts.ProfileIndex}
+	}
+	if opts.APN != "" {
+		values[0x14] = []byte(opts.APN)
+	}
+	if opts.Auth != AuthNone {
+		values[0x16] = []byte{uint8(opts.Auth)}
+	}
+	if opts.Username != "" {
+		values[0x17] = []byte(opts.Username)
+	}
+	if opts.Password != "" {
+		values[0x18] = []byte(opts.Password)
+	}
+	if opts.IPFamily != 0 {
+		values[0x19] = []byte{uint8(opts.IPFamily)}
+	}
+	resp, err := d.request(ServiceWDS, wdsStartNetwork, values)
+	if err != nil {
+		// The call end reason says why the network rejected the session.
+		if reason := resp[0x10]; len(reason) >= 2 {
+			return 0, fmt.Errorf("%w, call end reason %d", err, binary.LittleEndian.Uint16(reason))
+		}
+		return 0, err
+	}
+	if len(resp[0x01]) < 4 {
+		return 0, errors.New("invalid WDS start network response")
+	}
+	return binary.LittleEndian.Uint32(resp[0x01]), nil
+}
+
+// StopNetwork stops the data session started with the handle.
+func (d *Device) StopNetwork(handle uint32) error {
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, handle)
+	_, err := d.request(ServiceWDS, wdsStopNetwork, tlvs{0x01: value})
+	return err
+}
+
+// ConnectionStatus is the state of the packet data connection.
+type ConnectionStatus uint8
+
+const (
+	Disconnected   ConnectionStatus = 1
+	Connected      ConnectionStatus = 2
+	Suspended      ConnectionStatus = 3
+	Authenticating ConnectionStatus = 4
+)
+
+// PacketServiceStatus gets the state of the packet data connection.
+func (d *Device) PacketServiceStatus() (ConnectionStatus, error) {
+	resp, err := d.request(ServiceWDS, wdsGetPacketServiceStatus, tlvs{})
+	if err != nil {
+		return Disconnected, err
+	}
+	if len(resp[0x01]) < 1 {
+		return Disconnected, errors.New("invalid WDS packet service status response")
+	}
+	return ConnectionStatus(resp[0x01][0]), nil
+}
+
+// Settings requested from WDS get runtime settings.
+const (
+	settingsDNS     = 1 << 4
+	settingsIP      = 1 << 8
+	settingsGateway = 1 << 9
+	settingsMTU     = 1 << 13
+)
+
+// RuntimeSettings is the addressing of the data session, which has to be set on the network interface
+// when the modem isn't asked for it with DHCP.
+type RuntimeSettings struct {
+	IPv4        *net.IPNet // nil if the session has no IPv4 address.
+	IPv4Gateway net.IP
+	IPv4DNS     []net.IP
+	IPv6        *net.IPNet // nil if the session has no IPv6 address.
+	IPv6Gateway net.IP
+	IPv6DNS     []net.IP
+	MTU         int // 0 if not given.
+}
+
+// RuntimeSettings gets the addressing of the current data session.
+func (d *Device) RuntimeSettings() (RuntimeSettings, error) {
+	mask := make([]byte, 4)
+	binary.LittleEndian.PutUint32(mask, settingsDNS|settingsIP|settingsGateway|settingsMTU)
+	resp, err := d.request(ServiceWDS, wdsGetRuntimeSettings, tlvs{0x10: mask})
+	if err != nil {
+		return RuntimeSettings{}, err
+	}
+	s := RuntimeSettings{}
+	if addr := ipv4(resp[0x1E]); addr != nil {
+		s.IPv4 = &net.IPNet{IP: addr, Mask: net.CIDRMask(32, 32)}
+		if mask := ipv4(resp[0x21]); mask != nil {
+			s.IPv4.Mask = net.IPMask(mask)
+		}
+	}
+	s.IPv4Gateway = ipv4(resp[0x20])
+	for _, typ := range []uint8{0x15, 0x16} {
+		if dns := ipv4(resp[typ]); dns != nil {
+			s.IPv4DNS = append(s.IPv4DNS, dns)
+		}
+	}
+	if addr, prefix := ipv6(resp[0x25]); addr != nil {
+		s.IPv6 = &net.IPNet{IP: addr, Mask: net.CIDRMask(prefix, 128)}
+	}
+	s.IPv6Gateway, _ = ipv6(resp[0x26])
+	for _, typ := range []uint8{0x27, 0x28} {
+		if value := resp[typ]; len(value) >= net.IPv6len {
+			s.IPv6DNS = append(s.IPv6DNS, net.IP(append([]byte{}, value[:net.IPv6len]...)))
+		}
+	}
+	if value := resp[0x29]; len(value) >= 4 {
+		s.MTU = int(binary.LittleEndian.Uint32(value))
+	}
+	return s, nil
+}
+
+// ipv4 reads an IPv4 address, which QMI sends as a little endian uint32. nil if it is missing or 0.0.0.0.
+func ipv4(value []byte) net.IP {
+	if len(value) < 4 {
+		return nil
+	}
+	v := binary.LittleEndian.Uint32(value)
+	if v == 0 {
+		return nil
+	}
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).To4()
+}
+
+// ipv6 reads an IPv6 address followed by its prefix length.
+func ipv6(value []byte) (net.IP, int) {
+	if len(value) < net.IPv6len+1 {
+		return nil, 0
+	}
+	return net.IP(append([]byte{}, value[:net.IPv6len]...)), int(value[net.IPv6len])
+}
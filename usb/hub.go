@@ -0,0 +1,87 @@
+package usb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultDevRoot is where the usbfs device files are.
+const DefaultDevRoot = "/dev/bus/usb"
+
+// Hub class requests for switching port power, from the USB 2.0 spec.
+const (
+	hubPortRequestType  = 0x23 // Host to device, class request, to "other" (a port).
+	requestClearFeature = 0x01
+	requestSetFeature   = 0x03
+	featurePortPower    = 8
+)
+
+// ctrlTransfer is struct usbdevfs_ctrltransfer.
+type ctrlTransfer struct {
+	RequestType uint8
+	Request     uint8
+	Value       uint16
+	Index       uint16
+	Length      uint16
+	Timeout     uint32 // Milliseconds.
+	Data        unsafe.Pointer
+}
+
+// usbdevfsControl is USBDEVFS_CONTROL, _IOWR('U', 0, struct usbdevfs_ctrltransfer).
+var usbdevfsControl = uintptr(0xc0005500 | unsafe.Sizeof(ctrlTransfer{})<<16)
+
+// hubInterfaceName is the name of a hub's interface, which its ports are under in sysfs. Root hubs are
+// named "usb<bus>" with the interface "<bus>-0:1.0".
+func hubInterfaceName(hub string) string {
+	if bus, ok := strings.CutPrefix(hub, "usb"); ok {
+		return bus + "-0:1.0"
+	}
+	return hub + ":1.0"
+}
+
+// SetPortDisabled disables or enables a port of a hub through sysfs. The device on a disabled port is
+// removed, and the kernel turns off the port's power if the hub can switch it.
+func (b *Bus) SetPortDisabled(hub string, port int, disabled bool) error {
+	path := filepath.Join(b.devicesDir(), hubInterfaceName(hub), fmt.Sprintf("%s-port%d", hub, port), "disable")
+	value := "0"
+	if disabled {
+		value = "1"
+	}
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set port %d of hub '%s' disabled to %t: %w", port, hub, disabled, err)
+	}
+	return nil
+}
+
+// SetPortPower switches the power to a port of a hub with a control transfer, like uhubctl does. Hubs that
+// gang their ports switch them all together.
+func (b *Bus) SetPortPower(hub string, port int, on bool) error {
+	d, err := b.Device(hub)
+	if err != nil {
+		return fmt.Errorf("failed to find hub '%s': %w", hub, err)
+	}
+	f, err := os.OpenFile(filepath.Join(b.DevRoot, fmt.Sprintf("%03d", d.BusNum), fmt.Sprintf("%03d", d.DevNum)), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	t := ctrlTransfer{
+		RequestType: hubPortRequestType,
+		Request:     requestClearFeature,
+		Value:       featurePortPower,
+		Index:       uint16(port),
+		Timeout:     5000,
+	}
+	if on {
+		t.Request = requestSetFeature
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), usbdevfsControl, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		return fmt.Errorf("failed to switch power of port %d on hub '%s': %w", port, hub, errno)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package usb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Event is a kernel uevent.
+type Event struct {
+	Action    string // "add", "remove", "bind", "unbind" or "change".
+	DevPath   string // Path under sysfs, e.g "/devices/platform/soc/3f980000.usb/usb1/1-1/1-1.3".
+	Subsystem string
+	DevType   string // "usb_device" or "usb_interface" for USB.
+	Env       map[string]string
+}
+
+// Name is the last part of the device path, e.g "1-1.3" for a USB device.
+func (e Event) Name() string {
+	return e.DevPath[strings.LastIndex(e.DevPath, "/")+1:]
+}
+
+// IsUSBDevice is true for events about a USB device rather than one of its interfaces.
+func (e Event) IsUSBDevice() bool {
+	return e.Subsystem == "usb" && e.DevType == "usb_device"
+}
+
+// VendorProductID reads the IDs from the PRODUCT variable, e.g "1e0e/9018/318", which USB events have.
+// They are padded to four digits to match sysfs.
+func (e Event) VendorProductID() (string, string, bool) {
+	parts := strings.Split(e.Env["PRODUCT"], "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	pad := func(id string) string {
+		return strings.Repeat("0", max(4-len(id), 0)) + strings.ToLower(id)
+	}
+	return pad(parts[0]), pad(parts[1]), true
+}
+
+// ParseUevent parses a uevent from the kernel, "action@devpath" then "KEY=value" lines separated by
+// null bytes. ok is false if it isn't a kernel uevent.
+func ParseUevent(b []byte) (Event, bool) {
+	fields := bytes.Split(b, []byte{0})
+	header := string(fields[0])
+	at := strings.Index(header, "@")
+	if at < 0 {
+		return Event{}, false
+	}
+	e := Event{Action: header[:at], DevPath: header[at+1:], Env: map[string]string{}}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(string(field), "=")
+		if !ok {
+			continue
+		}
+		e.Env[key] = value
+	}
+	if action, ok := e.Env["ACTION"]; ok {
+		e.Action = action
+	}
+	if devPath, ok := e.Env["DEVPATH"]; ok {
+		e.DevPath = devPath
+	}
+	e.Subsystem = e.Env["SUBSYSTEM"]
+	e.DevType = e.Env["DEVTYPE"]
+	return e, true
+}
+
+// ErrEventsLost is returned by Next when events were dropped because the socket's buffer overflowed, which
+// can happen with a burst of events. The watcher can still be used, but anything tracked from the events
+// should be scanned again.
+var ErrEventsLost = errors.New("uevents were lost")
+
+// Size of the socket's receive buffer, to hold the burst of events from a device with many interfaces.
+const ueventBufferSize = 1024 * 1024
+
+// Watcher receives the kernel uevents.
+type Watcher struct {
+	f *os.File
+}
+
+// Watch starts receiving the kernel uevents for every subsystem.
+func Watch() (*Watcher, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	// SO_RCVBUFFORCE goes over the rmem_max limit but needs CAP_NET_ADMIN.
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, ueventBufferSize); err != nil {
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, ueventBufferSize)
+	}
+	// Group 1 is the kernel's events, udev rebroadcasts them on group 2 after processing them.
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &Watcher{f: os.NewFile(uintptr(fd), "uevent")}, nil
+}
+
+// Next waits for the next uevent. It returns ErrEventsLost if events were dropped, and an error that
+// IsClosed reports for once the watcher is closed.
+func (w *Watcher) Next() (Event, error) {
+	buf := make([]byte, 8192)
+	for {
+		n, err := w.f.Read(buf)
+		if errors.Is(err, unix.ENOBUFS) {
+			return Event{}, ErrEventsLost
+		}
+		if err != nil {
+			return Event{}, fmt.Errorf("failed to receive uevent: %w", err)
+		}
+		if e, ok := ParseUevent(buf[:n]); ok {
+			return e, nil
+		}
+	}
+}
+
+func (w *Watcher) Close() error {
+	return w.f.Close()
+}
+
+// IsClosed is true if the error from Next is because the watcher is closed, so no more events will come.
+func IsClosed(err error) bool {
+	return errors.Is(err, os.ErrClosed) || errors.Is(err, unix.EBADF)
+}
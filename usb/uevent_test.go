@@ -0,0 +1,81 @@
+package usb
+
+import (
+	"strings"
+	"testing"
+)
+
+func uevent(header string, env ...string) []byte {
+	return []byte(strings.Join(append([]string{header}, env...), "\x00") + "\x00")
+}
+
+func TestParseUevent(t *testing.T) {
+	e, ok := ParseUevent(uevent("remove@/devices/platform/soc/usb1/1-1/1-1.3",
+		"ACTION=remove",
+		"DEVPATH=/devices/platform/soc/usb1/1-1/1-1.3",
+		"SUBSYSTEM=usb",
+		"DEVTYPE=usb_device",
+		"PRODUCT=1e0e/9001/318",
+		"SEQNUM=1234",
+	))
+	if !ok {
+		t.Fatal("uevent not parsed")
+	}
+	if e.Action != "remove" || e.Name() != "1-1.3" || !e.IsUSBDevice() || e.Env["SEQNUM"] != "1234" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	vendorID, productID, ok := e.VendorProductID()
+	if !ok || vendorID != "1e0e" || productID != "9001" {
+		t.Errorf("got IDs %s:%s %t, want 1e0e:9001", vendorID, productID, ok)
+	}
+}
+
+func TestParseUeventInterface(t *testing.T) {
+	e, ok := ParseUevent(uevent("add@/devices/platform/soc/usb1/1-1/1-1.3/1-1.3:1.5",
+		"ACTION=add",
+		"DEVPATH=/devices/platform/soc/usb1/1-1/1-1.3/1-1.3:1.5",
+		"SUBSYSTEM=usb",
+		"DEVTYPE=usb_interface",
+		"PRODUCT=424/ec00/200",
+	))
+	if !ok {
+		t.Fatal("uevent not parsed")
+	}
+	if e.IsUSBDevice() || e.Name() != "1-1.3:1.5" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	// IDs without leading zeros are padded to match sysfs.
+	if vendorID, productID, _ := e.VendorProductID(); vendorID != "0424" || productID != "ec00" {
+		t.Errorf("got IDs %s:%s, want 0424:ec00", vendorID, productID)
+	}
+}
+
+func TestParseUeventNotKernel(t *testing.T) {
+	// udev's messages start with "libudev" and a binary header rather than "action@devpath".
+	if _, ok := ParseUevent([]byte("libudev\x00\xfe\xed\xca\xfe")); ok {
+		t.Error("udev message parsed as a kernel uevent")
+	}
+	e, _ := ParseUevent(uevent("change@/devices/virtual/net/lo", "SUBSYSTEM=net"))
+	if _, _, ok := e.VendorProductID(); ok {
+		t.Error("got IDs from an event without PRODUCT")
+	}
+}
+
+func TestWatcherClosed(t *testing.T) {
+	w, err := Watch()
+	if err != nil {
+		t.Skipf("can't open a uevent socket: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Next()
+		done <- err
+	}()
+	w.Close()
+	if err := <-done; !IsClosed(err) {
+		t.Errorf("got error %v after Close, want it to be reported as closed", err)
+	}
+	if IsClosed(ErrEventsLost) {
+		t.Error("lost events reported as closed")
+	}
+}
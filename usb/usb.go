@@ -0,0 +1,209 @@
+// Package usb finds USB devices, their interfaces and the tty, network and control devices on them from
+// sysfs, and watches for devices being added and removed with kernel uevents.
+package usb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultSysfsRoot is where sysfs is mounted.
+const DefaultSysfsRoot = "/sys"
+
+// Device is a USB device.
+type Device struct {
+	Name         string // Bus and port path, e.g "1-1.3".
+	Path         string // Directory in sysfs.
+	VendorID     string // Four lower case hex digits, e.g "1e0e".
+	ProductID    string
+	Manufacturer string
+	Product      string
+	Serial       string
+	BusNum       int
+	DevNum       int
+	Interfaces   []Interface
+}
+
+// Interface is an interface of a USB device, with the devices the kernel made for it.
+type Interface struct {
+	Name     string // e.g "1-1.3:1.2".
+	Path     string
+	Number   int
+	Class    int
+	SubClass int
+	Protocol int
+	Driver   string   // "" if no driver is bound.
+	TTYs     []string // e.g "ttyUSB2".
+	NetDevs  []string // e.g "usb0" or "wwan0".
+	USBMisc  []string // e.g "cdc-wdm0".
+}
+
+// Bus reads the USB devices from sysfs.
+type Bus struct {
+	Root    string // Where sysfs is mounted, a fake tree can be used for testing.
+	DevRoot string // Where the usbfs device files are.
+}
+
+func NewBus(root string) *Bus {
+	return &Bus{Root: root, DevRoot: DefaultDevRoot}
+}
+
+func (b *Bus) devicesDir() string {
+	return filepath.Join(b.Root, "bus", "usb", "devices")
+}
+
+// Devices returns the USB devices, including the root hubs, sorted by name.
+func (b *Bus) Devices() ([]Device, error) {
+	entries, err := os.ReadDir(b.devicesDir())
+	if err != nil {
+		return nil, err
+	}
+	devices := []Device{}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ":") {
+			continue // An interface.
+		}
+		device, err := b.Device(entry.Name())
+		if err != nil {
+			continue // Removed while being read, or not a device.
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices, nil
+}
+
+// Device reads the device with the name, e.g "1-1.3".
+func (b *Bus) Device(name string) (Device, error) {
+	dir := filepath.Join(b.devicesDir(), name)
+	d := Device{Name: name, Path: dir}
+	var err error
+	if d.VendorID, err = readAttr(dir, "idVendor"); err != nil {
+		return Device{}, err
+	}
+	if d.ProductID, err = readAttr(dir, "idProduct"); err != nil {
+		return Device{}, err
+	}
+	d.VendorID, d.ProductID = strings.ToLower(d.VendorID), strings.ToLower(d.ProductID)
+	d.Manufacturer, _ = readAttr(dir, "manufacturer")
+	d.Product, _ = readAttr(dir, "product")
+	d.Serial, _ = readAttr(dir, "serial")
+	d.BusNum, _ = readIntAttr(dir, "busnum", 10)
+	d.DevNum, _ = readIntAttr(dir, "devnum", 10)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return Device{}, err
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name+":") {
+			continue
+		}
+		intf, err := readInterface(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		d.Interfaces = append(d.Interfaces, intf)
+	}
+	sort.Slice(d.Interfaces, func(i, j int) bool { return d.Interfaces[i].Number < d.Interfaces[j].Number })
+	return d, nil
+}
+
+// Find returns the first device with the vendor ID, and product ID if it isn't "".
+func (b *Bus) Find(vendorID, productID string) (Device, bool, error) {
+	devices, err := b.Devices()
+	if err != nil {
+		return Device{}, false, err
+	}
+	for _, d := range devices {
+		if d.Matches(vendorID, productID) {
+			return d, true, nil
+		}
+	}
+	return Device{}, false, nil
+}
+
+// Matches is true if the device has the vendor ID, and product ID if it isn't "".
+func (d Device) Matches(vendorID, productID string) bool {
+	return strings.EqualFold(d.VendorID, vendorID) && (productID == "" || strings.EqualFold(d.ProductID, productID))
+}
+
+// Interface returns the interface with the number.
+func (d Device) Interface(number int) (Interface, bool) {
+	for _, intf := range d.Interfaces {
+		if intf.Number == number {
+			return intf, true
+		}
+	}
+	return Interface{}, false
+}
+
+// NetDevs returns the network interfaces on all the device's interfaces.
+func (d Device) NetDevs() []string {
+	netdevs := []string{}
+	for _, intf := range d.Interfaces {
+		netdevs = append(netdevs, intf.NetDevs...)
+	}
+	return netdevs
+}
+
+func readInterface(dir string) (Interface, error) {
+	intf := Interface{Name: filepath.Base(dir), Path: dir}
+	var err error
+	if intf.Number, err = readIntAttr(dir, "bInterfaceNumber", 16); err != nil {
+		return Interface{}, err
+	}
+	intf.Class, _ = readIntAttr(dir, "bInterfaceClass", 16)
+	intf.SubClass, _ = readIntAttr(dir, "bInterfaceSubClass", 16)
+	intf.Protocol, _ = readIntAttr(dir, "bInterfaceProtocol", 16)
+	if driver, err := os.Readlink(filepath.Join(dir, "driver")); err == nil {
+		intf.Driver = filepath.Base(driver)
+	}
+	// USB serial drivers put the tty directory straight under the interface, cdc-acm puts it under "tty".
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "tty") && entry.Name() != "tty" {
+			intf.TTYs = append(intf.TTYs, entry.Name())
+		}
+	}
+	intf.TTYs = append(intf.TTYs, childNames(dir, "tty")...)
+	intf.NetDevs = childNames(dir, "net")
+	intf.USBMisc = childNames(dir, "usbmisc")
+	return intf, nil
+}
+
+func childNames(dir, class string) []string {
+	entries, err := os.ReadDir(filepath.Join(dir, class))
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func readAttr(dir, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readIntAttr(dir, name string, base int) (int, error) {
+	value, err := readAttr(dir, name)
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return 0, errors.New("empty " + name)
+	}
+	n, err := strconv.ParseInt(value, base, 64)
+	return int(n), err
+}
@@ -0,0 +1,224 @@
+package usb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeSysfs builds a sysfs tree like the kernel's, with the devices under /sys/devices and symlinks to them
+// in /sys/bus/usb/devices.
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeSysfs(t *testing.T) *fakeSysfs {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "bus", "usb", "devices"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &fakeSysfs{t: t, root: root}
+}
+
+func (f *fakeSysfs) write(path, value string) {
+	f.t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeSysfs) mkdir(path string) {
+	f.t.Helper()
+	if err := os.MkdirAll(path, 0755); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// link adds the bus symlink for a device or interface.
+func (f *fakeSysfs) link(dir string) {
+	f.t.Helper()
+	if err := os.Symlink(dir, filepath.Join(f.root, "bus", "usb", "devices", filepath.Base(dir))); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeSysfs) device(parent, name, vendorID, productID string) string {
+	dir := filepath.Join(parent, name)
+	f.write(filepath.Join(dir, "idVendor"), vendorID)
+	f.write(filepath.Join(dir, "idProduct"), productID)
+	f.write(filepath.Join(dir, "busnum"), "1")
+	f.write(filepath.Join(dir, "devnum"), "4")
+	f.link(dir)
+	return dir
+}
+
+func (f *fakeSysfs) intf(device string, number int, class, driver string) string {
+	dir := filepath.Join(device, fmt.Sprintf("%s:1.%d", filepath.Base(device), number))
+	f.write(filepath.Join(dir, "bInterfaceNumber"), fmt.Sprintf("%02x", number))
+	f.write(filepath.Join(dir, "bInterfaceClass"), class)
+	if driver != "" {
+		if err := os.Symlink(filepath.Join(f.root, "bus", "usb", "drivers", driver), filepath.Join(dir, "driver")); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	f.link(dir)
+	return dir
+}
+
+// modemSysfs has a root hub, a hub and a modem with serial, ACM, QMI and network interfaces.
+func modemSysfs(t *testing.T) *fakeSysfs {
+	f := newFakeSysfs(t)
+	usb1 := f.device(filepath.Join(f.root, "devices", "platform", "soc"), "usb1", "1d6b", "0002")
+	f.intf(usb1, 0, "09", "hub")
+	hub := f.device(usb1, "1-1", "0424", "9514")
+	f.intf(hub, 0, "09", "hub")
+	modem := f.device(hub, "1-1.3", "1E0E", "9001")
+	f.write(filepath.Join(modem, "manufacturer"), "SimTech, Incorporated")
+	f.write(filepath.Join(modem, "product"), "SimTech SIM7600")
+	serial := f.intf(modem, 2, "ff", "option")
+	f.mkdir(filepath.Join(serial, "ttyUSB2", "tty", "ttyUSB2"))
+	acm := f.intf(modem, 1, "02", "cdc_acm")
+	f.mkdir(filepath.Join(acm, "tty", "ttyACM0"))
+	qmi := f.intf(modem, 5, "ff", "qmi_wwan")
+	f.mkdir(filepath.Join(qmi, "net", "wwan0"))
+	f.mkdir(filepath.Join(qmi, "usbmisc", "cdc-wdm0"))
+	f.intf(modem, 0, "ff", "")
+	return f
+}
+
+func TestDevices(t *testing.T) {
+	f := modemSysfs(t)
+	devices, err := NewBus(f.root).Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, d := range devices {
+		names = append(names, d.Name)
+	}
+	if want := []string{"1-1", "1-1.3", "usb1"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got devices %v, want %v", names, want)
+	}
+}
+
+func TestFind(t *testing.T) {
+	f := modemSysfs(t)
+	bus := NewBus(f.root)
+
+	d, found, err := bus.Find("1e0e", "")
+	if err != nil || !found {
+		t.Fatalf("modem not found, err: %v", err)
+	}
+	if d.VendorID != "1e0e" || d.ProductID != "9001" {
+		t.Errorf("got IDs %s:%s, want lower case 1e0e:9001", d.VendorID, d.ProductID)
+	}
+	if d.Product != "SimTech SIM7600" || d.BusNum != 1 || d.DevNum != 4 {
+		t.Errorf("unexpected device attributes %+v", d)
+	}
+
+	if _, found, _ := bus.Find("1e0e", "9018"); found {
+		t.Error("found the modem with the wrong product ID")
+	}
+	if _, found, _ := bus.Find("1E0E", "9001"); !found {
+		t.Error("IDs should match case insensitively")
+	}
+}
+
+func TestInterfaces(t *testing.T) {
+	f := modemSysfs(t)
+	d, err := NewBus(f.root).Device("1-1.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := []int{}
+	for _, intf := range d.Interfaces {
+		numbers = append(numbers, intf.Number)
+	}
+	if want := []int{0, 1, 2, 5}; !reflect.DeepEqual(numbers, want) {
+		t.Fatalf("got interfaces %v, want %v", numbers, want)
+	}
+
+	tests := []struct {
+		number  int
+		class   int
+		driver  string
+		ttys    []string
+		netdevs []string
+		usbmisc []string
+	}{
+		{number: 0, class: 0xff},
+		{number: 1, class: 0x02, driver: "cdc_acm", ttys: []string{"ttyACM0"}},
+		{number: 2, class: 0xff, driver: "option", ttys: []string{"ttyUSB2"}},
+		{number: 5, class: 0xff, driver: "qmi_wwan", netdevs: []string{"wwan0"}, usbmisc: []string{"cdc-wdm0"}},
+	}
+	for _, tt := range tests {
+		intf, ok := d.Interface(tt.number)
+		if !ok {
+			t.Errorf("interface %d not found", tt.number)
+			continue
+		}
+		if intf.Class != tt.class || intf.Driver != tt.driver {
+			t.Errorf("interface %d: got class %02x driver '%s', want %02x '%s'", tt.number, intf.Class, intf.Driver, tt.class, tt.driver)
+		}
+		if !reflect.DeepEqual(intf.TTYs, tt.ttys) || !reflect.DeepEqual(intf.NetDevs, tt.netdevs) || !reflect.DeepEqual(intf.USBMisc, tt.usbmisc) {
+			t.Errorf("interface %d: got ttys %v netdevs %v usbmisc %v", tt.number, intf.TTYs, intf.NetDevs, intf.USBMisc)
+		}
+	}
+	if got := d.NetDevs(); !reflect.DeepEqual(got, []string{"wwan0"}) {
+		t.Errorf("got netdevs %v, want [wwan0]", got)
+	}
+}
+
+func TestDeviceRemoved(t *testing.T) {
+	f := modemSysfs(t)
+	bus := NewBus(f.root)
+	// The bus symlink is left dangling for a moment when a device is removed.
+	if err := os.RemoveAll(filepath.Join(f.root, "devices", "platform", "soc", "usb1", "1-1", "1-1.3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := bus.Find("1e0e", ""); err != nil || found {
+		t.Errorf("removed modem was found, err: %v", err)
+	}
+	if _, found, _ := bus.Find("0424", "9514"); !found {
+		t.Error("hub should still be found")
+	}
+}
+
+func TestSetPortDisabled(t *testing.T) {
+	f := newFakeSysfs(t)
+	devices := filepath.Join(f.root, "bus", "usb", "devices")
+	f.mkdir(filepath.Join(devices, "1-1:1.0", "1-1-port2"))
+	f.mkdir(filepath.Join(devices, "1-0:1.0", "usb1-port1"))
+	bus := NewBus(f.root)
+
+	tests := []struct {
+		hub      string
+		port     int
+		disabled bool
+		path     string
+		want     string
+	}{
+		{"1-1", 2, true, "1-1:1.0/1-1-port2/disable", "1"},
+		{"1-1", 2, false, "1-1:1.0/1-1-port2/disable", "0"},
+		{"usb1", 1, true, "1-0:1.0/usb1-port1/disable", "1"},
+	}
+	for _, tt := range tests {
+		if err := bus.SetPortDisabled(tt.hub, tt.port, tt.disabled); err != nil {
+			t.Errorf("SetPortDisabled(%s, %d, %t): %v", tt.hub, tt.port, tt.disabled, err)
+			continue
+		}
+		got, _ := os.ReadFile(filepath.Join(devices, tt.path))
+		if string(got) != tt.want {
+			t.Errorf("SetPortDisabled(%s, %d, %t) wrote '%s', want '%s'", tt.hub, tt.port, tt.disabled, got, tt.want)
+		}
+	}
+	if err := bus.SetPortDisabled("1-1", 4, true); err == nil {
+		t.Error("expected an error for a port that doesn't exist")
+	}
+}